@@ -1,26 +1,29 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"qdt/internal/config"
-	"qdt/pkg/qdt"
+	"qdt/internal/logging"
+	"qdt/pkg/qdtclient"
 )
 
 type Config struct {
-	Server             string        `yaml:"server"`
-	Token              string        `yaml:"token"`
-	MTU                int           `yaml:"mtu"`
-	TunName            string        `yaml:"tun_name"`
-	RouteMode          string        `yaml:"route_mode"`
-	DNS                []string      `yaml:"dns"`
-	LogLevel           string        `yaml:"log_level"`
-	LogJSON            bool          `yaml:"log_json"`
-	Insecure           bool          `yaml:"insecure"`
-	Timeout            time.Duration `yaml:"timeout"`
-	ClientID           string        `yaml:"client_id"`
-	MaxReassemblyBytes int           `yaml:"max_reassembly_bytes"`
+	qdtclient.Config `yaml:",inline"`
+
+	LogLevel      string `yaml:"log_level"`
+	LogJSON       bool   `yaml:"log_json"`
+	LogFile       string `yaml:"log_file"`
+	LogMaxSizeMB  int    `yaml:"log_max_size_mb"`
+	LogMaxBackups int    `yaml:"log_max_backups"`
+	LogMaxAge     int    `yaml:"log_max_age"`
+	LogSyslog     bool   `yaml:"log_syslog"`
+	SyslogNetwork string `yaml:"syslog_network"`
+	SyslogAddr    string `yaml:"syslog_addr"`
+	SyslogTag     string `yaml:"syslog_tag"`
+	SocketPath    string `yaml:"socket_path"`
 }
 
 func LoadConfig(path string) (Config, error) {
@@ -28,37 +31,40 @@ func LoadConfig(path string) (Config, error) {
 	if err := config.Load(path, &cfg); err != nil {
 		return Config{}, err
 	}
-	applyDefaults(&cfg)
-	if err := validateConfig(cfg); err != nil {
+	if cfg.Discover != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		found, err := qdtclient.DiscoverServer(ctx, cfg.Discover)
+		if err != nil {
+			return Config{}, fmt.Errorf("discover %s: %w", cfg.Discover, err)
+		}
+		cfg.MergeDiscovered(found)
+	}
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
 		return Config{}, err
 	}
 	return cfg, nil
 }
 
-func applyDefaults(cfg *Config) {
-	if cfg.MTU == 0 {
-		cfg.MTU = qdt.DefaultMTU
-	}
-	if cfg.TunName == "" {
-		cfg.TunName = "qdt0"
-	}
-	if cfg.RouteMode == "" {
-		cfg.RouteMode = "default"
-	}
-	if cfg.Timeout == 0 {
-		cfg.Timeout = 10 * time.Second
-	}
-	if cfg.MaxReassemblyBytes == 0 {
-		cfg.MaxReassemblyBytes = qdt.DefaultMaxReassembly
+func (c Config) LogOutput() logging.Output {
+	return logging.Output{
+		Path:          c.LogFile,
+		MaxSizeMB:     c.LogMaxSizeMB,
+		MaxBackups:    c.LogMaxBackups,
+		MaxAgeDays:    c.LogMaxAge,
+		Syslog:        c.LogSyslog,
+		SyslogNetwork: c.SyslogNetwork,
+		SyslogAddr:    c.SyslogAddr,
+		SyslogTag:     c.SyslogTag,
 	}
 }
 
-func validateConfig(cfg Config) error {
-	if cfg.Server == "" {
-		return fmt.Errorf("server is required")
-	}
-	if cfg.Token == "" {
-		return fmt.Errorf("token is required")
+// controlSocketPath returns the configured control socket or the default one
+// used in daemon mode.
+func controlSocketPath(cfg Config) string {
+	if cfg.SocketPath != "" {
+		return cfg.SocketPath
 	}
-	return nil
+	return defaultControlSocket
 }
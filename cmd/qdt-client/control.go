@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"qdt/pkg/qdt"
+	"qdt/pkg/qdtclient"
+)
+
+// controlState tracks the live connection for the control socket API.
+type controlState struct {
+	mu          sync.Mutex
+	server      string
+	clientIP    string
+	client      *qdtclient.Client
+	connectedAt time.Time
+}
+
+type statusResponse struct {
+	Connected bool    `json:"connected"`
+	Server    string  `json:"server"`
+	ClientIP  string  `json:"client_ip,omitempty"`
+	Uptime    float64 `json:"uptime"`
+}
+
+func (c *controlState) setConnected(client *qdtclient.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.client = client
+	c.clientIP = client.LocalIP().String()
+	c.connectedAt = time.Now()
+}
+
+func (c *controlState) setDisconnected() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.client = nil
+	c.clientIP = ""
+}
+
+func (c *controlState) status() statusResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := statusResponse{Server: c.server, Connected: c.client != nil}
+	if st.Connected {
+		st.ClientIP = c.clientIP
+		st.Uptime = time.Since(c.connectedAt).Seconds()
+	}
+	return st
+}
+
+func (c *controlState) stats() (qdt.Stats, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil {
+		return qdt.Stats{}, false
+	}
+	return c.client.Stats(), true
+}
+
+// serveControl exposes GET /status, GET /stats and POST /disconnect on a
+// unix socket. disconnect is called to stop the client.
+func serveControl(path string, state *controlState, disconnect func(), log *slog.Logger) (io.Closer, error) {
+	ln, err := listenControl(path)
+	if err != nil {
+		return nil, fmt.Errorf("control socket: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, state.status())
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, _ *http.Request) {
+		st, ok := state.stats()
+		if !ok {
+			http.Error(w, "not connected", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, st)
+	})
+	mux.HandleFunc("POST /disconnect", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		disconnect()
+	})
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("control server error", "err", err)
+		}
+	}()
+	return srv, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// runControlCommand implements the status and disconnect subcommands.
+func runControlCommand(cmd string, socketPath string) error {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	var (
+		resp *http.Response
+		err  error
+	)
+	switch cmd {
+	case "status":
+		resp, err = client.Get("http://qdt/status")
+	case "disconnect":
+		resp, err = client.Post("http://qdt/disconnect", "", nil)
+	default:
+		return fmt.Errorf("unknown command: %s", cmd)
+	}
+	if err != nil {
+		return fmt.Errorf("control socket: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	if len(body) > 0 {
+		fmt.Print(string(body))
+	} else {
+		fmt.Println("ok")
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// The temp directory is per user on Windows.
+var defaultControlSocket = filepath.Join(os.TempDir(), "qdt-client.sock")
+
+func listenControl(path string) (net.Listener, error) {
+	_ = os.Remove(path)
+	return net.Listen("unix", path)
+}
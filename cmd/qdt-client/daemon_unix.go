@@ -0,0 +1,40 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+const daemonEnv = "QDT_CLIENT_DAEMON"
+
+// daemonize re-executes the client detached from the terminal in a new
+// session. It returns true in the parent, which should exit.
+func daemonize() (bool, error) {
+	if os.Getenv(daemonEnv) == "1" {
+		return false, nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return false, fmt.Errorf("daemon: %w", err)
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return false, fmt.Errorf("daemon: %w", err)
+	}
+	defer devNull.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin = devNull
+	cmd.Stdout = devNull
+	cmd.Stderr = devNull
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return false, fmt.Errorf("daemon: %w", err)
+	}
+	fmt.Printf("qdt-client started in background (pid %d)\n", cmd.Process.Pid)
+	return true, nil
+}
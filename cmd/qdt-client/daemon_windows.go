@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "errors"
+
+func daemonize() (bool, error) {
+	return false, errors.New("daemon mode is not supported on windows")
+}
@@ -0,0 +1,152 @@
+// Command qdt-rules-gen writes Prometheus alerting rules for the metrics
+// qdt-server exports.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []rule `yaml:"rules"`
+}
+
+type rule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+type thresholds struct {
+	maxSessions       int
+	sessionRatio      float64
+	dropRatio         float64
+	ipamAvailable     float64
+	slowReassembly    float64
+	handshakeFailures float64
+	forDuration       time.Duration
+}
+
+func main() {
+	var (
+		out string
+		t   thresholds
+	)
+	flag.StringVar(&out, "out", "", "output file, default stdout")
+	flag.IntVar(&t.maxSessions, "max-sessions", 0, "max_sessions of the server; 0 omits QDTSessionExhaustion")
+	flag.Float64Var(&t.sessionRatio, "session-ratio", 0.9, "share of max-sessions in use that fires QDTSessionExhaustion")
+	flag.Float64Var(&t.dropRatio, "drop-ratio", 0.05, "dropped to forwarded packets over 5 minutes that fires QDTHighDropRate")
+	flag.Float64Var(&t.ipamAvailable, "ipam-available", 0.1, "share of free pool addresses below which QDTIPAMExhaustion fires")
+	flag.Float64Var(&t.slowReassembly, "reassembly-per-minute", 1, "packets per minute reassembled after more than a second that fire QDTHighReassemblyTimeout")
+	flag.Float64Var(&t.handshakeFailures, "handshake-failures", 1, "failed handshakes per second over 5 minutes that fire QDTHandshakeFailureSpike")
+	flag.DurationVar(&t.forDuration, "for", 5*time.Minute, "how long a condition must hold before an alert fires")
+	flag.Parse()
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(rules(t)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := enc.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func rules(t thresholds) ruleFile {
+	forDuration := promDuration(t.forDuration)
+	var rs []rule
+	if t.maxSessions > 0 {
+		rs = append(rs, rule{
+			Alert:  "QDTSessionExhaustion",
+			Expr:   fmt.Sprintf("qdt_sessions_active > %g", t.sessionRatio*float64(t.maxSessions)),
+			For:    forDuration,
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "QDT server is close to max_sessions",
+				"description": fmt.Sprintf("{{ $value }} active sessions of %d allowed on {{ $labels.instance }}.", t.maxSessions),
+			},
+		})
+	}
+	rs = append(rs,
+		rule{
+			Alert:  "QDTHighDropRate",
+			Expr:   fmt.Sprintf("sum by (instance) (rate(qdt_drops_total[5m])) / sum by (instance) (rate(qdt_packets_total[5m])) > %g", t.dropRatio),
+			For:    forDuration,
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "QDT server drops many packets",
+				"description": "{{ $value | humanizePercentage }} of packets dropped on {{ $labels.instance }}; see qdt_drops_total by reason.",
+			},
+		},
+		rule{
+			Alert:  "QDTIPAMExhaustion",
+			Expr:   fmt.Sprintf("qdt_ipam_available / qdt_ipam_pool_total < %g", t.ipamAvailable),
+			For:    forDuration,
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary":     "QDT address pool is almost exhausted",
+				"description": "{{ $value | humanizePercentage }} of pool addresses free on {{ $labels.instance }}.",
+			},
+		},
+		// Expired reassembly entries are not counted, so packets that took
+		// more than a second to complete stand in for them.
+		rule{
+			Alert:  "QDTHighReassemblyTimeout",
+			Expr:   fmt.Sprintf("(sum by (instance) (rate(qdt_reassembly_wait_seconds_count[5m])) - sum by (instance) (rate(qdt_reassembly_wait_seconds_bucket{le=\"1\"}[5m]))) * 60 > %g", t.slowReassembly),
+			For:    forDuration,
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "QDT fragments arrive close to the reassembly timeout",
+				"description": "{{ $value }} packets per minute reassembled after more than a second on {{ $labels.instance }}; fragments are being lost or delayed.",
+			},
+		},
+		rule{
+			Alert:  "QDTHandshakeFailureSpike",
+			Expr:   fmt.Sprintf("sum by (instance) (rate(qdt_handshakes_total{result!=\"ok\"}[5m])) > %g", t.handshakeFailures),
+			For:    forDuration,
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "QDT handshakes are failing",
+				"description": "{{ $value }} failed handshakes per second on {{ $labels.instance }}; see qdt_handshakes_total by result.",
+			},
+		},
+	)
+	return ruleFile{Groups: []ruleGroup{{Name: "qdt", Rules: rs}}}
+}
+
+// promDuration formats d in Prometheus duration syntax, which has no
+// fractional units.
+func promDuration(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
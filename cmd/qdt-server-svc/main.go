@@ -0,0 +1,175 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"qdt/internal/logging"
+	"qdt/internal/server"
+)
+
+const serviceName = "qdt-server"
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "install":
+			if err := install(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, "install:", err)
+				os.Exit(1)
+			}
+			return
+		case "uninstall":
+			if err := uninstall(); err != nil {
+				fmt.Fprintln(os.Stderr, "uninstall:", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	var configPath string
+	flag.StringVar(&configPath, "config", "server.yaml", "path to config file")
+	flag.Parse()
+
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		slog.Error("service detection error", "err", err)
+		os.Exit(1)
+	}
+	if isService {
+		if err := svc.Run(serviceName, &handler{configPath: configPath}); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := run(ctx, configPath); err != nil {
+		slog.Error("server error", "err", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, configPath string) error {
+	cfg, err := server.LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	logger, err := logging.New(cfg.LogLevel, cfg.LogJSON, cfg.LogOutput())
+	if err != nil {
+		return fmt.Errorf("logger: %w", err)
+	}
+	srv, err := server.NewServer(cfg, logger, server.NewMetrics())
+	if err != nil {
+		return fmt.Errorf("server init: %w", err)
+	}
+	if err := srv.Serve(ctx); err != nil && err != context.Canceled {
+		return err
+	}
+	return nil
+}
+
+type handler struct {
+	configPath string
+}
+
+func (h *handler) Execute(args []string, r <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, h.configPath) }()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				slog.Error("server error", "err", err)
+				return true, 1
+			}
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				status <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+				if err := <-done; err != nil {
+					slog.Error("server error", "err", err)
+				}
+				return false, 0
+			}
+		}
+	}
+}
+
+func install(args []string) error {
+	fs := flag.NewFlagSet("install", flag.ExitOnError)
+	configPath := fs.String("config", "server.yaml", "path to config file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	absConfig, err := filepath.Abs(*configPath)
+	if err != nil {
+		return fmt.Errorf("config path: %w", err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("executable path: %w", err)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "QDT server",
+		Description: "QUIC datagram tunnel server",
+		StartType:   mgr.StartAutomatic,
+	}, "-config", absConfig)
+	if err != nil {
+		return fmt.Errorf("create service: %w", err)
+	}
+	defer s.Close()
+	return nil
+}
+
+func uninstall() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("open service: %w", err)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("delete service: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	fmt.Fprintln(os.Stderr, "qdt-server-svc runs on Windows only; use qdt-server instead")
+	os.Exit(1)
+}
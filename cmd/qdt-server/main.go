@@ -10,39 +10,71 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/coreos/go-systemd/v22/activation"
+
 	"qdt/internal/logging"
+	"qdt/internal/server"
 )
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	var configPath string
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(server.RunAudit(os.Args[2:]))
+	}
+
+	var (
+		configPath string
+		systemd    bool
+	)
 	flag.StringVar(&configPath, "config", "server.yaml", "path to config file")
+	flag.BoolVar(&systemd, "systemd", false, "notify systemd when the server is ready")
 	flag.Parse()
 
-	cfg, err := LoadConfig(configPath)
+	cfg, err := server.LoadConfig(configPath)
 	if err != nil {
 		slog.Error("config error", "err", err)
 		os.Exit(1)
 	}
 
-	logger, err := logging.New(cfg.LogLevel, cfg.LogJSON)
+	logger, err := logging.New(cfg.LogLevel, cfg.LogJSON, cfg.LogOutput())
 	if err != nil {
 		slog.Error("logger error", "err", err)
 		os.Exit(1)
 	}
 
-	metrics := NewMetrics()
-	server, err := NewServer(cfg, logger, metrics)
+	metrics := server.NewMetrics()
+	srv, err := server.NewServer(cfg, logger, metrics)
 	if err != nil {
 		logger.Error("server init error", "err", err)
 		os.Exit(1)
 	}
 
+	srv.NotifySystemd = systemd
+	if os.Getenv("LISTEN_FDS") != "" {
+		conns, err := activation.PacketConns()
+		if err != nil {
+			logger.Error("socket activation error", "err", err)
+			os.Exit(1)
+		}
+		// Sockets that are not datagram sockets come back as nil.
+		for i, pc := range conns {
+			if pc == nil {
+				logger.Warn("ignoring non-datagram activated socket", "index", i)
+				continue
+			}
+			srv.PacketConns = append(srv.PacketConns, pc)
+		}
+		if len(srv.PacketConns) == 0 {
+			logger.Error("socket activation error", "err", "no datagram sockets passed")
+			os.Exit(1)
+		}
+	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	if err := server.Serve(ctx); err != nil && err != context.Canceled {
+	if err := srv.Serve(ctx); err != nil && err != context.Canceled {
 		logger.Error("server error", "err", err)
 		time.Sleep(100 * time.Millisecond)
 		os.Exit(1)
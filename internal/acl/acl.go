@@ -0,0 +1,193 @@
+// Package acl decides whether a tunneled packet may pass, based on its
+// addresses, protocol and destination port.
+package acl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+type Action uint8
+
+const (
+	Allow Action = iota
+	Drop
+)
+
+func ParseAction(s string) (Action, error) {
+	switch s {
+	case "allow":
+		return Allow, nil
+	case "drop":
+		return Drop, nil
+	default:
+		return 0, fmt.Errorf("unknown acl action %q", s)
+	}
+}
+
+func (a Action) String() string {
+	if a == Drop {
+		return "drop"
+	}
+	return "allow"
+}
+
+// Rule matches packets from Src to Dst; an invalid (zero) prefix matches any
+// address. Proto 0 matches any protocol and a zero DstPortMin any port; a
+// zero DstPortMax means DstPortMin alone. A port range only matches TCP, UDP
+// and SCTP packets that carry the port.
+type Rule struct {
+	Src        netip.Prefix
+	Dst        netip.Prefix
+	Proto      uint8
+	DstPortMin uint16
+	DstPortMax uint16
+	Action     Action
+}
+
+// bucket holds the rules sharing one destination prefix, in config order.
+type bucket struct {
+	dst   netip.Addr
+	rules []Rule
+}
+
+// level holds the buckets of one address family and prefix length, sorted
+// by address for binary search.
+type level struct {
+	is4     bool
+	bits    int
+	buckets []bucket
+}
+
+// Matcher applies the rule with the most specific destination prefix that
+// matches a packet; rules with the same destination apply in config order.
+type Matcher struct {
+	levels []level
+	def    Action
+}
+
+// New builds a Matcher from rules. def applies to packets no rule matches.
+func New(rules []Rule, def Action) *Matcher {
+	m := &Matcher{def: def}
+	for _, r := range rules {
+		if r.Dst.IsValid() {
+			m.add(r.Dst.Masked(), r)
+			continue
+		}
+		m.add(netip.PrefixFrom(netip.IPv4Unspecified(), 0), r)
+		m.add(netip.PrefixFrom(netip.IPv6Unspecified(), 0), r)
+	}
+	slices.SortStableFunc(m.levels, func(a, b level) int { return b.bits - a.bits })
+	for _, l := range m.levels {
+		slices.SortFunc(l.buckets, func(a, b bucket) int { return a.dst.Compare(b.dst) })
+	}
+	return m
+}
+
+func (m *Matcher) add(dst netip.Prefix, r Rule) {
+	is4 := dst.Addr().Is4()
+	i := slices.IndexFunc(m.levels, func(l level) bool { return l.is4 == is4 && l.bits == dst.Bits() })
+	if i < 0 {
+		m.levels = append(m.levels, level{is4: is4, bits: dst.Bits()})
+		i = len(m.levels) - 1
+	}
+	l := &m.levels[i]
+	j := slices.IndexFunc(l.buckets, func(b bucket) bool { return b.dst == dst.Addr() })
+	if j < 0 {
+		l.buckets = append(l.buckets, bucket{dst: dst.Addr()})
+		j = len(l.buckets) - 1
+	}
+	l.buckets[j].rules = append(l.buckets[j].rules, r)
+}
+
+// Match returns the action for pkt, an IPv4 or IPv6 packet. Packets that
+// cannot be parsed get the default action.
+func (m *Matcher) Match(pkt []byte) Action {
+	h, ok := parse(pkt)
+	if !ok {
+		return m.def
+	}
+	for _, l := range m.levels {
+		if l.is4 != h.dst.Is4() {
+			continue
+		}
+		key, _ := h.dst.Prefix(l.bits)
+		i, found := slices.BinarySearchFunc(l.buckets, key.Addr(), func(b bucket, a netip.Addr) int { return b.dst.Compare(a) })
+		if !found {
+			continue
+		}
+		for _, r := range l.buckets[i].rules {
+			if r.matches(h) {
+				return r.Action
+			}
+		}
+	}
+	return m.def
+}
+
+func (r Rule) matches(h header) bool {
+	if r.Src.IsValid() && !r.Src.Contains(h.src) {
+		return false
+	}
+	if r.Proto != 0 && r.Proto != h.proto {
+		return false
+	}
+	if r.DstPortMin == 0 {
+		return true
+	}
+	hi := r.DstPortMax
+	if hi == 0 {
+		hi = r.DstPortMin
+	}
+	return h.hasPort && h.port >= r.DstPortMin && h.port <= hi
+}
+
+type header struct {
+	src, dst netip.Addr
+	proto    uint8
+	port     uint16
+	hasPort  bool
+}
+
+// parse reads the fields rules match on. IPv6 extension headers are not
+// followed, and non-initial IPv4 fragments carry no port.
+func parse(pkt []byte) (header, bool) {
+	var h header
+	var l4 []byte
+	if len(pkt) == 0 {
+		return h, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		ihl := int(pkt[0]&0x0F) * 4
+		if len(pkt) < 20 || ihl < 20 || len(pkt) < ihl {
+			return h, false
+		}
+		h.src = netip.AddrFrom4([4]byte(pkt[12:16]))
+		h.dst = netip.AddrFrom4([4]byte(pkt[16:20]))
+		h.proto = pkt[9]
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1FFF == 0 {
+			l4 = pkt[ihl:]
+		}
+	case 6:
+		if len(pkt) < 40 {
+			return h, false
+		}
+		h.src = netip.AddrFrom16([16]byte(pkt[8:24]))
+		h.dst = netip.AddrFrom16([16]byte(pkt[24:40]))
+		h.proto = pkt[6]
+		l4 = pkt[40:]
+	default:
+		return h, false
+	}
+	switch h.proto {
+	case 6, 17, 132:
+		if len(l4) >= 4 {
+			h.port = binary.BigEndian.Uint16(l4[2:4])
+			h.hasPort = true
+		}
+	}
+	return h, true
+}
@@ -0,0 +1,48 @@
+package acl
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+func ipv4(src, dst string, proto uint8, port uint16) []byte {
+	pkt := make([]byte, 24)
+	pkt[0] = 0x45
+	pkt[9] = proto
+	s, d := netip.MustParseAddr(src).As4(), netip.MustParseAddr(dst).As4()
+	copy(pkt[12:16], s[:])
+	copy(pkt[16:20], d[:])
+	binary.BigEndian.PutUint16(pkt[22:24], port)
+	return pkt
+}
+
+func TestMatch(t *testing.T) {
+	m := New([]Rule{
+		{Proto: 6, DstPortMin: 6881, DstPortMax: 6889, Action: Drop},
+		{Dst: netip.MustParsePrefix("10.1.0.0/16"), Action: Drop},
+		{Dst: netip.MustParsePrefix("10.1.2.0/24"), Src: netip.MustParsePrefix("10.8.0.2/32"), Action: Allow},
+		{Dst: netip.MustParsePrefix("10.1.3.0/24"), Proto: 17, DstPortMin: 53, Action: Allow},
+	}, Allow)
+	cases := []struct {
+		pkt  []byte
+		want Action
+	}{
+		{ipv4("10.8.0.2", "1.1.1.1", 6, 443), Allow},
+		{ipv4("10.8.0.2", "1.1.1.1", 6, 6885), Drop},
+		{ipv4("10.8.0.2", "1.1.1.1", 17, 6885), Allow},
+		{ipv4("10.8.0.2", "10.1.9.9", 6, 443), Drop},
+		{ipv4("10.8.0.2", "10.1.2.9", 6, 443), Allow},
+		{ipv4("10.8.0.3", "10.1.2.9", 6, 443), Drop},
+		{ipv4("10.8.0.3", "10.1.3.9", 17, 53), Allow},
+		{ipv4("10.8.0.3", "10.1.3.9", 17, 54), Drop},
+	}
+	for i, c := range cases {
+		if got := m.Match(c.pkt); got != c.want {
+			t.Fatalf("case %d: got %s, want %s", i, got, c.want)
+		}
+	}
+	if got := New(nil, Drop).Match([]byte{0x45}); got != Drop {
+		t.Fatalf("short packet: got %s, want default drop", got)
+	}
+}
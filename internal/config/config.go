@@ -1,13 +1,35 @@
 package config
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/BurntSushi/toml"
 	"gopkg.in/yaml.v3"
 )
 
+// EnvPrefix is the prefix used by Load for environment overrides.
+const EnvPrefix = "QDT"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
 func Load(path string, out any) error {
+	if err := LoadFile(path, out); err != nil {
+		return err
+	}
+	return OverrideFromEnv(EnvPrefix, out)
+}
+
+// LoadFile parses a config file without applying environment overrides. The
+// format follows the extension: .toml, .json, or YAML for anything else.
+func LoadFile(path string, out any) error {
 	if path == "" {
 		return fmt.Errorf("config path is empty")
 	}
@@ -15,8 +37,200 @@ func Load(path string, out any) error {
 	if err != nil {
 		return fmt.Errorf("read config: %w", err)
 	}
-	if err := yaml.Unmarshal(b, out); err != nil {
+	if err := unmarshal(strings.ToLower(filepath.Ext(path)), b, out); err != nil {
 		return fmt.Errorf("parse config: %w", err)
 	}
 	return nil
 }
+
+// unmarshal decodes TOML and JSON into generic values and feeds them through
+// YAML, so the yaml struct tags define the keys in every format.
+func unmarshal(ext string, b []byte, out any) error {
+	var v any
+	switch ext {
+	case ".toml":
+		m := map[string]any{}
+		if _, err := toml.Decode(string(b), &m); err != nil {
+			return err
+		}
+		v = m
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+		v = jsonNumbers(v)
+	default:
+		return yaml.Unmarshal(b, out)
+	}
+	y, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(y, out)
+}
+
+// Marshal encodes v in the format LoadFile would expect for path.
+func Marshal(path string, v any) ([]byte, error) {
+	y, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".toml" && ext != ".json" {
+		return y, nil
+	}
+	m := map[string]any{}
+	if err := yaml.Unmarshal(y, &m); err != nil {
+		return nil, err
+	}
+	if ext == ".json" {
+		return json.MarshalIndent(m, "", "  ")
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonNumbers replaces json.Number with int64 or float64 so that YAML does
+// not quote them as strings.
+func jsonNumbers(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, e := range t {
+			t[k] = jsonNumbers(e)
+		}
+	case []any:
+		for i, e := range t {
+			t[i] = jsonNumbers(e)
+		}
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+		f, _ := t.Float64()
+		return f
+	}
+	return v
+}
+
+// OverrideFromEnv sets fields of the struct pointed to by out from environment
+// variables named <PREFIX>_<FIELD>, where FIELD is the upper-cased yaml key.
+// Nested structs extend the prefix, so rate_limit.pps maps to QDT_RATE_LIMIT_PPS.
+func OverrideFromEnv(prefix string, out any) error {
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("env override: expected pointer to struct")
+	}
+	return overrideStruct(prefix, v.Elem())
+}
+
+func overrideStruct(prefix string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct && isInline(field) {
+			if err := overrideStruct(prefix, fv); err != nil {
+				return err
+			}
+			continue
+		}
+		name := envName(prefix, field)
+		if fv.Kind() == reflect.Struct {
+			if err := overrideStruct(name, fv); err != nil {
+				return err
+			}
+			continue
+		}
+		raw := os.Getenv(name)
+		if raw == "" {
+			continue
+		}
+		if err := setFromString(fv, raw); err != nil {
+			return fmt.Errorf("env %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// isInline reports whether field is tagged `yaml:",inline"`; its keys sit
+// at the same level as the parent's.
+func isInline(field reflect.StructField) bool {
+	_, opts, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	for _, o := range strings.Split(opts, ",") {
+		if o == "inline" {
+			return true
+		}
+	}
+	return false
+}
+
+func envName(prefix string, field reflect.StructField) string {
+	key := field.Name
+	if tag, _, _ := strings.Cut(field.Tag.Get("yaml"), ","); tag != "" && tag != "-" {
+		key = tag
+	}
+	key = strings.NewReplacer(".", "_", "-", "_").Replace(key)
+	return strings.ToUpper(prefix + "_" + key)
+}
+
+func setFromString(v reflect.Value, raw string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(raw, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported slice type %s", v.Type())
+		}
+		parts := strings.Split(raw, ",")
+		out := reflect.MakeSlice(v.Type(), 0, len(parts))
+		for _, p := range parts {
+			if p = strings.TrimSpace(p); p != "" {
+				out = reflect.Append(out, reflect.ValueOf(p).Convert(v.Type().Elem()))
+			}
+		}
+		v.Set(out)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Server   string        `yaml:"server"`
+	MTU      int           `yaml:"mtu"`
+	Insecure bool          `yaml:"insecure"`
+	Timeout  time.Duration `yaml:"timeout"`
+	DNS      []string      `yaml:"dns"`
+	Ratio    float64       `yaml:"ratio"`
+	Limit    struct {
+		PPS   int `yaml:"pps"`
+		Burst int `yaml:"burst"`
+	} `yaml:"rate_limit"`
+}
+
+func TestLoadFileFormats(t *testing.T) {
+	want := testConfig{
+		Server:   "vpn.example.com:443",
+		MTU:      1350,
+		Insecure: true,
+		Timeout:  2 * time.Minute,
+		DNS:      []string{"1.1.1.1", "8.8.8.8"},
+		Ratio:    0.5,
+	}
+	want.Limit.PPS = 10000
+	want.Limit.Burst = 4194304
+
+	cases := []struct {
+		name string
+		body string
+	}{
+		{"server.yaml", `
+server: "vpn.example.com:443"
+mtu: 1350
+insecure: true
+timeout: 2m
+dns: ["1.1.1.1", "8.8.8.8"]
+ratio: 0.5
+rate_limit:
+  pps: 10000
+  burst: 4194304
+`},
+		{"server.yml", `{server: "vpn.example.com:443", mtu: 1350, insecure: true, timeout: 2m, dns: [1.1.1.1, 8.8.8.8], ratio: 0.5, rate_limit: {pps: 10000, burst: 4194304}}`},
+		{"server.toml", `
+server = "vpn.example.com:443"
+mtu = 1350
+insecure = true
+timeout = "2m"
+dns = ["1.1.1.1", "8.8.8.8"]
+ratio = 0.5
+
+[rate_limit]
+pps = 10000
+burst = 4194304
+`},
+		{"server.json", `{
+  "server": "vpn.example.com:443",
+  "mtu": 1350,
+  "insecure": true,
+  "timeout": "2m",
+  "dns": ["1.1.1.1", "8.8.8.8"],
+  "ratio": 0.5,
+  "rate_limit": {"pps": 10000, "burst": 4194304}
+}`},
+		{"server.conf", `
+server: "vpn.example.com:443"
+mtu: 1350
+insecure: true
+timeout: 2m
+dns: ["1.1.1.1", "8.8.8.8"]
+ratio: 0.5
+rate_limit: {pps: 10000, burst: 4194304}
+`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tc.name)
+			if err := os.WriteFile(path, []byte(tc.body), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			var got testConfig
+			if err := LoadFile(path, &got); err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %+v, want %+v", got, want)
+			}
+
+			b, err := Marshal(path, &got)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			if err := os.WriteFile(path, b, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			var again testConfig
+			if err := LoadFile(path, &again); err != nil {
+				t.Fatalf("reload: %v", err)
+			}
+			if !reflect.DeepEqual(again, want) {
+				t.Fatalf("round trip got %+v, want %+v", again, want)
+			}
+		})
+	}
+}
+
+func TestOverrideFromEnv(t *testing.T) {
+	type envConfig struct {
+		Name    string        `yaml:"name"`
+		On      bool          `yaml:"on"`
+		Port    int           `yaml:"port"`
+		Small   int8          `yaml:"small"`
+		Size    uint32        `yaml:"size"`
+		Ratio   float64       `yaml:"ratio"`
+		Timeout time.Duration `yaml:"timeout"`
+		DNS     []string      `yaml:"dns"`
+		Limit   struct {
+			PPS int `yaml:"pps"`
+		} `yaml:"rate_limit"`
+	}
+	cases := []struct {
+		env     string
+		val     string
+		check   func(c envConfig) bool
+		wantErr bool
+	}{
+		{env: "TEST_NAME", val: "gw1", check: func(c envConfig) bool { return c.Name == "gw1" }},
+		{env: "TEST_ON", val: "true", check: func(c envConfig) bool { return c.On }},
+		{env: "TEST_PORT", val: "-443", check: func(c envConfig) bool { return c.Port == -443 }},
+		{env: "TEST_SMALL", val: "127", check: func(c envConfig) bool { return c.Small == 127 }},
+		{env: "TEST_SIZE", val: "4096", check: func(c envConfig) bool { return c.Size == 4096 }},
+		{env: "TEST_RATIO", val: "0.25", check: func(c envConfig) bool { return c.Ratio == 0.25 }},
+		{env: "TEST_TIMEOUT", val: "1m30s", check: func(c envConfig) bool { return c.Timeout == 90*time.Second }},
+		{env: "TEST_DNS", val: "1.1.1.1, ,8.8.8.8", check: func(c envConfig) bool {
+			return reflect.DeepEqual(c.DNS, []string{"1.1.1.1", "8.8.8.8"})
+		}},
+		{env: "TEST_RATE_LIMIT_PPS", val: "500", check: func(c envConfig) bool { return c.Limit.PPS == 500 }},
+		{env: "TEST_ON", val: "maybe", wantErr: true},
+		{env: "TEST_PORT", val: "443x", wantErr: true},
+		{env: "TEST_SMALL", val: "128", wantErr: true},
+		{env: "TEST_SIZE", val: "-1", wantErr: true},
+		{env: "TEST_RATIO", val: "half", wantErr: true},
+		{env: "TEST_TIMEOUT", val: "90", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.env+"="+tc.val, func(t *testing.T) {
+			t.Setenv(tc.env, tc.val)
+			c := envConfig{Name: "default", Port: 1}
+			err := OverrideFromEnv("TEST", &c)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", c)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.check(c) {
+				t.Fatalf("unexpected config %+v", c)
+			}
+		})
+	}
+}
+
+func TestOverrideFromEnvUnsupported(t *testing.T) {
+	var c struct {
+		Ports []int `yaml:"ports"`
+	}
+	t.Setenv("TEST_PORTS", "1,2")
+	if err := OverrideFromEnv("TEST", &c); err == nil {
+		t.Fatal("expected error for []int")
+	}
+	if err := OverrideFromEnv("TEST", c); err == nil {
+		t.Fatal("expected error for non-pointer")
+	}
+}
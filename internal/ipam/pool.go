@@ -1,20 +1,36 @@
 package ipam
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"net"
+	"slices"
 	"sync"
+	"time"
 )
 
+// Allocation describes an assigned address. ClientID is empty when the
+// caller did not name one.
+type Allocation struct {
+	IP          net.IP    `json:"ip"`
+	ClientID    string    `json:"client_id,omitempty"`
+	AllocatedAt time.Time `json:"allocated_at"`
+}
+
 type Pool struct {
 	mu       sync.Mutex
 	base     uint32
 	max      uint32
 	next     uint32
 	used     map[uint32]bool
+	meta     map[uint32]Allocation
 	reserved map[uint32]bool
 	cidr     string
+
+	// reservedInRange counts reserved addresses between base and max;
+	// the network and broadcast addresses are reserved but outside it.
+	reservedInRange int
 }
 
 func New(cidr string, reserve []net.IP) (*Pool, error) {
@@ -46,14 +62,22 @@ func New(cidr string, reserve []net.IP) (*Pool, error) {
 	}
 	res[netUint] = true
 	res[broadcast] = true
+	inRange := 0
+	for ip := range res {
+		if ip >= base && ip <= max {
+			inRange++
+		}
+	}
 
 	return &Pool{
-		base:     base,
-		max:      max,
-		next:     base,
-		used:     make(map[uint32]bool),
-		reserved: res,
-		cidr:     cidr,
+		base:            base,
+		max:             max,
+		next:            base,
+		used:            make(map[uint32]bool),
+		meta:            make(map[uint32]Allocation),
+		reserved:        res,
+		cidr:            cidr,
+		reservedInRange: inRange,
 	}, nil
 }
 
@@ -61,7 +85,32 @@ func (p *Pool) CIDR() string {
 	return p.cidr
 }
 
+// Total returns the number of assignable addresses in the pool.
+func (p *Pool) Total() int {
+	return int(p.max-p.base+1) - p.reservedInRange
+}
+
+// Used returns the number of addresses currently assigned.
+func (p *Pool) Used() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.used)
+}
+
+// Available returns the number of addresses that can still be acquired.
+func (p *Pool) Available() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return int(p.max-p.base+1) - len(p.used) - p.reservedInRange
+}
+
 func (p *Pool) Acquire() (net.IP, error) {
+	return p.AcquireFor("")
+}
+
+// AcquireFor assigns the next free address and records clientID as its
+// holder.
+func (p *Pool) AcquireFor(clientID string) (net.IP, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	span := p.max - p.base + 1
@@ -70,13 +119,41 @@ func (p *Pool) Acquire() (net.IP, error) {
 		if p.used[candidate] || p.reserved[candidate] {
 			continue
 		}
-		p.used[candidate] = true
 		p.next = candidate + 1
-		return uint32ToIP(candidate), nil
+		return p.assign(candidate, clientID), nil
 	}
 	return nil, fmt.Errorf("address pool exhausted")
 }
 
+// Claim marks a specific address as used. It returns false if the address
+// is outside the pool, reserved or already assigned.
+func (p *Pool) Claim(ip net.IP) bool {
+	return p.ClaimFor(ip, "")
+}
+
+// ClaimFor is Claim with clientID recorded as the holder.
+func (p *Pool) ClaimFor(ip net.IP, clientID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	v4 := ip.To4()
+	if v4 == nil {
+		return false
+	}
+	v := binary.BigEndian.Uint32(v4)
+	if v < p.base || v > p.max || p.used[v] || p.reserved[v] {
+		return false
+	}
+	p.assign(v, clientID)
+	return true
+}
+
+func (p *Pool) assign(v uint32, clientID string) net.IP {
+	ip := uint32ToIP(v)
+	p.used[v] = true
+	p.meta[v] = Allocation{IP: ip, ClientID: clientID, AllocatedAt: time.Now()}
+	return ip
+}
+
 func (p *Pool) Release(ip net.IP) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -84,7 +161,23 @@ func (p *Pool) Release(ip net.IP) {
 	if v4 == nil {
 		return
 	}
-	delete(p.used, binary.BigEndian.Uint32(v4))
+	v := binary.BigEndian.Uint32(v4)
+	delete(p.used, v)
+	delete(p.meta, v)
+}
+
+// Snapshot returns the current allocations ordered by address.
+func (p *Pool) Snapshot() []Allocation {
+	p.mu.Lock()
+	out := make([]Allocation, 0, len(p.meta))
+	for _, a := range p.meta {
+		out = append(out, a)
+	}
+	p.mu.Unlock()
+	slices.SortFunc(out, func(a, b Allocation) int {
+		return bytes.Compare(a.IP.To4(), b.IP.To4())
+	})
+	return out
 }
 
 func uint32ToIP(v uint32) net.IP {
@@ -0,0 +1,36 @@
+package ipam
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	p, err := New("10.0.0.0/29", []net.IP{net.ParseIP("10.0.0.1")})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	a, err := p.AcquireFor("laptop")
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if !p.ClaimFor(net.ParseIP("10.0.0.5"), "phone") {
+		t.Fatalf("claim failed")
+	}
+	b, err := p.Acquire()
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	p.Release(b)
+
+	snap := p.Snapshot()
+	if len(snap) != 2 {
+		t.Fatalf("snapshot has %d allocations, want 2", len(snap))
+	}
+	if !snap[0].IP.Equal(a) || snap[0].ClientID != "laptop" || snap[0].AllocatedAt.IsZero() {
+		t.Fatalf("first allocation = %+v", snap[0])
+	}
+	if snap[1].IP.String() != "10.0.0.5" || snap[1].ClientID != "phone" {
+		t.Fatalf("second allocation = %+v", snap[1])
+	}
+}
@@ -65,6 +65,28 @@ func PacketDest(pkt []byte) (net.IP, error) {
 	}
 }
 
+// PacketProtocol returns the IPv4 protocol or IPv6 next-header number.
+// IPv6 extension headers are not followed.
+func PacketProtocol(pkt []byte) (uint8, bool) {
+	if len(pkt) == 0 {
+		return 0, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return 0, false
+		}
+		return pkt[9], true
+	case 6:
+		if len(pkt) < 40 {
+			return 0, false
+		}
+		return pkt[6], true
+	default:
+		return 0, false
+	}
+}
+
 func ipVersion(pkt []byte) (int, error) {
 	if len(pkt) == 0 {
 		return 0, ErrPacketTooShort
@@ -101,3 +123,128 @@ func PacketDestV4(pkt []byte) (uint32, bool) {
 	}
 	return binary.BigEndian.Uint32(pkt[16:20]), true
 }
+
+// PacketSourceV6 returns the IPv6 source address.
+func PacketSourceV6(pkt []byte) ([16]byte, bool) {
+	var ip [16]byte
+	if len(pkt) < 40 || pkt[0]>>4 != 6 {
+		return ip, false
+	}
+	copy(ip[:], pkt[8:24])
+	return ip, true
+}
+
+// PacketDestV6 returns the IPv6 destination address.
+func PacketDestV6(pkt []byte) ([16]byte, bool) {
+	var ip [16]byte
+	if len(pkt) < 40 || pkt[0]>>4 != 6 {
+		return ip, false
+	}
+	copy(ip[:], pkt[24:40])
+	return ip, true
+}
+
+var ErrICMPSuppressed = errors.New("icmp error suppressed")
+
+// BuildICMPUnreachable returns an IPv4 ICMP destination-unreachable (host
+// unreachable) packet addressed to the sender of original. It refuses to
+// answer non-initial fragments and ICMP errors, per RFC 1812.
+func BuildICMPUnreachable(original []byte) ([]byte, error) {
+	if len(original) < 20 {
+		return nil, ErrPacketTooShort
+	}
+	if original[0]>>4 != 4 {
+		return nil, ErrUnknownIP
+	}
+	ihl := int(original[0]&0x0F) * 4
+	if ihl < 20 || len(original) < ihl {
+		return nil, ErrPacketTooShort
+	}
+	if binary.BigEndian.Uint16(original[6:8])&0x1FFF != 0 {
+		return nil, ErrICMPSuppressed
+	}
+	if original[9] == 1 && len(original) > ihl && !icmpIsQuery(original[ihl]) {
+		return nil, ErrICMPSuppressed
+	}
+	quote := ihl + 8
+	if quote > len(original) {
+		quote = len(original)
+	}
+	pkt := make([]byte, 20+8+quote)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = 1
+	copy(pkt[12:16], original[16:20])
+	copy(pkt[16:20], original[12:16])
+	binary.BigEndian.PutUint16(pkt[10:12], Checksum(pkt[:20]))
+
+	icmp := pkt[20:]
+	icmp[0] = 3
+	icmp[1] = 1
+	copy(icmp[8:], original[:quote])
+	binary.BigEndian.PutUint16(icmp[2:4], Checksum(icmp))
+	return pkt, nil
+}
+
+func icmpIsQuery(typ byte) bool {
+	switch typ {
+	case 0, 8, 13, 14, 15, 16, 17, 18:
+		return true
+	default:
+		return false
+	}
+}
+
+// Checksum computes the Internet checksum (RFC 1071) of b.
+func Checksum(b []byte) uint16 {
+	var sum uint32
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// RecomputeChecksum rewrites the IPv4 header checksum of pkt in place.
+func RecomputeChecksum(pkt []byte) {
+	if len(pkt) < 20 || pkt[0]>>4 != 4 {
+		return
+	}
+	ihl := int(pkt[0]&0x0F) * 4
+	if ihl < 20 || len(pkt) < ihl {
+		return
+	}
+	pkt[10], pkt[11] = 0, 0
+	binary.BigEndian.PutUint16(pkt[10:12], Checksum(pkt[:ihl]))
+}
+
+// SetDSCP rewrites the DSCP bits of an IPv4 or IPv6 packet, preserving ECN.
+// IPv4 header checksums are updated.
+func SetDSCP(pkt []byte, dscp uint8) {
+	if len(pkt) == 0 {
+		return
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return
+		}
+		pkt[1] = (pkt[1] & 0x03) | (dscp << 2)
+		RecomputeChecksum(pkt)
+	case 6:
+		if len(pkt) < 40 {
+			return
+		}
+		tc := (pkt[0]&0x0F)<<4 | pkt[1]>>4
+		tc = (tc & 0x03) | (dscp << 2)
+		pkt[0] = (pkt[0] & 0xF0) | (tc >> 4)
+		pkt[1] = (tc << 4) | (pkt[1] & 0x0F)
+	}
+}
@@ -0,0 +1,116 @@
+package iputil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+// ipv4Packet returns a UDP packet from 10.0.0.2 to 192.0.2.1 with payloadLen
+// bytes of payload and a valid header checksum.
+func ipv4Packet(payloadLen int) []byte {
+	pkt := make([]byte, 20+8+payloadLen)
+	pkt[0] = 0x45
+	pkt[1] = 0xb9 // DSCP 46, ECN 1
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = 17
+	copy(pkt[12:16], []byte{10, 0, 0, 2})
+	copy(pkt[16:20], []byte{192, 0, 2, 1})
+	for i := 20; i < len(pkt); i++ {
+		pkt[i] = byte(i)
+	}
+	RecomputeChecksum(pkt)
+	return pkt
+}
+
+func TestBuildICMPUnreachable(t *testing.T) {
+	for _, payloadLen := range []int{100, 0} {
+		orig := ipv4Packet(payloadLen)
+		pkt, err := BuildICMPUnreachable(orig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		quote := min(len(orig), 28)
+		if len(pkt) != 20+8+quote || int(binary.BigEndian.Uint16(pkt[2:4])) != len(pkt) {
+			t.Fatalf("payload %d: length %d, total length field %d", payloadLen, len(pkt), binary.BigEndian.Uint16(pkt[2:4]))
+		}
+		if Checksum(pkt[:20]) != 0 {
+			t.Fatalf("payload %d: bad ipv4 header checksum", payloadLen)
+		}
+		icmp := pkt[20:]
+		if Checksum(icmp) != 0 {
+			t.Fatalf("payload %d: bad icmp checksum", payloadLen)
+		}
+		if icmp[0] != 3 || icmp[1] != 1 {
+			t.Fatalf("payload %d: icmp type %d code %d", payloadLen, icmp[0], icmp[1])
+		}
+		if !bytes.Equal(pkt[12:16], orig[16:20]) || !bytes.Equal(pkt[16:20], orig[12:16]) {
+			t.Fatalf("payload %d: addresses not swapped", payloadLen)
+		}
+		if !bytes.Equal(icmp[8:], orig[:quote]) {
+			t.Fatalf("payload %d: quoted datagram %x, want %x", payloadLen, icmp[8:], orig[:quote])
+		}
+	}
+
+	frag := ipv4Packet(8)
+	binary.BigEndian.PutUint16(frag[6:8], 185)
+	if _, err := BuildICMPUnreachable(frag); !errors.Is(err, ErrICMPSuppressed) {
+		t.Fatalf("non-initial fragment: got %v", err)
+	}
+	icmpErr := ipv4Packet(8)
+	icmpErr[9], icmpErr[20] = 1, 3
+	if _, err := BuildICMPUnreachable(icmpErr); !errors.Is(err, ErrICMPSuppressed) {
+		t.Fatalf("icmp error: got %v", err)
+	}
+}
+
+func TestSetDSCP(t *testing.T) {
+	pkt := ipv4Packet(16)
+	SetDSCP(pkt, 10)
+	if pkt[1]>>2 != 10 || pkt[1]&0x03 != 1 {
+		t.Fatalf("ipv4 tos %#x, want dscp 10 ecn 1", pkt[1])
+	}
+	if Checksum(pkt[:20]) != 0 {
+		t.Fatal("ipv4 header checksum invalid after SetDSCP")
+	}
+
+	v6 := make([]byte, 40)
+	// Version 6, traffic class 0xb9 (DSCP 46, ECN 1), flow label 0xabcde.
+	binary.BigEndian.PutUint32(v6[0:4], 6<<28|0xb9<<20|0xabcde)
+	SetDSCP(v6, 10)
+	word := binary.BigEndian.Uint32(v6[0:4])
+	if word>>28 != 6 || word>>20&0xff != 10<<2|1 || word&0xfffff != 0xabcde {
+		t.Fatalf("ipv6 first word %#x", word)
+	}
+}
+
+func TestPacketAddrV6(t *testing.T) {
+	src := netip.MustParseAddr("2001:db8::1").As16()
+	dst := netip.MustParseAddr("2001:db8:ffff::2").As16()
+	pkt := make([]byte, 48)
+	pkt[0] = 0x60
+	binary.BigEndian.PutUint16(pkt[4:6], 8)
+	pkt[6] = 17
+	pkt[7] = 64
+	copy(pkt[8:24], src[:])
+	copy(pkt[24:40], dst[:])
+
+	if got, ok := PacketSourceV6(pkt); !ok || got != src {
+		t.Fatalf("source %x ok=%v", got, ok)
+	}
+	if got, ok := PacketDestV6(pkt); !ok || got != dst {
+		t.Fatalf("dest %x ok=%v", got, ok)
+	}
+	if _, ok := PacketSourceV6(pkt[:39]); ok {
+		t.Fatal("source of a short packet")
+	}
+	if _, ok := PacketDestV6(pkt[:39]); ok {
+		t.Fatal("dest of a short packet")
+	}
+	if _, ok := PacketSourceV6(ipv4Packet(40)); ok {
+		t.Fatal("ipv6 source of an ipv4 packet")
+	}
+}
@@ -1,27 +1,116 @@
 package logging
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"strings"
+
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-func New(level string, json bool) (*slog.Logger, error) {
+// DefaultMaxSizeMB is the size at which a log file is rotated when
+// Output.MaxSizeMB is zero.
+const DefaultMaxSizeMB = 100
+
+// Output selects where logs go. With Path set they are written to a rotated
+// file instead of stdout; rotated files are compressed, and zero MaxBackups
+// and MaxAgeDays keep them forever. With Syslog set they are also sent to
+// the syslog daemon at SyslogAddr over SyslogNetwork, or to the local one
+// when SyslogNetwork is empty.
+type Output struct {
+	Path       string
+	MaxSizeMB  int
+	MaxBackups int
+	MaxAgeDays int
+
+	Syslog        bool
+	SyslogNetwork string
+	SyslogAddr    string
+	SyslogTag     string
+}
+
+func New(level string, json bool, out Output) (*slog.Logger, error) {
 	lvl, err := parseLevel(level)
 	if err != nil {
 		return nil, err
 	}
+	var w io.Writer = os.Stdout
+	if out.Path != "" {
+		if err := os.MkdirAll(filepath.Dir(out.Path), 0o755); err != nil {
+			return nil, fmt.Errorf("log file dir: %w", err)
+		}
+		maxSize := out.MaxSizeMB
+		if maxSize <= 0 {
+			maxSize = DefaultMaxSizeMB
+		}
+		w = &lumberjack.Logger{
+			Filename:   out.Path,
+			MaxSize:    maxSize,
+			MaxBackups: out.MaxBackups,
+			MaxAge:     out.MaxAgeDays,
+			Compress:   true,
+		}
+	}
 	opts := &slog.HandlerOptions{Level: lvl}
 	var handler slog.Handler
 	if json {
-		handler = slog.NewJSONHandler(os.Stdout, opts)
+		handler = slog.NewJSONHandler(w, opts)
 	} else {
-		handler = slog.NewTextHandler(os.Stdout, opts)
+		handler = slog.NewTextHandler(w, opts)
+	}
+	if out.Syslog {
+		sh, err := NewSyslogHandler(out.SyslogNetwork, out.SyslogAddr, out.SyslogTag, lvl)
+		if err != nil {
+			return nil, fmt.Errorf("syslog: %w", err)
+		}
+		handler = multiHandler{handler, sh}
 	}
 	return slog.New(handler), nil
 }
 
+// multiHandler passes each record to all of its handlers.
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range m {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
 func parseLevel(level string) (slog.Level, error) {
 	switch strings.ToLower(level) {
 	case "debug":
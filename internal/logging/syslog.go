@@ -0,0 +1,81 @@
+//go:build !windows && !plan9
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"log/syslog"
+	"strings"
+	"sync"
+)
+
+// SyslogHandler sends records to syslog as key=value text, mapping the slog
+// level to the syslog severity. Time and level are left to syslog.
+type SyslogHandler struct {
+	w     *syslog.Writer
+	level slog.Leveler
+	text  slog.Handler
+	out   *syslogBuffer
+}
+
+// syslogBuffer is shared by a handler and those derived from it with
+// WithAttrs and WithGroup, which write into the same buffer.
+type syslogBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// NewSyslogHandler connects to the syslog daemon at addr over network, or to
+// the local one when network is empty. An empty tag uses the program name.
+func NewSyslogHandler(network, addr, tag string, level slog.Leveler) (*SyslogHandler, error) {
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	out := &syslogBuffer{}
+	text := slog.NewTextHandler(&out.buf, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	return &SyslogHandler{w: w, level: level, text: text, out: out}, nil
+}
+
+func (h *SyslogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *SyslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.mu.Lock()
+	h.out.buf.Reset()
+	err := h.text.Handle(ctx, r)
+	line := strings.TrimSuffix(h.out.buf.String(), "\n")
+	h.out.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.w.Err(line)
+	case r.Level >= slog.LevelWarn:
+		return h.w.Warning(line)
+	case r.Level >= slog.LevelInfo:
+		return h.w.Info(line)
+	default:
+		return h.w.Debug(line)
+	}
+}
+
+func (h *SyslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &SyslogHandler{w: h.w, level: h.level, text: h.text.WithAttrs(attrs), out: h.out}
+}
+
+func (h *SyslogHandler) WithGroup(name string) slog.Handler {
+	return &SyslogHandler{w: h.w, level: h.level, text: h.text.WithGroup(name), out: h.out}
+}
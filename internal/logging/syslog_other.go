@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package logging
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// NewSyslogHandler is not available on this platform; log/syslog has no
+// implementation here.
+func NewSyslogHandler(network, addr, tag string, level slog.Leveler) (slog.Handler, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
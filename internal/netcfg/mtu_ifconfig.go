@@ -0,0 +1,30 @@
+//go:build !linux && !windows
+
+package netcfg
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// GetInterfaceMTU parses the "mtu N" field of `ifconfig <ifName>`.
+func GetInterfaceMTU(ifName string) (int, error) {
+	out, err := exec.Command("ifconfig", ifName).Output()
+	if err != nil {
+		return 0, fmt.Errorf("ifconfig %s: %w", ifName, err)
+	}
+	fields := strings.Fields(string(out))
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] != "mtu" {
+			continue
+		}
+		mtu, err := strconv.Atoi(fields[i+1])
+		if err != nil {
+			return 0, fmt.Errorf("parse mtu %q: %w", fields[i+1], err)
+		}
+		return mtu, nil
+	}
+	return 0, fmt.Errorf("no mtu in ifconfig output for %s", ifName)
+}
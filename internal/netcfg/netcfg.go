@@ -1,5 +1,9 @@
 package netcfg
 
+import "errors"
+
+var errNotSupported = errors.New("not supported")
+
 type InterfaceConfig struct {
 	Name    string
 	Address string
@@ -7,7 +11,20 @@ type InterfaceConfig struct {
 	MTU     int
 }
 
+// Route sends Dest through Gateway. Among routes to the same destination a
+// lower Metric wins; zero leaves it to the system.
 type Route struct {
 	Dest    string
 	Gateway string
+	Metric  int
+}
+
+// PolicyRoute sends traffic matching SrcCIDR and DstCIDR (either may be
+// empty) through the tunnel via routing table Table. As with ip rule, a
+// lower Priority is consulted first.
+type PolicyRoute struct {
+	SrcCIDR  string
+	DstCIDR  string
+	Table    int
+	Priority int
 }
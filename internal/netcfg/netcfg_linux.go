@@ -3,6 +3,8 @@
 package netcfg
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -10,6 +12,7 @@ import (
 	"strings"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 func ConfigureInterface(cfg InterfaceConfig) error {
@@ -71,20 +74,67 @@ func DeleteRoutes(ifName string, routes []Route) error {
 	return nil
 }
 
-func SetDNS(ifName string, dns []string) error {
-	if len(dns) == 0 {
+// AddPolicyRoutes installs a route through ifName in each rule's table and
+// an ip rule selecting that table.
+func AddPolicyRoutes(ifName string, rules []PolicyRoute) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("link %s: %w", ifName, err)
+	}
+	for _, r := range rules {
+		route, rule, err := buildPolicyRoute(link, r)
+		if err != nil {
+			return err
+		}
+		_ = netlink.RouteDel(route)
+		if err := netlink.RouteAdd(route); err != nil {
+			return fmt.Errorf("route add table %d: %w", r.Table, err)
+		}
+		_ = netlink.RuleDel(rule)
+		if err := netlink.RuleAdd(rule); err != nil {
+			return fmt.Errorf("rule add: %w", err)
+		}
+	}
+	return nil
+}
+
+func DeletePolicyRoutes(ifName string, rules []PolicyRoute) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("link %s: %w", ifName, err)
+	}
+	for _, r := range rules {
+		route, rule, err := buildPolicyRoute(link, r)
+		if err != nil {
+			return err
+		}
+		_ = netlink.RuleDel(rule)
+		_ = netlink.RouteDel(route)
+	}
+	return nil
+}
+
+// SetDNS points the link at the dns servers and installs searchDomains for
+// single-label names. With servers set, the "~." routing domain also sends
+// all other lookups over the link.
+func SetDNS(ifName string, dns, searchDomains []string) error {
+	if len(dns) == 0 && len(searchDomains) == 0 {
 		return nil
 	}
 	path, err := exec.LookPath("resolvectl")
 	if err != nil {
 		return nil
 	}
-	args := append([]string{"dns", ifName}, dns...)
-	cmd := exec.Command(path, args...)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("resolvectl dns: %w", err)
+	domains := searchDomains
+	if len(dns) > 0 {
+		args := append([]string{"dns", ifName}, dns...)
+		cmd := exec.Command(path, args...)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("resolvectl dns: %w", err)
+		}
+		domains = append([]string{"~."}, searchDomains...)
 	}
-	cmd = exec.Command(path, "domain", ifName, "~.")
+	cmd := exec.Command(path, append([]string{"domain", ifName}, domains...)...)
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("resolvectl domain: %w", err)
 	}
@@ -103,31 +153,68 @@ func ResetDNS(ifName string) error {
 	return nil
 }
 
+const (
+	ipForwardPath   = "/proc/sys/net/ipv4/ip_forward"
+	ipv6ForwardPath = "/proc/sys/net/ipv6/conf/all/forwarding"
+)
+
 func EnableIPForwarding() error {
-	return os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644)
+	if err := os.WriteFile(ipForwardPath, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("enable ip forwarding: %w", err)
+	}
+	return nil
 }
 
-func SetupNAT(cidr, outIface string) error {
+func IsIPForwardingEnabled() (bool, error) {
+	b, err := os.ReadFile(ipForwardPath)
+	if err != nil {
+		return false, fmt.Errorf("read ip_forward: %w", err)
+	}
+	return strings.TrimSpace(string(b)) == "1", nil
+}
+
+func EnableIPv6Forwarding() error {
+	if err := os.WriteFile(ipv6ForwardPath, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("enable ipv6 forwarding: %w", err)
+	}
+	return nil
+}
+
+func IsIPv6ForwardingEnabled() (bool, error) {
+	b, err := os.ReadFile(ipv6ForwardPath)
+	if err != nil {
+		return false, fmt.Errorf("read ipv6 forwarding: %w", err)
+	}
+	return strings.TrimSpace(string(b)) == "1", nil
+}
+
+func SetupNAT(cidr, outIface string) error   { return setupNAT("iptables", cidr, outIface) }
+func SetupNATv6(cidr, outIface string) error { return setupNAT("ip6tables", cidr, outIface) }
+
+func CleanupNAT(cidr, outIface string) error   { return cleanupNAT("iptables", cidr, outIface) }
+func CleanupNATv6(cidr, outIface string) error { return cleanupNAT("ip6tables", cidr, outIface) }
+
+func setupNAT(iptables, cidr, outIface string) error {
 	if cidr == "" || outIface == "" {
 		return nil
 	}
 	args := []string{"-t", "nat", "-A", "POSTROUTING", "-s", cidr, "-o", outIface, "-j", "MASQUERADE"}
-	if err := exec.Command("iptables", args...).Run(); err != nil {
-		return fmt.Errorf("iptables nat: %w", err)
+	if err := exec.Command(iptables, args...).Run(); err != nil {
+		return fmt.Errorf("%s nat: %w", iptables, err)
 	}
 	forwardArgs := []string{"-A", "FORWARD", "-s", cidr, "-o", outIface, "-j", "ACCEPT"}
-	_ = exec.Command("iptables", forwardArgs...).Run()
+	_ = exec.Command(iptables, forwardArgs...).Run()
 	return nil
 }
 
-func CleanupNAT(cidr, outIface string) error {
+func cleanupNAT(iptables, cidr, outIface string) error {
 	if cidr == "" || outIface == "" {
 		return nil
 	}
 	args := []string{"-t", "nat", "-D", "POSTROUTING", "-s", cidr, "-o", outIface, "-j", "MASQUERADE"}
-	_ = exec.Command("iptables", args...).Run()
+	_ = exec.Command(iptables, args...).Run()
 	forwardArgs := []string{"-D", "FORWARD", "-s", cidr, "-o", outIface, "-j", "ACCEPT"}
-	_ = exec.Command("iptables", forwardArgs...).Run()
+	_ = exec.Command(iptables, forwardArgs...).Run()
 	return nil
 }
 
@@ -155,9 +242,95 @@ func buildRoute(link netlink.Link, r Route) (*netlink.Route, error) {
 		LinkIndex: link.Attrs().Index,
 		Dst:       dst,
 		Gw:        gw,
+		Priority:  r.Metric,
 	}, nil
 }
 
+func buildPolicyRoute(link netlink.Link, r PolicyRoute) (*netlink.Route, *netlink.Rule, error) {
+	rule := netlink.NewRule()
+	rule.Table = r.Table
+	rule.Priority = r.Priority
+	if r.SrcCIDR != "" {
+		_, src, err := net.ParseCIDR(r.SrcCIDR)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse policy src: %w", err)
+		}
+		rule.Src = src
+	}
+	if r.DstCIDR != "" {
+		_, dst, err := net.ParseCIDR(r.DstCIDR)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse policy dst: %w", err)
+		}
+		rule.Dst = dst
+	}
+	route, err := buildRoute(link, Route{Dest: r.DstCIDR})
+	if err != nil {
+		return nil, nil, err
+	}
+	route.Table = r.Table
+	return route, rule, nil
+}
+
+// WatchInterface calls onChange each time ifName, or any interface when
+// ifName is empty, is set up or down or appears, until ctx is done.
+func WatchInterface(ctx context.Context, ifName string, onChange func(up bool)) error {
+	updates := make(chan netlink.LinkUpdate)
+	done := make(chan struct{})
+	if err := netlink.LinkSubscribe(updates, done); err != nil {
+		return fmt.Errorf("subscribe link updates: %w", err)
+	}
+	defer func() {
+		close(done)
+		// The subscription closes updates once its socket is shut.
+		go func() {
+			for range updates {
+			}
+		}()
+	}()
+
+	state := make(map[int]bool)
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("list links: %w", err)
+	}
+	for _, l := range links {
+		state[l.Attrs().Index] = l.Attrs().Flags&net.FlagUp != 0
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case u, ok := <-updates:
+			if !ok {
+				return errors.New("link updates closed")
+			}
+			attrs := u.Attrs()
+			if ifName != "" && attrs.Name != ifName {
+				continue
+			}
+			up := attrs.Flags&net.FlagUp != 0 && u.Header.Type != unix.RTM_DELLINK
+			last, seen := state[attrs.Index]
+			if u.Header.Type == unix.RTM_DELLINK {
+				delete(state, attrs.Index)
+			} else {
+				state[attrs.Index] = up
+			}
+			if !seen || last != up {
+				onChange(up)
+			}
+		}
+	}
+}
+
+func GetInterfaceMTU(ifName string) (int, error) {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return 0, fmt.Errorf("link %s: %w", ifName, err)
+	}
+	return link.Attrs().MTU, nil
+}
+
 func InterfaceIndexByName(name string) (int, error) {
 	link, err := netlink.LinkByName(name)
 	if err != nil {
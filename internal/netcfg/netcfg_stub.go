@@ -2,15 +2,24 @@
 
 package netcfg
 
-import "errors"
+import "context"
 
-var errNotSupported = errors.New("not supported")
+func ConfigureInterface(cfg InterfaceConfig) error                { return errNotSupported }
+func AddRoutes(ifName string, routes []Route) error               { return errNotSupported }
+func DeleteRoutes(ifName string, routes []Route) error            { return errNotSupported }
+func AddPolicyRoutes(ifName string, rules []PolicyRoute) error    { return errNotSupported }
+func DeletePolicyRoutes(ifName string, rules []PolicyRoute) error { return errNotSupported }
+func SetDNS(ifName string, dns, searchDomains []string) error     { return errNotSupported }
+func ResetDNS(ifName string) error                                { return errNotSupported }
+func EnableIPForwarding() error                                   { return errNotSupported }
+func IsIPForwardingEnabled() (bool, error)                        { return false, errNotSupported }
+func EnableIPv6Forwarding() error                                 { return errNotSupported }
+func IsIPv6ForwardingEnabled() (bool, error)                      { return false, errNotSupported }
+func SetupNAT(cidr, outIface string) error                        { return errNotSupported }
+func CleanupNAT(cidr, outIface string) error                      { return errNotSupported }
+func SetupNATv6(cidr, outIface string) error                      { return errNotSupported }
+func CleanupNATv6(cidr, outIface string) error                    { return errNotSupported }
 
-func ConfigureInterface(cfg InterfaceConfig) error     { return errNotSupported }
-func AddRoutes(ifName string, routes []Route) error    { return errNotSupported }
-func DeleteRoutes(ifName string, routes []Route) error { return errNotSupported }
-func SetDNS(ifName string, dns []string) error         { return errNotSupported }
-func ResetDNS(ifName string) error                     { return errNotSupported }
-func EnableIPForwarding() error                        { return errNotSupported }
-func SetupNAT(cidr, outIface string) error             { return errNotSupported }
-func CleanupNAT(cidr, outIface string) error           { return errNotSupported }
+func WatchInterface(ctx context.Context, ifName string, onChange func(up bool)) error {
+	return errNotSupported
+}
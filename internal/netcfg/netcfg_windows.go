@@ -3,9 +3,11 @@
 package netcfg
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os/exec"
+	"strconv"
 	"strings"
 )
 
@@ -45,6 +47,9 @@ func AddRoutes(ifName string, routes []Route) error {
 			gw = "0.0.0.0"
 		}
 		args := []string{"ADD", ip, "MASK", mask, gw, "IF", fmt.Sprintf("%d", idx)}
+		if r.Metric > 0 {
+			args = append(args, "METRIC", fmt.Sprintf("%d", r.Metric))
+		}
 		_ = exec.Command("route", args...).Run()
 	}
 	return nil
@@ -66,7 +71,16 @@ func DeleteRoutes(ifName string, routes []Route) error {
 	return nil
 }
 
-func SetDNS(ifName string, dns []string) error {
+// SetDNS sets the interface's DNS servers. Windows keeps a single
+// connection-specific suffix per interface, so only the first search domain
+// is applied.
+func SetDNS(ifName string, dns, searchDomains []string) error {
+	if len(searchDomains) > 0 {
+		cmd := fmt.Sprintf("Set-DnsClient -InterfaceAlias %s -ConnectionSpecificSuffix %s", psQuote(ifName), psQuote(searchDomains[0]))
+		if err := exec.Command("powershell", "-NoProfile", "-Command", cmd).Run(); err != nil {
+			return fmt.Errorf("set dns suffix: %w", err)
+		}
+	}
 	if len(dns) == 0 {
 		return nil
 	}
@@ -82,6 +96,8 @@ func SetDNS(ifName string, dns []string) error {
 }
 
 func ResetDNS(ifName string) error {
+	cmd := fmt.Sprintf("Set-DnsClient -InterfaceAlias %s -ResetConnectionSpecificSuffix", psQuote(ifName))
+	_ = exec.Command("powershell", "-NoProfile", "-Command", cmd).Run()
 	args := []string{"interface", "ip", "set", "dns", fmt.Sprintf("name=%s", ifName), "dhcp"}
 	if err := exec.Command("netsh", args...).Run(); err != nil {
 		return fmt.Errorf("netsh set dns dhcp: %w", err)
@@ -89,9 +105,49 @@ func ResetDNS(ifName string) error {
 	return nil
 }
 
-func EnableIPForwarding() error              { return nil }
-func SetupNAT(cidr, outIface string) error   { return nil }
-func CleanupNAT(cidr, outIface string) error { return nil }
+func AddPolicyRoutes(ifName string, rules []PolicyRoute) error    { return errNotSupported }
+func DeletePolicyRoutes(ifName string, rules []PolicyRoute) error { return errNotSupported }
+
+func WatchInterface(ctx context.Context, ifName string, onChange func(up bool)) error {
+	return errNotSupported
+}
+
+func EnableIPForwarding() error                { return nil }
+func IsIPForwardingEnabled() (bool, error)     { return false, errNotSupported }
+func EnableIPv6Forwarding() error              { return nil }
+func IsIPv6ForwardingEnabled() (bool, error)   { return false, errNotSupported }
+func SetupNAT(cidr, outIface string) error     { return nil }
+func CleanupNAT(cidr, outIface string) error   { return nil }
+func SetupNATv6(cidr, outIface string) error   { return nil }
+func CleanupNATv6(cidr, outIface string) error { return nil }
+
+// GetInterfaceMTU reads the MTU column of `netsh interface ipv4 show
+// interfaces`.
+func GetInterfaceMTU(ifName string) (int, error) {
+	out, err := exec.Command("netsh", "interface", "ipv4", "show", "interfaces").Output()
+	if err != nil {
+		return 0, fmt.Errorf("netsh show interfaces: %w", err)
+	}
+	ifName = strings.TrimSpace(ifName)
+	for _, line := range strings.Split(string(out), "\n") {
+		// Idx  Met  MTU  State  Name, where Name may contain spaces.
+		fields := strings.Fields(line)
+		if len(fields) < 5 || strings.Join(fields[4:], " ") != ifName {
+			continue
+		}
+		mtu, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, fmt.Errorf("parse mtu %q: %w", fields[2], err)
+		}
+		return mtu, nil
+	}
+	return 0, fmt.Errorf("interface not found: %s", ifName)
+}
+
+// psQuote returns s as a single-quoted PowerShell string literal.
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
 
 func interfaceIndex(name string) (int, error) {
 	name = strings.TrimSpace(name)
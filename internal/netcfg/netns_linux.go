@@ -0,0 +1,56 @@
+//go:build linux
+
+package netcfg
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// InNamespace runs fn with its OS thread in the network namespace at path,
+// e.g. /var/run/netns/myvpn, so that netlink calls, commands it starts and
+// devices it opens belong to that namespace. fn runs on a goroutine of its
+// own; an empty path runs fn directly.
+func InNamespace(path string, fn func() error) error {
+	if path == "" {
+		return fn()
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		restored := false
+		defer func() {
+			// A thread left in the wrong namespace stays locked, which makes
+			// Go discard it when this goroutine exits.
+			if restored {
+				runtime.UnlockOSThread()
+			}
+		}()
+		orig, err := netns.Get()
+		if err != nil {
+			errCh <- fmt.Errorf("get netns: %w", err)
+			return
+		}
+		defer orig.Close()
+		fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			restored = true
+			errCh <- fmt.Errorf("open netns %s: %w", path, err)
+			return
+		}
+		target := netns.NsHandle(fd)
+		defer target.Close()
+		if err := netns.Set(target); err != nil {
+			restored = true
+			errCh <- fmt.Errorf("enter netns %s: %w", path, err)
+			return
+		}
+		err = fn()
+		restored = netns.Set(orig) == nil
+		errCh <- err
+	}()
+	return <-errCh
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package netcfg
+
+func InNamespace(path string, fn func() error) error {
+	if path != "" {
+		return errNotSupported
+	}
+	return fn()
+}
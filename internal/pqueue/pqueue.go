@@ -0,0 +1,126 @@
+// Package pqueue is a bounded packet queue ordered by DSCP class, so that
+// interactive traffic overtakes bulk transfers waiting in the same queue.
+package pqueue
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// NumPriorities is the number of priority levels; 0 is served first.
+const NumPriorities = 6
+
+// Priority maps the DSCP class of an IP packet to a priority level: EF and
+// above 0, AF4x 1, AF3x 2, AF2x 3, AF1x 4 and best effort 5. Packets that
+// are not IP are best effort.
+func Priority(pkt []byte) int {
+	if len(pkt) < 2 {
+		return NumPriorities - 1
+	}
+	var dscp byte
+	switch pkt[0] >> 4 {
+	case 4:
+		dscp = pkt[1] >> 2
+	case 6:
+		dscp = (pkt[0]<<4 | pkt[1]>>4) >> 2
+	default:
+		return NumPriorities - 1
+	}
+	class := int(dscp >> 3)
+	if class >= NumPriorities-1 {
+		return 0
+	}
+	return NumPriorities - 1 - class
+}
+
+type item struct {
+	pkt      []byte
+	priority int
+	seq      uint64
+}
+
+type itemHeap []item
+
+func (h itemHeap) Len() int { return len(h) }
+func (h itemHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h itemHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *itemHeap) Push(x any)   { *h = append(*h, x.(item)) }
+func (h *itemHeap) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = item{}
+	*h = old[:len(old)-1]
+	return it
+}
+
+// Queue is a bounded min-heap of packets. Packets of equal priority leave in
+// the order they arrived. Priority is strict: sustained high-priority
+// traffic can starve lower classes.
+type Queue struct {
+	mu    sync.Mutex
+	items itemHeap
+	limit int
+	seq   uint64
+	ready chan struct{}
+}
+
+func New(limit int) *Queue {
+	return &Queue{items: make(itemHeap, 0, limit), limit: limit, ready: make(chan struct{}, 1)}
+}
+
+// Enqueue adds pkt, returning false without taking it when the queue is
+// full.
+func (q *Queue) Enqueue(pkt []byte) bool {
+	q.mu.Lock()
+	if len(q.items) >= q.limit {
+		q.mu.Unlock()
+		return false
+	}
+	heap.Push(&q.items, item{pkt: pkt, priority: Priority(pkt), seq: q.seq})
+	q.seq++
+	q.mu.Unlock()
+	q.signal()
+	return true
+}
+
+// Dequeue removes the highest-priority packet, or returns false if the queue
+// is empty.
+func (q *Queue) Dequeue() ([]byte, bool) {
+	q.mu.Lock()
+	if len(q.items) == 0 {
+		q.mu.Unlock()
+		return nil, false
+	}
+	it := heap.Pop(&q.items).(item)
+	more := len(q.items) > 0
+	q.mu.Unlock()
+	if more {
+		// Wake another consumer for the rest.
+		q.signal()
+	}
+	return it.pkt, true
+}
+
+// Ready receives a value when the queue may have become non-empty; the
+// receiver should Dequeue until it returns false or its batch is full.
+func (q *Queue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+func (q *Queue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
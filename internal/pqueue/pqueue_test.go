@@ -0,0 +1,54 @@
+package pqueue
+
+import "testing"
+
+func ipv4(dscp byte, id byte) []byte {
+	pkt := make([]byte, 20)
+	pkt[0] = 0x45
+	pkt[1] = dscp << 2
+	pkt[4] = id
+	return pkt
+}
+
+func TestPriority(t *testing.T) {
+	cases := []struct {
+		dscp byte
+		want int
+	}{{46, 0}, {48, 0}, {34, 1}, {26, 2}, {18, 3}, {10, 4}, {0, 5}}
+	for _, c := range cases {
+		if got := Priority(ipv4(c.dscp, 0)); got != c.want {
+			t.Fatalf("dscp %d: got priority %d, want %d", c.dscp, got, c.want)
+		}
+	}
+	tc := byte(46 << 2)
+	v6 := make([]byte, 40)
+	v6[0] = 0x60 | tc>>4
+	v6[1] = tc << 4
+	if got := Priority(v6); got != 0 {
+		t.Fatalf("ipv6 ef: got priority %d, want 0", got)
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	q := New(4)
+	for i, dscp := range []byte{0, 26, 0, 46} {
+		if !q.Enqueue(ipv4(dscp, byte(i))) {
+			t.Fatalf("enqueue %d failed", i)
+		}
+	}
+	if q.Enqueue(ipv4(46, 9)) {
+		t.Fatalf("enqueue past limit succeeded")
+	}
+	<-q.Ready()
+	var order []byte
+	for {
+		pkt, ok := q.Dequeue()
+		if !ok {
+			break
+		}
+		order = append(order, pkt[4])
+	}
+	if want := []byte{3, 1, 0, 2}; string(order) != string(want) {
+		t.Fatalf("dequeue order %v, want %v", order, want)
+	}
+}
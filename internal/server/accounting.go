@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// AccountingRecord is POSTed as JSON to accounting_url when a session closes.
+// In and out are seen from the server: BytesIn is traffic from the client.
+type AccountingRecord struct {
+	SessionID  uint64    `json:"session_id"`
+	ClientID   string    `json:"client_id,omitempty"`
+	ClientIP   string    `json:"client_ip"`
+	Platform   string    `json:"platform,omitempty"`
+	StartTime  time.Time `json:"start_time"`
+	EndTime    time.Time `json:"end_time"`
+	BytesIn    uint64    `json:"bytes_in"`
+	BytesOut   uint64    `json:"bytes_out"`
+	PacketsIn  uint64    `json:"packets_in"`
+	PacketsOut uint64    `json:"packets_out"`
+}
+
+type accountant struct {
+	url     string
+	client  *http.Client
+	log     *slog.Logger
+	metrics *Metrics
+}
+
+func newAccountant(url string, timeout time.Duration, log *slog.Logger, metrics *Metrics) *accountant {
+	return &accountant{
+		url: url,
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{MaxIdleConnsPerHost: 16, IdleConnTimeout: 90 * time.Second},
+		},
+		log:     log,
+		metrics: metrics,
+	}
+}
+
+func accountingRecord(sess *Session) AccountingRecord {
+	st := sess.Stats()
+	return AccountingRecord{
+		SessionID:  sess.id,
+		ClientID:   sess.clientID,
+		ClientIP:   sess.ip.String(),
+		Platform:   sess.platform,
+		StartTime:  sess.startedAt.UTC(),
+		EndTime:    time.Now().UTC(),
+		BytesIn:    st.BytesRecv,
+		BytesOut:   st.BytesSent,
+		PacketsIn:  st.PacketsRecv,
+		PacketsOut: st.PacketsSent,
+	}
+}
+
+// Send posts rec and only logs failures; it is meant to run in its own
+// goroutine so session cleanup never waits on the endpoint.
+func (a *accountant) Send(rec AccountingRecord) {
+	if err := a.post(rec); err != nil {
+		a.metrics.accountingErrors.Inc()
+		a.log.Warn("accounting webhook failed", "id", rec.SessionID, "err", err)
+	}
+}
+
+func (a *accountant) post(rec AccountingRecord) error {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"qdt/internal/netcfg"
+)
+
+// maxAdvertiseRoutes bounds the routes one client may advertise.
+const maxAdvertiseRoutes = 16
+
+// prefix4 is an IPv4 network with its address and mask in host byte order.
+type prefix4 struct {
+	network uint32
+	mask    uint32
+}
+
+func parsePrefix4(cidr string) (prefix4, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return prefix4{}, err
+	}
+	ip4 := ipnet.IP.To4()
+	if ip4 == nil || len(ipnet.Mask) != net.IPv4len {
+		return prefix4{}, fmt.Errorf("%s is not ipv4", cidr)
+	}
+	return prefix4{network: binary.BigEndian.Uint32(ip4), mask: binary.BigEndian.Uint32(ipnet.Mask)}, nil
+}
+
+func (p prefix4) contains(ip uint32) bool {
+	return ip&p.mask == p.network
+}
+
+// covers reports whether q lies entirely within p.
+func (p prefix4) covers(q prefix4) bool {
+	return q.mask&p.mask == p.mask && p.contains(q.network)
+}
+
+func (p prefix4) overlaps(q prefix4) bool {
+	return p.contains(q.network) || q.contains(p.network)
+}
+
+func (p prefix4) String() string {
+	ip := make(net.IP, net.IPv4len)
+	mask := make(net.IPMask, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, p.network)
+	binary.BigEndian.PutUint32(mask, p.mask)
+	return (&net.IPNet{IP: ip, Mask: mask}).String()
+}
+
+type advertisedRoute struct {
+	prefix prefix4
+	sess   *Session
+}
+
+// routeTable maps the networks advertised by reverse-tunnel clients to
+// their sessions. It is consulted only for destinations that are not a
+// client address, so a linear scan is fine.
+type routeTable struct {
+	mu     sync.RWMutex
+	routes []advertisedRoute
+}
+
+// Lookup returns the session advertising the longest prefix containing ip.
+func (t *routeTable) Lookup(ip uint32) *Session {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var best *advertisedRoute
+	for i := range t.routes {
+		r := &t.routes[i]
+		if r.prefix.contains(ip) && (best == nil || r.prefix.mask > best.prefix.mask) {
+			best = r
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.sess
+}
+
+// Add records the prefixes of sess unless one overlaps a route advertised
+// by another session.
+func (t *routeTable) Add(sess *Session, prefixes []prefix4) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range t.routes {
+		for _, p := range prefixes {
+			if r.sess != sess && r.prefix.overlaps(p) {
+				return false
+			}
+		}
+	}
+	for _, p := range prefixes {
+		t.routes = append(t.routes, advertisedRoute{prefix: p, sess: sess})
+	}
+	return true
+}
+
+func (t *routeTable) Remove(sess *Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	kept := t.routes[:0]
+	for _, r := range t.routes {
+		if r.sess != sess {
+			kept = append(kept, r)
+		}
+	}
+	clear(t.routes[len(kept):])
+	t.routes = kept
+}
+
+// parseAdvertiseRoutes checks the routes a client asks to advertise against
+// allowed_advertise_prefix and the address pool.
+func (s *Server) parseAdvertiseRoutes(cidrs []string) ([]prefix4, *handshakeReject) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+	if s.cfg.AllowedAdvertisePrefix == "" {
+		return nil, &handshakeReject{http.StatusForbidden, "advertise_denied", "route advertisement is disabled"}
+	}
+	if len(cidrs) > maxAdvertiseRoutes {
+		return nil, &handshakeReject{http.StatusBadRequest, "advertise_denied", "too many advertised routes"}
+	}
+	allowed, err := parsePrefix4(s.cfg.AllowedAdvertisePrefix)
+	if err != nil {
+		return nil, &handshakeReject{http.StatusInternalServerError, "advertise_denied", "invalid allowed_advertise_prefix"}
+	}
+	pool, err := parsePrefix4(s.pool.CIDR())
+	if err != nil {
+		return nil, &handshakeReject{http.StatusInternalServerError, "advertise_denied", "invalid pool cidr"}
+	}
+	out := make([]prefix4, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		p, err := parsePrefix4(cidr)
+		if err != nil {
+			return nil, &handshakeReject{http.StatusBadRequest, "advertise_denied", "invalid advertised route " + cidr}
+		}
+		if !allowed.covers(p) || p.overlaps(pool) {
+			return nil, &handshakeReject{http.StatusForbidden, "advertise_denied", "advertised route " + cidr + " is not allowed"}
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// advertise routes the prefixes of sess through the tun via its client
+// address.
+func (s *Server) advertise(sess *Session, prefixes []prefix4) *handshakeReject {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	if !s.advertised.Add(sess, prefixes) {
+		return &handshakeReject{http.StatusConflict, "advertise_conflict", "advertised route is already in use"}
+	}
+	sess.advertised = prefixes
+	err := netcfg.InNamespace(s.cfg.NetNamespace, func() error {
+		return netcfg.AddRoutes(s.tun.Name, kernelRoutes(sess))
+	})
+	if err != nil {
+		sess.log.Warn("advertised route add failed", "err", err)
+		s.advertised.Remove(sess)
+		sess.advertised = nil
+		return &handshakeReject{http.StatusInternalServerError, "route_error", "advertised route error"}
+	}
+	sess.log.Info("routes advertised", "routes", len(prefixes))
+	return nil
+}
+
+func (s *Server) withdraw(sess *Session) {
+	if len(sess.advertised) == 0 {
+		return
+	}
+	s.advertised.Remove(sess)
+	err := netcfg.InNamespace(s.cfg.NetNamespace, func() error {
+		return netcfg.DeleteRoutes(s.tun.Name, kernelRoutes(sess))
+	})
+	if err != nil {
+		sess.log.Warn("advertised route cleanup failed", "err", err)
+	}
+}
+
+func (s *Session) advertisedRoutes() []string {
+	var out []string
+	for _, p := range s.advertised {
+		out = append(out, p.String())
+	}
+	return out
+}
+
+func kernelRoutes(sess *Session) []netcfg.Route {
+	routes := make([]netcfg.Route, len(sess.advertised))
+	for i, p := range sess.advertised {
+		routes[i] = netcfg.Route{Dest: p.String(), Gateway: sess.ip.String()}
+	}
+	return routes
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestRouteTable(t *testing.T) {
+	mustPrefix := func(cidr string) prefix4 {
+		p, err := parsePrefix4(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	ip := func(s string) uint32 { return binary.BigEndian.Uint32(net.ParseIP(s).To4()) }
+
+	allowed := mustPrefix("192.168.0.0/16")
+	if !allowed.covers(mustPrefix("192.168.10.0/24")) || allowed.covers(mustPrefix("192.0.0.0/8")) {
+		t.Fatal("covers mismatch")
+	}
+
+	var table routeTable
+	a, b := &Session{}, &Session{}
+	if !table.Add(a, []prefix4{mustPrefix("192.168.0.0/16")}) {
+		t.Fatal("add a failed")
+	}
+	if table.Add(b, []prefix4{mustPrefix("192.168.10.0/24")}) {
+		t.Fatal("overlapping route accepted")
+	}
+	if got := table.Lookup(ip("192.168.10.1")); got != a {
+		t.Fatalf("lookup = %p, want %p", got, a)
+	}
+	if got := table.Lookup(ip("10.0.0.1")); got != nil {
+		t.Fatalf("lookup outside routes = %p, want nil", got)
+	}
+	table.Remove(a)
+	if !table.Add(b, []prefix4{mustPrefix("192.168.10.0/24")}) {
+		t.Fatal("add b after remove failed")
+	}
+	if got := table.Lookup(ip("192.168.10.1")); got != b {
+		t.Fatalf("lookup after remove = %p, want %p", got, b)
+	}
+}
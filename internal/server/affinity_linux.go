@@ -0,0 +1,18 @@
+package server
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// pinToCPU locks the calling goroutine to its OS thread and binds that
+// thread to cpu modulo the CPU count. The goroutine must not unlock the
+// thread: when it exits, the runtime discards the pinned thread instead of
+// reusing it for other goroutines.
+func pinToCPU(cpu int) error {
+	runtime.LockOSThread()
+	var set unix.CPUSet
+	set.Set(cpu % runtime.NumCPU())
+	return unix.SchedSetaffinity(0, &set)
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+)
+
+// BenchmarkHandoffLatency passes timestamps from a producer to a consumer
+// goroutine, as tunReadLoop hands packets to an encodeLoop, and reports the
+// latency distribution with and without pin_to_cpu style pinning.
+func BenchmarkHandoffLatency(b *testing.B) {
+	b.Run("unpinned", func(b *testing.B) { benchHandoff(b, false) })
+	b.Run("pinned", func(b *testing.B) {
+		if runtime.NumCPU() < 2 {
+			b.Skip("needs at least 2 cpus")
+		}
+		benchHandoff(b, true)
+	})
+}
+
+func benchHandoff(b *testing.B, pin bool) {
+	ch := make(chan time.Time, 64)
+	lat := make([]time.Duration, 0, b.N)
+	done := make(chan struct{})
+	go func() {
+		if pin {
+			if err := pinToCPU(firstEncodeCPU); err != nil {
+				b.Error(err)
+			}
+		}
+		for t := range ch {
+			lat = append(lat, time.Since(t))
+		}
+		close(done)
+	}()
+	b.ResetTimer()
+	go func() {
+		if pin {
+			if err := pinToCPU(tunReadCPU); err != nil {
+				b.Error(err)
+			}
+		}
+		for i := 0; i < b.N; i++ {
+			ch <- time.Now()
+		}
+		close(ch)
+	}()
+	<-done
+	b.StopTimer()
+	slices.Sort(lat)
+	b.ReportMetric(float64(lat[len(lat)/2].Nanoseconds()), "p50-ns")
+	b.ReportMetric(float64(lat[len(lat)*99/100].Nanoseconds()), "p99-ns")
+}
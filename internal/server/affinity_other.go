@@ -0,0 +1,9 @@
+//go:build !linux
+
+package server
+
+import "errors"
+
+func pinToCPU(cpu int) error {
+	return errors.New("cpu pinning is only supported on linux")
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"qdt/pkg/qdt"
+)
+
+// quicProtocols are the ALPN values of the QUIC listener, most preferred
+// first; the TLS stack picks by server preference. qdt/2 goes last until its
+// handler lands, so only clients offering nothing else negotiate it.
+var quicProtocols = []string{qdt.ALPNv1, http3.NextProtoH3, qdt.ALPNv2}
+
+// errCodeUnsupportedProtocol closes connections that negotiated a protocol
+// version without a handler.
+const errCodeUnsupportedProtocol quic.ApplicationErrorCode = 0x100
+
+// alpnListener accepts QUIC connections for every QDT protocol version.
+// h3 and qdt/1 connections are returned to the HTTP/3 server; qdt/2 ones
+// are dispatched to the binary handler.
+type alpnListener struct {
+	*quic.EarlyListener
+	s *Server
+}
+
+// listenQUIC opens the QUIC listener on pc, or on the configured address
+// when pc is nil. http3.Server's own listeners only offer h3.
+func (s *Server) listenQUIC(pc net.PacketConn, tlsConf *tls.Config, quicConf *quic.Config) (*alpnListener, error) {
+	// Initialize the session ticket keys before cloning so every listener
+	// resumes the others' sessions; see golang/go#60506.
+	_, _ = tlsConf.DecryptTicket(nil, tls.ConnectionState{})
+	conf := tlsConf.Clone()
+	conf.NextProtos = quicProtocols
+	var (
+		ln  *quic.EarlyListener
+		err error
+	)
+	if pc != nil {
+		ln, err = quic.ListenEarly(pc, conf, quicConf)
+	} else {
+		ln, err = quic.ListenAddrEarly(s.cfg.Addr, conf, quicConf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("quic listen: %w", err)
+	}
+	return &alpnListener{EarlyListener: ln, s: s}, nil
+}
+
+func (l *alpnListener) Accept(ctx context.Context) (*quic.Conn, error) {
+	for {
+		conn, err := l.EarlyListener.Accept(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if conn.ConnectionState().TLS.NegotiatedProtocol == qdt.ALPNv2 {
+			go l.s.serveBinary(conn)
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// serveBinary will handle the binary connect of qdt/2. Until it exists the
+// connection is refused.
+func (s *Server) serveBinary(conn *quic.Conn) {
+	s.log.Debug("qdt/2 connection refused", "remote", conn.RemoteAddr())
+	_ = conn.CloseWithError(errCodeUnsupportedProtocol, "qdt/2 not supported")
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	auditSessionOpen  = "session_open"
+	auditSessionClose = "session_close"
+)
+
+// AuditEvent is one line of the audit log. PrevHash is the hex SHA-256 of the
+// previous line, so removing or editing an entry breaks the chain.
+type AuditEvent struct {
+	Time      time.Time     `json:"time"`
+	Type      string        `json:"type"`
+	SessionID uint64        `json:"session_id"`
+	ClientIP  string        `json:"client_ip"`
+	ClientID  string        `json:"client_id,omitempty"`
+	Platform  string        `json:"platform,omitempty"`
+	BytesIn   uint64        `json:"bytes_in"`
+	BytesOut  uint64        `json:"bytes_out"`
+	Duration  time.Duration `json:"duration"`
+	PrevHash  string        `json:"prev_hash"`
+}
+
+type auditLog struct {
+	mu       sync.Mutex
+	f        *os.File
+	prevHash string
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	prev, err := lastAuditHash(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	return &auditLog{f: f, prevHash: prev}, nil
+}
+
+func (a *auditLog) Write(ev AuditEvent) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ev.PrevHash = a.prevHash
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("marshal audit event: %w", err)
+	}
+	if _, err := a.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write audit event: %w", err)
+	}
+	a.prevHash = auditHash(line)
+	return nil
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
+
+func auditHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+func lastAuditHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("open audit log: %w", err)
+	}
+	defer f.Close()
+	var last []byte
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 4096), 1<<20)
+	for sc.Scan() {
+		if line := bytes.TrimSpace(sc.Bytes()); len(line) > 0 {
+			last = append(last[:0], line...)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", fmt.Errorf("read audit log: %w", err)
+	}
+	if last == nil {
+		return "", nil
+	}
+	return auditHash(last), nil
+}
+
+// verifyAuditLog recomputes the hash chain and reports every broken link.
+func verifyAuditLog(r io.Reader, out io.Writer) (int, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 4096), 1<<20)
+	prev := ""
+	broken := 0
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var ev AuditEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			fmt.Fprintf(out, "line %d: invalid event: %v\n", lineNo, err)
+			broken++
+		} else if ev.PrevHash != prev {
+			fmt.Fprintf(out, "line %d: broken chain: prev_hash %q, expected %q\n", lineNo, ev.PrevHash, prev)
+			broken++
+		}
+		prev = auditHash(line)
+	}
+	if err := sc.Err(); err != nil {
+		return broken, fmt.Errorf("read audit log: %w", err)
+	}
+	return broken, nil
+}
+
+// RunAudit implements the "audit" subcommand and returns the exit code.
+func RunAudit(args []string) int {
+	if len(args) != 2 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "usage: qdt-server audit verify <file>")
+		return 2
+	}
+	f, err := os.Open(args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+	broken, err := verifyAuditLog(f, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if broken > 0 {
+		fmt.Printf("%d broken link(s)\n", broken)
+		return 1
+	}
+	fmt.Println("audit chain ok")
+	return 0
+}
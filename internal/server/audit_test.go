@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	write := func(evs ...AuditEvent) {
+		a, err := openAuditLog(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ev := range evs {
+			if err := a.Write(ev); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := a.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Unix(1700000000, 0).UTC()
+	write(
+		AuditEvent{Time: now, Type: auditSessionOpen, SessionID: 1, ClientIP: "10.8.0.2"},
+		AuditEvent{Time: now, Type: auditSessionOpen, SessionID: 2, ClientIP: "10.8.0.3"},
+	)
+	// Reopening continues the chain from the last line on disk.
+	write(
+		AuditEvent{Time: now, Type: auditSessionClose, SessionID: 1, ClientIP: "10.8.0.2", BytesIn: 100},
+		AuditEvent{Time: now, Type: auditSessionClose, SessionID: 2, ClientIP: "10.8.0.3", BytesIn: 200},
+	)
+	orig, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if broken, err := verifyAuditLog(bytes.NewReader(orig), io.Discard); err != nil || broken != 0 {
+		t.Fatalf("intact log: broken=%d err=%v", broken, err)
+	}
+
+	lines := bytes.SplitAfter(orig, []byte("\n"))
+	flipped := bytes.Clone(orig)
+	flipped[bytes.Index(flipped, []byte(`"bytes_in":100`))+len(`"bytes_in":`)] = '9'
+	deleted := bytes.Join([][]byte{lines[0], lines[2], lines[3]}, nil)
+	for name, b := range map[string][]byte{"flipped byte": flipped, "deleted record": deleted} {
+		var out bytes.Buffer
+		broken, err := verifyAuditLog(bytes.NewReader(b), &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if broken != 1 || !bytes.Contains(out.Bytes(), []byte("broken chain")) {
+			t.Fatalf("%s: broken=%d, output %q", name, broken, out.String())
+		}
+	}
+}
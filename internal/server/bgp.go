@@ -0,0 +1,124 @@
+//go:build bgp
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	api "github.com/osrg/gobgp/v3/api"
+	gobgp "github.com/osrg/gobgp/v3/pkg/server"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const bgpSupported = true
+
+// startBGP runs an embedded GoBGP speaker that announces the pool to the
+// configured peers. The returned func withdraws the pool and stops it.
+func (s *Server) startBGP(ctx context.Context) (func(), error) {
+	bgp := gobgp.NewBgpServer()
+	go bgp.Serve()
+
+	// ListenPort -1: only dial the peers, never accept connections.
+	err := bgp.StartBgp(ctx, &api.StartBgpRequest{Global: &api.Global{
+		Asn:        s.cfg.BGP.ASN,
+		RouterId:   s.cfg.BGP.RouterID,
+		ListenPort: -1,
+	}})
+	if err != nil {
+		bgp.Stop()
+		return nil, fmt.Errorf("start: %w", err)
+	}
+	fail := func(err error) (func(), error) {
+		_ = bgp.StopBgp(context.Background(), &api.StopBgpRequest{})
+		bgp.Stop()
+		return nil, err
+	}
+
+	watchCtx, cancelWatch := context.WithCancel(context.Background())
+	err = bgp.WatchEvent(watchCtx, &api.WatchEventRequest{Peer: &api.WatchEventRequest_Peer{}}, func(r *api.WatchEventResponse) {
+		p := r.GetPeer()
+		if p == nil || p.Type != api.WatchEventResponse_PeerEvent_STATE {
+			return
+		}
+		s.log.Info("bgp peer state", "peer", p.Peer.GetConf().GetNeighborAddress(), "state", p.Peer.GetState().GetSessionState().String())
+	})
+	if err != nil {
+		cancelWatch()
+		return fail(fmt.Errorf("watch peers: %w", err))
+	}
+
+	for _, peer := range s.cfg.BGP.Peers {
+		err := bgp.AddPeer(ctx, &api.AddPeerRequest{Peer: &api.Peer{
+			Conf: &api.PeerConf{NeighborAddress: peer.Addr, PeerAsn: peer.ASN},
+		}})
+		if err != nil {
+			cancelWatch()
+			return fail(fmt.Errorf("add peer %s: %w", peer.Addr, err))
+		}
+	}
+
+	withdraw, err := announcePool(ctx, bgp, s.pool.CIDR())
+	if err != nil {
+		cancelWatch()
+		return fail(err)
+	}
+	s.log.Info("bgp started", "asn", s.cfg.BGP.ASN, "router_id", s.cfg.BGP.RouterID, "peers", len(s.cfg.BGP.Peers), "prefix", s.pool.CIDR())
+
+	return func() {
+		stopCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := withdraw(stopCtx); err != nil {
+			s.log.Warn("bgp withdraw failed", "err", err)
+		}
+		cancelWatch()
+		if err := bgp.StopBgp(stopCtx, &api.StopBgpRequest{}); err != nil {
+			s.log.Warn("bgp stop failed", "err", err)
+		}
+		bgp.Stop()
+	}, nil
+}
+
+// announcePool adds cidr to the global RIB of bgp, from where it is sent to
+// every established peer. The returned func withdraws it again.
+func announcePool(ctx context.Context, bgp *gobgp.BgpServer, cidr string) (func(context.Context) error, error) {
+	path, err := poolPath(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := bgp.AddPath(ctx, &api.AddPathRequest{TableType: api.TableType_GLOBAL, Path: path}); err != nil {
+		return nil, fmt.Errorf("announce %s: %w", cidr, err)
+	}
+	return func(ctx context.Context) error {
+		return bgp.DeletePath(ctx, &api.DeletePathRequest{TableType: api.TableType_GLOBAL, Path: path})
+	}, nil
+}
+
+// poolPath builds the IPv4 unicast path for cidr. A zero next hop makes
+// GoBGP substitute its local address on each peering.
+func poolPath(cidr string) (*api.Path, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("parse pool cidr: %w", err)
+	}
+	ones, _ := ipnet.Mask.Size()
+	nlri, err := anypb.New(&api.IPAddressPrefix{Prefix: ipnet.IP.String(), PrefixLen: uint32(ones)})
+	if err != nil {
+		return nil, err
+	}
+	origin, err := anypb.New(&api.OriginAttribute{Origin: 0})
+	if err != nil {
+		return nil, err
+	}
+	nextHop, err := anypb.New(&api.NextHopAttribute{NextHop: "0.0.0.0"})
+	if err != nil {
+		return nil, err
+	}
+	return &api.Path{
+		Family: &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST},
+		Nlri:   nlri,
+		Pattrs: []*anypb.Any{origin, nextHop},
+	}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !bgp
+
+package server
+
+import (
+	"context"
+	"errors"
+)
+
+const bgpSupported = false
+
+func (s *Server) startBGP(context.Context) (func(), error) {
+	return nil, errors.New("bgp requires a build with -tags bgp")
+}
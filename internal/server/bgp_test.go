@@ -0,0 +1,53 @@
+//go:build bgp
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	api "github.com/osrg/gobgp/v3/api"
+	gobgp "github.com/osrg/gobgp/v3/pkg/server"
+)
+
+func TestAnnouncePool(t *testing.T) {
+	ctx := context.Background()
+	bgp := gobgp.NewBgpServer()
+	go bgp.Serve()
+	defer bgp.Stop()
+	if err := bgp.StartBgp(ctx, &api.StartBgpRequest{Global: &api.Global{Asn: 65000, RouterId: "192.0.2.1", ListenPort: -1}}); err != nil {
+		t.Fatal(err)
+	}
+	defer bgp.StopBgp(ctx, &api.StopBgpRequest{})
+
+	rib := func() []string {
+		var prefixes []string
+		err := bgp.ListPath(ctx, &api.ListPathRequest{
+			TableType: api.TableType_GLOBAL,
+			Family:    &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST},
+		}, func(d *api.Destination) {
+			prefixes = append(prefixes, d.Prefix)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return prefixes
+	}
+
+	if _, err := announcePool(ctx, bgp, "10.8.0.0/33"); err == nil {
+		t.Fatal("announced an invalid cidr")
+	}
+	withdraw, err := announcePool(ctx, bgp, "10.8.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rib(); len(got) != 1 || got[0] != "10.8.0.0/24" {
+		t.Fatalf("rib after announce: %v", got)
+	}
+	if err := withdraw(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := rib(); len(got) != 0 {
+		t.Fatalf("rib after withdraw: %v", got)
+	}
+}
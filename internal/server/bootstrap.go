@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"crypto/ecdsa"
@@ -16,7 +16,7 @@ import (
 	"path/filepath"
 	"time"
 
-	"gopkg.in/yaml.v3"
+	"qdt/internal/config"
 )
 
 func ensureServerAssets(configPath string, cfg *Config) (bool, error) {
@@ -29,6 +29,13 @@ func ensureServerAssets(configPath string, cfg *Config) (bool, error) {
 		cfg.Token = token
 		updated = true
 	}
+	if cfg.ACME.Domain != "" {
+		if cfg.ACME.CacheDir == "" {
+			cfg.ACME.CacheDir = filepath.Join(filepath.Dir(configPath), "acme")
+			updated = true
+		}
+		return updated, nil
+	}
 	if cfg.TLSCert == "" {
 		cfg.TLSCert = defaultCertPath(configPath)
 		updated = true
@@ -76,7 +83,7 @@ func writeConfig(path string, cfg Config) error {
 	if err := ensureDir(path); err != nil {
 		return err
 	}
-	b, err := yaml.Marshal(&cfg)
+	b, err := config.Marshal(path, &cfg)
 	if err != nil {
 		return fmt.Errorf("marshal config: %w", err)
 	}
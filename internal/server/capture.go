@@ -0,0 +1,21 @@
+package server
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// packetCapture records plaintext IP packets for debugging. Only debug builds
+// provide an implementation; see capture_debug.go.
+type packetCapture interface {
+	Write(pkt []byte)
+	Close()
+}
+
+// captureFileName derives a per-session file from capture_file, so
+// /tmp/qdt.pcap becomes /tmp/qdt-<session id>.pcap.
+func captureFileName(base string, sessionID uint64) string {
+	ext := filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + "-" + strconv.FormatUint(sessionID, 10) + ext
+}
@@ -0,0 +1,93 @@
+//go:build debug
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const captureSupported = true
+
+const captureQueue = 1024
+
+// pcapCapture writes plaintext packets to a pcap file from its own goroutine
+// so the data path never blocks on disk. Packets are dropped when the queue
+// is full.
+type pcapCapture struct {
+	mu     sync.Mutex
+	closed bool
+	ch     chan capturedPacket
+	done   chan struct{}
+}
+
+type capturedPacket struct {
+	at    time.Time
+	frame []byte
+}
+
+func openCapture(path string) (packetCapture, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open capture: %w", err)
+	}
+	bw := bufio.NewWriter(f)
+	w := pcapgo.NewWriter(bw)
+	if err := w.WriteFileHeader(maxPacketSize+14, layers.LinkTypeEthernet); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("write capture header: %w", err)
+	}
+	c := &pcapCapture{ch: make(chan capturedPacket, captureQueue), done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		defer f.Close()
+		defer bw.Flush()
+		for p := range c.ch {
+			ci := gopacket.CaptureInfo{Timestamp: p.at, CaptureLength: len(p.frame), Length: len(p.frame)}
+			_ = w.WritePacket(ci, p.frame)
+		}
+	}()
+	return c, nil
+}
+
+func (c *pcapCapture) Write(pkt []byte) {
+	if len(pkt) == 0 {
+		return
+	}
+	// Synthetic Ethernet header: zero MACs and the EtherType of the IP version.
+	frame := make([]byte, 14+len(pkt))
+	if pkt[0]>>4 == 6 {
+		frame[12], frame[13] = 0x86, 0xdd
+	} else {
+		frame[12], frame[13] = 0x08, 0x00
+	}
+	copy(frame[14:], pkt)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.ch <- capturedPacket{at: time.Now(), frame: frame}:
+	default:
+	}
+}
+
+func (c *pcapCapture) Close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.ch)
+	c.mu.Unlock()
+	<-c.done
+}
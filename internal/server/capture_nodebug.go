@@ -0,0 +1,11 @@
+//go:build !debug
+
+package server
+
+import "errors"
+
+const captureSupported = false
+
+func openCapture(string) (packetCapture, error) {
+	return nil, errors.New("packet capture requires a build with -tags debug")
+}
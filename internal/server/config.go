@@ -0,0 +1,602 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"runtime"
+	"time"
+
+	"qdt/internal/acl"
+	"qdt/internal/config"
+	"qdt/internal/logging"
+	"qdt/pkg/qdt"
+)
+
+type Config struct {
+	Addr    string `yaml:"addr"`
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+	ACME    struct {
+		Domain   string `yaml:"domain"`
+		Email    string `yaml:"email"`
+		CacheDir string `yaml:"cache_dir"`
+	} `yaml:"acme"`
+	ACMEChallengePort            int             `yaml:"acme_challenge_port"`
+	WebSocket                    bool            `yaml:"websocket"`
+	TCPFallbackAddr              string          `yaml:"tcp_fallback_addr"`
+	Token                        string          `yaml:"token"`
+	JWTSecret                    string          `yaml:"jwt_secret"`
+	JWTIssuer                    string          `yaml:"jwt_issuer"`
+	MTU                          int             `yaml:"mtu"`
+	TunName                      string          `yaml:"tun_name"`
+	NetNamespace                 string          `yaml:"net_namespace"`
+	PoolCIDR                     string          `yaml:"pool_cidr"`
+	GatewayIP                    string          `yaml:"gateway_ip"`
+	DNS                          []string        `yaml:"dns"`
+	SearchDomains                []string        `yaml:"search_domains"`
+	MetricsAddr                  string          `yaml:"metrics_addr"`
+	HealthAddr                   string          `yaml:"health_addr"`
+	PprofAddr                    string          `yaml:"pprof_addr"`
+	AdminAddr                    string          `yaml:"admin_addr"`
+	AdminToken                   string          `yaml:"admin_token"`
+	OTLPMetricsEndpoint          string          `yaml:"otlp_metrics_endpoint"`
+	OTLPMetricsInterval          time.Duration   `yaml:"otlp_metrics_interval"`
+	StatsDAddr                   string          `yaml:"statsd_addr"`
+	StatsDPrefix                 string          `yaml:"statsd_prefix"`
+	StatsFlushInterval           time.Duration   `yaml:"stats_flush_interval"`
+	MaxDropLabelCardinality      int             `yaml:"max_drop_label_cardinality"`
+	AuditLog                     string          `yaml:"audit_log"`
+	AccountingURL                string          `yaml:"accounting_url"`
+	AccountingTimeout            time.Duration   `yaml:"accounting_timeout"`
+	CaptureFile                  string          `yaml:"capture_file"`
+	CaptureBuildTag              string          `yaml:"capture_build_tag"`
+	LogLevel                     string          `yaml:"log_level"`
+	LogJSON                      bool            `yaml:"log_json"`
+	LogFile                      string          `yaml:"log_file"`
+	LogMaxSizeMB                 int             `yaml:"log_max_size_mb"`
+	LogMaxBackups                int             `yaml:"log_max_backups"`
+	LogMaxAge                    int             `yaml:"log_max_age"`
+	LogSyslog                    bool            `yaml:"log_syslog"`
+	SyslogNetwork                string          `yaml:"syslog_network"`
+	SyslogAddr                   string          `yaml:"syslog_addr"`
+	SyslogTag                    string          `yaml:"syslog_tag"`
+	SessionTimeout               time.Duration   `yaml:"session_timeout"`
+	MaxTokenAge                  time.Duration   `yaml:"max_token_age"`
+	KeepaliveEnabled             bool            `yaml:"keepalive_enabled"`
+	KeepaliveInterval            time.Duration   `yaml:"keepalive_interval"`
+	KeepaliveTimeout             time.Duration   `yaml:"keepalive_timeout"`
+	WatchdogTimeout              time.Duration   `yaml:"watchdog_timeout"`
+	MaxReassemblyBytes           int             `yaml:"max_reassembly_bytes"`
+	MaxReassemblyAggregateBytes  int             `yaml:"max_reassembly_aggregate_bytes"`
+	ReassemblyTTL                time.Duration   `yaml:"reassembly_ttl"`
+	MaxFragmentEntries           int             `yaml:"max_fragment_entries"`
+	MaxFragmentEntriesPerSession int             `yaml:"max_fragment_entries_per_session"`
+	MaxSessions                  int             `yaml:"max_sessions"`
+	MaxSessionsPerIP             int             `yaml:"max_sessions_per_ip"`
+	MaxSessionsPerClientID       int             `yaml:"max_sessions_per_client_id"`
+	SendICMPUnreachable          bool            `yaml:"send_icmp_unreachable"`
+	Compress                     bool            `yaml:"compress"`
+	FragmentNAK                  bool            `yaml:"fragment_nak"`
+	ReplayProtection0RTT         bool            `yaml:"replay_protection_0rtt"`
+	ReplayWindowAutoScale        bool            `yaml:"replay_window_auto_scale"`
+	FIPSMode                     bool            `yaml:"fips_mode"`
+	AllowHairpin                 bool            `yaml:"allow_hairpin"`
+	AllowedAdvertisePrefix       string          `yaml:"allowed_advertise_prefix"`
+	CoalesceInterval             time.Duration   `yaml:"coalesce_interval"`
+	CoalesceMaxBytes             int             `yaml:"coalesce_max_bytes"`
+	CoalesceThreshold            int             `yaml:"coalesce_threshold"`
+	DSCPMark                     uint8           `yaml:"dscp_mark"`
+	RateLimit                    RateLimitConfig `yaml:"rate_limit"`
+	ShaperType                   string          `yaml:"shaper_type"`
+	ProtocolRateLimits           struct {
+		TCP  RateLimitConfig `yaml:"tcp"`
+		UDP  RateLimitConfig `yaml:"udp"`
+		ICMP RateLimitConfig `yaml:"icmp"`
+	} `yaml:"protocol_rate_limits"`
+	HandshakeRate             RateLimitConfig `yaml:"handshake_rate"`
+	HandshakeRateWarmup       time.Duration   `yaml:"handshake_rate_warmup"`
+	HandshakeRateWarmupFactor float64         `yaml:"handshake_rate_warmup_factor"`
+	HandshakeIPRate           struct {
+		PPS   int           `yaml:"pps"`
+		Burst int           `yaml:"burst"`
+		TTL   time.Duration `yaml:"ttl"`
+	} `yaml:"handshake_ip_rate"`
+	SendWorkers             int                     `yaml:"send_workers"`
+	SendQueue               int                     `yaml:"send_queue"`
+	SendBatch               int                     `yaml:"send_batch"`
+	SendDatagramQueue       int                     `yaml:"send_datagram_queue"`
+	SessionShards           int                     `yaml:"session_shards"`
+	PinToCPU                bool                    `yaml:"pin_to_cpu"`
+	RequireIPForwarding     bool                    `yaml:"require_ip_forwarding"`
+	Tenants                 map[string]TenantConfig `yaml:"tenants"`
+	ACL                     []ACLRule               `yaml:"acl"`
+	ACLDefaultAction        string                  `yaml:"acl_default_action"`
+	QUICMaxIncomingStreams  int                     `yaml:"quic_max_incoming_streams"`
+	QUICInitialStreamWindow uint64                  `yaml:"quic_initial_stream_window"`
+	QUICInitialConnWindow   uint64                  `yaml:"quic_initial_conn_window"`
+	QUICMaxDatagramPayload  uint16                  `yaml:"quic_max_datagram_payload"`
+	NAT                     struct {
+		Enabled       bool   `yaml:"enabled"`
+		ExternalIface string `yaml:"external_iface"`
+	} `yaml:"nat"`
+	BGP BGPConfig `yaml:"bgp"`
+}
+
+// BGPConfig announces the pool to upstream routers from an embedded GoBGP
+// speaker. It requires a build with -tags bgp.
+type BGPConfig struct {
+	Enabled  bool      `yaml:"enabled"`
+	ASN      uint32    `yaml:"asn"`
+	RouterID string    `yaml:"router_id"`
+	Peers    []BGPPeer `yaml:"peers"`
+}
+
+type BGPPeer struct {
+	Addr string `yaml:"addr"`
+	ASN  uint32 `yaml:"asn"`
+}
+
+// TenantConfig overrides send and rate limit settings for the clients whose
+// JWT has a given subject; zero fields use the global value.
+type TenantConfig struct {
+	SendQueue    int             `yaml:"send_queue"`
+	SendBatch    int             `yaml:"send_batch"`
+	SendWorkers  int             `yaml:"send_workers"`
+	InRateLimit  RateLimitConfig `yaml:"in_rate_limit"`
+	OutRateLimit RateLimitConfig `yaml:"out_rate_limit"`
+}
+
+// sendParams returns the send workers, queue depth and batch size for a
+// session authenticated as subject. Tenants are only looked up by the JWT
+// subject: a client ID is whatever the client claims, so a static token
+// (empty subject) gets the global values.
+func (c Config) sendParams(subject string) (workers, queue, batch int) {
+	workers, queue, batch = c.SendWorkers, c.SendQueue, c.SendBatch
+	t, ok := c.Tenants[subject]
+	if !ok || subject == "" {
+		return workers, queue, batch
+	}
+	if t.SendWorkers > 0 {
+		workers = t.SendWorkers
+	}
+	if t.SendQueue > 0 {
+		queue = t.SendQueue
+	}
+	if t.SendBatch > 0 {
+		batch = t.SendBatch
+	}
+	return workers, queue, batch
+}
+
+// rateLimits returns the client to server and server to client limits for a
+// session authenticated as subject; like sendParams it ignores the client ID.
+func (c Config) rateLimits(subject string) (in, out RateLimitConfig) {
+	in, out = c.RateLimit, c.RateLimit
+	t, ok := c.Tenants[subject]
+	if !ok || subject == "" {
+		return in, out
+	}
+	if t.InRateLimit.PPS > 0 {
+		in.PPS = t.InRateLimit.PPS
+	}
+	if t.InRateLimit.Burst > 0 {
+		in.Burst = t.InRateLimit.Burst
+	}
+	if t.OutRateLimit.PPS > 0 {
+		out.PPS = t.OutRateLimit.PPS
+	}
+	if t.OutRateLimit.Burst > 0 {
+		out.Burst = t.OutRateLimit.Burst
+	}
+	return in, out
+}
+
+// ACLRule allows or drops packets between SrcCIDR and DstCIDR. Empty CIDRs
+// and a zero Proto match anything; DstPortMax defaults to DstPortMin.
+type ACLRule struct {
+	SrcCIDR    string `yaml:"src_cidr"`
+	DstCIDR    string `yaml:"dst_cidr"`
+	Proto      uint8  `yaml:"proto"`
+	DstPortMin uint16 `yaml:"dst_port_min"`
+	DstPortMax uint16 `yaml:"dst_port_max"`
+	Action     string `yaml:"action"`
+}
+
+// aclMatcher builds the packet filter, or returns nil when no rule is
+// configured.
+func (c Config) aclMatcher() (*acl.Matcher, error) {
+	if len(c.ACL) == 0 {
+		return nil, nil
+	}
+	def, err := acl.ParseAction(c.ACLDefaultAction)
+	if err != nil {
+		return nil, fmt.Errorf("acl_default_action: %w", err)
+	}
+	rules := make([]acl.Rule, len(c.ACL))
+	for i, r := range c.ACL {
+		rule := acl.Rule{Proto: r.Proto, DstPortMin: r.DstPortMin, DstPortMax: r.DstPortMax}
+		if r.SrcCIDR != "" {
+			if rule.Src, err = netip.ParsePrefix(r.SrcCIDR); err != nil {
+				return nil, fmt.Errorf("acl rule %d: src_cidr: %w", i, err)
+			}
+		}
+		if r.DstCIDR != "" {
+			if rule.Dst, err = netip.ParsePrefix(r.DstCIDR); err != nil {
+				return nil, fmt.Errorf("acl rule %d: dst_cidr: %w", i, err)
+			}
+		}
+		if r.DstPortMax != 0 && r.DstPortMax < r.DstPortMin {
+			return nil, fmt.Errorf("acl rule %d: dst_port_max is below dst_port_min", i)
+		}
+		if rule.Action, err = acl.ParseAction(r.Action); err != nil {
+			return nil, fmt.Errorf("acl rule %d: %w", i, err)
+		}
+		rules[i] = rule
+	}
+	return acl.New(rules, def), nil
+}
+
+// Values of shaper_type: a token bucket lets rate_limit.burst packets
+// through at once, a leaky bucket spaces packets evenly at rate_limit.pps.
+const (
+	ShaperToken = "token"
+	ShaperLeaky = "leaky"
+)
+
+// RateLimitConfig is a token bucket: PPS packets per second with bursts of up
+// to Burst. A zero PPS disables the limit where no default applies.
+type RateLimitConfig struct {
+	PPS   int `yaml:"pps"`
+	Burst int `yaml:"burst"`
+}
+
+func LoadConfig(path string) (Config, error) {
+	if path == "" {
+		return Config{}, fmt.Errorf("config path is empty")
+	}
+	// Booleans that default to true are seeded before the file is decoded,
+	// so only an explicit false in the file turns them off.
+	cfg := Config{RequireIPForwarding: true}
+	exists, err := fileExists(path)
+	if err != nil {
+		return Config{}, err
+	}
+	if exists {
+		if err := config.LoadFile(path, &cfg); err != nil {
+			return Config{}, err
+		}
+	}
+	applyDefaults(&cfg)
+	updated, err := ensureServerAssets(path, &cfg)
+	if err != nil {
+		return Config{}, err
+	}
+	if !exists || updated {
+		if err := writeConfig(path, cfg); err != nil {
+			return Config{}, err
+		}
+	}
+	// Environment overrides are applied after the config is persisted so
+	// secrets passed via QDT_* variables are never written to disk.
+	if err := config.OverrideFromEnv(config.EnvPrefix, &cfg); err != nil {
+		return Config{}, err
+	}
+	if err := validateConfig(cfg); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// LogOutput returns the log file and syslog settings for logging.New.
+func (c Config) LogOutput() logging.Output {
+	return logging.Output{
+		Path:          c.LogFile,
+		MaxSizeMB:     c.LogMaxSizeMB,
+		MaxBackups:    c.LogMaxBackups,
+		MaxAgeDays:    c.LogMaxAge,
+		Syslog:        c.LogSyslog,
+		SyslogNetwork: c.SyslogNetwork,
+		SyslogAddr:    c.SyslogAddr,
+		SyslogTag:     c.SyslogTag,
+	}
+}
+
+// SetDefaults fills zero fields with their defaults, as LoadConfig does.
+func (c *Config) SetDefaults() {
+	applyDefaults(c)
+}
+
+func (c Config) Validate() error {
+	return validateConfig(c)
+}
+
+func applyDefaults(cfg *Config) {
+	if cfg.Addr == "" {
+		cfg.Addr = ":443"
+	}
+	if cfg.ACMEChallengePort == 0 {
+		cfg.ACMEChallengePort = 80
+	}
+	if cfg.MTU == 0 {
+		cfg.MTU = qdt.DefaultMTU
+	}
+	if cfg.TunName == "" {
+		cfg.TunName = "qdt0"
+	}
+	if cfg.PoolCIDR == "" {
+		cfg.PoolCIDR = "10.8.0.0/24"
+	}
+	if cfg.GatewayIP == "" {
+		cfg.GatewayIP = defaultGateway(cfg.PoolCIDR)
+	}
+	if cfg.MetricsAddr == "" {
+		cfg.MetricsAddr = ":9100"
+	}
+	if cfg.HealthAddr == "" {
+		cfg.HealthAddr = ":9200"
+	}
+	if cfg.PprofAddr == "" {
+		cfg.PprofAddr = ""
+	}
+	if cfg.AdminAddr == "" {
+		cfg.AdminAddr = "127.0.0.1:9300"
+	}
+	if cfg.SessionTimeout == 0 {
+		cfg.SessionTimeout = 2 * time.Minute
+	}
+	if cfg.AccountingTimeout == 0 {
+		cfg.AccountingTimeout = 5 * time.Second
+	}
+	if cfg.MaxTokenAge == 0 {
+		cfg.MaxTokenAge = 5 * time.Minute
+	}
+	if cfg.OTLPMetricsInterval == 0 {
+		cfg.OTLPMetricsInterval = time.Minute
+	}
+	if cfg.StatsDPrefix == "" {
+		cfg.StatsDPrefix = "qdt"
+	}
+	if cfg.StatsFlushInterval == 0 {
+		cfg.StatsFlushInterval = 10 * time.Second
+	}
+	if cfg.ShaperType == "" {
+		cfg.ShaperType = ShaperToken
+	}
+	if cfg.MaxDropLabelCardinality == 0 {
+		cfg.MaxDropLabelCardinality = DefaultMaxDropLabelCardinality
+	}
+	if cfg.LogMaxSizeMB == 0 {
+		cfg.LogMaxSizeMB = logging.DefaultMaxSizeMB
+	}
+	if cfg.KeepaliveInterval == 0 {
+		cfg.KeepaliveInterval = 30 * time.Second
+	}
+	if cfg.KeepaliveTimeout == 0 {
+		cfg.KeepaliveTimeout = 10 * time.Second
+	}
+	if cfg.WatchdogTimeout == 0 {
+		cfg.WatchdogTimeout = DefaultWatchdogTimeout
+	}
+	if cfg.MaxReassemblyBytes == 0 {
+		cfg.MaxReassemblyBytes = qdt.DefaultMaxReassembly
+	}
+	if cfg.MaxReassemblyAggregateBytes == 0 {
+		cfg.MaxReassemblyAggregateBytes = qdt.DefaultMaxReassemblyAggregate
+	}
+	if cfg.ReassemblyTTL == 0 {
+		cfg.ReassemblyTTL = qdt.DefaultReassemblyTTL
+	}
+	if cfg.MaxFragmentEntries == 0 {
+		cfg.MaxFragmentEntries = 1024
+	}
+	if cfg.MaxFragmentEntriesPerSession == 0 {
+		cfg.MaxFragmentEntriesPerSession = 128
+	}
+	if cfg.RateLimit.PPS == 0 {
+		cfg.RateLimit.PPS = 10000
+	}
+	if cfg.RateLimit.Burst == 0 {
+		cfg.RateLimit.Burst = 20000
+	}
+	if cfg.HandshakeRate.PPS == 0 {
+		cfg.HandshakeRate.PPS = 100
+	}
+	if cfg.HandshakeRate.Burst == 0 {
+		cfg.HandshakeRate.Burst = 200
+	}
+	if cfg.HandshakeRateWarmup > 0 && cfg.HandshakeRateWarmupFactor == 0 {
+		cfg.HandshakeRateWarmupFactor = 10
+	}
+	if cfg.HandshakeIPRate.PPS == 0 {
+		cfg.HandshakeIPRate.PPS = 20
+	}
+	if cfg.HandshakeIPRate.Burst == 0 {
+		cfg.HandshakeIPRate.Burst = 40
+	}
+	if cfg.HandshakeIPRate.TTL == 0 {
+		cfg.HandshakeIPRate.TTL = 1 * time.Minute
+	}
+	if cfg.SendWorkers == 0 {
+		cfg.SendWorkers = runtime.NumCPU()
+	}
+	if cfg.SendQueue == 0 {
+		cfg.SendQueue = 4096
+	}
+	if cfg.SendBatch == 0 {
+		cfg.SendBatch = 4
+	}
+	if cfg.SendDatagramQueue == 0 {
+		cfg.SendDatagramQueue = cfg.SendQueue
+	}
+	if cfg.QUICMaxIncomingStreams == 0 {
+		cfg.QUICMaxIncomingStreams = 32
+	}
+	if cfg.ACLDefaultAction == "" {
+		cfg.ACLDefaultAction = "allow"
+	}
+	if cfg.SessionShards == 0 {
+		cfg.SessionShards = runtime.NumCPU() * 4
+	}
+}
+
+func validateConfig(cfg Config) error {
+	if cfg.ACME.Domain == "" && (cfg.TLSCert == "" || cfg.TLSKey == "") {
+		return fmt.Errorf("tls_cert and tls_key are required")
+	}
+	if cfg.Token == "" {
+		return fmt.Errorf("token is required")
+	}
+	if cfg.GatewayIP == "" {
+		return fmt.Errorf("gateway_ip is required")
+	}
+	if err := validateGateway(cfg.GatewayIP, cfg.PoolCIDR); err != nil {
+		return err
+	}
+	if cfg.CaptureFile != "" {
+		if !captureSupported {
+			return fmt.Errorf("capture_file requires a binary built with -tags debug")
+		}
+		if cfg.CaptureBuildTag != "debug" {
+			return fmt.Errorf("capture_build_tag must be \"debug\" to enable plaintext capture")
+		}
+	}
+	if cfg.AccountingURL != "" {
+		u, err := url.Parse(cfg.AccountingURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("accounting_url must be an http or https url")
+		}
+	}
+	if cfg.HandshakeRateWarmup < 0 {
+		return fmt.Errorf("handshake_rate_warmup must be positive")
+	}
+	if cfg.HandshakeRateWarmup > 0 && cfg.HandshakeRateWarmupFactor < 1 {
+		return fmt.Errorf("handshake_rate_warmup_factor must be at least 1")
+	}
+	if cfg.OTLPMetricsInterval < 0 {
+		return fmt.Errorf("otlp_metrics_interval must be positive")
+	}
+	if cfg.StatsFlushInterval < 0 {
+		return fmt.Errorf("stats_flush_interval must be positive")
+	}
+	if cfg.WatchdogTimeout < 0 {
+		return fmt.Errorf("watchdog_timeout must be positive")
+	}
+	if cfg.ReassemblyTTL < 0 {
+		return fmt.Errorf("reassembly_ttl must be positive")
+	}
+	if cfg.ShaperType != ShaperToken && cfg.ShaperType != ShaperLeaky {
+		return fmt.Errorf("shaper_type must be %q or %q", ShaperToken, ShaperLeaky)
+	}
+	if cfg.MaxDropLabelCardinality < 0 {
+		return fmt.Errorf("max_drop_label_cardinality must be positive")
+	}
+	if cfg.DSCPMark > 63 {
+		return fmt.Errorf("dscp_mark must be between 0 and 63")
+	}
+	if cfg.AdminAddr != "" && !loopbackAddr(cfg.AdminAddr) && cfg.AdminToken == "" {
+		return fmt.Errorf("admin_token is required when admin_addr is not a loopback address")
+	}
+	if cfg.WebSocket && cfg.TCPFallbackAddr == cfg.Addr {
+		return fmt.Errorf("tcp_fallback_addr must differ from addr when websocket is enabled")
+	}
+	if cfg.NetNamespace != "" && runtime.GOOS != "linux" {
+		return fmt.Errorf("net_namespace is only supported on linux")
+	}
+	if cfg.PinToCPU && runtime.GOOS != "linux" {
+		return fmt.Errorf("pin_to_cpu is only supported on linux")
+	}
+	if cfg.AllowedAdvertisePrefix != "" {
+		if _, err := parsePrefix4(cfg.AllowedAdvertisePrefix); err != nil {
+			return fmt.Errorf("allowed_advertise_prefix: %w", err)
+		}
+	}
+	if _, err := cfg.aclMatcher(); err != nil {
+		return err
+	}
+	if cfg.BGP.Enabled {
+		if err := validateBGP(cfg.BGP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateBGP(cfg BGPConfig) error {
+	if !bgpSupported {
+		return fmt.Errorf("bgp requires a binary built with -tags bgp")
+	}
+	if cfg.ASN == 0 {
+		return fmt.Errorf("bgp.asn is required")
+	}
+	if ip := net.ParseIP(cfg.RouterID); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("bgp.router_id must be an ipv4 address")
+	}
+	if len(cfg.Peers) == 0 {
+		return fmt.Errorf("bgp.peers is required")
+	}
+	for i, p := range cfg.Peers {
+		if net.ParseIP(p.Addr) == nil {
+			return fmt.Errorf("bgp.peers[%d]: invalid addr %q", i, p.Addr)
+		}
+		if p.ASN == 0 {
+			return fmt.Errorf("bgp.peers[%d]: asn is required", i)
+		}
+	}
+	return nil
+}
+
+// validateGateway checks that gateway is a usable host address of the IPv4
+// pool, so a typo fails at startup rather than when addresses are handed out.
+func validateGateway(gateway, poolCIDR string) error {
+	_, ipnet, err := net.ParseCIDR(poolCIDR)
+	if err != nil {
+		return fmt.Errorf("pool_cidr %s: %w", poolCIDR, err)
+	}
+	network := ipnet.IP.To4()
+	if network == nil {
+		return fmt.Errorf("pool_cidr %s is not ipv4", poolCIDR)
+	}
+	gw := net.ParseIP(gateway).To4()
+	if gw == nil {
+		return fmt.Errorf("gateway_ip %s is not an ipv4 address", gateway)
+	}
+	if !ipnet.Contains(gw) {
+		return fmt.Errorf("gateway_ip %s is not within pool_cidr %s", gateway, poolCIDR)
+	}
+	broadcast := make(net.IP, len(network))
+	for i := range network {
+		broadcast[i] = network[i] | ^ipnet.Mask[i]
+	}
+	if gw.Equal(network) || gw.Equal(broadcast) {
+		return fmt.Errorf("gateway_ip %s is the network or broadcast address of pool_cidr %s", gateway, poolCIDR)
+	}
+	return nil
+}
+
+func defaultGateway(cidr string) string {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return ""
+	}
+	ip := ipnet.IP.To4()
+	if ip == nil {
+		return ""
+	}
+	ip[3]++
+	return ip.String()
+}
+
+// loopbackAddr reports whether addr (host:port) only listens on loopback.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,113 @@
+package server
+
+import "testing"
+
+func TestValidateGateway(t *testing.T) {
+	cases := []struct {
+		gateway string
+		ok      bool
+	}{
+		{"10.8.0.1", true},
+		{"10.8.0.254", true},
+		{"10.9.0.1", false},
+		{"10.8.0.0", false},
+		{"10.8.0.255", false},
+		{"not-an-ip", false},
+	}
+	for _, c := range cases {
+		err := validateGateway(c.gateway, "10.8.0.0/24")
+		if (err == nil) != c.ok {
+			t.Fatalf("%s: got err %v, want ok=%v", c.gateway, err, c.ok)
+		}
+	}
+	if err := validateGateway("10.9.0.1", "10.8.0.0/24"); err.Error() != "gateway_ip 10.9.0.1 is not within pool_cidr 10.8.0.0/24" {
+		t.Fatalf("unexpected message: %v", err)
+	}
+}
+
+func TestValidateBGP(t *testing.T) {
+	valid := BGPConfig{Enabled: true, ASN: 65000, RouterID: "192.0.2.1", Peers: []BGPPeer{{Addr: "192.0.2.254", ASN: 65001}}}
+	if !bgpSupported {
+		if err := validateBGP(valid); err == nil {
+			t.Fatal("bgp accepted by a build without -tags bgp")
+		}
+		return
+	}
+	cases := []struct {
+		name   string
+		modify func(c *BGPConfig)
+		ok     bool
+	}{
+		{"valid", func(c *BGPConfig) {}, true},
+		{"ipv6 peer", func(c *BGPConfig) { c.Peers[0].Addr = "2001:db8::1" }, true},
+		{"no asn", func(c *BGPConfig) { c.ASN = 0 }, false},
+		{"ipv6 router id", func(c *BGPConfig) { c.RouterID = "2001:db8::1" }, false},
+		{"bad router id", func(c *BGPConfig) { c.RouterID = "router" }, false},
+		{"no peers", func(c *BGPConfig) { c.Peers = nil }, false},
+		{"bad peer addr", func(c *BGPConfig) { c.Peers[0].Addr = "peer" }, false},
+		{"no peer asn", func(c *BGPConfig) { c.Peers[0].ASN = 0 }, false},
+	}
+	for _, c := range cases {
+		cfg := valid
+		cfg.Peers = append([]BGPPeer(nil), valid.Peers...)
+		c.modify(&cfg)
+		if err := validateBGP(cfg); (err == nil) != c.ok {
+			t.Fatalf("%s: got err %v, want ok=%v", c.name, err, c.ok)
+		}
+	}
+}
+
+func TestLoopbackAddr(t *testing.T) {
+	cases := []struct {
+		addr string
+		ok   bool
+	}{
+		{"127.0.0.1:9300", true},
+		{"[::1]:9300", true},
+		{"localhost:9300", true},
+		{":9300", false},
+		{"0.0.0.0:9300", false},
+		{"192.0.2.1:9300", false},
+		{"127.0.0.1", false},
+	}
+	for _, c := range cases {
+		if got := loopbackAddr(c.addr); got != c.ok {
+			t.Fatalf("%s: got %v, want %v", c.addr, got, c.ok)
+		}
+	}
+}
+
+func TestTenantLimits(t *testing.T) {
+	cfg := Config{
+		RateLimit:   RateLimitConfig{PPS: 100, Burst: 200},
+		SendQueue:   1024,
+		SendBatch:   32,
+		SendWorkers: 2,
+		Tenants: map[string]TenantConfig{
+			"backup-box": {
+				SendQueue:    64,
+				InRateLimit:  RateLimitConfig{PPS: 2000},
+				OutRateLimit: RateLimitConfig{PPS: 20000, Burst: 40000},
+			},
+			"": {InRateLimit: RateLimitConfig{PPS: 1e6}},
+		},
+	}
+	in, out := cfg.rateLimits("backup-box")
+	if in != (RateLimitConfig{PPS: 2000, Burst: 200}) || out != (RateLimitConfig{PPS: 20000, Burst: 40000}) {
+		t.Fatalf("tenant limits in=%+v out=%+v", in, out)
+	}
+	if _, queue, batch := cfg.sendParams("backup-box"); queue != 64 || batch != 32 {
+		t.Fatalf("tenant send queue %d batch %d", queue, batch)
+	}
+	// Unknown subjects and static-token clients (empty subject) get the
+	// global values, whatever client ID they declare.
+	for _, subject := range []string{"laptop", ""} {
+		in, out := cfg.rateLimits(subject)
+		if in != cfg.RateLimit || out != cfg.RateLimit {
+			t.Fatalf("subject %q: limits in=%+v out=%+v, want global", subject, in, out)
+		}
+		if _, queue, _ := cfg.sendParams(subject); queue != cfg.SendQueue {
+			t.Fatalf("subject %q: send queue %d, want global", subject, queue)
+		}
+	}
+}
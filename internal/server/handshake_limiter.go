@@ -1,9 +1,10 @@
-package main
+package server
 
 import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -12,6 +13,10 @@ import (
 type handshakeLimiter struct {
 	global *rate.Limiter
 	perIP  *ipRateLimiter
+	// globalRate is the configured global limit, restored once the warmup
+	// deadline (unix nanoseconds, 0 when not warming up) passes.
+	globalRate  rate.Limit
+	warmupUntil atomic.Int64
 }
 
 type ipRateLimiter struct {
@@ -45,13 +50,26 @@ func newHandshakeLimiter(globalPPS, globalBurst int, ipPPS, ipBurst int, ttl tim
 			entries: make(map[string]*ipLimiterEntry),
 		}
 	}
-	return &handshakeLimiter{global: global, perIP: perIP}
+	return &handshakeLimiter{global: global, perIP: perIP, globalRate: rate.Limit(globalPPS)}
+}
+
+// startWarmup raises the global limit by factor for d, so clients
+// reconnecting together after a restart are not turned away.
+func (l *handshakeLimiter) startWarmup(d time.Duration, factor float64) {
+	if l == nil || l.global == nil || d <= 0 || factor <= 1 {
+		return
+	}
+	l.global.SetLimit(l.globalRate * rate.Limit(factor))
+	l.warmupUntil.Store(time.Now().Add(d).UnixNano())
 }
 
 func (l *handshakeLimiter) Allow(ip string) bool {
 	if l == nil {
 		return true
 	}
+	if until := l.warmupUntil.Load(); until != 0 && time.Now().UnixNano() >= until && l.warmupUntil.CompareAndSwap(until, 0) {
+		l.global.SetLimit(l.globalRate)
+	}
 	if l.global != nil && !l.global.Allow() {
 		return false
 	}
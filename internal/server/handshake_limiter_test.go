@@ -0,0 +1,21 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestHandshakeLimiterWarmup(t *testing.T) {
+	l := newHandshakeLimiter(10, 1, 0, 0, 0)
+	l.startWarmup(50*time.Millisecond, 10)
+	if got := l.global.Limit(); got != rate.Limit(100) {
+		t.Fatalf("limit during warmup = %v, want 100", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	l.Allow("")
+	if got := l.global.Limit(); got != rate.Limit(10) {
+		t.Fatalf("limit after warmup = %v, want 10", got)
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type Metrics struct {
+	sessions         prometheus.Gauge
+	packets          *prometheus.CounterVec
+	bytes            *prometheus.CounterVec
+	drops            *CardinalityLimitedCounterVec
+	handshakes       *prometheus.CounterVec
+	compressionRatio prometheus.Histogram
+	reassemblyWait   prometheus.Histogram
+	fragmentNAKs     *prometheus.CounterVec
+	quicRTT          *prometheus.GaugeVec
+	quicBytesSent    *prometheus.CounterVec
+	quicBytesRecv    *prometheus.CounterVec
+	ipamTotal        prometheus.Gauge
+	ipamUsed         prometheus.Gauge
+	ipamAvailable    prometheus.Gauge
+	accountingErrors prometheus.Counter
+	tunReadBytes     prometheus.Counter
+	tunWriteBytes    prometheus.Counter
+	tunReadErrors    prometheus.Counter
+	tunWriteErrors   prometheus.Counter
+	virtualRouted    prometheus.Counter
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		sessions: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "qdt_sessions_active",
+			Help: "Active QDT sessions",
+		}),
+		packets: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "qdt_packets_total",
+			Help: "QDT packets",
+		}, []string{"direction"}),
+		bytes: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "qdt_bytes_total",
+			Help: "QDT bytes",
+		}, []string{"direction"}),
+		drops: newCardinalityLimitedCounterVec(promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "qdt_drops_total",
+			Help: "QDT drops",
+		}, []string{"reason"}), DefaultMaxDropLabelCardinality),
+		handshakes: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "qdt_handshakes_total",
+			Help: "QDT handshake results",
+		}, []string{"result"}),
+		compressionRatio: promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:    "qdt_compression_ratio",
+			Help:    "Compressed to original size of outgoing packets",
+			Buckets: []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1, 1.1},
+		}),
+		reassemblyWait: promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:    "qdt_reassembly_wait_seconds",
+			Help:    "Time from the first fragment of a packet to its reassembly",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5},
+		}),
+		fragmentNAKs: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "qdt_fragment_naks_total",
+			Help: "Fragment NAKs sent to and received from clients",
+		}, []string{"direction"}),
+		quicRTT: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qdt_quic_rtt_seconds",
+			Help: "Smoothed RTT of each QUIC connection",
+		}, []string{"remote_addr"}),
+		quicBytesSent: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "qdt_quic_bytes_sent_total",
+			Help: "Bytes sent on each QUIC connection, including retransmissions",
+		}, []string{"remote_addr"}),
+		quicBytesRecv: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "qdt_quic_bytes_received_total",
+			Help: "Bytes received on each QUIC connection",
+		}, []string{"remote_addr"}),
+		ipamTotal: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "qdt_ipam_pool_total",
+			Help: "Assignable client addresses in the pool",
+		}),
+		ipamUsed: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "qdt_ipam_used",
+			Help: "Client addresses currently assigned",
+		}),
+		ipamAvailable: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "qdt_ipam_available",
+			Help: "Client addresses still available",
+		}),
+		accountingErrors: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "qdt_accounting_errors_total",
+			Help: "Accounting webhook deliveries that failed",
+		}),
+		tunReadBytes: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "qdt_tun_read_bytes_total",
+			Help: "Bytes read from the TUN device",
+		}),
+		tunWriteBytes: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "qdt_tun_write_bytes_total",
+			Help: "Bytes written to the TUN device",
+		}),
+		tunReadErrors: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "qdt_tun_read_errors_total",
+			Help: "Failed reads from the TUN device",
+		}),
+		tunWriteErrors: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "qdt_tun_write_errors_total",
+			Help: "Failed writes to the TUN device",
+		}),
+		virtualRouted: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "qdt_virtual_routed_packets_total",
+			Help: "Client-to-client packets forwarded inside the server",
+		}),
+	}
+}
+
+// DefaultMaxDropLabelCardinality is the default number of distinct drop
+// reasons before new ones are counted as "other".
+const DefaultMaxDropLabelCardinality = 32
+
+// overflowLabel replaces every label value once the limit is reached.
+const overflowLabel = "other"
+
+// CardinalityLimitedCounterVec caps the number of distinct label value
+// combinations of a CounterVec, so a label fed from a new code path cannot
+// grow the series without bound. Combinations beyond the limit are counted
+// with every label set to "other".
+type CardinalityLimitedCounterVec struct {
+	*prometheus.CounterVec
+	mu    sync.RWMutex
+	limit int
+	seen  map[string]struct{}
+}
+
+func newCardinalityLimitedCounterVec(vec *prometheus.CounterVec, limit int) *CardinalityLimitedCounterVec {
+	return &CardinalityLimitedCounterVec{CounterVec: vec, limit: limit, seen: make(map[string]struct{})}
+}
+
+// SetLimit changes the limit for label values not seen yet.
+func (v *CardinalityLimitedCounterVec) SetLimit(limit int) {
+	v.mu.Lock()
+	v.limit = limit
+	v.mu.Unlock()
+}
+
+func (v *CardinalityLimitedCounterVec) WithLabelValues(lvs ...string) prometheus.Counter {
+	if !v.admit(strings.Join(lvs, "\xff")) {
+		over := make([]string, len(lvs))
+		for i := range over {
+			over[i] = overflowLabel
+		}
+		lvs = over
+	}
+	return v.CounterVec.WithLabelValues(lvs...)
+}
+
+func (v *CardinalityLimitedCounterVec) With(labels prometheus.Labels) prometheus.Counter {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = labels[name]
+	}
+	if !v.admit(strings.Join(values, "\xff")) {
+		over := make(prometheus.Labels, len(labels))
+		for name := range labels {
+			over[name] = overflowLabel
+		}
+		labels = over
+	}
+	return v.CounterVec.With(labels)
+}
+
+// admit reports whether key is known or still fits under the limit.
+func (v *CardinalityLimitedCounterVec) admit(key string) bool {
+	v.mu.RLock()
+	_, ok := v.seen[key]
+	v.mu.RUnlock()
+	if ok {
+		return true
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.seen[key]; ok {
+		return true
+	}
+	if len(v.seen) >= v.limit {
+		return false
+	}
+	v.seen[key] = struct{}{}
+	return true
+}
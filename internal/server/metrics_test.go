@@ -0,0 +1,27 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCardinalityLimitedCounterVec(t *testing.T) {
+	vec := newCardinalityLimitedCounterVec(prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_drops_total"}, []string{"reason"}), 2)
+	vec.WithLabelValues("a").Inc()
+	vec.WithLabelValues("b").Inc()
+	vec.WithLabelValues("c").Inc()
+	vec.With(prometheus.Labels{"reason": "d"}).Inc()
+	vec.WithLabelValues("a").Inc()
+
+	if got := testutil.CollectAndCount(vec.CounterVec); got != 3 {
+		t.Fatalf("series = %d, want 3", got)
+	}
+	if got := testutil.ToFloat64(vec.CounterVec.WithLabelValues(overflowLabel)); got != 2 {
+		t.Fatalf("other = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(vec.CounterVec.WithLabelValues("a")); got != 2 {
+		t.Fatalf("a = %v, want 2", got)
+	}
+}
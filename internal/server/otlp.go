@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// startOTLPExport pushes the session, packet, byte and drop metrics to
+// otlp_metrics_endpoint over gRPC. The instruments observe the Prometheus
+// collectors at each export, so both outputs report the same values and no
+// call site counts twice. The returned func flushes and stops the export.
+func (s *Server) startOTLPExport(ctx context.Context) (func(), error) {
+	opt := otlpmetricgrpc.WithEndpoint(s.cfg.OTLPMetricsEndpoint)
+	if strings.Contains(s.cfg.OTLPMetricsEndpoint, "://") {
+		// An http:// URL selects a plaintext connection.
+		opt = otlpmetricgrpc.WithEndpointURL(s.cfg.OTLPMetricsEndpoint)
+	}
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		s.log.Warn("otlp export failed", "err", err)
+	}))
+	exp, err := otlpmetricgrpc.New(ctx, opt)
+	if err != nil {
+		return nil, fmt.Errorf("otlp exporter: %w", err)
+	}
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exp, sdkmetric.WithInterval(s.cfg.OTLPMetricsInterval))),
+		sdkmetric.WithResource(resource.NewSchemaless(attribute.String("service.name", "qdt-server"))),
+	)
+	stop := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			s.log.Warn("otlp shutdown failed", "err", err)
+		}
+	}
+	if err := s.registerOTLPInstruments(provider.Meter("qdt/server")); err != nil {
+		stop()
+		return nil, err
+	}
+	return stop, nil
+}
+
+func (s *Server) registerOTLPInstruments(meter metric.Meter) error {
+	sessions, err := meter.Int64ObservableGauge("qdt.sessions.active", metric.WithDescription("Active QDT sessions"))
+	if err != nil {
+		return fmt.Errorf("otlp instrument: %w", err)
+	}
+	packets, err := meter.Float64ObservableCounter("qdt.packets.total", metric.WithDescription("QDT packets"))
+	if err != nil {
+		return fmt.Errorf("otlp instrument: %w", err)
+	}
+	bytes, err := meter.Float64ObservableCounter("qdt.bytes.total", metric.WithDescription("QDT bytes"), metric.WithUnit("By"))
+	if err != nil {
+		return fmt.Errorf("otlp instrument: %w", err)
+	}
+	drops, err := meter.Float64ObservableCounter("qdt.drops.total", metric.WithDescription("QDT drops"))
+	if err != nil {
+		return fmt.Errorf("otlp instrument: %w", err)
+	}
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		var m dto.Metric
+		if s.metrics.sessions.Write(&m) == nil {
+			o.ObserveInt64(sessions, int64(m.GetGauge().GetValue()))
+		}
+		observeCounters(o, packets, s.metrics.packets)
+		observeCounters(o, bytes, s.metrics.bytes)
+		observeCounters(o, drops, s.metrics.drops.CounterVec)
+		return nil
+	}, sessions, packets, bytes, drops)
+	if err != nil {
+		return fmt.Errorf("otlp callback: %w", err)
+	}
+	return nil
+}
+
+// observeCounters reports every child of a Prometheus counter vector, with
+// its labels as attributes.
+func observeCounters(o metric.Observer, inst metric.Float64Observable, vec *prometheus.CounterVec) {
+	ch := make(chan prometheus.Metric, 16)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+	for pm := range ch {
+		var m dto.Metric
+		if pm.Write(&m) != nil || m.Counter == nil {
+			continue
+		}
+		attrs := make([]attribute.KeyValue, 0, len(m.Label))
+		for _, l := range m.Label {
+			attrs = append(attrs, attribute.String(l.GetName(), l.GetValue()))
+		}
+		o.ObserveFloat64(inst, m.Counter.GetValue(), metric.WithAttributes(attrs...))
+	}
+}
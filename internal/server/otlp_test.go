@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestOTLPInstrumentsMirrorPrometheus(t *testing.T) {
+	s := &Server{metrics: testMetrics()}
+	s.metrics.sessions.Set(2)
+	s.metrics.drops.CounterVec.Reset()
+	s.metrics.drops.WithLabelValues("acl").Add(3)
+
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	if err := s.registerOTLPInstruments(provider.Meter("test")); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	got := make(map[string]float64)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		switch data := m.Data.(type) {
+		case metricdata.Gauge[int64]:
+			got[m.Name] = float64(data.DataPoints[0].Value)
+		case metricdata.Sum[float64]:
+			for _, dp := range data.DataPoints {
+				if reason, ok := dp.Attributes.Value("reason"); ok && reason.AsString() == "acl" {
+					got[m.Name] = dp.Value
+				}
+			}
+		}
+	}
+	if got["qdt.sessions.active"] != 2 || got["qdt.drops.total"] != 3 {
+		t.Fatalf("observed %v, want 2 sessions and 3 acl drops", got)
+	}
+}
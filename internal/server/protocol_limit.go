@@ -0,0 +1,52 @@
+package server
+
+import (
+	"golang.org/x/time/rate"
+)
+
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// newProtocolLimiters builds the per-session limiters from
+// protocol_rate_limits, or returns nil when none is configured.
+func (s *Server) newProtocolLimiters() *[256]*rate.Limiter {
+	limits := s.cfg.ProtocolRateLimits
+	if limits.TCP.PPS <= 0 && limits.UDP.PPS <= 0 && limits.ICMP.PPS <= 0 {
+		return nil
+	}
+	var out [256]*rate.Limiter
+	out[protoTCP] = newRateLimiter(limits.TCP)
+	out[protoUDP] = newRateLimiter(limits.UDP)
+	// ICMP and ICMPv6 share one bucket.
+	out[protoICMP] = newRateLimiter(limits.ICMP)
+	out[protoICMPv6] = out[protoICMP]
+	return &out
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rate.Limiter {
+	if cfg.PPS <= 0 {
+		return nil
+	}
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = cfg.PPS
+	}
+	return rate.NewLimiter(rate.Limit(cfg.PPS), burst)
+}
+
+func protocolDropReason(proto uint8) string {
+	switch proto {
+	case protoTCP:
+		return "rate_tcp"
+	case protoUDP:
+		return "rate_udp"
+	case protoICMP, protoICMPv6:
+		return "rate_icmp"
+	default:
+		return "rate_proto"
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const quicStatsInterval = 5 * time.Second
+
+// watchQUICConn is the http3 ConnContext hook. It samples the connection's
+// RTT and byte counters into metrics labelled by remote address until the
+// connection closes, then removes them.
+func (s *Server) watchQUICConn(ctx context.Context, c *quic.Conn) context.Context {
+	go s.pollQUICStats(c)
+	return ctx
+}
+
+func (s *Server) pollQUICStats(c *quic.Conn) {
+	addr := c.RemoteAddr().String()
+	m := s.metrics
+	defer func() {
+		m.quicRTT.DeleteLabelValues(addr)
+		m.quicBytesSent.DeleteLabelValues(addr)
+		m.quicBytesRecv.DeleteLabelValues(addr)
+	}()
+	ticker := time.NewTicker(quicStatsInterval)
+	defer ticker.Stop()
+	var sent, recv uint64
+	for {
+		select {
+		case <-c.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		st := c.ConnectionStats()
+		m.quicRTT.WithLabelValues(addr).Set(st.SmoothedRTT.Seconds())
+		m.quicBytesSent.WithLabelValues(addr).Add(float64(st.BytesSent - sent))
+		m.quicBytesRecv.WithLabelValues(addr).Add(float64(st.BytesReceived - recv))
+		sent, recv = st.BytesSent, st.BytesReceived
+	}
+}
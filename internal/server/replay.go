@@ -0,0 +1,40 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+)
+
+// nonceCacheSize bounds the client nonces remembered for 0-RTT replay
+// protection. A replay must arrive while its nonce is still cached, which
+// covers the short window in which captured early data is useful.
+const nonceCacheSize = 4096
+
+// nonceCache is an LRU set of client nonces from 0-RTT connect requests.
+type nonceCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	seen  map[string]*list.Element
+}
+
+func newNonceCache(size int) *nonceCache {
+	return &nonceCache{size: size, order: list.New(), seen: make(map[string]*list.Element)}
+}
+
+// Add records nonce and reports whether it had not been seen before.
+func (c *nonceCache) Add(nonce string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.seen[nonce]; ok {
+		c.order.MoveToFront(el)
+		return false
+	}
+	c.seen[nonce] = c.order.PushFront(nonce)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.seen, oldest.Value.(string))
+	}
+	return true
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestEarlyReplay(t *testing.T) {
+	s := &Server{nonces: newNonceCache(2)}
+	if !s.quicConfig().Allow0RTT {
+		t.Fatal("0-RTT disabled with replay protection")
+	}
+	if s.earlyReplay(true, "a") {
+		t.Fatal("first 0-RTT request refused")
+	}
+	if !s.earlyReplay(true, "a") {
+		t.Fatal("replayed 0-RTT nonce accepted")
+	}
+	// A full handshake cannot be replayed and is not checked.
+	if s.earlyReplay(false, "a") {
+		t.Fatal("1-RTT request refused")
+	}
+	for i := range 2 {
+		s.earlyReplay(true, fmt.Sprint(i))
+	}
+	if s.earlyReplay(true, "a") {
+		t.Fatal("evicted nonce still refused")
+	}
+
+	s = &Server{}
+	if s.quicConfig().Allow0RTT {
+		t.Fatal("0-RTT allowed without replay protection")
+	}
+	if !s.earlyReplay(true, "b") {
+		t.Fatal("0-RTT request accepted without replay protection")
+	}
+}
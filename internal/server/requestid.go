@@ -0,0 +1,33 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"qdt/pkg/qdt"
+)
+
+// maxRequestIDLen bounds client-supplied request IDs, which end up in logs.
+const maxRequestIDLen = 64
+
+// requestID returns the X-Request-ID of r, or a new ID when it has none or
+// one that is too long or not printable.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(qdt.RequestIDHeader)
+	if id == "" || len(id) > maxRequestIDLen {
+		return newRequestID()
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return newRequestID()
+		}
+	}
+	return id
+}
+
+func newRequestID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,1307 @@
+// Package server implements the QDT server: the HTTP/3 connect handshake,
+// per-client sessions and the shared TUN device.
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/time/rate"
+
+	"qdt/internal/acl"
+	"qdt/internal/bufferpool"
+	"qdt/internal/ipam"
+	"qdt/internal/iputil"
+	"qdt/internal/netcfg"
+	"qdt/internal/shaper"
+	"qdt/internal/tun"
+	"qdt/pkg/qdt"
+)
+
+const maxPacketSize = 65535
+
+type Server struct {
+	cfg        Config
+	log        *slog.Logger
+	metrics    *Metrics
+	tun        *tun.Device
+	pool       *ipam.Pool
+	packetPool *bufferpool.Pool
+	tunWriteCh chan []byte
+
+	sessions *sessionTable
+	hsLimit  *handshakeLimiter
+	audit    *auditLog
+	acct     *accountant
+
+	ready          atomic.Bool
+	tunReadErrAt   atomic.Int64
+	tunReadDown    atomic.Bool
+	activeSessions atomic.Int64
+	dgPool         *bufferpool.Pool
+	icmpLast       sync.Map
+	resumeKey      []byte
+	fragBudget     *qdt.EntryBudget
+	startedAt      time.Time
+	nonces         *nonceCache
+	acl            *acl.Matcher
+	cpuSeq         atomic.Uint64
+	perIP          *sessionCounter
+	perClientID    *sessionCounter
+	advertised     routeTable
+
+	// PacketConns are pre-bound sockets, e.g. from systemd socket activation;
+	// when empty the server listens on cfg.Addr itself.
+	PacketConns []net.PacketConn
+	// NotifySystemd sends sd_notify READY=1 once the network is configured.
+	NotifySystemd bool
+}
+
+func NewServer(cfg Config, log *slog.Logger, metrics *Metrics) (*Server, error) {
+	if cfg.FIPSMode {
+		if err := qdt.EnableFIPSMode(); err != nil {
+			return nil, err
+		}
+	}
+	var tunDev *tun.Device
+	err := netcfg.InNamespace(cfg.NetNamespace, func() error {
+		var err error
+		tunDev, err = tun.Open(cfg.TunName)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tun open: %w", err)
+	}
+
+	gatewayIP := net.ParseIP(cfg.GatewayIP)
+	if gatewayIP == nil {
+		return nil, fmt.Errorf("invalid gateway ip")
+	}
+	pool, err := ipam.New(cfg.PoolCIDR, []net.IP{gatewayIP})
+	if err != nil {
+		return nil, fmt.Errorf("ip pool: %w", err)
+	}
+
+	resumeKey := make([]byte, 32)
+	if _, err := rand.Read(resumeKey); err != nil {
+		return nil, fmt.Errorf("resume key: %w", err)
+	}
+
+	var audit *auditLog
+	if cfg.AuditLog != "" {
+		audit, err = openAuditLog(cfg.AuditLog)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Server{
+		cfg:         cfg,
+		log:         log,
+		metrics:     metrics,
+		tun:         tunDev,
+		pool:        pool,
+		packetPool:  bufferpool.New(maxPacketSize),
+		tunWriteCh:  make(chan []byte, 4096),
+		sessions:    newSessionTable(cfg.SessionShards),
+		hsLimit:     newHandshakeLimiter(cfg.HandshakeRate.PPS, cfg.HandshakeRate.Burst, cfg.HandshakeIPRate.PPS, cfg.HandshakeIPRate.Burst, cfg.HandshakeIPRate.TTL),
+		dgPool:      bufferpool.New(cfg.MTU),
+		audit:       audit,
+		resumeKey:   resumeKey,
+		fragBudget:  qdt.NewEntryBudget(cfg.MaxFragmentEntries),
+		startedAt:   time.Now(),
+		perIP:       newSessionCounter(),
+		perClientID: newSessionCounter(),
+	}
+	metrics.drops.SetLimit(cfg.MaxDropLabelCardinality)
+	if s.acl, err = cfg.aclMatcher(); err != nil {
+		return nil, err
+	}
+	if cfg.ReplayProtection0RTT {
+		s.nonces = newNonceCache(nonceCacheSize)
+	}
+	if cfg.AccountingURL != "" {
+		s.acct = newAccountant(cfg.AccountingURL, cfg.AccountingTimeout, log, metrics)
+	}
+	return s, nil
+}
+
+func (s *Server) Serve(ctx context.Context) error {
+	if err := s.configureNetwork(); err != nil {
+		return err
+	}
+	s.hsLimit.startWarmup(s.cfg.HandshakeRateWarmup, s.cfg.HandshakeRateWarmupFactor)
+	s.ready.Store(true)
+	if s.NotifySystemd {
+		if _, err := daemon.SdNotify(false, daemon.SdNotifyReady); err != nil {
+			s.log.Warn("sd_notify failed", "err", err)
+		}
+		defer daemon.SdNotify(false, daemon.SdNotifyStopping)
+	}
+	defer s.audit.Close()
+	if s.cfg.CaptureFile != "" {
+		s.log.Warn("plaintext packet capture is enabled; never use this in production", "file", s.cfg.CaptureFile)
+	}
+	if s.cfg.NAT.Enabled {
+		defer func() {
+			err := netcfg.InNamespace(s.cfg.NetNamespace, func() error {
+				if s.poolIPv6() {
+					return netcfg.CleanupNATv6(s.cfg.PoolCIDR, s.cfg.NAT.ExternalIface)
+				}
+				return netcfg.CleanupNAT(s.cfg.PoolCIDR, s.cfg.NAT.ExternalIface)
+			})
+			if err != nil {
+				s.log.Warn("nat cleanup failed", "err", err)
+			}
+		}()
+	}
+	if s.cfg.BGP.Enabled {
+		stopBGP, err := s.startBGP(ctx)
+		if err != nil {
+			return fmt.Errorf("bgp: %w", err)
+		}
+		defer stopBGP()
+	}
+
+	tlsConf, acmeSrv, err := s.tlsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if acmeSrv != nil {
+		defer acmeSrv.Close()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(qdt.ConnectPath, s.connectHandler)
+
+	quicConf := s.quicConfig()
+	h3srv := &http3.Server{
+		Handler:         mux,
+		EnableDatagrams: true,
+		ConnContext:     s.watchQUICConn,
+	}
+	var listeners []*alpnListener
+	if len(s.PacketConns) > 0 {
+		for _, pc := range s.PacketConns {
+			ln, err := s.listenQUIC(pc, tlsConf, quicConf)
+			if err != nil {
+				return err
+			}
+			defer ln.Close()
+			listeners = append(listeners, ln)
+		}
+	} else {
+		ln, err := s.listenQUIC(nil, tlsConf, quicConf)
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		listeners = append(listeners, ln)
+	}
+
+	if s.cfg.WebSocket {
+		wsSrv := s.startWebSocketServer(tlsConf)
+		defer wsSrv.Close()
+	}
+	if s.cfg.TCPFallbackAddr != "" {
+		ln, err := s.startTCPFallback(ctx, tlsConf)
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+	}
+
+	metricsSrv, healthSrv := s.startMetricsServer()
+	adminSrv := s.startAdminServer()
+	pprofSrv := s.startPprofServer()
+	if s.cfg.OTLPMetricsEndpoint != "" {
+		stop, err := s.startOTLPExport(ctx)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+	if s.cfg.StatsDAddr != "" {
+		stop, err := s.startStatsD(ctx)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	go s.pinned(tunWriteCPU, s.tunWriteLoop)(ctx)
+	go s.pinned(tunReadCPU, s.tunReadLoop)(ctx)
+	go s.sessionSweepLoop(ctx)
+	go s.ipamMetricsLoop(ctx)
+	go s.tunMetricsLoop(ctx)
+
+	errCh := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln *alpnListener) {
+			errCh <- h3srv.ServeListener(ln)
+		}(ln)
+	}
+
+	select {
+	case <-ctx.Done():
+		_ = h3srv.Close()
+		if metricsSrv != nil {
+			_ = metricsSrv.Close()
+		}
+		if healthSrv != nil {
+			_ = healthSrv.Close()
+		}
+		_ = adminSrv.Close()
+		if pprofSrv != nil {
+			_ = pprofSrv.Close()
+		}
+		return ctx.Err()
+	case err := <-errCh:
+		if !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}
+}
+
+// newShaper returns the shaper_type limiter for r, or nil when r is
+// unlimited.
+func (s *Server) newShaper(r RateLimitConfig) shaper.Shaper {
+	switch {
+	case r.PPS <= 0:
+		return nil
+	case s.cfg.ShaperType == ShaperLeaky:
+		return shaper.NewLeakyBucket(r.PPS)
+	case r.Burst > 0:
+		return rate.NewLimiter(rate.Limit(r.PPS), r.Burst)
+	}
+	return nil
+}
+
+// quicConfig returns the QUIC settings for the connect listeners. Early data
+// is only accepted when replayed connect requests are refused by nonce.
+func (s *Server) quicConfig() *quic.Config {
+	return &quic.Config{
+		EnableDatagrams:                true,
+		Allow0RTT:                      s.nonces != nil,
+		KeepAlivePeriod:                10 * time.Second,
+		MaxIdleTimeout:                 30 * time.Second,
+		MaxIncomingStreams:             int64(s.cfg.QUICMaxIncomingStreams),
+		MaxIncomingUniStreams:          32,
+		InitialStreamReceiveWindow:     s.cfg.QUICInitialStreamWindow,
+		InitialConnectionReceiveWindow: s.cfg.QUICInitialConnWindow,
+	}
+}
+
+// earlyReplay reports whether a connect request must be refused as a possible
+// replay. Early data can be resent by anyone who captured it; a client never
+// reuses its nonce, so a repeated one is a replay.
+func (s *Server) earlyReplay(early bool, clientNonce string) bool {
+	return early && (s.nonces == nil || !s.nonces.Add(clientNonce))
+}
+
+func used0RTT(w http.ResponseWriter) bool {
+	h, ok := w.(http3.Hijacker)
+	return ok && h.Connection().ConnectionState().Used0RTT
+}
+
+// Close releases the TUN device. It must not be called while Serve runs.
+func (s *Server) Close() error {
+	return s.tun.Close()
+}
+
+// SessionInfo describes an active session.
+type SessionInfo struct {
+	ID        uint64    `json:"id"`
+	ClientID  string    `json:"client_id"`
+	ClientIP  net.IP    `json:"client_ip"`
+	Platform  string    `json:"platform"`
+	StartedAt time.Time `json:"started_at"`
+	Stats     qdt.Stats `json:"stats"`
+
+	AdvertisedRoutes []string `json:"advertised_routes,omitempty"`
+}
+
+func (s *Server) Sessions() []SessionInfo {
+	list := s.sessions.Snapshot()
+	out := make([]SessionInfo, 0, len(list))
+	for _, sess := range list {
+		out = append(out, SessionInfo{
+			ID:        sess.id,
+			ClientID:  sess.clientID,
+			ClientIP:  sess.ip,
+			Platform:  sess.platform,
+			StartedAt: sess.startedAt,
+			Stats:     sess.Stats(),
+
+			AdvertisedRoutes: sess.advertisedRoutes(),
+		})
+	}
+	return out
+}
+
+// sessionsHandler lists the active sessions and the pool allocations. An
+// allocation without a session belongs to a handshake in progress.
+func (s *Server) sessionsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Sessions    []SessionInfo     `json:"sessions"`
+		Allocations []ipam.Allocation `json:"allocations"`
+	}{s.Sessions(), s.pool.Snapshot()})
+}
+
+// notifyHandler sends the request body to the client of a session as a
+// notification.
+func (s *Server) notifyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid session id", http.StatusBadRequest)
+		return
+	}
+	sess := s.sessions.GetBySessionID(id)
+	if sess == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	payload, err := io.ReadAll(io.LimitReader(r.Body, qdt.MaxNotificationBytes+1))
+	if err != nil {
+		http.Error(w, "read body", http.StatusBadRequest)
+		return
+	}
+	switch err := sess.SendNotification(r.Context(), payload); {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, qdt.ErrNotificationTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, qdt.ErrNotificationDisabled):
+		http.Error(w, "client does not accept notifications", http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+// configureNetwork sets up the TUN device, forwarding and NAT, inside
+// cfg.NetNamespace when set.
+func (s *Server) configureNetwork() error {
+	return netcfg.InNamespace(s.cfg.NetNamespace, s.configureNamespace)
+}
+
+func (s *Server) configureNamespace() error {
+	_, ipnet, err := net.ParseCIDR(s.cfg.PoolCIDR)
+	if err != nil {
+		return fmt.Errorf("parse pool cidr: %w", err)
+	}
+	maskSize, _ := ipnet.Mask.Size()
+	addr := fmt.Sprintf("%s/%d", s.cfg.GatewayIP, maskSize)
+	if err := netcfg.ConfigureInterface(netcfg.InterfaceConfig{
+		Name:    s.tun.Name,
+		Address: addr,
+		MTU:     s.cfg.MTU,
+	}); err != nil {
+		return fmt.Errorf("configure tun: %w", err)
+	}
+	ipv6 := ipnet.IP.To4() == nil
+	if err := s.enableForwarding(ipv6); err != nil {
+		return err
+	}
+	if s.cfg.NAT.Enabled {
+		setupNAT := netcfg.SetupNAT
+		if ipv6 {
+			setupNAT = netcfg.SetupNATv6
+		}
+		if err := setupNAT(s.cfg.PoolCIDR, s.cfg.NAT.ExternalIface); err != nil {
+			return fmt.Errorf("nat setup: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) poolIPv6() bool {
+	ip, _, err := net.ParseCIDR(s.cfg.PoolCIDR)
+	return err == nil && ip.To4() == nil
+}
+
+// enableForwarding turns on IP forwarding for the pool's address family,
+// logging the state before and after. Without it traffic reaches the TUN
+// device but never leaves the host, so a failure is fatal when
+// RequireIPForwarding is set. The sysctl is only written when forwarding is
+// off, so an already enabled host may keep /proc read-only.
+func (s *Server) enableForwarding(ipv6 bool) error {
+	enable, enabled := netcfg.EnableIPForwarding, netcfg.IsIPForwardingEnabled
+	if ipv6 {
+		enable, enabled = netcfg.EnableIPv6Forwarding, netcfg.IsIPv6ForwardingEnabled
+	}
+	return s.ensureForwarding(ipv6, enable, enabled)
+}
+
+func (s *Server) ensureForwarding(ipv6 bool, enable func() error, enabled func() (bool, error)) error {
+	if on, err := enabled(); err == nil {
+		s.log.Info("ip forwarding state", "enabled", on, "ipv6", ipv6)
+		if on {
+			return nil
+		}
+	}
+	if err := enable(); err != nil {
+		if s.cfg.RequireIPForwarding {
+			return err
+		}
+		s.log.Warn("enable ip forwarding failed", "err", err)
+		return nil
+	}
+	if on, err := enabled(); err == nil {
+		if !on && s.cfg.RequireIPForwarding {
+			return fmt.Errorf("ip forwarding is still disabled after enabling it")
+		}
+		s.log.Info("ip forwarding enabled", "enabled", on)
+	}
+	return nil
+}
+
+func (s *Server) startMetricsServer() (*http.Server, *http.Server) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/livez", s.liveHandler)
+	mux.HandleFunc("/healthz", s.healthHandler)
+	mux.HandleFunc("/readyz", s.readyHandler)
+
+	metricsSrv := &http.Server{Addr: s.cfg.MetricsAddr, Handler: mux}
+	go func() {
+		if err := metricsSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.log.Error("metrics server error", "err", err)
+		}
+	}()
+	if s.cfg.HealthAddr == "" || s.cfg.HealthAddr == s.cfg.MetricsAddr {
+		return metricsSrv, nil
+	}
+	healthMux := http.NewServeMux()
+	healthMux.HandleFunc("/livez", s.liveHandler)
+	healthMux.HandleFunc("/healthz", s.healthHandler)
+	healthMux.HandleFunc("/readyz", s.readyHandler)
+	healthSrv := &http.Server{Addr: s.cfg.HealthAddr, Handler: healthMux}
+	go func() {
+		if err := healthSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.log.Error("health server error", "err", err)
+		}
+	}()
+	return metricsSrv, healthSrv
+}
+
+// startAdminServer serves the session API on admin_addr, which is loopback
+// unless admin_token guards it: the API exposes client identities and can
+// message clients.
+func (s *Server) startAdminServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/sessions", s.sessionsHandler)
+	mux.HandleFunc("POST /api/sessions/{id}/notify", s.notifyHandler)
+	srv := &http.Server{Addr: s.cfg.AdminAddr, Handler: s.adminAuth(mux)}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.log.Error("admin server error", "err", err)
+		}
+	}()
+	return srv
+}
+
+// adminAuth requires "Authorization: Bearer <admin_token>" when admin_token
+// is set.
+func (s *Server) adminAuth(next http.Handler) http.Handler {
+	if s.cfg.AdminToken == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !tokenMatch(token, s.cfg.AdminToken) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) startPprofServer() *http.Server {
+	if s.cfg.PprofAddr == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	srv := &http.Server{Addr: s.cfg.PprofAddr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.log.Error("pprof server error", "err", err)
+		}
+	}()
+	return srv
+}
+
+// liveHandler is the liveness probe: it only reports that the process is up.
+func (s *Server) liveHandler(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// healthHandler reports the state of each subsystem as JSON and returns 503
+// while the TUN device fails. An exhausted pool or session limit is reported
+// as "full" but leaves the status ok: a busy server is healthy, and /readyz
+// takes it out of rotation.
+func (s *Server) healthHandler(w http.ResponseWriter, _ *http.Request) {
+	ok := true
+	status := func(healthy bool) string {
+		if healthy {
+			return "ok"
+		}
+		ok = false
+		return "failed"
+	}
+	capacity := func(left bool) string {
+		if left {
+			return "ok"
+		}
+		return "full"
+	}
+	checks := map[string]any{
+		"tun":  status(!s.tunReadDown.Load() && s.tun.Check() == nil),
+		"ipam": capacity(s.pool.Available() > 0),
+		"sessions": map[string]any{
+			"status": capacity(!s.sessionsFull()),
+			"active": s.sessions.Count(),
+			"max":    s.cfg.MaxSessions,
+		},
+		"uptime_seconds": int64(time.Since(s.startedAt).Seconds()),
+	}
+	body := map[string]any{"status": "ok", "checks": checks}
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		body["status"] = "degraded"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (s *Server) sessionsFull() bool {
+	return s.cfg.MaxSessions > 0 && s.activeSessions.Load() >= int64(s.cfg.MaxSessions)
+}
+
+// readyHandler is the readiness probe: it fails while the server cannot
+// accept new sessions.
+func (s *Server) readyHandler(w http.ResponseWriter, _ *http.Request) {
+	checks := map[string]string{
+		"network":  "ok",
+		"sessions": "ok",
+		"ipam":     "ok",
+		"tun":      "ok",
+	}
+	ok := true
+	fail := func(name string) {
+		checks[name] = "failed"
+		ok = false
+	}
+	if !s.ready.Load() {
+		fail("network")
+	}
+	if s.sessionsFull() {
+		fail("sessions")
+	}
+	if s.pool.Available() <= 0 {
+		fail("ipam")
+	}
+	if s.tunReadDown.Load() || time.Since(time.Unix(0, s.tunReadErrAt.Load())) < 5*time.Second {
+		fail("tun")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"checks": checks})
+}
+
+func (s *Server) connectHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	remote := remoteIP(r.RemoteAddr)
+	if clientAddr, _ := r.Context().Value(http3.RemoteAddrContextKey).(net.Addr); clientAddr != nil {
+		remote = remoteIP(clientAddr.String())
+	}
+	id := requestID(r)
+	log := s.log.With("request_id", id)
+	w.Header().Set(qdt.RequestIDHeader, id)
+	var req qdt.ConnectRequest
+	reject := func(status int, reason, msg string) {
+		s.metrics.handshakes.WithLabelValues(reason).Inc()
+		logReject(log, reason, remote, req, start)
+		http.Error(w, msg, status)
+	}
+	if !s.ready.Load() {
+		reject(http.StatusServiceUnavailable, "not_ready", "not ready")
+		return
+	}
+	if r.Method != http.MethodPost {
+		reject(http.StatusMethodNotAllowed, "method", "method not allowed")
+		return
+	}
+	token := r.Header.Get(qdt.TokenHeader)
+	subject, ok := s.authenticate(token)
+	if !ok {
+		reject(http.StatusUnauthorized, "unauthorized", "unauthorized")
+		return
+	}
+	if !s.hsLimit.Allow(remote) {
+		reject(http.StatusTooManyRequests, "rate_limited", "rate limited")
+		return
+	}
+	if s.sessionsFull() {
+		reject(http.StatusServiceUnavailable, "busy", "server busy")
+		return
+	}
+	streamer, ok := w.(http3.HTTPStreamer)
+	if !ok {
+		reject(http.StatusBadRequest, "not_http3", "not http3")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, qdt.MaxBodyBytes)
+	req, err := qdt.DecodeConnectRequest(r.Body)
+	if err != nil {
+		reject(http.StatusBadRequest, "bad_request", "bad request")
+		return
+	}
+	if s.earlyReplay(used0RTT(w), req.ClientNonce) {
+		reject(http.StatusTooEarly, "replay", "replayed request")
+		return
+	}
+	sess, handoff, resp, rej := s.establishSession(remote, token, subject, req, nil)
+	if rej != nil {
+		reject(rej.status, rej.reason, rej.msg)
+		return
+	}
+	resp.RequestID = id
+	logAccept(log, remote, req, resp, start)
+	if err := qdt.WriteConnectResponse(w, resp); err != nil {
+		sess.log.Error("connect response failed", "err", err)
+		if handoff == nil {
+			sess.Close(err)
+		}
+		return
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	// HTTPStream sends the response header, so it is only taken once the
+	// handshake has succeeded. Nothing uses the session's stream before Start.
+	stream := streamer.HTTPStream()
+	s.runSession(stream.Context(), sess, stream, handoff)
+}
+
+// runSession starts sess over stream, or moves it there when the client
+// resumed a session that is still live, and blocks while stream carries it.
+func (s *Server) runSession(ctx context.Context, sess *Session, stream qdt.DatagramConn, handoff *qdt.Tunnel) {
+	if handoff != nil {
+		if err := sess.Handoff(ctx, stream, handoff); err != nil {
+			s.metrics.handshakes.WithLabelValues("handoff_failed").Inc()
+			sess.log.Debug("handoff failed", "err", err)
+			return
+		}
+		sess.log.Info("session handed off to a new connection")
+	} else {
+		sess.setStream(stream)
+		sess.Start(ctx)
+	}
+	s.metrics.handshakes.WithLabelValues("ok").Inc()
+	sess.waitStream(stream)
+}
+
+// logReject records a refused connect attempt. req is empty when it was
+// refused before the request was read.
+func logReject(log *slog.Logger, reason, remote string, req qdt.ConnectRequest, start time.Time) {
+	log.Warn("connect rejected", "reason", reason, "client_addr", remote, "client_id", req.ClientID, "platform", req.Platform, "elapsed", time.Since(start))
+}
+
+// logAccept records the session a connect request was given.
+func logAccept(log *slog.Logger, remote string, req qdt.ConnectRequest, resp qdt.ConnectResponse, start time.Time) {
+	log.Info("connect accepted", "session_id", resp.SessionID, "client_ip", resp.ClientIP, "client_addr", remote, "client_id", req.ClientID, "elapsed", time.Since(start))
+}
+
+type handshakeReject struct {
+	status int
+	reason string
+	msg    string
+}
+
+// establishSession allocates an address and keys for an authenticated client
+// and registers a session carried over conn. It is shared by the HTTP/3 and
+// WebSocket handshakes. When the client resumes a session that is still
+// live, that session is returned with the tunnel to hand it off to.
+func (s *Server) establishSession(remote, token, subject string, req qdt.ConnectRequest, conn qdt.DatagramConn) (*Session, *qdt.Tunnel, qdt.ConnectResponse, *handshakeReject) {
+	if req.ClientID == "" {
+		req.ClientID = subject
+	}
+	clientNonce, err := qdt.DecodeNonce(req.ClientNonce)
+	if err != nil {
+		return nil, nil, qdt.ConnectResponse{}, &handshakeReject{http.StatusBadRequest, "bad_nonce", "bad nonce"}
+	}
+	// A client outside FIPS mode would seal with ChaCha20-Poly1305.
+	if s.cfg.FIPSMode && !qdt.HasCap(req.Caps, qdt.CapFIPS) {
+		return nil, nil, qdt.ConnectResponse{}, &handshakeReject{http.StatusBadRequest, "fips_required", "fips mode required"}
+	}
+	serverNonce, err := qdt.NewHandshakeNonce()
+	if err != nil {
+		return nil, nil, qdt.ConnectResponse{}, &handshakeReject{http.StatusInternalServerError, "nonce_error", "nonce error"}
+	}
+	clientIP, resumed := s.resumeAddress(req.ResumeToken, req.ClientID)
+	var sessionID uint64
+	if resumed != nil {
+		sessionID = resumed.id
+	} else if sessionID, err = qdt.NewSessionID(); err != nil {
+		return nil, nil, qdt.ConnectResponse{}, &handshakeReject{http.StatusInternalServerError, "session_id_error", "session id error"}
+	}
+	if clientIP == nil {
+		clientIP, err = s.pool.AcquireFor(req.ClientID)
+		if err != nil {
+			return nil, nil, qdt.ConnectResponse{}, &handshakeReject{http.StatusServiceUnavailable, "pool_exhausted", "address pool exhausted"}
+		}
+	}
+	releaseIP := resumed == nil
+	defer func() {
+		if releaseIP {
+			s.pool.Release(clientIP)
+		}
+	}()
+	ip4 := clientIP.To4()
+	if ip4 == nil {
+		return nil, nil, qdt.ConnectResponse{}, &handshakeReject{http.StatusInternalServerError, "bad_ip", "invalid client ip"}
+	}
+	mtu := s.cfg.MTU
+	if req.MTU > 0 && req.MTU < mtu {
+		mtu = req.MTU
+	}
+	if p := int(s.cfg.QUICMaxDatagramPayload); p > 0 && p < mtu {
+		mtu = p
+	}
+	var kemSecret, kemCiphertext []byte
+	if qdt.HasCap(req.Caps, qdt.CapPQMLKEM768) {
+		if kemSecret, kemCiphertext, err = qdt.EncapsulateKEM(req.KemPublicKey); err != nil {
+			return nil, nil, qdt.ConnectResponse{}, &handshakeReject{http.StatusBadRequest, "bad_kem_key", "bad kem public key"}
+		}
+	}
+	keys, err := qdt.DeriveHybridKeyMaterial(token, clientNonce, serverNonce, kemSecret)
+	if err != nil {
+		return nil, nil, qdt.ConnectResponse{}, &handshakeReject{http.StatusInternalServerError, "key_derivation_error", "key derivation error"}
+	}
+	replay := qdt.NewReplayWindow(2048)
+	if s.cfg.ReplayWindowAutoScale {
+		replay.EnableAutoScale()
+	}
+	send, recv, err := qdt.NewServerCipherStates(keys, replay)
+	if err != nil {
+		return nil, nil, qdt.ConnectResponse{}, &handshakeReject{http.StatusInternalServerError, "cipher_error", "cipher error"}
+	}
+	tunnel := qdt.NewTunnelWithLimits(sessionID, mtu, send, recv, s.cfg.MaxReassemblyBytes, s.cfg.MaxReassemblyAggregateBytes, s.cfg.ReassemblyTTL)
+	tunnel.Reasm = qdt.NewReassembler(s.cfg.ReassemblyTTL, s.cfg.MaxFragmentEntriesPerSession, s.cfg.MaxReassemblyBytes, s.cfg.MaxReassemblyAggregateBytes)
+	tunnel.Reasm.Budget = s.fragBudget
+	tunnel.Reasm.OnAssembled = s.observeReassemblyWait
+
+	resp := qdt.ConnectResponse{
+		Version:       qdt.ProtocolVersion,
+		SessionID:     sessionID,
+		ServerNonce:   qdt.EncodeNonce(serverNonce),
+		MTU:           mtu,
+		ClientIP:      clientIP.String(),
+		GatewayIP:     s.cfg.GatewayIP,
+		CIDR:          s.pool.CIDR(),
+		DNS:           s.cfg.DNS,
+		SearchDomains: s.cfg.SearchDomains,
+		ResumeToken:   qdt.IssueResumeToken(s.resumeKey, sessionID, clientIP, time.Now().Add(s.cfg.MaxTokenAge)),
+	}
+	if s.cfg.FIPSMode {
+		resp.Caps = append(resp.Caps, qdt.CapFIPS)
+	}
+	if kemCiphertext != nil {
+		resp.Caps = append(resp.Caps, qdt.CapPQMLKEM768)
+		resp.KemCiphertext = kemCiphertext
+	}
+	if qdt.HasCap(req.Caps, qdt.CapCoalesce) {
+		resp.Caps = append(resp.Caps, qdt.CapCoalesce)
+		if s.cfg.CoalesceInterval > 0 {
+			tunnel.EnableCoalescing(s.cfg.CoalesceInterval, s.cfg.CoalesceMaxBytes, s.cfg.CoalesceThreshold)
+		}
+	}
+	if s.cfg.FragmentNAK && qdt.HasCap(req.Caps, qdt.CapFragmentNAK) {
+		tunnel.EnableFragmentNAK(0)
+		resp.Caps = append(resp.Caps, qdt.CapFragmentNAK)
+	}
+	if qdt.HasCap(req.Caps, qdt.CapCompactHeader) {
+		tunnel.EnableCompactHeader()
+		resp.Caps = append(resp.Caps, qdt.CapCompactHeader)
+	}
+	if qdt.HasCap(req.Caps, qdt.CapFragEpoch) {
+		tunnel.EnableFragEpoch()
+		resp.Caps = append(resp.Caps, qdt.CapFragEpoch)
+	}
+	if qdt.HasCap(req.Caps, qdt.CapNotification) {
+		tunnel.EnableNotifications()
+		resp.Caps = append(resp.Caps, qdt.CapNotification)
+	}
+	resp.Caps = append(resp.Caps, qdt.CapPong)
+	if s.cfg.Compress && qdt.HasCap(req.Caps, qdt.CapCompress) {
+		tunnel.EnableCompression()
+		tunnel.CompressObserver = s.observeCompression
+		resp.Caps = append(resp.Caps, qdt.CapCompress)
+	}
+	if resumed != nil {
+		// A handed-off session keeps the per-IP slot of the address it
+		// first connected from.
+		return resumed, tunnel, resp, nil
+	}
+
+	advertise, reject := s.parseAdvertiseRoutes(req.AdvertiseRoutes)
+	if reject != nil {
+		return nil, nil, qdt.ConnectResponse{}, reject
+	}
+	// Checked after resumeAddress, which frees the slot of a session being
+	// replaced.
+	if !s.perIP.acquire(remote, s.cfg.MaxSessionsPerIP) {
+		return nil, nil, qdt.ConnectResponse{}, &handshakeReject{http.StatusTooManyRequests, "ip_limit", "too many sessions from this address"}
+	}
+	if !s.perClientID.acquire(req.ClientID, s.cfg.MaxSessionsPerClientID) {
+		s.perIP.release(remote, s.cfg.MaxSessionsPerIP)
+		return nil, nil, qdt.ConnectResponse{}, &handshakeReject{http.StatusTooManyRequests, "client_id_limit", "too many sessions for this client id"}
+	}
+
+	// With equal limits the token bucket is shared by both directions. A
+	// leaky bucket has no slack for a reply in the same slot as its
+	// request, so each direction always gets its own.
+	inRate, outRate := s.cfg.rateLimits(subject)
+	inLimiter := s.newShaper(inRate)
+	outShaper := inLimiter
+	if inRate != outRate || s.cfg.ShaperType == ShaperLeaky {
+		outShaper = s.newShaper(outRate)
+	}
+	sendWorkers, sendQueue, sendBatch := s.cfg.sendParams(subject)
+	sess := newSession(sessionID, clientIP, binary.BigEndian.Uint32(ip4), req.ClientID, conn, tunnel, s.packetPool, s.dgPool, s.tunWriteCh, inLimiter, outShaper, sendWorkers, sendQueue, s.cfg.SendDatagramQueue, sendBatch, s.metrics, s.log, s.onSessionClose)
+	sess.platform = req.Platform
+	sess.remoteIP = remote
+	sess.protoLimiters = s.newProtocolLimiters()
+	sess.acl = s.acl
+	sess.watchdogTimeout = s.cfg.watchdogDeadline()
+	if s.cfg.PinToCPU {
+		sess.pinCPU = func() { s.pin(s.nextCPU()) }
+	}
+	if s.cfg.AllowHairpin {
+		sess.hairpin = s.hairpin
+	}
+	if reject := s.advertise(sess, advertise); reject != nil {
+		s.perIP.release(remote, s.cfg.MaxSessionsPerIP)
+		s.perClientID.release(req.ClientID, s.cfg.MaxSessionsPerClientID)
+		return nil, nil, qdt.ConnectResponse{}, reject
+	}
+	if s.cfg.CaptureFile != "" {
+		if sess.capture, err = openCapture(captureFileName(s.cfg.CaptureFile, sessionID)); err != nil {
+			sess.log.Warn("packet capture failed", "err", err)
+		}
+	}
+	s.addSession(sess)
+	s.writeAudit(auditSessionOpen, sess)
+	releaseIP = false
+
+	return sess, nil, resp, nil
+}
+
+// resumeAddress returns the address bound to a valid resume token, or nil if
+// a fresh one must be acquired. If the session the token was issued to still
+// holds the address and belongs to clientID, it is returned to be handed off;
+// one for another client id is closed.
+func (s *Server) resumeAddress(token, clientID string) (net.IP, *Session) {
+	if token == "" {
+		return nil, nil
+	}
+	id, ip, err := qdt.VerifyResumeToken(s.resumeKey, token, time.Now())
+	if err != nil {
+		s.log.Debug("resume token rejected", "err", err)
+		return nil, nil
+	}
+	if old := s.sessions.GetByIP(binary.BigEndian.Uint32(ip.To4())); old != nil {
+		if old.id != id {
+			return nil, nil
+		}
+		if old.clientID == clientID {
+			return ip, old
+		}
+		old.Close(fmt.Errorf("resumed by a new connection"))
+	}
+	if !s.pool.ClaimFor(ip, clientID) {
+		return nil, nil
+	}
+	s.log.Debug("session resumed", "prev_id", id, "ip", ip.String())
+	return ip, nil
+}
+
+func (s *Server) observeCompression(raw, compressed int) {
+	s.metrics.compressionRatio.Observe(float64(compressed) / float64(raw))
+}
+
+func (s *Server) observeReassemblyWait(wait time.Duration) {
+	s.metrics.reassemblyWait.Observe(wait.Seconds())
+}
+
+// authenticate accepts either the static token or, when jwt_secret is set,
+// a signed JWT. The returned subject is empty for static tokens.
+func (s *Server) authenticate(token string) (string, bool) {
+	if !qdt.IsJWT(token) {
+		return "", tokenMatch(token, s.cfg.Token)
+	}
+	if s.cfg.JWTSecret == "" {
+		return "", false
+	}
+	subject, err := qdt.VerifyJWT(token, s.cfg.JWTSecret, s.cfg.JWTIssuer)
+	if err != nil {
+		s.log.Debug("jwt rejected", "err", err)
+		return "", false
+	}
+	return subject, true
+}
+
+func tokenMatch(got, want string) bool {
+	h1 := sha256.Sum256([]byte(got))
+	h2 := sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(h1[:], h2[:]) == 1
+}
+
+func (s *Server) addSession(sess *Session) {
+	s.sessions.Add(sess)
+	s.metrics.sessions.Inc()
+	s.activeSessions.Add(1)
+}
+
+func (s *Server) onSessionClose(sess *Session, err error) {
+	if err != nil {
+		sess.log.Info("session closed", "err", err)
+	}
+	s.sessions.Remove(sess)
+	s.withdraw(sess)
+	s.pool.Release(sess.ip)
+	s.metrics.sessions.Dec()
+	s.activeSessions.Add(-1)
+	s.perIP.release(sess.remoteIP, s.cfg.MaxSessionsPerIP)
+	s.perClientID.release(sess.clientID, s.cfg.MaxSessionsPerClientID)
+	s.writeAudit(auditSessionClose, sess)
+	if s.acct != nil {
+		go s.acct.Send(accountingRecord(sess))
+	}
+}
+
+func (s *Server) writeAudit(eventType string, sess *Session) {
+	if s.audit == nil {
+		return
+	}
+	ev := AuditEvent{
+		Time:      time.Now().UTC(),
+		Type:      eventType,
+		SessionID: sess.id,
+		ClientIP:  sess.ip.String(),
+		ClientID:  sess.clientID,
+		Platform:  sess.platform,
+	}
+	if eventType == auditSessionClose {
+		st := sess.Stats()
+		ev.BytesIn = st.BytesRecv
+		ev.BytesOut = st.BytesSent
+		ev.Duration = time.Since(sess.startedAt)
+	}
+	if err := s.audit.Write(ev); err != nil {
+		s.log.Warn("audit write failed", "err", err)
+	}
+}
+
+// The TUN loops get the first two cores; encoders take the rest in turn.
+const (
+	tunReadCPU = iota
+	tunWriteCPU
+	firstEncodeCPU
+)
+
+// pinned wraps loop to run bound to cpu when pin_to_cpu is set.
+func (s *Server) pinned(cpu int, loop func(context.Context)) func(context.Context) {
+	if !s.cfg.PinToCPU {
+		return loop
+	}
+	return func(ctx context.Context) {
+		s.pin(cpu)
+		loop(ctx)
+	}
+}
+
+// nextCPU returns the core for the next encode goroutine.
+func (s *Server) nextCPU() int {
+	return firstEncodeCPU + int(s.cpuSeq.Add(1)-1)
+}
+
+func (s *Server) pin(cpu int) {
+	if err := pinToCPU(cpu); err != nil {
+		s.log.Warn("cpu pinning failed", "cpu", cpu, "err", err)
+	}
+}
+
+func (s *Server) tunReadLoop(ctx context.Context) {
+	// Only Wintun queues packets that can be drained in one call; a Linux
+	// TUN fd returns one packet per read.
+	batch := 1
+	if runtime.GOOS == "windows" {
+		batch = max(s.cfg.SendBatch, 1)
+	}
+	bufs := make([][]byte, batch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		for i := range bufs {
+			bufs[i] = s.packetPool.Get()
+		}
+		n, err := s.tun.ReadBatch(bufs)
+		for _, b := range bufs[n:] {
+			s.packetPool.Put(b)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				// Shutting down; Close may have closed the device.
+				return
+			}
+			s.tunReadErrAt.Store(time.Now().UnixNano())
+			s.tunReadDown.Store(true)
+			s.log.Error("tun read error", "err", err)
+			return
+		}
+		for _, pkt := range bufs[:n] {
+			s.routeFromTUN(pkt)
+		}
+	}
+}
+
+// routeFromTUN queues a packet read from the TUN device for the session it
+// is addressed to, taking ownership of its pool buffer.
+func (s *Server) routeFromTUN(pkt []byte) {
+	if len(pkt) == 0 {
+		s.packetPool.Put(pkt)
+		return
+	}
+	dst4, ok := iputil.PacketDestV4(pkt)
+	if !ok {
+		s.packetPool.Put(pkt)
+		s.metrics.drops.WithLabelValues("bad_packet").Inc()
+		return
+	}
+	sess := s.sessions.GetByIP(dst4)
+	if sess == nil {
+		sess = s.advertised.Lookup(dst4)
+	}
+	if sess == nil {
+		s.metrics.drops.WithLabelValues("no_session").Inc()
+		if s.cfg.SendICMPUnreachable && s.sendICMPUnreachable(pkt) {
+			return
+		}
+		s.packetPool.Put(pkt)
+		return
+	}
+	if s.acl != nil && s.acl.Match(pkt) == acl.Drop {
+		s.metrics.drops.WithLabelValues("acl").Inc()
+		s.packetPool.Put(pkt)
+		return
+	}
+	if ok := sess.Enqueue(pkt); !ok {
+		s.metrics.drops.WithLabelValues("queue_full").Inc()
+		s.packetPool.Put(pkt)
+	}
+}
+
+// hairpin hands a packet from one client straight to the session of the
+// client it is addressed to, skipping the TUN device and the kernel.
+func (s *Server) hairpin(from *Session, pkt []byte) bool {
+	dst4, ok := iputil.PacketDestV4(pkt)
+	if !ok {
+		return false
+	}
+	dest := s.sessions.GetByIP(dst4)
+	if dest == nil {
+		dest = s.advertised.Lookup(dst4)
+	}
+	if dest == nil || dest == from {
+		return false
+	}
+	if !dest.Enqueue(pkt) {
+		s.metrics.drops.WithLabelValues("queue_full").Inc()
+		s.packetPool.Put(pkt)
+		return true
+	}
+	s.metrics.virtualRouted.Inc()
+	s.metrics.bytes.WithLabelValues("hairpin").Add(float64(len(pkt)))
+	return true
+}
+
+// sendICMPUnreachable answers pkt with a host-unreachable error, at most once
+// per second per source. It reports whether pkt's buffer was handed off.
+func (s *Server) sendICMPUnreachable(pkt []byte) bool {
+	src4, ok := iputil.PacketSourceV4(pkt)
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	if last, ok := s.icmpLast.Load(src4); ok && now.Sub(last.(time.Time)) < time.Second {
+		return false
+	}
+	icmp, err := iputil.BuildICMPUnreachable(pkt)
+	if err != nil {
+		return false
+	}
+	s.icmpLast.Store(src4, now)
+	out := pkt[:len(icmp)]
+	copy(out, icmp)
+	select {
+	case s.tunWriteCh <- out:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) tunWriteLoop(ctx context.Context) {
+	batchSize := s.cfg.SendBatch
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	batch := make([][]byte, 0, batchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pkt := <-s.tunWriteCh:
+			batch = append(batch[:0], pkt)
+		drain:
+			for len(batch) < batchSize {
+				select {
+				case next := <-s.tunWriteCh:
+					batch = append(batch, next)
+				default:
+					break drain
+				}
+			}
+			s.writeTunBatch(batch)
+		}
+	}
+}
+
+func (s *Server) writeTunBatch(batch [][]byte) {
+	if s.cfg.DSCPMark != 0 {
+		for _, pkt := range batch {
+			iputil.SetDSCP(pkt, s.cfg.DSCPMark)
+		}
+	}
+	for off := 0; off < len(batch); {
+		n, err := s.tun.WriteBatch(batch[off:])
+		off += n
+		if err != nil {
+			s.log.Error("tun write error", "err", err)
+			// Skip the packet that failed and carry on with the rest.
+			off++
+		}
+	}
+	for i, pkt := range batch {
+		s.packetPool.Put(pkt)
+		batch[i] = nil
+	}
+}
+
+func (s *Server) ipamMetricsLoop(ctx context.Context) {
+	s.metrics.ipamTotal.Set(float64(s.pool.Total()))
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		s.metrics.ipamUsed.Set(float64(s.pool.Used()))
+		s.metrics.ipamAvailable.Set(float64(s.pool.Available()))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tunMetricsLoop adds the change of the TUN device counters since the last
+// sample to the Prometheus counters every 5 seconds.
+func (s *Server) tunMetricsLoop(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	var last tun.Stats
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		st := s.tun.Stats()
+		s.metrics.tunReadBytes.Add(float64(st.ReadBytes - last.ReadBytes))
+		s.metrics.tunWriteBytes.Add(float64(st.WriteBytes - last.WriteBytes))
+		s.metrics.tunReadErrors.Add(float64(st.ReadErrors - last.ReadErrors))
+		s.metrics.tunWriteErrors.Add(float64(st.WriteErrors - last.WriteErrors))
+		last = st
+	}
+}
+
+func (s *Server) sessionSweepLoop(ctx context.Context) {
+	every := 30 * time.Second
+	if s.cfg.KeepaliveEnabled && s.cfg.KeepaliveInterval < every {
+		every = s.cfg.KeepaliveInterval
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			s.icmpLast.Range(func(k, v any) bool {
+				if now.Sub(v.(time.Time)) > time.Minute {
+					s.icmpLast.Delete(k)
+				}
+				return true
+			})
+			list := s.sessions.Snapshot()
+			for _, sess := range list {
+				idle := now.Sub(time.Unix(0, sess.lastSeen.Load()))
+				if s.cfg.KeepaliveEnabled {
+					if idle > s.cfg.KeepaliveInterval {
+						go sess.probe(s.cfg.KeepaliveTimeout)
+					}
+					continue
+				}
+				if idle > s.cfg.SessionTimeout {
+					sess.Close(fmt.Errorf("idle timeout"))
+				}
+			}
+		}
+	}
+}
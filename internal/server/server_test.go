@@ -0,0 +1,69 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEnsureForwarding(t *testing.T) {
+	readOnly := func() error { return errors.New("read-only file system") }
+	for _, tc := range []struct {
+		name    string
+		on      bool
+		enable  func() error
+		require bool
+		wantErr bool
+		writes  int
+	}{
+		{name: "already enabled", on: true, enable: readOnly, require: true, writes: 0},
+		{name: "enabled now", enable: nil, require: true, writes: 1},
+		{name: "write fails", enable: readOnly, require: true, wantErr: true, writes: 1},
+		{name: "write fails, not required", enable: readOnly, writes: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			on, writes := tc.on, 0
+			enable := func() error {
+				writes++
+				if tc.enable != nil {
+					return tc.enable()
+				}
+				on = true
+				return nil
+			}
+			s := &Server{cfg: Config{RequireIPForwarding: tc.require}, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+			err := s.ensureForwarding(false, enable, func() (bool, error) { return on, nil })
+			if (err != nil) != tc.wantErr || writes != tc.writes {
+				t.Fatalf("err=%v writes=%d, want error %v and %d writes", err, writes, tc.wantErr, tc.writes)
+			}
+		})
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	s := &Server{cfg: Config{AdminToken: "admin-secret"}}
+	h := s.adminAuth(ok)
+	for _, tc := range []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"admin-secret", http.StatusUnauthorized},
+		{"Bearer admin-secret", http.StatusNoContent},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/sessions", nil)
+		if tc.auth != "" {
+			r.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Fatalf("authorization %q: got %d, want %d", tc.auth, w.Code, tc.want)
+		}
+	}
+}
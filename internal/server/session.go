@@ -0,0 +1,626 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"qdt/internal/acl"
+	"qdt/internal/bufferpool"
+	"qdt/internal/iputil"
+	"qdt/internal/pqueue"
+	"qdt/internal/shaper"
+	"qdt/pkg/qdt"
+)
+
+// ErrUseNewStream ends the receive loop of a stream that Handoff replaced.
+var ErrUseNewStream = errors.New("session moved to a new stream")
+
+// sessionLink is a stream carrying a session and the tunnel keyed to it.
+type sessionLink struct {
+	stream qdt.DatagramConn
+	tunnel *qdt.Tunnel
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	// carried holds the stats of the tunnels this link replaced.
+	carried qdt.Stats
+}
+
+type Session struct {
+	id          uint64
+	ip          net.IP
+	clientID    string
+	platform    string
+	remoteIP    string
+	startedAt   time.Time
+	ip4         uint32
+	link        atomic.Pointer[sessionLink]
+	linkMu      sync.Mutex
+	sendQ       *pqueue.Queue
+	dgCh        chan []byte
+	dgPool      *bufferpool.Pool
+	sendWorkers int
+	sendBatch   int
+	closeOnce   sync.Once
+	closed      chan struct{}
+	lastSeen    atomic.Int64
+	pongCh      chan struct{}
+	capture     packetCapture
+	probing     atomic.Bool
+	inLimiter   shaper.Shaper
+	shaper      shaper.Shaper
+	metrics     *Metrics
+	log         *slog.Logger
+	pool        *bufferpool.Pool
+	onClose     func(*Session, error)
+	tunWriteCh  chan<- []byte
+
+	// protoLimiters is indexed by IP protocol number; nil entries are
+	// unlimited, and the array itself is nil when no limits are configured.
+	protoLimiters *[256]*rate.Limiter
+	// hairpin, when set, delivers a packet addressed to another client and
+	// reports whether it took ownership of the buffer.
+	hairpin func(from *Session, pkt []byte) bool
+	// advertised lists the networks routed through this client; packets
+	// from them are accepted alongside the client address.
+	advertised []prefix4
+	// acl filters packets from the client; nil allows everything.
+	acl *acl.Matcher
+	// pinCPU, when set, pins the calling encode goroutine to its own core.
+	pinCPU func()
+	// watchdogReset is kicked by the receive and encode loops; with a
+	// non-zero watchdogTimeout the session closes when it goes quiet.
+	watchdogReset   chan struct{}
+	watchdogTimeout time.Duration
+}
+
+func newSession(id uint64, ip net.IP, ip4 uint32, clientID string, stream qdt.DatagramConn, tunnel *qdt.Tunnel, pool *bufferpool.Pool, dgPool *bufferpool.Pool, tunWriteCh chan<- []byte, inLimiter, outShaper shaper.Shaper, sendWorkers int, sendQueue int, dgQueue int, sendBatch int, metrics *Metrics, log *slog.Logger, onClose func(*Session, error)) *Session {
+	if sendWorkers <= 0 {
+		sendWorkers = 1
+	}
+	if sendQueue <= 0 {
+		sendQueue = 1024
+	}
+	if dgQueue <= 0 {
+		dgQueue = sendQueue
+	}
+	if sendBatch <= 0 {
+		sendBatch = 1
+	}
+	s := &Session{
+		id:          id,
+		ip:          ip,
+		ip4:         ip4,
+		clientID:    clientID,
+		sendQ:       pqueue.New(sendQueue),
+		dgCh:        make(chan []byte, dgQueue),
+		dgPool:      dgPool,
+		sendWorkers: sendWorkers,
+		sendBatch:   sendBatch,
+		closed:      make(chan struct{}),
+		inLimiter:   inLimiter,
+		shaper:      outShaper,
+		metrics:     metrics,
+		log:         log.With(slog.Uint64("session_id", id), slog.String("client_ip", ip.String()), slog.String("client_id", clientID)),
+		pool:        pool,
+		onClose:     onClose,
+		tunWriteCh:  tunWriteCh,
+		startedAt:   time.Now(),
+		pongCh:      make(chan struct{}, 1),
+
+		watchdogReset: make(chan struct{}, 1),
+	}
+	tunnel.PongHandler = s.onPong
+	s.link.Store(&sessionLink{stream: stream, tunnel: tunnel})
+	s.handlePing(tunnel)
+	s.handleFragmentNAK(tunnel)
+	s.lastSeen.Store(time.Now().UnixNano())
+	return s
+}
+
+// setStream sets the stream of a session that has not been started.
+func (s *Session) setStream(stream qdt.DatagramConn) {
+	l := *s.link.Load()
+	l.stream = stream
+	s.link.Store(&l)
+}
+
+// Start runs the session over its stream; ctx bounds that stream only, so
+// the session outlives it when handed off.
+func (s *Session) Start(ctx context.Context) {
+	old := s.link.Load()
+	l := newSessionLink(ctx, old.stream, old.tunnel)
+	s.link.Store(l)
+	go s.recvLoop(l)
+	go s.sendLoop()
+	for i := 0; i < s.sendWorkers; i++ {
+		go s.encodeLoop()
+	}
+	if s.watchdogTimeout > 0 {
+		go s.watchdogLoop(s.watchdogTimeout)
+	}
+}
+
+func newSessionLink(ctx context.Context, stream qdt.DatagramConn, tunnel *qdt.Tunnel) *sessionLink {
+	l := &sessionLink{stream: stream, tunnel: tunnel, done: make(chan struct{})}
+	l.ctx, l.cancel = context.WithCancel(ctx)
+	return l
+}
+
+// Handoff moves a started session onto stream and the tunnel keyed for it,
+// as when the client reconnects from another network. The old stream's
+// receive loop finishes the datagram in hand before the new one starts, so
+// packets from the client stay in order. ctx bounds the new stream.
+func (s *Session) Handoff(ctx context.Context, stream qdt.DatagramConn, tunnel *qdt.Tunnel) error {
+	s.linkMu.Lock()
+	select {
+	case <-s.closed:
+		s.linkMu.Unlock()
+		return fmt.Errorf("session closed")
+	default:
+	}
+	old := s.link.Load()
+	if old.done == nil {
+		s.linkMu.Unlock()
+		return fmt.Errorf("session not started")
+	}
+	tunnel.PongHandler = s.onPong
+	s.handlePing(tunnel)
+	s.handleFragmentNAK(tunnel)
+	l := newSessionLink(ctx, stream, tunnel)
+	l.carried = addStats(old.carried, old.tunnel.Stats())
+	s.link.Store(l)
+	s.linkMu.Unlock()
+
+	old.cancel()
+	<-old.done
+	go s.recvLoop(l)
+	return nil
+}
+
+// handleFragmentNAK, when tunnel negotiated fragment NAKs, sends them for
+// packets from the client and answers the client's. Both go out on the
+// stream tunnel is keyed to, and stop once it has been handed off.
+// handlePing answers the client's pings, which it times to score the link.
+func (s *Session) handlePing(tunnel *qdt.Tunnel) {
+	tunnel.PingHandler = func() {
+		if l := s.link.Load(); l.tunnel == tunnel {
+			_ = tunnel.SendPong(l.stream)
+		}
+	}
+}
+
+func (s *Session) handleFragmentNAK(tunnel *qdt.Tunnel) {
+	if !tunnel.FragmentNAKEnabled() {
+		return
+	}
+	stream := func() qdt.DatagramConn {
+		if l := s.link.Load(); l.tunnel == tunnel {
+			return l.stream
+		}
+		return nil
+	}
+	tunnel.Reasm.OnMissing = func(id uint32, missing []uint32) {
+		if conn := stream(); conn != nil {
+			s.metrics.fragmentNAKs.WithLabelValues("sent").Inc()
+			_ = tunnel.SendFragmentNAK(conn, id, missing)
+		}
+	}
+	tunnel.FragmentNAKHandler = func(id uint32, missing []uint32) {
+		conn := stream()
+		if conn == nil {
+			return
+		}
+		s.metrics.fragmentNAKs.WithLabelValues("received").Inc()
+		for _, off := range missing {
+			if err := tunnel.ResendFragment(conn, id, off); err != nil {
+				s.log.Debug("resend fragment failed", "frag_id", id, "offset", off, "err", err)
+				return
+			}
+		}
+	}
+}
+
+// linkFailed closes the session for an error on l's stream. It returns
+// ErrUseNewStream instead when l has been handed off.
+func (s *Session) linkFailed(l *sessionLink, err error) error {
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+	if s.link.Load() != l {
+		return ErrUseNewStream
+	}
+	s.Close(err)
+	return err
+}
+
+// waitStream blocks until the session closes or moves off stream.
+func (s *Session) waitStream(stream qdt.DatagramConn) {
+	l := s.link.Load()
+	if l.stream != stream {
+		return
+	}
+	select {
+	case <-l.done:
+	case <-s.closed:
+	}
+}
+
+// Stats returns the tunnel counters of the session across handoffs.
+func (s *Session) Stats() qdt.Stats {
+	l := s.link.Load()
+	return addStats(l.carried, l.tunnel.Stats())
+}
+
+func addStats(a, b qdt.Stats) qdt.Stats {
+	return qdt.Stats{
+		BytesSent:     a.BytesSent + b.BytesSent,
+		BytesRecv:     a.BytesRecv + b.BytesRecv,
+		PacketsSent:   a.PacketsSent + b.PacketsSent,
+		PacketsRecv:   a.PacketsRecv + b.PacketsRecv,
+		FragmentsSent: a.FragmentsSent + b.FragmentsSent,
+		FragmentsRecv: a.FragmentsRecv + b.FragmentsRecv,
+		ReplayDrops:   a.ReplayDrops + b.ReplayDrops,
+		DecodeErrors:  a.DecodeErrors + b.DecodeErrors,
+		CompressedIn:  a.CompressedIn + b.CompressedIn,
+		CompressedOut: a.CompressedOut + b.CompressedOut,
+	}
+}
+
+// Enqueue queues pkt for the client, ahead of packets in lower DSCP
+// classes. It returns false when the send queue is full.
+func (s *Session) Enqueue(pkt []byte) bool {
+	return s.sendQ.Enqueue(pkt)
+}
+
+func (s *Session) Close(err error) {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		if l := s.link.Load(); l.cancel != nil {
+			l.cancel()
+		}
+		if s.capture != nil {
+			s.capture.Close()
+		}
+		if s.onClose != nil {
+			s.onClose(s, err)
+		}
+	})
+}
+
+// SendNotification sends payload to the client's notification handler.
+func (s *Session) SendNotification(ctx context.Context, payload []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-s.closed:
+		return fmt.Errorf("session closed")
+	default:
+	}
+	l := s.link.Load()
+	return l.tunnel.SendNotification(l.stream, payload)
+}
+
+func (s *Session) onPong() {
+	s.lastSeen.Store(time.Now().UnixNano())
+	select {
+	case s.pongCh <- struct{}{}:
+	default:
+	}
+}
+
+// probe sends a ping and closes the session if no pong arrives within timeout.
+func (s *Session) probe(timeout time.Duration) {
+	if !s.probing.CompareAndSwap(false, true) {
+		return
+	}
+	defer s.probing.Store(false)
+	select {
+	case <-s.pongCh:
+	default:
+	}
+	l := s.link.Load()
+	if err := l.tunnel.SendPing(l.stream); err != nil {
+		_ = s.linkFailed(l, fmt.Errorf("send ping: %w", err))
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-s.pongCh:
+	case <-s.closed:
+	case <-timer.C:
+		s.Close(fmt.Errorf("keepalive timeout"))
+	}
+}
+
+func (s *Session) recvLoop(l *sessionLink) {
+	defer close(l.done)
+	defer l.tunnel.Reasm.Reset()
+	for {
+		select {
+		case <-s.closed:
+			return
+		default:
+		}
+		b, err := l.stream.ReceiveDatagram(l.ctx)
+		if err != nil {
+			if errors.Is(s.linkFailed(l, fmt.Errorf("receive datagram: %w", err)), ErrUseNewStream) {
+				s.log.Debug("stream handed off")
+			} else {
+				s.log.Debug("receive datagram failed", "err", err)
+			}
+			return
+		}
+		s.kickWatchdog()
+		if s.inLimiter != nil && !s.inLimiter.Allow() {
+			s.metrics.drops.WithLabelValues("rate_in").Inc()
+			continue
+		}
+		dst := s.pool.Get()
+		pkt, pooled, err := l.tunnel.DecodeDatagramInto(dst[:0], b)
+		if err != nil {
+			s.pool.Put(dst)
+			if errors.Is(err, qdt.ErrReplay) {
+				s.metrics.drops.WithLabelValues("replay").Inc()
+				continue
+			}
+			if errors.Is(err, qdt.ErrReassemblyMemoryExceeded) {
+				s.metrics.drops.WithLabelValues("reassembly_memory").Inc()
+				continue
+			}
+			s.metrics.drops.WithLabelValues("decode").Inc()
+			s.log.Debug("decode datagram failed", "err", err)
+			continue
+		}
+		if !s.deliver(dst, pkt, pooled) {
+			return
+		}
+		for {
+			next := s.pool.Get()
+			pkt, ok := l.tunnel.NextCoalesced(next)
+			if !ok {
+				s.pool.Put(next)
+				break
+			}
+			if !s.deliver(next, pkt, true) {
+				return
+			}
+		}
+	}
+}
+
+// deliver checks a decoded packet from the client and queues it for the TUN
+// device. dst is the pool buffer backing pkt when pooled is set. It returns
+// false once the session is closed.
+func (s *Session) deliver(dst, pkt []byte, pooled bool) bool {
+	if len(pkt) == 0 {
+		s.pool.Put(dst)
+		return true
+	}
+	if !pooled {
+		if len(pkt) > cap(dst) {
+			s.pool.Put(dst)
+			s.metrics.drops.WithLabelValues("decode_oversize").Inc()
+			return true
+		}
+		copy(dst, pkt)
+		pkt = dst[:len(pkt)]
+		pooled = true
+	}
+	src4, ok := iputil.PacketSourceV4(pkt)
+	if !ok {
+		s.pool.Put(dst)
+		s.metrics.drops.WithLabelValues("bad_packet").Inc()
+		return true
+	}
+	if src4 != s.ip4 && !s.fromAdvertised(src4) {
+		s.pool.Put(dst)
+		s.metrics.drops.WithLabelValues("src_mismatch").Inc()
+		return true
+	}
+	if s.acl != nil && s.acl.Match(pkt) == acl.Drop {
+		s.pool.Put(dst)
+		s.metrics.drops.WithLabelValues("acl").Inc()
+		return true
+	}
+	if s.protoLimiters != nil {
+		if proto, ok := iputil.PacketProtocol(pkt); ok {
+			if lim := s.protoLimiters[proto]; lim != nil && !lim.Allow() {
+				s.pool.Put(dst)
+				s.metrics.drops.WithLabelValues(protocolDropReason(proto)).Inc()
+				return true
+			}
+		}
+	}
+	s.lastSeen.Store(time.Now().UnixNano())
+	if s.capture != nil {
+		s.capture.Write(pkt)
+	}
+	if s.hairpin != nil && s.hairpin(s, pkt) {
+		return true
+	}
+	select {
+	case s.tunWriteCh <- pkt:
+		s.metrics.packets.WithLabelValues("in").Inc()
+		s.metrics.bytes.WithLabelValues("in").Add(float64(len(pkt)))
+	default:
+		if pooled {
+			s.pool.Put(pkt)
+		} else {
+			s.pool.Put(dst)
+		}
+		s.metrics.drops.WithLabelValues("tun_backpressure").Inc()
+	case <-s.closed:
+		if pooled {
+			s.pool.Put(pkt)
+		} else {
+			s.pool.Put(dst)
+		}
+		return false
+	}
+	return true
+}
+
+func (s *Session) encodeLoop() {
+	if s.pinCPU != nil {
+		s.pinCPU()
+	}
+	l := s.link.Load()
+	enc := l.tunnel.NewEncoder()
+	co := l.tunnel.NewCoalescer(s.allocDatagram, s.enqueueDatagram)
+	defer func() {
+		if co != nil {
+			co.Stop()
+		}
+	}()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-s.sendQ.Ready():
+			s.kickWatchdog()
+			// After a handoff, packets are sealed for the new tunnel.
+			if cur := s.link.Load(); cur != l {
+				if co != nil {
+					_ = co.Flush()
+					co.Stop()
+				}
+				l = cur
+				enc = l.tunnel.NewEncoder()
+				co = l.tunnel.NewCoalescer(s.allocDatagram, s.enqueueDatagram)
+			}
+			for i := 0; i < s.sendBatch; i++ {
+				pkt, ok := s.sendQ.Dequeue()
+				if !ok {
+					break
+				}
+				if err := s.processEncode(enc, co, pkt); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Session) processEncode(enc *qdt.Encoder, co *qdt.Coalescer, pkt []byte) error {
+	if s.shaper != nil && !s.shaper.Allow() {
+		s.metrics.drops.WithLabelValues("rate_out").Inc()
+		s.pool.Put(pkt)
+		return nil
+	}
+	if s.capture != nil {
+		s.capture.Write(pkt)
+	}
+	// Small packets may be batched by the coalescer; anything else flushes
+	// its batch first so packet order is kept.
+	var err error
+	queued := false
+	if co != nil {
+		if queued, err = co.Add(pkt); err == nil && !queued {
+			err = co.Flush()
+		}
+	}
+	if err == nil && !queued {
+		err = enc.EncodePacketTo(pkt, s.allocDatagram, s.enqueueDatagram)
+	}
+	if err != nil {
+		s.pool.Put(pkt)
+		if errors.Is(err, qdt.ErrCounterExhausted) {
+			s.log.Warn("send counter exhausted, closing session")
+			s.Close(qdt.ErrCounterExhausted)
+			return err
+		}
+		s.log.Debug("encode packet failed", "err", err)
+		s.Close(fmt.Errorf("send datagram: %w", err))
+		return err
+	}
+	s.metrics.packets.WithLabelValues("out").Inc()
+	s.metrics.bytes.WithLabelValues("out").Add(float64(len(pkt)))
+	s.lastSeen.Store(time.Now().UnixNano())
+	s.pool.Put(pkt)
+	return nil
+}
+
+func (s *Session) allocDatagram(size int) []byte {
+	buf := s.dgPool.Get()
+	if size > cap(buf) {
+		s.dgPool.Put(buf)
+		s.metrics.drops.WithLabelValues("datagram_oversize").Inc()
+		return nil
+	}
+	return buf[:size]
+}
+
+func (s *Session) enqueueDatagram(buf []byte) error {
+	select {
+	case s.dgCh <- buf:
+		return nil
+	case <-s.closed:
+		if buf != nil {
+			s.dgPool.Put(buf)
+		}
+		return fmt.Errorf("session closed")
+	}
+}
+
+func (s *Session) sendLoop() {
+	for {
+		select {
+		case <-s.closed:
+			return
+		case dg := <-s.dgCh:
+			if err := s.sendDatagram(dg); err != nil {
+				return
+			}
+		batchLoop:
+			for i := 1; i < s.sendBatch; i++ {
+				select {
+				case next := <-s.dgCh:
+					if err := s.sendDatagram(next); err != nil {
+						return
+					}
+				default:
+					break batchLoop
+				}
+			}
+		}
+	}
+}
+
+// sendDatagram sends dg on the current stream. A failure on a stream that
+// has just been handed off drops dg and keeps the session.
+func (s *Session) sendDatagram(dg []byte) error {
+	l := s.link.Load()
+	if err := l.stream.SendDatagram(dg); err != nil {
+		if dg != nil {
+			s.dgPool.Put(dg)
+		}
+		if errors.Is(s.linkFailed(l, fmt.Errorf("send datagram: %w", err)), ErrUseNewStream) {
+			return nil
+		}
+		s.log.Debug("send datagram failed", "err", err)
+		return err
+	}
+	if dg != nil {
+		s.dgPool.Put(dg)
+	}
+	return nil
+}
+
+func (s *Session) fromAdvertised(ip uint32) bool {
+	for _, p := range s.advertised {
+		if p.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
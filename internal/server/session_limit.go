@@ -0,0 +1,43 @@
+package server
+
+import "sync"
+
+// sessionCounter counts active sessions per key, for max_sessions_per_ip
+// and max_sessions_per_client_id.
+type sessionCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newSessionCounter() *sessionCounter {
+	return &sessionCounter{counts: make(map[string]int)}
+}
+
+// acquire takes a slot for key and reports whether it stayed within limit.
+// An empty key or a limit of 0 is never refused.
+func (c *sessionCounter) acquire(key string, limit int) bool {
+	if key == "" || limit <= 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[key] >= limit {
+		return false
+	}
+	c.counts[key]++
+	return true
+}
+
+// release returns a slot taken by a successful acquire.
+func (c *sessionCounter) release(key string, limit int) {
+	if key == "" || limit <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[key] <= 1 {
+		delete(c.counts, key)
+		return
+	}
+	c.counts[key]--
+}
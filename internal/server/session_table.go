@@ -1,4 +1,4 @@
-package main
+package server
 
 import "sync"
 
@@ -6,9 +6,12 @@ type sessionTable struct {
 	shards []sessionShard
 }
 
+// sessionShard holds the sessions whose IP maps to it in byIP and, as an
+// independent index, those whose session ID maps to it in byID.
 type sessionShard struct {
 	mu   sync.RWMutex
 	byIP map[uint32]*Session
+	byID map[uint64]*Session
 }
 
 func newSessionTable(shards int) *sessionTable {
@@ -18,6 +21,7 @@ func newSessionTable(shards int) *sessionTable {
 	t := &sessionTable{shards: make([]sessionShard, shards)}
 	for i := range t.shards {
 		t.shards[i].byIP = make(map[uint32]*Session)
+		t.shards[i].byID = make(map[uint64]*Session)
 	}
 	return t
 }
@@ -27,11 +31,19 @@ func (t *sessionTable) shard(ip uint32) *sessionShard {
 	return &t.shards[idx]
 }
 
+func (t *sessionTable) idShard(id uint64) *sessionShard {
+	return &t.shards[id%uint64(len(t.shards))]
+}
+
 func (t *sessionTable) Add(sess *Session) {
 	sh := t.shard(sess.ip4)
 	sh.mu.Lock()
 	sh.byIP[sess.ip4] = sess
 	sh.mu.Unlock()
+	sh = t.idShard(sess.id)
+	sh.mu.Lock()
+	sh.byID[sess.id] = sess
+	sh.mu.Unlock()
 }
 
 func (t *sessionTable) Remove(sess *Session) {
@@ -39,6 +51,31 @@ func (t *sessionTable) Remove(sess *Session) {
 	sh.mu.Lock()
 	delete(sh.byIP, sess.ip4)
 	sh.mu.Unlock()
+	sh = t.idShard(sess.id)
+	sh.mu.Lock()
+	delete(sh.byID, sess.id)
+	sh.mu.Unlock()
+}
+
+func (t *sessionTable) GetBySessionID(id uint64) *Session {
+	sh := t.idShard(id)
+	sh.mu.RLock()
+	sess := sh.byID[id]
+	sh.mu.RUnlock()
+	return sess
+}
+
+// Count returns the number of sessions, locking one shard at a time; it is
+// not an atomic snapshot of the whole table.
+func (t *sessionTable) Count() int {
+	n := 0
+	for i := range t.shards {
+		sh := &t.shards[i]
+		sh.mu.RLock()
+		n += len(sh.byIP)
+		sh.mu.RUnlock()
+	}
+	return n
 }
 
 func (t *sessionTable) GetByIP(ip uint32) *Session {
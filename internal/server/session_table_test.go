@@ -0,0 +1,29 @@
+package server
+
+import "testing"
+
+func TestSessionTableRemove(t *testing.T) {
+	tbl := newSessionTable(4)
+	// Both sessions share an IP shard but not an ID shard.
+	a := &Session{id: 1, ip4: 0x0a080002}
+	b := &Session{id: 2, ip4: 0x0a080006}
+	tbl.Add(a)
+	tbl.Add(b)
+	if tbl.Count() != 2 {
+		t.Fatalf("count %d, want 2", tbl.Count())
+	}
+
+	tbl.Remove(a)
+	if got := tbl.GetBySessionID(a.id); got != nil {
+		t.Fatalf("removed session still found by id")
+	}
+	if got := tbl.GetByIP(a.ip4); got != nil {
+		t.Fatalf("removed session still found by ip")
+	}
+	if tbl.GetBySessionID(b.id) != b || tbl.GetByIP(b.ip4) != b {
+		t.Fatalf("remaining session not found by both indexes")
+	}
+	if tbl.Count() != 1 || len(tbl.Snapshot()) != 1 {
+		t.Fatalf("count %d, snapshot %d, want 1", tbl.Count(), len(tbl.Snapshot()))
+	}
+}
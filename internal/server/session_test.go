@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"qdt/internal/bufferpool"
+	"qdt/pkg/qdt"
+)
+
+// testMetrics is shared by the package tests; NewMetrics registers with the
+// default registry and may only run once.
+var testMetrics = sync.OnceValue(NewMetrics)
+
+// fakeDatagramConn is a channel-backed DatagramConn. Datagrams sent on one
+// end of a pair are received on the other.
+type fakeDatagramConn struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func newFakeDatagramPair() (*fakeDatagramConn, *fakeDatagramConn) {
+	ab := make(chan []byte, 16)
+	ba := make(chan []byte, 16)
+	return &fakeDatagramConn{in: ba, out: ab}, &fakeDatagramConn{in: ab, out: ba}
+}
+
+func (c *fakeDatagramConn) SendDatagram(b []byte) error {
+	c.out <- append([]byte(nil), b...)
+	return nil
+}
+
+func (c *fakeDatagramConn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case b := <-c.in:
+		return b, nil
+	}
+}
+
+func (c *fakeDatagramConn) receive(t *testing.T) []byte {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	b, err := c.ReceiveDatagram(ctx)
+	if err != nil {
+		t.Fatalf("receive datagram: %v", err)
+	}
+	return b
+}
+
+// newTestTunnels returns a client and server tunnel keyed like a handshake
+// with a fresh pair of nonces.
+func newTestTunnels(t *testing.T, sessionID uint64) (client, server *qdt.Tunnel) {
+	t.Helper()
+	clientNonce, err := qdt.NewHandshakeNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverNonce, err := qdt.NewHandshakeNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	km, err := qdt.DeriveKeyMaterial("secret", clientNonce, serverNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cSend, cRecv, err := qdt.NewClientCipherStates(km, qdt.NewReplayWindow(2048))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sSend, sRecv, err := qdt.NewServerCipherStates(km, qdt.NewReplayWindow(2048))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return qdt.NewTunnel(sessionID, qdt.DefaultMTU, cSend, cRecv), qdt.NewTunnel(sessionID, qdt.DefaultMTU, sSend, sRecv)
+}
+
+func testPacket(src, dst net.IP, payload string) []byte {
+	pkt := make([]byte, 20+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = 17
+	copy(pkt[12:16], src.To4())
+	copy(pkt[16:20], dst.To4())
+	copy(pkt[20:], payload)
+	return pkt
+}
+
+// encode seals pkt with tunnel as a single datagram.
+func encode(t *testing.T, tunnel *qdt.Tunnel, pkt []byte) []byte {
+	t.Helper()
+	var dg []byte
+	if err := tunnel.EncodePacket(pkt, func(b []byte) error {
+		dg = append([]byte(nil), b...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return dg
+}
+
+func TestSessionHandoff(t *testing.T) {
+	clientIP := net.IPv4(10, 8, 0, 2).To4()
+	remote := net.IPv4(192, 0, 2, 1).To4()
+	tunCh := make(chan []byte, 16)
+	closed := make(chan error, 1)
+	client1, server1 := newTestTunnels(t, 7)
+	clientConn1, serverConn1 := newFakeDatagramPair()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	sess := newSession(7, clientIP, binary.BigEndian.Uint32(clientIP), "laptop", serverConn1, server1,
+		bufferpool.New(2048), bufferpool.New(2048), tunCh, nil, nil, 1, 16, 16, 1, testMetrics(), log,
+		func(_ *Session, err error) { closed <- err })
+	sess.Start(context.Background())
+	defer sess.Close(nil)
+
+	fromTun := func(want string) {
+		t.Helper()
+		select {
+		case pkt := <-tunCh:
+			if got := string(pkt[20:]); got != want {
+				t.Fatalf("tun got %q, want %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("packet %q not delivered", want)
+		}
+	}
+
+	first := encode(t, client1, testPacket(clientIP, remote, "one"))
+	if err := clientConn1.SendDatagram(first); err != nil {
+		t.Fatal(err)
+	}
+	fromTun("one")
+	// A replay on the first link is dropped.
+	replays := testutil.ToFloat64(testMetrics().drops.WithLabelValues("replay"))
+	if err := clientConn1.SendDatagram(first); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return testutil.ToFloat64(testMetrics().drops.WithLabelValues("replay")) == replays+1 })
+
+	// Hand off while the first stream is still live: its receive loop is
+	// blocked in ReceiveDatagram and must give way without closing the
+	// session.
+	oldLink := sess.link.Load()
+	client2, server2 := newTestTunnels(t, 7)
+	clientConn2, serverConn2 := newFakeDatagramPair()
+	if err := sess.Handoff(context.Background(), serverConn2, server2); err != nil {
+		t.Fatalf("handoff: %v", err)
+	}
+	select {
+	case <-oldLink.done:
+	default:
+		t.Fatal("old receive loop still running after handoff")
+	}
+	sess.waitStream(serverConn1)
+
+	if err := clientConn2.SendDatagram(encode(t, client2, testPacket(clientIP, remote, "two"))); err != nil {
+		t.Fatal(err)
+	}
+	fromTun("two")
+	st := sess.Stats()
+	if st.PacketsRecv != 2 || st.BytesRecv != uint64(2*len(testPacket(clientIP, remote, "one"))) {
+		t.Fatalf("stats after handoff %+v, want both links' packets", st)
+	}
+
+	// Datagrams sealed for the old tunnel are not accepted on the new link,
+	// and packets to the client are sealed for the new tunnel.
+	if err := clientConn2.SendDatagram(first); err != nil {
+		t.Fatal(err)
+	}
+	pkt := sess.pool.Get()
+	pkt = pkt[:copy(pkt, testPacket(remote, clientIP, "three"))]
+	if !sess.Enqueue(pkt) {
+		t.Fatal("enqueue failed")
+	}
+	got, err := client2.DecodeDatagram(clientConn2.receive(t))
+	if err != nil || string(got[20:]) != "three" {
+		t.Fatalf("client decode %q, %v", got, err)
+	}
+	select {
+	case pkt := <-tunCh:
+		t.Fatalf("old-tunnel datagram delivered on the new link: %q", pkt)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A late failure on the old stream leaves the session open.
+	if err := sess.linkFailed(oldLink, errors.New("stream reset")); !errors.Is(err, ErrUseNewStream) {
+		t.Fatalf("old link failure: got %v, want ErrUseNewStream", err)
+	}
+	select {
+	case err := <-closed:
+		t.Fatalf("session closed after handoff: %v", err)
+	case <-sess.closed:
+		t.Fatal("session closed after handoff")
+	default:
+	}
+
+	// A failure on the current stream still closes it.
+	if err := sess.linkFailed(sess.link.Load(), errors.New("stream reset")); err == nil {
+		t.Fatal("current link failure returned nil")
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session not closed by current link failure")
+	}
+	if err := sess.Handoff(context.Background(), serverConn1, server1); err == nil {
+		t.Fatal("handoff of a closed session succeeded")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSessionAnswersPing(t *testing.T) {
+	clientIP := net.IPv4(10, 8, 0, 2).To4()
+	client, server := newTestTunnels(t, 9)
+	clientConn, serverConn := newFakeDatagramPair()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	sess := newSession(9, clientIP, binary.BigEndian.Uint32(clientIP), "laptop", serverConn, server,
+		bufferpool.New(2048), bufferpool.New(2048), make(chan []byte, 1), nil, nil, 1, 16, 16, 1, testMetrics(), log,
+		func(*Session, error) {})
+	sess.Start(context.Background())
+	defer sess.Close(nil)
+
+	ponged := false
+	client.PongHandler = func() { ponged = true }
+	if err := client.SendPing(clientConn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.DecodeDatagram(clientConn.receive(t)); err != nil {
+		t.Fatal(err)
+	}
+	if !ponged || client.RTT() <= 0 {
+		t.Fatalf("pong not received: ponged=%v rtt=%v", ponged, client.RTT())
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// statsdMaxPacket keeps each datagram below a typical path MTU.
+const statsdMaxPacket = 1432
+
+// statsdClient writes metrics in the plain StatsD line format over UDP,
+// batching lines into as few datagrams as fit. It stands in for
+// github.com/cactus/go-statsd-client/v5, which the module proxy this tree is
+// built against does not serve (403); the output matches that client's
+// buffered sender, so it can be swapped in once the module is available.
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	buf    bytes.Buffer
+	// last holds the counter values of the previous flush; StatsD counters
+	// are deltas.
+	last map[string]float64
+}
+
+func newStatsdClient(addr, prefix string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("statsd dial: %w", err)
+	}
+	return &statsdClient{conn: conn, prefix: prefix, last: make(map[string]float64)}, nil
+}
+
+func (c *statsdClient) gauge(name string, v float64) error {
+	return c.line(name, v, "g")
+}
+
+// count emits the change of a cumulative counter since the last flush.
+func (c *statsdClient) count(name string, total float64) error {
+	delta := total - c.last[name]
+	c.last[name] = total
+	if delta <= 0 {
+		return nil
+	}
+	return c.line(name, delta, "c")
+}
+
+func (c *statsdClient) line(name string, v float64, typ string) error {
+	l := c.prefix + "." + name + ":" + strconv.FormatFloat(v, 'f', -1, 64) + "|" + typ
+	if c.buf.Len() > 0 && c.buf.Len()+1+len(l) > statsdMaxPacket {
+		if err := c.send(); err != nil {
+			return err
+		}
+	}
+	if c.buf.Len() > 0 {
+		c.buf.WriteByte('\n')
+	}
+	c.buf.WriteString(l)
+	return nil
+}
+
+func (c *statsdClient) send() error {
+	if c.buf.Len() == 0 {
+		return nil
+	}
+	_, err := c.conn.Write(c.buf.Bytes())
+	c.buf.Reset()
+	return err
+}
+
+// startStatsD pushes the session, packet, byte and drop metrics to
+// statsd_addr every stats_flush_interval, read from the Prometheus
+// collectors like the OTLP export.
+func (s *Server) startStatsD(ctx context.Context) (func(), error) {
+	c, err := newStatsdClient(s.cfg.StatsDAddr, s.cfg.StatsDPrefix)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(s.cfg.StatsFlushInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := s.metrics.flush(c); err != nil {
+					s.log.Debug("statsd flush failed", "err", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		_ = s.metrics.flush(c)
+		c.conn.Close()
+	}, nil
+}
+
+// flush writes the current metric values to c: sessions.active as a gauge,
+// and packets.<direction>, bytes.<direction> and drops.<reason> as counters.
+func (m *Metrics) flush(c *statsdClient) error {
+	var pm dto.Metric
+	if m.sessions.Write(&pm) == nil {
+		if err := c.gauge("sessions.active", pm.GetGauge().GetValue()); err != nil {
+			return err
+		}
+	}
+	for _, vec := range []struct {
+		name string
+		vec  *prometheus.CounterVec
+	}{{"packets", m.packets}, {"bytes", m.bytes}, {"drops", m.drops.CounterVec}} {
+		for label, v := range counterValues(vec.vec) {
+			if err := c.count(vec.name+"."+label, v); err != nil {
+				return err
+			}
+		}
+	}
+	return c.send()
+}
+
+// counterValues returns the value of every child of a single-label counter
+// vector, keyed by the label value.
+func counterValues(vec *prometheus.CounterVec) map[string]float64 {
+	ch := make(chan prometheus.Metric, 16)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+	out := make(map[string]float64)
+	for pm := range ch {
+		var m dto.Metric
+		if pm.Write(&m) != nil || m.Counter == nil || len(m.Label) == 0 {
+			continue
+		}
+		out[m.Label[0].GetValue()] = m.Counter.GetValue()
+	}
+	return out
+}
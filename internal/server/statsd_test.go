@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsdClientCounterDeltas(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	c, err := newStatsdClient(pc.LocalAddr().String(), "qdt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+
+	read := func() string {
+		buf := make([]byte, statsdMaxPacket)
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	c.gauge("sessions.active", 2)
+	c.count("packets.in", 10)
+	if err := c.send(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := read(), "qdt.sessions.active:2|g\nqdt.packets.in:10|c"; got != want {
+		t.Fatalf("first flush = %q, want %q", got, want)
+	}
+	c.count("packets.in", 25)
+	if err := c.send(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := read(), "qdt.packets.in:15|c"; got != want {
+		t.Fatalf("second flush = %q, want %q", got, want)
+	}
+}
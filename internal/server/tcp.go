@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"qdt/internal/transport"
+	"qdt/pkg/qdt"
+)
+
+// startTCPFallback accepts length-framed TLS TCP clients on
+// tcp_fallback_addr, for networks where UDP is blocked and WebSocket is not
+// an option. The handshake runs in-band as for WebSocket.
+func (s *Server) startTCPFallback(ctx context.Context, tlsConf *tls.Config) (net.Listener, error) {
+	conf := tlsConf.Clone()
+	conf.NextProtos = []string{transport.TCPALPN}
+	ln, err := tls.Listen("tcp", s.cfg.TCPFallbackAddr, conf)
+	if err != nil {
+		return nil, fmt.Errorf("tcp fallback listen: %w", err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					s.log.Error("tcp fallback accept failed", "err", err)
+				}
+				return
+			}
+			go s.tcpHandler(ctx, c)
+		}
+	}()
+	return ln, nil
+}
+
+func (s *Server) tcpHandler(ctx context.Context, c net.Conn) {
+	start := time.Now()
+	remote := remoteIP(c.RemoteAddr().String())
+	if !s.ready.Load() {
+		s.metrics.handshakes.WithLabelValues("not_ready").Inc()
+		logReject(s.log, "not_ready", remote, qdt.ConnectRequest{}, start)
+		c.Close()
+		return
+	}
+	if !s.hsLimit.Allow(remote) {
+		s.metrics.handshakes.WithLabelValues("rate_limited").Inc()
+		logReject(s.log, "rate_limited", remote, qdt.ConnectRequest{}, start)
+		c.Close()
+		return
+	}
+	s.serveInband(ctx, remote, transport.NewTCPConn(c))
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsConfig builds the server TLS config. With acme.domain set, certificates
+// are obtained and renewed through Let's Encrypt and the returned server
+// answers HTTP-01 challenges; it is nil otherwise. Static certificates are
+// reloaded from disk when they change, until ctx is done.
+func (s *Server) tlsConfig(ctx context.Context) (*tls.Config, *http.Server, error) {
+	if s.cfg.ACME.Domain != "" {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(s.cfg.ACME.Domain),
+			Email:      s.cfg.ACME.Email,
+			Cache:      autocert.DirCache(s.cfg.ACME.CacheDir),
+		}
+		conf := m.TLSConfig()
+		conf.NextProtos = []string{http3.NextProtoH3}
+		return conf, s.startACMEChallengeServer(m), nil
+	}
+
+	reloader, err := newCertReloader(s.cfg.TLSCert, s.cfg.TLSKey, s.log)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := reloader.watch(ctx); err != nil {
+		s.log.Warn("certificate watch disabled", "err", err)
+	}
+	return &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		NextProtos:     []string{http3.NextProtoH3},
+	}, nil, nil
+}
+
+// certReloader serves the current certificate to each handshake and swaps it
+// when the files on disk change. Established sessions keep their connection.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	log      *slog.Logger
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+func newCertReloader(certFile, keyFile string, log *slog.Logger) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, log: log}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load cert: %w", err)
+	}
+	r.cert.Store(&cert)
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// watch follows the parent directories rather than the files so renames and
+// symlink swaps, as done by most certificate tooling, are picked up.
+func (r *certReloader) watch(ctx context.Context) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("cert watcher: %w", err)
+	}
+	certFile, keyFile := filepath.Clean(r.certFile), filepath.Clean(r.keyFile)
+	for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return fmt.Errorf("watch %s: %w", dir, err)
+		}
+	}
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Clean(ev.Name)
+				if name != certFile && name != keyFile {
+					continue
+				}
+				if !ev.Has(fsnotify.Write) && !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Rename) {
+					continue
+				}
+				// A half-written pair fails to load; keep the old certificate
+				// until the matching file lands.
+				if err := r.reload(); err != nil {
+					r.log.Debug("certificate reload failed", "err", err)
+					continue
+				}
+				r.log.Info("certificate reloaded", "cert", r.certFile)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				r.log.Warn("certificate watch error", "err", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *Server) startACMEChallengeServer(m *autocert.Manager) *http.Server {
+	srv := &http.Server{
+		Addr:    ":" + strconv.Itoa(s.cfg.ACMEChallengePort),
+		Handler: m.HTTPHandler(nil),
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.log.Error("acme challenge server error", "err", err)
+		}
+	}()
+	return srv
+}
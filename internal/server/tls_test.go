@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertReloadOnChange(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := generateSelfSigned(certFile, keyFile); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	reloader, err := newCertReloader(certFile, keyFile, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("reloader: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := reloader.watch(ctx); err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: reloader.GetCertificate})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.(*tls.Conn).Handshake()
+			c.Close()
+		}
+	}()
+	peerCert := func() []byte {
+		c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer c.Close()
+		return c.ConnectionState().PeerCertificates[0].Raw
+	}
+
+	before := peerCert()
+	if err := generateSelfSigned(certFile, keyFile); err != nil {
+		t.Fatalf("regenerate: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		after := peerCert()
+		if !bytes.Equal(before, after) {
+			if !bytes.Equal(after, reloader.cert.Load().Certificate[0]) {
+				t.Fatalf("served certificate is not the reloaded one")
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate was not rotated")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultWatchdogTimeout is how long a session may go without its receive
+// or encode loop making progress before it is closed.
+const DefaultWatchdogTimeout = 5 * time.Minute
+
+var errWatchdogTimeout = errors.New("watchdog timeout")
+
+// watchdogDeadline is how long a session may go without receiving or sending
+// before the watchdog closes it. An idle session is silent too, so the
+// deadline is stretched to what the idle sweep allows: session_timeout, or
+// with keepalive the wait for a probe and its pong.
+func (c Config) watchdogDeadline() time.Duration {
+	if c.KeepaliveEnabled {
+		return max(c.WatchdogTimeout, 2*c.KeepaliveInterval+c.KeepaliveTimeout)
+	}
+	return max(c.WatchdogTimeout, c.SessionTimeout)
+}
+
+// watchdogLoop closes the session when kickWatchdog has not been called for
+// timeout, as when a half-open stream blocks ReceiveDatagram and no packet
+// for the client arrives either. It runs until the session closes, across
+// handoffs.
+func (s *Session) watchdogLoop(timeout time.Duration) {
+	t := time.AfterFunc(timeout, func() {
+		s.log.Warn("session watchdog fired", "timeout", timeout)
+		s.Close(errWatchdogTimeout)
+	})
+	defer t.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-s.watchdogReset:
+			t.Reset(timeout)
+		}
+	}
+}
+
+func (s *Session) kickWatchdog() {
+	select {
+	case s.watchdogReset <- struct{}{}:
+	default:
+	}
+}
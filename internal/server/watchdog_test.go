@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"qdt/internal/bufferpool"
+)
+
+func TestWatchdogDeadline(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		want time.Duration
+	}{
+		{"watchdog longer", Config{WatchdogTimeout: 5 * time.Minute, SessionTimeout: 2 * time.Minute}, 5 * time.Minute},
+		{"session timeout longer", Config{WatchdogTimeout: time.Minute, SessionTimeout: 10 * time.Minute}, 10 * time.Minute},
+		{"keepalive", Config{WatchdogTimeout: time.Minute, SessionTimeout: 10 * time.Minute, KeepaliveEnabled: true,
+			KeepaliveInterval: 45 * time.Second, KeepaliveTimeout: 10 * time.Second}, 100 * time.Second},
+	} {
+		if got := tc.cfg.watchdogDeadline(); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestWatchdogIdleSession checks that an idle session outlives
+// watchdog_timeout when session_timeout is longer and keepalive is off.
+func TestWatchdogIdleSession(t *testing.T) {
+	cfg := Config{WatchdogTimeout: 50 * time.Millisecond, SessionTimeout: 300 * time.Millisecond}
+	clientIP := net.IPv4(10, 8, 0, 3).To4()
+	_, server := newTestTunnels(t, 10)
+	_, serverConn := newFakeDatagramPair()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	closed := make(chan error, 1)
+	sess := newSession(10, clientIP, binary.BigEndian.Uint32(clientIP), "laptop", serverConn, server,
+		bufferpool.New(2048), bufferpool.New(2048), make(chan []byte, 1), nil, nil, 1, 16, 16, 1, testMetrics(), log,
+		func(_ *Session, err error) { closed <- err })
+	sess.watchdogTimeout = cfg.watchdogDeadline()
+	sess.Start(context.Background())
+	defer sess.Close(nil)
+
+	select {
+	case err := <-closed:
+		t.Fatalf("idle session closed after watchdog_timeout: %v", err)
+	case <-time.After(150 * time.Millisecond):
+	}
+	select {
+	case err := <-closed:
+		if !errors.Is(err, errWatchdogTimeout) {
+			t.Fatalf("closed with %v, want watchdog timeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stalled session was not closed")
+	}
+}
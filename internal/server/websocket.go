@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"nhooyr.io/websocket"
+
+	"qdt/internal/transport"
+	"qdt/pkg/qdt"
+)
+
+const inbandHandshakeTimeout = 10 * time.Second
+
+// startWebSocketServer serves the WebSocket fallback over TLS on the TCP side
+// of the listen address, for clients whose UDP is blocked.
+func (s *Server) startWebSocketServer(tlsConf *tls.Config) *http.Server {
+	conf := tlsConf.Clone()
+	conf.NextProtos = []string{"http/1.1"}
+	mux := http.NewServeMux()
+	mux.HandleFunc(qdt.WebSocketPath, s.wsHandler)
+	srv := &http.Server{Addr: s.cfg.Addr, Handler: mux, TLSConfig: conf}
+	go func() {
+		if err := srv.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.log.Error("websocket server error", "err", err)
+		}
+	}()
+	return srv
+}
+
+// inbandConn is a stream transport that carries the connect handshake as
+// its first messages.
+type inbandConn interface {
+	qdt.DatagramConn
+	CloseWithReason(reason string) error
+	Close() error
+}
+
+func (s *Server) wsHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	remote := remoteIP(r.RemoteAddr)
+	reject := func(reason string) {
+		s.metrics.handshakes.WithLabelValues(reason).Inc()
+		logReject(s.log, reason, remote, qdt.ConnectRequest{}, start)
+	}
+	if !s.ready.Load() {
+		reject("not_ready")
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	if !s.hsLimit.Allow(remote) {
+		reject("rate_limited")
+		http.Error(w, "rate limited", http.StatusTooManyRequests)
+		return
+	}
+	c, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		reject("bad_request")
+		return
+	}
+	s.serveInband(r.Context(), remote, transport.NewWSConn(c))
+}
+
+// serveInband runs the connect handshake in-band: the client sends its token
+// and then the connect request as messages, and the server answers with the
+// connect response before datagrams flow. It returns when the session ends.
+func (s *Server) serveInband(ctx context.Context, remote string, conn inbandConn) {
+	defer conn.Close()
+	start := time.Now()
+	id := newRequestID()
+	log := s.log.With("request_id", id)
+	var req qdt.ConnectRequest
+	reject := func(reason, msg string) {
+		s.metrics.handshakes.WithLabelValues(reason).Inc()
+		logReject(log, reason, remote, req, start)
+		_ = conn.CloseWithReason(msg)
+	}
+
+	hsCtx, cancel := context.WithTimeout(ctx, inbandHandshakeTimeout)
+	token, err := conn.ReceiveDatagram(hsCtx)
+	if err != nil {
+		cancel()
+		reject("bad_request", "bad request")
+		return
+	}
+	body, err := conn.ReceiveDatagram(hsCtx)
+	cancel()
+	if err != nil {
+		reject("bad_request", "bad request")
+		return
+	}
+	subject, ok := s.authenticate(string(token))
+	if !ok {
+		reject("unauthorized", "unauthorized")
+		return
+	}
+	if s.cfg.MaxSessions > 0 && s.activeSessions.Load() >= int64(s.cfg.MaxSessions) {
+		reject("busy", "server busy")
+		return
+	}
+	req, err = qdt.DecodeConnectRequest(bytes.NewReader(body))
+	if err != nil {
+		reject("bad_request", "bad request")
+		return
+	}
+	sess, handoff, resp, rej := s.establishSession(remote, string(token), subject, req, conn)
+	if rej != nil {
+		reject(rej.reason, rej.msg)
+		return
+	}
+	resp.RequestID = id
+	logAccept(log, remote, req, resp, start)
+	payload, err := json.Marshal(resp)
+	if err == nil {
+		err = conn.SendDatagram(payload)
+	}
+	if err != nil {
+		sess.log.Error("connect response failed", "err", err)
+		if handoff == nil {
+			sess.Close(err)
+		}
+		return
+	}
+	s.runSession(ctx, sess, conn, handoff)
+}
@@ -0,0 +1,43 @@
+// Package shaper paces per-session packet rates. A *rate.Limiter is the
+// token bucket Shaper, which lets bursts through; LeakyBucket spaces
+// packets evenly, which suits constant-rate traffic such as video.
+package shaper
+
+import (
+	"sync"
+	"time"
+)
+
+// Shaper reports whether one more packet may pass now.
+type Shaper interface {
+	Allow() bool
+}
+
+// LeakyBucket releases one permit every 1/pps seconds and keeps at most one
+// pending, so an idle session cannot save up a burst. Permits follow a
+// fixed schedule computed from the clock rather than a ticker, so a bucket
+// needs no goroutine.
+type LeakyBucket struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func NewLeakyBucket(pps int) *LeakyBucket {
+	return &LeakyBucket{interval: time.Second / time.Duration(pps)}
+}
+
+func (b *LeakyBucket) Allow() bool {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Before(b.next) {
+		return false
+	}
+	if now.Sub(b.next) >= b.interval {
+		// Idle for more than a slot: only the one pending permit is left.
+		b.next = now
+	}
+	b.next = b.next.Add(b.interval)
+	return true
+}
@@ -0,0 +1,21 @@
+package shaper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeakyBucketNoBurst(t *testing.T) {
+	b := NewLeakyBucket(100)
+	time.Sleep(50 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("first packet denied")
+	}
+	if b.Allow() {
+		t.Fatal("idle bucket allowed a burst")
+	}
+	time.Sleep(12 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("packet after one interval denied")
+	}
+}
@@ -0,0 +1,105 @@
+// Package testutil holds helpers shared by tests.
+package testutil
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// DatagramConn is qdt.DatagramConn, restated so that package qdt's own tests
+// can import this package.
+type DatagramConn interface {
+	SendDatagram([]byte) error
+	ReceiveDatagram(context.Context) ([]byte, error)
+}
+
+// ChaosProxy wraps a DatagramConn to simulate a bad network. Sent datagrams
+// are dropped with probability DropRate, delayed by up to MaxDelayMs, or held
+// back with probability ReorderRate and released in shuffled order once
+// ReorderBufferSize are held or an in-order datagram overtakes them.
+// Received datagrams are returned twice with probability DuplicateRate.
+// Rates are in [0, 1]; the fields must be set before first use.
+type ChaosProxy struct {
+	Conn              DatagramConn
+	DropRate          float64
+	ReorderRate       float64
+	ReorderBufferSize int
+	DuplicateRate     float64
+	MaxDelayMs        int
+
+	mu   sync.Mutex
+	rng  *rand.Rand
+	held [][]byte
+	dup  []byte
+}
+
+// NewChaosProxy returns a proxy over conn whose choices are reproducible for
+// a given seed.
+func NewChaosProxy(conn DatagramConn, seed uint64) *ChaosProxy {
+	return &ChaosProxy{Conn: conn, rng: rand.New(rand.NewPCG(seed, seed))}
+}
+
+func (p *ChaosProxy) SendDatagram(b []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rng.Float64() < p.DropRate {
+		return nil
+	}
+	if p.MaxDelayMs > 0 {
+		time.Sleep(time.Duration(p.rng.IntN(p.MaxDelayMs+1)) * time.Millisecond)
+	}
+	if p.rng.Float64() < p.ReorderRate {
+		p.held = append(p.held, append([]byte(nil), b...))
+		if len(p.held) < max(p.ReorderBufferSize, 1) {
+			return nil
+		}
+		return p.flushLocked()
+	}
+	if err := p.Conn.SendDatagram(b); err != nil {
+		return err
+	}
+	return p.flushLocked()
+}
+
+// Flush sends the datagrams still held back for reordering.
+func (p *ChaosProxy) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.flushLocked()
+}
+
+func (p *ChaosProxy) flushLocked() error {
+	p.rng.Shuffle(len(p.held), func(i, j int) {
+		p.held[i], p.held[j] = p.held[j], p.held[i]
+	})
+	held := p.held
+	p.held = nil
+	for _, b := range held {
+		if err := p.Conn.SendDatagram(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *ChaosProxy) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	p.mu.Lock()
+	if b := p.dup; b != nil {
+		p.dup = nil
+		p.mu.Unlock()
+		return b, nil
+	}
+	p.mu.Unlock()
+	b, err := p.Conn.ReceiveDatagram(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	if p.rng.Float64() < p.DuplicateRate {
+		p.dup = append([]byte(nil), b...)
+	}
+	p.mu.Unlock()
+	return b, nil
+}
@@ -0,0 +1,255 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// masqueInitialPacketSize leaves room in each proxy packet for a datagram
+// carrying a full-sized inner QUIC packet of MASQUEPacketSize bytes.
+const masqueInitialPacketSize = 1350
+
+// MASQUEPacketSize is the QUIC packet size to use for connections relayed
+// with DialMASQUE; larger packets would not fit in a proxy datagram.
+const MASQUEPacketSize = 1200
+
+// MASQUEDatagramSize is the largest datagram payload a connection with
+// MASQUEPacketSize packets can send: the short header with a 20 byte
+// connection ID and 4 byte packet number, the DATAGRAM frame header and the
+// AEAD tag take the rest.
+const MASQUEDatagramSize = MASQUEPacketSize - (1 + 20 + 4 + 3 + 16)
+
+var ErrMASQUEUnsupported = errors.New("proxy does not support extended CONNECT with HTTP datagrams")
+
+// DialMASQUE asks the MASQUE proxy at proxy (host:port) to relay UDP to
+// target (host:port) with CONNECT-UDP (RFC 9298), and returns a PacketConn
+// whose datagrams travel as HTTP datagrams on that request. Only target is
+// reachable through it. tlsConf verifies the proxy; its NextProtos are
+// replaced with h3. Closing the conn closes the proxy connection.
+func DialMASQUE(ctx context.Context, proxy, target string, tlsConf *tls.Config) (net.PacketConn, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("target: %w", err)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, fmt.Errorf("resolve target: %w", err)
+	}
+	conf := tlsConf.Clone()
+	conf.NextProtos = []string{http3.NextProtoH3}
+	conn, err := quic.DialAddr(ctx, proxy, conf, &quic.Config{
+		EnableDatagrams:   true,
+		InitialPacketSize: masqueInitialPacketSize,
+		KeepAlivePeriod:   15 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy: %w", err)
+	}
+	fail := func(err error) (net.PacketConn, error) {
+		_ = conn.CloseWithError(0, "")
+		return nil, err
+	}
+
+	tr := &http3.Transport{EnableDatagrams: true}
+	cc := tr.NewClientConn(conn)
+	select {
+	case <-ctx.Done():
+		return fail(ctx.Err())
+	case <-cc.Context().Done():
+		return fail(fmt.Errorf("proxy closed the connection: %w", context.Cause(cc.Context())))
+	case <-cc.ReceivedSettings():
+	}
+	if s := cc.Settings(); !s.EnableExtendedConnect || !s.EnableDatagrams {
+		return fail(ErrMASQUEUnsupported)
+	}
+
+	str, err := cc.OpenRequestStream(ctx)
+	if err != nil {
+		return fail(fmt.Errorf("open request stream: %w", err))
+	}
+	u := &url.URL{
+		Scheme: "https",
+		Host:   proxy,
+		Path:   "/.well-known/masque/udp/" + url.PathEscape(host) + "/" + port + "/",
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Proto:  "connect-udp",
+		Host:   proxy,
+		URL:    u,
+		Header: http.Header{"Capsule-Protocol": {"?1"}},
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		_ = str.SetDeadline(dl)
+	}
+	if err := str.SendRequestHeader(req); err != nil {
+		return fail(fmt.Errorf("send connect-udp: %w", err))
+	}
+	resp, err := str.ReadResponse()
+	if err != nil {
+		return fail(fmt.Errorf("read connect-udp response: %w", err))
+	}
+	_ = str.SetDeadline(time.Time{})
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fail(fmt.Errorf("proxy refused connect-udp: %s", resp.Status))
+	}
+
+	c := &masquePacketConn{conn: conn, str: str, raddr: raddr, writes: make(chan masqueWrite)}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	go c.writeLoop()
+	return c, nil
+}
+
+// masquePacketConn relays datagrams to a single target over a CONNECT-UDP
+// request stream. Each HTTP datagram starts with context ID 0 followed by
+// the UDP payload.
+type masquePacketConn struct {
+	conn  *quic.Conn
+	str   *http3.RequestStream
+	raddr *net.UDPAddr
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	writes    chan masqueWrite
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// masqueWrite is a datagram handed to writeLoop by a WriteTo with a deadline.
+type masqueWrite struct {
+	b    []byte
+	errc chan error
+}
+
+// writeLoop sends the datagrams of writes that have a deadline, so that
+// WriteTo can give up on a send blocked by a full queue.
+func (c *masquePacketConn) writeLoop() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case w := <-c.writes:
+			w.errc <- c.str.SendDatagram(w.b)
+		}
+	}
+}
+
+// WriteTo blocks while the datagram send queue is full. Past the write
+// deadline it returns os.ErrDeadlineExceeded; the datagram may still be sent
+// once the queue drains.
+func (c *masquePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	buf := make([]byte, 0, 1+len(p))
+	buf = quicvarint.Append(buf, 0)
+	buf = append(buf, p...)
+	if deadline.IsZero() {
+		if err := c.str.SendDatagram(buf); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return 0, os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	w := masqueWrite{b: buf, errc: make(chan error, 1)}
+	select {
+	case c.writes <- w:
+	case <-c.ctx.Done():
+		return 0, net.ErrClosed
+	case <-timer.C:
+		return 0, os.ErrDeadlineExceeded
+	}
+	select {
+	case err := <-w.errc:
+		if err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	case <-timer.C:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *masquePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+	ctx := c.ctx
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	for {
+		b, err := c.str.ReceiveDatagram(ctx)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			if c.ctx.Err() != nil {
+				return 0, nil, net.ErrClosed
+			}
+			return 0, nil, err
+		}
+		id, n, err := quicvarint.Parse(b)
+		if err != nil || id != 0 {
+			// Unknown context IDs are dropped, as RFC 9298 requires.
+			continue
+		}
+		return copy(p, b[n:]), c.raddr, nil
+	}
+}
+
+func (c *masquePacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+		_ = c.str.Close()
+		_ = c.conn.CloseWithError(0, "")
+	})
+	return nil
+}
+
+func (c *masquePacketConn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+func (c *masquePacketConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *masquePacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+func (c *masquePacketConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
@@ -0,0 +1,207 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// masqueProxy serves CONNECT-UDP on an in-process HTTP/3 server. Before each
+// datagram from the target it sends one with context ID 1, which clients
+// must drop.
+func masqueProxy(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http3.Server{
+		TLSConfig:       http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}),
+		QUICConfig:      &quic.Config{EnableDatagrams: true},
+		EnableDatagrams: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+			if r.Method != http.MethodConnect || r.Proto != "connect-udp" || len(parts) != 5 || parts[0] != ".well-known" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			target, err := net.Dial("udp", net.JoinHostPort(parts[3], parts[4]))
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer target.Close()
+			w.Header().Set("Capsule-Protocol", "?1")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			str := w.(http3.HTTPStreamer).HTTPStream()
+			go func() {
+				buf := make([]byte, 1500)
+				for {
+					n, err := target.Read(buf)
+					if err != nil {
+						return
+					}
+					_ = str.SendDatagram(append(quicvarint.Append(nil, 1), "junk"...))
+					_ = str.SendDatagram(append(quicvarint.Append(nil, 0), buf[:n]...))
+				}
+			}()
+			for {
+				b, err := str.ReceiveDatagram(r.Context())
+				if err != nil {
+					return
+				}
+				id, n, err := quicvarint.Parse(b)
+				if err != nil || id != 0 {
+					continue
+				}
+				_, _ = target.Write(b[n:])
+			}
+		}),
+	}
+	go srv.Serve(pc)
+	t.Cleanup(func() { srv.Close() })
+	return pc.LocalAddr().String()
+}
+
+func TestMASQUERoundTrip(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pc, err := DialMASQUE(ctx, masqueProxy(t), echo.LocalAddr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for _, msg := range []string{"first", "second"} {
+		if _, err := pc.WriteTo([]byte(msg), echo.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg || addr.String() != echo.LocalAddr().String() {
+			t.Fatalf("got %q from %v, want %q from %v", buf[:n], addr, msg, echo.LocalAddr())
+		}
+	}
+
+	pc.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, _, err := pc.ReadFrom(make([]byte, 1500)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past deadline: got %v", err)
+	}
+	pc.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := pc.WriteTo([]byte("late"), echo.LocalAddr()); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write past deadline: got %v", err)
+	}
+	pc.Close()
+	if _, _, err := pc.ReadFrom(make([]byte, 1500)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("read after close: got %v", err)
+	}
+}
+
+// TestMASQUEInnerQUIC checks that a QUIC connection relayed with the packet
+// size the client uses can carry datagrams of MASQUEDatagramSize.
+func TestMASQUEInnerQUIC(t *testing.T) {
+	cert := testCertificate(t)
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"test"}}, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		for {
+			b, err := conn.ReceiveDatagram(context.Background())
+			if err != nil {
+				return
+			}
+			conn.SendDatagram(b)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	raddr := ln.Addr().(*net.UDPAddr)
+	pc, err := DialMASQUE(ctx, masqueProxy(t), raddr.String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer pc.Close()
+	conn, err := quic.Dial(ctx, pc, raddr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"test"}}, &quic.Config{
+		EnableDatagrams:         true,
+		InitialPacketSize:       MASQUEPacketSize,
+		DisablePathMTUDiscovery: true,
+	})
+	if err != nil {
+		t.Fatalf("dial through proxy: %v", err)
+	}
+	defer conn.CloseWithError(0, "")
+	dg := bytes.Repeat([]byte{0xa5}, MASQUEDatagramSize)
+	if err := conn.SendDatagram(dg); err != nil {
+		t.Fatalf("send %d byte datagram: %v", len(dg), err)
+	}
+	got, err := conn.ReceiveDatagram(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dg) {
+		t.Fatalf("echo of %d bytes, want %d", len(got), len(dg))
+	}
+}
@@ -0,0 +1,285 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	socksVersion      = 0x05
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksAuthNoAccept = 0xff
+	socksCmdUDP       = 0x03
+	socksAtypIPv4     = 0x01
+	socksAtypDomain   = 0x03
+	socksAtypIPv6     = 0x04
+	socksRepNotSupp   = 0x07
+)
+
+var ErrUDPAssociateUnsupported = errors.New("socks5 proxy does not support UDP ASSOCIATE; QUIC requires UDP associate, a CONNECT-only proxy cannot be used")
+
+// DialSOCKS5UDP opens a UDP association through the SOCKS5 proxy described by
+// proxyURL (socks5://[user:pass@]host:port) and returns a PacketConn that
+// relays datagrams through it. The association lives as long as the returned
+// conn; closing it tears down the proxy control connection.
+func DialSOCKS5UDP(ctx context.Context, proxyURL string) (net.PacketConn, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse proxy url: %w", err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("unsupported proxy scheme: %q", u.Scheme)
+	}
+	var d net.Dialer
+	ctrl, err := d.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy: %w", err)
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		_ = ctrl.SetDeadline(dl)
+	}
+	relay, err := socksAssociate(ctrl, u.User)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	_ = ctrl.SetDeadline(time.Time{})
+	if relay.IP.IsUnspecified() {
+		if tcpAddr, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			relay.IP = tcpAddr.IP
+		}
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("listen udp: %w", err)
+	}
+	c := &socksPacketConn{udp: udp, ctrl: ctrl, relay: relay}
+	go func() {
+		// The association ends when the control connection closes.
+		_, _ = io.Copy(io.Discard, ctrl)
+		_ = c.Close()
+	}()
+	return c, nil
+}
+
+func socksAssociate(conn net.Conn, user *url.Userinfo) (*net.UDPAddr, error) {
+	methods := []byte{socksAuthNone}
+	if user != nil {
+		methods = append(methods, socksAuthPassword)
+	}
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return nil, fmt.Errorf("socks5 greeting: %w", err)
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return nil, fmt.Errorf("socks5 greeting: %w", err)
+	}
+	if resp[0] != socksVersion {
+		return nil, fmt.Errorf("socks5: unexpected version %d", resp[0])
+	}
+	switch resp[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if err := socksPasswordAuth(conn, user); err != nil {
+			return nil, err
+		}
+	case socksAuthNoAccept:
+		return nil, fmt.Errorf("socks5: no acceptable auth method")
+	default:
+		return nil, fmt.Errorf("socks5: unsupported auth method %d", resp[1])
+	}
+
+	req := []byte{socksVersion, socksCmdUDP, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("socks5 udp associate: %w", err)
+	}
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, fmt.Errorf("socks5 udp associate: %w", err)
+	}
+	if hdr[1] == socksRepNotSupp {
+		return nil, ErrUDPAssociateUnsupported
+	}
+	if hdr[1] != 0x00 {
+		return nil, fmt.Errorf("socks5 udp associate failed: reply code %d", hdr[1])
+	}
+	ip, port, err := readSocksAddr(conn, hdr[3])
+	if err != nil {
+		return nil, fmt.Errorf("socks5 udp associate: %w", err)
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+func socksPasswordAuth(conn net.Conn, user *url.Userinfo) error {
+	if user == nil {
+		return fmt.Errorf("socks5: proxy requires credentials")
+	}
+	name := user.Username()
+	pass, _ := user.Password()
+	if len(name) > 255 || len(pass) > 255 {
+		return fmt.Errorf("socks5: credentials too long")
+	}
+	msg := []byte{0x01, byte(len(name))}
+	msg = append(msg, name...)
+	msg = append(msg, byte(len(pass)))
+	msg = append(msg, pass...)
+	if _, err := conn.Write(msg); err != nil {
+		return fmt.Errorf("socks5 auth: %w", err)
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return fmt.Errorf("socks5 auth: %w", err)
+	}
+	if resp[1] != 0x00 {
+		return fmt.Errorf("socks5: authentication failed")
+	}
+	return nil
+}
+
+func readSocksAddr(r io.Reader, atyp byte) (net.IP, int, error) {
+	var ip net.IP
+	switch atyp {
+	case socksAtypIPv4:
+		ip = make(net.IP, net.IPv4len)
+	case socksAtypIPv6:
+		ip = make(net.IP, net.IPv6len)
+	case socksAtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return nil, 0, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, 0, err
+		}
+		addrs, err := net.LookupIP(string(name))
+		if err != nil || len(addrs) == 0 {
+			return nil, 0, fmt.Errorf("resolve relay %q: %w", name, err)
+		}
+		ip = addrs[0]
+	default:
+		return nil, 0, fmt.Errorf("unknown address type %d", atyp)
+	}
+	if atyp != socksAtypDomain {
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, 0, err
+		}
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, 0, err
+	}
+	return ip, int(binary.BigEndian.Uint16(port[:])), nil
+}
+
+// socksPacketConn wraps each datagram in the SOCKS5 UDP request header. The
+// UDP socket is not embedded so quic-go cannot bypass the framing through the
+// OOB-capable *net.UDPConn methods.
+type socksPacketConn struct {
+	udp       *net.UDPConn
+	ctrl      net.Conn
+	relay     *net.UDPAddr
+	mu        sync.Mutex
+	readBuf   []byte
+	closeOnce sync.Once
+}
+
+func (c *socksPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("socks5: unsupported address %T", addr)
+	}
+	b := appendSocksUDPHeader(make([]byte, 0, 22+len(p)), udpAddr)
+	if _, err := c.udp.WriteTo(append(b, p...), c.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *socksPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cap(c.readBuf) < len(p)+262 {
+		c.readBuf = make([]byte, len(p)+262)
+	}
+	buf := c.readBuf[:cap(c.readBuf)]
+	for {
+		n, from, err := c.udp.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Only the relay may send to the association; anything else could be
+		// injected by an off-path sender.
+		if from.Port != c.relay.Port || !from.IP.Equal(c.relay.IP) {
+			continue
+		}
+		payload, src, ok := parseSocksUDP(buf[:n])
+		if !ok {
+			continue
+		}
+		return copy(p, payload), src, nil
+	}
+}
+
+// appendSocksUDPHeader appends the SOCKS5 UDP request header for addr:
+// RSV[2] FRAG[1] ATYP[1] DST.ADDR DST.PORT[2].
+func appendSocksUDPHeader(b []byte, addr *net.UDPAddr) []byte {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = append(append(b, 0, 0, 0, socksAtypIPv4), ip4...)
+	} else {
+		b = append(append(b, 0, 0, 0, socksAtypIPv6), addr.IP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+}
+
+// parseSocksUDP splits a datagram from the relay into its payload and source
+// address. Fragmented datagrams (FRAG != 0) and domain addresses are not
+// supported and reported as !ok.
+func parseSocksUDP(b []byte) ([]byte, *net.UDPAddr, bool) {
+	if len(b) < 4 || b[2] != 0 {
+		return nil, nil, false
+	}
+	var ip net.IP
+	off := 4
+	switch b[3] {
+	case socksAtypIPv4:
+		ip = make(net.IP, net.IPv4len)
+	case socksAtypIPv6:
+		ip = make(net.IP, net.IPv6len)
+	default:
+		return nil, nil, false
+	}
+	if len(b) < off+len(ip)+2 {
+		return nil, nil, false
+	}
+	off += copy(ip, b[off:])
+	port := int(binary.BigEndian.Uint16(b[off : off+2]))
+	return b[off+2:], &net.UDPAddr{IP: ip, Port: port}, true
+}
+
+func (c *socksPacketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		_ = c.ctrl.Close()
+		err = c.udp.Close()
+	})
+	return err
+}
+
+func (c *socksPacketConn) LocalAddr() net.Addr { return c.udp.LocalAddr() }
+
+func (c *socksPacketConn) SetDeadline(t time.Time) error { return c.udp.SetDeadline(t) }
+
+func (c *socksPacketConn) SetReadDeadline(t time.Time) error { return c.udp.SetReadDeadline(t) }
+
+func (c *socksPacketConn) SetWriteDeadline(t time.Time) error { return c.udp.SetWriteDeadline(t) }
@@ -0,0 +1,122 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// socksStub accepts one UDP ASSOCIATE and answers with the address of relay.
+func socksStub(t *testing.T, relay *net.UDPConn) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		var greet [2]byte
+		if _, err := io.ReadFull(conn, greet[:]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, greet[1])); err != nil {
+			return
+		}
+		conn.Write([]byte{socksVersion, socksAuthNone})
+		var req [10]byte
+		if _, err := io.ReadFull(conn, req[:]); err != nil || req[1] != socksCmdUDP {
+			return
+		}
+		addr := relay.LocalAddr().(*net.UDPAddr)
+		reply := append([]byte{socksVersion, 0, 0, socksAtypIPv4}, addr.IP.To4()...)
+		conn.Write(binary.BigEndian.AppendUint16(reply, uint16(addr.Port)))
+	}()
+	return "socks5://" + ln.Addr().String()
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pc, err := DialSOCKS5UDP(ctx, socksStub(t, relay))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	relay.SetDeadline(time.Now().Add(5 * time.Second))
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 4433}
+	if _, err := pc.WriteTo([]byte("ping"), target); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, client, err := relay.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, dst, ok := parseSocksUDP(buf[:n])
+	if !ok || string(payload) != "ping" || !dst.IP.Equal(target.IP) || dst.Port != target.Port {
+		t.Fatalf("relay got %q for %v", payload, dst)
+	}
+
+	// A datagram from anyone but the relay and a fragmented reply are
+	// dropped; the following valid reply is returned.
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := other.WriteTo(append(appendSocksUDPHeader(nil, target), "spoof"...), client); err != nil {
+		t.Fatal(err)
+	}
+	frag := appendSocksUDPHeader(nil, target)
+	frag[2] = 1
+	if _, err := relay.WriteTo(append(frag, "frag"...), client); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := relay.WriteTo(append(appendSocksUDPHeader(nil, target), "pong"...), client); err != nil {
+		t.Fatal(err)
+	}
+	n, src, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "pong" || src.String() != target.String() {
+		t.Fatalf("got %q from %v", buf[:n], src)
+	}
+}
+
+func TestSOCKS5UDPHeader(t *testing.T) {
+	for _, addr := range []*net.UDPAddr{
+		{IP: net.IPv4(198, 51, 100, 1), Port: 443},
+		{IP: net.ParseIP("2001:db8::1"), Port: 65535},
+	} {
+		b := append(appendSocksUDPHeader(nil, addr), "data"...)
+		payload, src, ok := parseSocksUDP(b)
+		if !ok || !bytes.Equal(payload, []byte("data")) || !src.IP.Equal(addr.IP) || src.Port != addr.Port {
+			t.Fatalf("%v: got %q from %v ok=%v", addr, payload, src, ok)
+		}
+		b[2] = 1
+		if _, _, ok := parseSocksUDP(b); ok {
+			t.Fatalf("%v: fragmented datagram accepted", addr)
+		}
+		b[2] = 0
+		if _, _, ok := parseSocksUDP(b[:5]); ok {
+			t.Fatalf("%v: truncated datagram accepted", addr)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"qdt/pkg/qdt"
+)
+
+// TCPALPN is negotiated on the TLS connection of the TCP fallback.
+const TCPALPN = "qdt-tcp"
+
+const tcpMaxFrame = 65535
+
+// tcpWriteTimeout bounds each frame write, so a peer that stops reading
+// fails the connection instead of blocking the sender.
+const tcpWriteTimeout = 10 * time.Second
+
+// TCPConn carries QDT datagrams over a TLS TCP connection, each prefixed
+// with its length as a 4-byte big-endian integer. It is the last resort when
+// neither QUIC nor WebSocket can connect.
+type TCPConn struct {
+	c            net.Conn
+	r            *bufio.Reader
+	wmu          sync.Mutex
+	writeTimeout time.Duration
+}
+
+func NewTCPConn(c net.Conn) *TCPConn {
+	return &TCPConn{c: c, r: bufio.NewReader(c), writeTimeout: tcpWriteTimeout}
+}
+
+// DialTCP opens a TLS connection to addr (host:port).
+func DialTCP(ctx context.Context, addr string, tlsConf *tls.Config) (qdt.DatagramConn, error) {
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{TCPALPN}
+	d := &tls.Dialer{Config: tlsConf}
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("tcp dial: %w", err)
+	}
+	return NewTCPConn(c), nil
+}
+
+// SendDatagram writes b as one frame. A write that times out may leave a
+// partial frame behind, so the connection must be closed after an error.
+func (t *TCPConn) SendDatagram(b []byte) error {
+	if len(b) > tcpMaxFrame {
+		return fmt.Errorf("datagram too large: %d bytes", len(b))
+	}
+	frame := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	copy(frame[4:], b)
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	if err := t.c.SetWriteDeadline(time.Now().Add(t.writeTimeout)); err != nil {
+		return err
+	}
+	_, err := t.c.Write(frame)
+	return err
+}
+
+// ReceiveDatagram reads the next frame. It must not be called concurrently.
+func (t *TCPConn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	// Cancellation interrupts the read through the deadline, which is
+	// cleared again if it fired after the frame was read.
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		t.c.SetReadDeadline(time.Now())
+		close(fired)
+	})
+	defer func() {
+		if !stop() {
+			<-fired
+			t.c.SetReadDeadline(time.Time{})
+		}
+	}()
+	var hdr [4]byte
+	if _, err := io.ReadFull(t.r, hdr[:]); err != nil {
+		return nil, t.readErr(ctx, err)
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > tcpMaxFrame {
+		return nil, fmt.Errorf("frame too large: %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(t.r, b); err != nil {
+		return nil, t.readErr(ctx, err)
+	}
+	return b, nil
+}
+
+func (t *TCPConn) readErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// CloseWithReason closes the connection. Unlike WebSocket, plain TCP has no
+// way to carry the reason to the peer.
+func (t *TCPConn) CloseWithReason(reason string) error {
+	return t.c.Close()
+}
+
+func (t *TCPConn) Close() error {
+	return t.c.Close()
+}
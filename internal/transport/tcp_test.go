@@ -0,0 +1,64 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTCPRoundTrip(t *testing.T) {
+	ca, cb := net.Pipe()
+	a, b := NewTCPConn(ca), NewTCPConn(cb)
+	defer a.Close()
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, msg := range [][]byte{[]byte("ping"), {}, bytes.Repeat([]byte{0x5a}, tcpMaxFrame)} {
+		errc := make(chan error, 1)
+		go func() { errc <- a.SendDatagram(msg) }()
+		got, err := b.ReceiveDatagram(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("received %d bytes, want %d", len(got), len(msg))
+		}
+	}
+	if err := a.SendDatagram(make([]byte, tcpMaxFrame+1)); err == nil {
+		t.Fatal("oversized datagram sent")
+	}
+
+	// A cancelled receive returns and leaves the connection usable.
+	rctx, rcancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer rcancel()
+	if _, err := b.ReceiveDatagram(rctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("cancelled receive: got %v", err)
+	}
+	go a.SendDatagram([]byte("after"))
+	if got, err := b.ReceiveDatagram(ctx); err != nil || string(got) != "after" {
+		t.Fatalf("receive after cancel: %q, %v", got, err)
+	}
+}
+
+func TestTCPWriteTimeout(t *testing.T) {
+	ca, cb := net.Pipe()
+	defer cb.Close()
+	a := NewTCPConn(ca)
+	defer a.Close()
+	a.writeTimeout = 50 * time.Millisecond
+	// Nothing reads from the other end of the pipe.
+	start := time.Now()
+	if err := a.SendDatagram([]byte("stalled")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want a deadline error", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("write failed after %v", d)
+	}
+}
@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"nhooyr.io/websocket"
+
+	"qdt/pkg/qdt"
+)
+
+const wsReadLimit = 65535
+
+// wsWriteTimeout bounds each write, so a peer that stops reading fails the
+// connection instead of blocking the sender.
+const wsWriteTimeout = 10 * time.Second
+
+// WSConn carries QDT datagrams as binary WebSocket messages. It is used when
+// UDP is blocked and QUIC cannot connect.
+type WSConn struct {
+	c            *websocket.Conn
+	writeTimeout time.Duration
+}
+
+func NewWSConn(c *websocket.Conn) *WSConn {
+	c.SetReadLimit(wsReadLimit)
+	return &WSConn{c: c, writeTimeout: wsWriteTimeout}
+}
+
+// DialWS opens a WebSocket connection to url (wss://host:port/path).
+func DialWS(ctx context.Context, url string, tlsConf *tls.Config) (qdt.DatagramConn, error) {
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{"http/1.1"}
+	c, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		HTTPClient: &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("websocket dial: %w", err)
+	}
+	return NewWSConn(c), nil
+}
+
+// SendDatagram writes b as one message. A write that does not complete
+// within the write timeout closes the connection.
+func (w *WSConn) SendDatagram(b []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.writeTimeout)
+	defer cancel()
+	return w.c.Write(ctx, websocket.MessageBinary, b)
+}
+
+func (w *WSConn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	for {
+		typ, b, err := w.c.Read(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if typ == websocket.MessageBinary {
+			return b, nil
+		}
+	}
+}
+
+// CloseWithReason closes the connection with a policy-violation status, used
+// to reject a handshake after the upgrade.
+func (w *WSConn) CloseWithReason(reason string) error {
+	return w.c.Close(websocket.StatusPolicyViolation, reason)
+}
+
+func (w *WSConn) Close() error {
+	return w.c.Close(websocket.StatusNormalClosure, "")
+}
@@ -0,0 +1,93 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// wsServer accepts WebSocket connections and hands each to serve.
+func wsServer(t *testing.T, serve func(*WSConn)) string {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn := NewWSConn(c)
+		defer conn.Close()
+		serve(conn)
+	}))
+	t.Cleanup(srv.Close)
+	return "wss" + strings.TrimPrefix(srv.URL, "https")
+}
+
+func TestWSRoundTrip(t *testing.T) {
+	url := wsServer(t, func(c *WSConn) {
+		for {
+			b, err := c.ReceiveDatagram(context.Background())
+			if err != nil {
+				return
+			}
+			if err := c.SendDatagram(b); err != nil {
+				return
+			}
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := DialWS(ctx, url, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.(*WSConn).Close()
+	for _, msg := range [][]byte{[]byte("ping"), bytes.Repeat([]byte{0x5a}, 1350)} {
+		if err := conn.SendDatagram(msg); err != nil {
+			t.Fatal(err)
+		}
+		got, err := conn.ReceiveDatagram(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("echo of %d bytes, want %d", len(got), len(msg))
+		}
+	}
+}
+
+func TestWSWriteTimeout(t *testing.T) {
+	// The server never reads, so once the socket buffers are full a write
+	// can only end through the timeout.
+	stop := make(chan struct{})
+	defer close(stop)
+	url := wsServer(t, func(*WSConn) { <-stop })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := DialWS(ctx, url, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := conn.(*WSConn)
+	defer ws.Close()
+	ws.writeTimeout = 50 * time.Millisecond
+	msg := make([]byte, wsReadLimit)
+	for i := 0; ; i++ {
+		if i == 10000 {
+			t.Fatal("writes to a stalled peer never failed")
+		}
+		start := time.Now()
+		if err := ws.SendDatagram(msg); err != nil {
+			if d := time.Since(start); d > 2*time.Second {
+				t.Fatalf("write failed after %v, want about the 50ms timeout", d)
+			}
+			return
+		}
+	}
+}
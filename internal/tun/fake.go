@@ -0,0 +1,73 @@
+package tun
+
+import (
+	"context"
+	"os"
+)
+
+// FakeDevice is an in-memory TUN replacement for tests. Packets injected with
+// InjectPacket are returned by Read, and packets passed to Write can be
+// collected with DrainPacket.
+type FakeDevice struct {
+	Name    string
+	readCh  chan []byte
+	writeCh chan []byte
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func NewFakeDevice(bufSize int) *FakeDevice {
+	if bufSize <= 0 {
+		bufSize = 64
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &FakeDevice{
+		Name:    "fake0",
+		readCh:  make(chan []byte, bufSize),
+		writeCh: make(chan []byte, bufSize),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (d *FakeDevice) Read(buf []byte) (int, error) {
+	select {
+	case <-d.ctx.Done():
+		return 0, os.ErrClosed
+	case pkt := <-d.readCh:
+		return copy(buf, pkt), nil
+	}
+}
+
+func (d *FakeDevice) Write(buf []byte) (int, error) {
+	pkt := append([]byte(nil), buf...)
+	select {
+	case <-d.ctx.Done():
+		return 0, os.ErrClosed
+	case d.writeCh <- pkt:
+		return len(buf), nil
+	}
+}
+
+func (d *FakeDevice) Close() error {
+	d.cancel()
+	return nil
+}
+
+// InjectPacket queues pkt to be returned by a later Read.
+func (d *FakeDevice) InjectPacket(pkt []byte) {
+	select {
+	case <-d.ctx.Done():
+	case d.readCh <- append([]byte(nil), pkt...):
+	}
+}
+
+// DrainPacket returns the next written packet without blocking.
+func (d *FakeDevice) DrainPacket() ([]byte, bool) {
+	select {
+	case pkt := <-d.writeCh:
+		return pkt, true
+	default:
+		return nil, false
+	}
+}
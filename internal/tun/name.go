@@ -0,0 +1,37 @@
+package tun
+
+import (
+	"errors"
+	"strconv"
+)
+
+// AutoName asks Open to pick the first free name with DefaultNamePrefix.
+const AutoName = "auto"
+
+const DefaultNamePrefix = "qdt"
+
+var ErrNoFreeName = errors.New("no free tun name")
+
+// FindAvailableTUNName returns the first of prefix0 to prefix63 that no
+// interface uses yet.
+func FindAvailableTUNName(prefix string) (string, error) {
+	for i := 0; i < 64; i++ {
+		name := prefix + strconv.Itoa(i)
+		exists, err := interfaceExists(name)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return name, nil
+		}
+	}
+	return "", ErrNoFreeName
+}
+
+// resolveName picks a free name when name is empty or AutoName.
+func resolveName(name string) (string, error) {
+	if name != "" && name != AutoName {
+		return name, nil
+	}
+	return FindAvailableTUNName(DefaultNamePrefix)
+}
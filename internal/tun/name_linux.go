@@ -0,0 +1,22 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+func interfaceExists(name string) (bool, error) {
+	_, err := netlink.LinkByName(name)
+	var notFound netlink.LinkNotFoundError
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("lookup %s: %w", name, err)
+	}
+	return true, nil
+}
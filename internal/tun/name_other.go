@@ -0,0 +1,21 @@
+//go:build !linux
+
+package tun
+
+import (
+	"fmt"
+	"net"
+)
+
+func interfaceExists(name string) (bool, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return false, fmt.Errorf("interfaces: %w", err)
+	}
+	for _, iface := range ifaces {
+		if iface.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,47 @@
+//go:build linux || windows
+
+package tun
+
+import "sync/atomic"
+
+// Stats is a snapshot of the traffic and errors of a Device.
+type Stats struct {
+	ReadBytes   uint64
+	WriteBytes  uint64
+	ReadErrors  uint64
+	WriteErrors uint64
+}
+
+// counters are updated by the Device on every read and write.
+type counters struct {
+	readBytes   atomic.Uint64
+	writeBytes  atomic.Uint64
+	readErrors  atomic.Uint64
+	writeErrors atomic.Uint64
+}
+
+func (c *counters) read(n int, err error) {
+	if err != nil {
+		c.readErrors.Add(1)
+		return
+	}
+	c.readBytes.Add(uint64(n))
+}
+
+func (c *counters) write(n int, err error) {
+	if err != nil {
+		c.writeErrors.Add(1)
+		return
+	}
+	c.writeBytes.Add(uint64(n))
+}
+
+// Stats returns the counters of d since it was opened.
+func (d *Device) Stats() Stats {
+	return Stats{
+		ReadBytes:   d.stats.readBytes.Load(),
+		WriteBytes:  d.stats.writeBytes.Load(),
+		ReadErrors:  d.stats.readErrors.Load(),
+		WriteErrors: d.stats.writeErrors.Load(),
+	}
+}
@@ -3,18 +3,28 @@
 package tun
 
 import (
+	"errors"
 	"fmt"
+	"os"
 
 	"github.com/songgao/water"
+	"golang.org/x/sys/unix"
 )
 
 // Device wraps a TUN interface.
 type Device struct {
 	Interface *water.Interface
 	Name      string
+	stats     counters
 }
 
+// Open creates the TUN device name, or the first free qdtN when name is
+// empty or AutoName.
 func Open(name string) (*Device, error) {
+	name, err := resolveName(name)
+	if err != nil {
+		return nil, err
+	}
 	cfg := water.Config{DeviceType: water.TUN}
 	cfg.Name = name
 	iface, err := water.New(cfg)
@@ -25,11 +35,96 @@ func Open(name string) (*Device, error) {
 }
 
 func (d *Device) Read(buf []byte) (int, error) {
-	return d.Interface.Read(buf)
+	n, err := d.Interface.Read(buf)
+	d.stats.read(n, err)
+	return n, err
+}
+
+// ReadBatch reads a single packet into bufs[0], resliced to its length; a
+// TUN fd returns one packet per read.
+func (d *Device) ReadBatch(bufs [][]byte) (int, error) {
+	n, err := d.Read(bufs[0][:cap(bufs[0])])
+	if err != nil {
+		return 0, err
+	}
+	bufs[0] = bufs[0][:n]
+	return 1, nil
 }
 
 func (d *Device) Write(buf []byte) (int, error) {
-	return d.Interface.Write(buf)
+	n, err := d.Interface.Write(buf)
+	d.stats.write(n, err)
+	return n, err
+}
+
+// WriteBatch writes pkts and returns the number of packets written. A TUN fd
+// takes exactly one packet per write, and writev would join its iovecs into a
+// single packet, so the packets are written back to back inside one raw fd
+// callback; this saves the runtime poller round trip per packet.
+func (d *Device) WriteBatch(pkts [][]byte) (int, error) {
+	f, ok := d.Interface.ReadWriteCloser.(*os.File)
+	if !ok {
+		return d.writeEach(pkts)
+	}
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return d.writeEach(pkts)
+	}
+	n := 0
+	var werr error
+	err = rc.Write(func(fd uintptr) bool {
+		for n < len(pkts) {
+			var wn int
+			wn, werr = unix.Write(int(fd), pkts[n])
+			if errors.Is(werr, unix.EAGAIN) {
+				werr = nil
+				return false
+			}
+			d.stats.write(wn, werr)
+			if werr != nil {
+				return true
+			}
+			n++
+		}
+		return true
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, werr
+}
+
+func (d *Device) writeEach(pkts [][]byte) (int, error) {
+	for i, pkt := range pkts {
+		if _, err := d.Write(pkt); err != nil {
+			return i, err
+		}
+	}
+	return len(pkts), nil
+}
+
+// Check issues a TUNGETIFF ioctl, which fails once the device is closed or
+// detached from its interface.
+func (d *Device) Check() error {
+	f, ok := d.Interface.ReadWriteCloser.(*os.File)
+	if !ok {
+		return nil
+	}
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ierr error
+	err = rc.Control(func(fd uintptr) {
+		var ifr *unix.Ifreq
+		if ifr, ierr = unix.NewIfreq(""); ierr == nil {
+			ierr = unix.IoctlIfreq(int(fd), unix.TUNGETIFF, ifr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return ierr
 }
 
 func (d *Device) Close() error {
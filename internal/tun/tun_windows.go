@@ -3,19 +3,31 @@
 package tun
 
 import (
+	"errors"
 	"fmt"
+	"os"
 
+	"golang.org/x/sys/windows"
 	"golang.zx2c4.com/wintun"
 )
 
 // Device wraps a Wintun session.
 type Device struct {
 	adapter *wintun.Adapter
-	session *wintun.Session
-	Name    string
+	session wintun.Session
+	// closed is signalled by Close to wake a reader waiting for packets.
+	closed windows.Handle
+	Name   string
+	stats  counters
 }
 
+// Open creates or opens the Wintun adapter name, or creates the first free
+// qdtN when name is empty or AutoName.
 func Open(name string) (*Device, error) {
+	name, err := resolveName(name)
+	if err != nil {
+		return nil, err
+	}
 	adapter, err := wintun.CreateAdapter(name, "QDT", nil)
 	if err != nil {
 		adapter, err = wintun.OpenAdapter(name)
@@ -28,33 +40,102 @@ func Open(name string) (*Device, error) {
 		adapter.Close()
 		return nil, fmt.Errorf("start session: %w", err)
 	}
-	return &Device{adapter: adapter, session: session, Name: adapter.Name()}, nil
+	closed, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		session.End()
+		adapter.Close()
+		return nil, fmt.Errorf("create event: %w", err)
+	}
+	return &Device{adapter: adapter, session: session, closed: closed, Name: name}, nil
 }
 
 func (d *Device) Read(buf []byte) (int, error) {
-	packet, err := d.session.ReceivePacket()
-	if err != nil {
+	bufs := [][]byte{buf}
+	if _, err := d.ReadBatch(bufs); err != nil {
 		return 0, err
 	}
-	n := copy(buf, packet)
-	d.session.ReleaseReceivePacket(packet)
-	return n, nil
+	return len(bufs[0]), nil
+}
+
+// ReadBatch drains up to len(bufs) packets from the Wintun ring, waiting
+// only for the first, and reslices bufs[i] to the length of each packet.
+// The ring slots are released together once the batch is copied out.
+func (d *Device) ReadBatch(bufs [][]byte) (int, error) {
+	held := make([][]byte, 0, len(bufs))
+	defer func() {
+		for _, p := range held {
+			d.session.ReleaseReceivePacket(p)
+		}
+	}()
+	for len(held) < len(bufs) {
+		packet, err := d.session.ReceivePacket()
+		switch {
+		case err == nil:
+			d.stats.read(len(packet), nil)
+			n := len(held)
+			bufs[n] = bufs[n][:copy(bufs[n][:cap(bufs[n])], packet)]
+			held = append(held, packet)
+		case errors.Is(err, windows.ERROR_NO_MORE_ITEMS) && len(held) > 0:
+			return len(held), nil
+		case errors.Is(err, windows.ERROR_NO_MORE_ITEMS):
+			if err := d.waitReadable(); err != nil {
+				d.stats.read(0, err)
+				return 0, err
+			}
+		case len(held) > 0:
+			return len(held), nil
+		default:
+			d.stats.read(0, err)
+			return 0, err
+		}
+	}
+	return len(held), nil
+}
+
+func (d *Device) waitReadable() error {
+	events := []windows.Handle{d.session.ReadWaitEvent(), d.closed}
+	ev, err := windows.WaitForMultipleObjects(events, false, windows.INFINITE)
+	if err != nil {
+		return fmt.Errorf("wait for packets: %w", err)
+	}
+	if ev == windows.WAIT_OBJECT_0+1 {
+		return os.ErrClosed
+	}
+	return nil
 }
 
 func (d *Device) Write(buf []byte) (int, error) {
 	packet, err := d.session.AllocateSendPacket(len(buf))
 	if err != nil {
+		d.stats.write(0, err)
 		return 0, err
 	}
 	copy(packet, buf)
 	d.session.SendPacket(packet)
+	d.stats.write(len(buf), nil)
 	return len(buf), nil
 }
 
-func (d *Device) Close() error {
-	if d.session != nil {
-		d.session.End()
+// Check reports whether the device is usable; a Wintun session has no
+// cheap probe, so it always succeeds.
+func (d *Device) Check() error {
+	return nil
+}
+
+// WriteBatch allocates and sends each packet in turn on the Wintun ring and
+// returns the number of packets written.
+func (d *Device) WriteBatch(pkts [][]byte) (int, error) {
+	for i, pkt := range pkts {
+		if _, err := d.Write(pkt); err != nil {
+			return i, err
+		}
 	}
+	return len(pkts), nil
+}
+
+func (d *Device) Close() error {
+	windows.SetEvent(d.closed)
+	d.session.End()
 	if d.adapter != nil {
 		d.adapter.Close()
 	}
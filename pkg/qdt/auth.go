@@ -0,0 +1,64 @@
+package qdt
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrJWTSecretEmpty = errors.New("jwt secret is empty")
+	ErrJWTTTLInvalid  = errors.New("jwt ttl must be positive")
+)
+
+// IsJWT reports whether token looks like a JWT rather than a static token.
+func IsJWT(token string) bool {
+	return strings.Contains(token, ".")
+}
+
+// GenerateJWT signs an HS256 token for clientID that expires after ttl.
+// VerifyJWT requires an expiry, so ttl must be positive.
+func GenerateJWT(secret, issuer, clientID string, ttl time.Duration) (string, error) {
+	if secret == "" {
+		return "", ErrJWTSecretEmpty
+	}
+	if ttl <= 0 {
+		return "", ErrJWTTTLInvalid
+	}
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Issuer:    issuer,
+		Subject:   clientID,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		return "", &HandshakeError{Reason: "sign jwt", Err: err}
+	}
+	return signed, nil
+}
+
+// VerifyJWT validates an HS256 token and returns its subject.
+func VerifyJWT(token, secret, issuer string) (string, error) {
+	if secret == "" {
+		return "", ErrJWTSecretEmpty
+	}
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+	}
+	if issuer != "" {
+		opts = append(opts, jwt.WithIssuer(issuer))
+	}
+	var claims jwt.RegisteredClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return []byte(secret), nil
+	}, opts...)
+	if err != nil {
+		return "", &HandshakeError{Reason: "verify jwt", Err: err}
+	}
+	return claims.Subject, nil
+}
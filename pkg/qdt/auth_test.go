@@ -0,0 +1,57 @@
+package qdt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestJWTRoundTrip(t *testing.T) {
+	token, err := GenerateJWT("secret", "qdt", "laptop", time.Minute)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if !IsJWT(token) {
+		t.Fatalf("expected jwt format")
+	}
+	sub, err := VerifyJWT(token, "secret", "qdt")
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if sub != "laptop" {
+		t.Fatalf("subject mismatch: %q", sub)
+	}
+	if _, err := VerifyJWT(token, "other", "qdt"); err == nil {
+		t.Fatalf("expected error for wrong secret")
+	}
+	if _, err := VerifyJWT(token, "secret", "someone-else"); err == nil {
+		t.Fatalf("expected error for wrong issuer")
+	}
+}
+
+func TestJWTExpiry(t *testing.T) {
+	claims := jwt.RegisteredClaims{
+		Issuer:    "qdt",
+		Subject:   "laptop",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+	}
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := VerifyJWT(expired, "secret", "qdt"); err == nil {
+		t.Fatalf("expected error for expired token")
+	}
+	if _, err := GenerateJWT("secret", "qdt", "laptop", 0); !errors.Is(err, ErrJWTTTLInvalid) {
+		t.Fatalf("generate without ttl: got %v", err)
+	}
+	noExp, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Issuer: "qdt", Subject: "laptop"}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := VerifyJWT(noExp, "secret", "qdt"); err == nil {
+		t.Fatalf("expected error for missing exp")
+	}
+}
@@ -0,0 +1,181 @@
+package qdt
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func benchKeyMaterial(b *testing.B) KeyMaterial {
+	b.Helper()
+	clientNonce := make([]byte, HandshakeNonceSize)
+	serverNonce := make([]byte, HandshakeNonceSize)
+	for i := range clientNonce {
+		clientNonce[i] = byte(i)
+		serverNonce[i] = byte(200 - i)
+	}
+	km, err := DeriveKeyMaterial("bench-secret", clientNonce, serverNonce)
+	if err != nil {
+		b.Fatalf("derive keys: %v", err)
+	}
+	return km
+}
+
+func benchTunnel(b *testing.B, mtu int) *Tunnel {
+	b.Helper()
+	km := benchKeyMaterial(b)
+	send, _, err := NewClientCipherStates(km, nil)
+	if err != nil {
+		b.Fatalf("cipher states: %v", err)
+	}
+	_, recv, err := NewServerCipherStates(km, NewReplayWindow(2048))
+	if err != nil {
+		b.Fatalf("cipher states: %v", err)
+	}
+	return NewTunnel(1, mtu, send, recv)
+}
+
+func discard([]byte) error { return nil }
+
+func BenchmarkEncodePacket(b *testing.B) {
+	tun := benchTunnel(b, DefaultMTU)
+	payload := bytes.Repeat([]byte("p"), tun.payloadMTU())
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := tun.EncodePacket(payload, discard); err != nil {
+			b.Fatalf("encode: %v", err)
+		}
+	}
+}
+
+// BenchmarkHeaderOverhead encodes 64 byte packets, the size of TCP ACKs and
+// voice frames, and reports the bytes each datagram adds with full and
+// compact headers.
+func BenchmarkHeaderOverhead(b *testing.B) {
+	for _, compact := range []bool{false, true} {
+		name := "full"
+		if compact {
+			name = "compact"
+		}
+		b.Run(name, func(b *testing.B) {
+			tun := benchTunnel(b, DefaultMTU)
+			if compact {
+				tun.EnableCompactHeader()
+			}
+			payload := bytes.Repeat([]byte("a"), 64)
+			var size int
+			emit := func(d []byte) error {
+				size = len(d)
+				return nil
+			}
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := tun.EncodePacket(payload, emit); err != nil {
+					b.Fatalf("encode: %v", err)
+				}
+			}
+			b.ReportMetric(float64(size-len(payload)), "overhead-bytes")
+		})
+	}
+}
+
+func BenchmarkEncodePacketFragment(b *testing.B) {
+	// A 1500 byte MTU splits an 8000 byte payload into 6 fragments.
+	tun := benchTunnel(b, 1500)
+	payload := bytes.Repeat([]byte("f"), 8000)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := tun.EncodePacket(payload, discard); err != nil {
+			b.Fatalf("encode: %v", err)
+		}
+	}
+}
+
+func BenchmarkDecodeDatagramInto(b *testing.B) {
+	const batch = 4096
+	tun := benchTunnel(b, DefaultMTU)
+	payload := bytes.Repeat([]byte("d"), tun.payloadMTU())
+	dgrams := make([][]byte, 0, batch)
+	for len(dgrams) < batch {
+		err := tun.EncodePacket(payload, func(d []byte) error {
+			dgrams = append(dgrams, append([]byte(nil), d...))
+			return nil
+		})
+		if err != nil {
+			b.Fatalf("encode: %v", err)
+		}
+	}
+	km := benchKeyMaterial(b)
+	dst := make([]byte, DefaultMTU)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%batch == 0 && i > 0 {
+			// Counters repeat per batch, so start a fresh replay window.
+			b.StopTimer()
+			_, recv, err := NewServerCipherStates(km, NewReplayWindow(2048))
+			if err != nil {
+				b.Fatalf("cipher states: %v", err)
+			}
+			tun.Recv = recv
+			b.StartTimer()
+		}
+		if _, _, err := tun.DecodeDatagramInto(dst[:0], dgrams[i%batch]); err != nil {
+			b.Fatalf("decode: %v", err)
+		}
+	}
+}
+
+func BenchmarkEncoderParallel(b *testing.B) {
+	tun := benchTunnel(b, DefaultMTU)
+	payload := bytes.Repeat([]byte("p"), tun.payloadMTU())
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		enc := tun.NewEncoder()
+		for pb.Next() {
+			if err := enc.EncodePacket(payload, discard); err != nil {
+				b.Errorf("encode: %v", err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkReassembler(b *testing.B) {
+	const chunk = 1000
+	payload := bytes.Repeat([]byte("r"), 4*chunk)
+	frags := make([][]byte, 0, 4)
+	for _, idx := range []int{2, 0, 3, 1} {
+		off := idx * chunk
+		hdr := EncodeFragmentHeader(1, uint32(off), uint32(len(payload)))
+		frags = append(frags, append(hdr, payload[off:off+chunk]...))
+	}
+	reasm := NewReassembler(time.Second, 16, 0, 0)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out []byte
+		for _, f := range frags {
+			pkt, err := reasm.Push(f)
+			if err != nil {
+				b.Fatalf("push: %v", err)
+			}
+			if pkt != nil {
+				out = pkt
+			}
+		}
+		if len(out) != len(payload) {
+			b.Fatalf("reassembly incomplete")
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package qdt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CapCoalesce is advertised in ConnectRequest.Caps and ConnectResponse.Caps by
+// peers that can decode MsgCoalesced.
+const CapCoalesce = "coalesce"
+
+// DefaultCoalesceThreshold is the packet size below which packets are
+// coalesced when no threshold is configured.
+const DefaultCoalesceThreshold = 256
+
+type coalesceConfig struct {
+	interval  time.Duration
+	maxBytes  int
+	threshold int
+}
+
+// EnableCoalescing makes PumpTunToConn and NewCoalescer combine packets
+// shorter than threshold bytes into one MsgCoalesced datagram of at most
+// maxBytes payload, holding the first packet for up to interval. A zero
+// maxBytes fills the datagram MTU. It must be called before the tunnel
+// carries traffic, once the peer advertised CapCoalesce.
+func (t *Tunnel) EnableCoalescing(interval time.Duration, maxBytes, threshold int) {
+	if threshold <= 0 {
+		threshold = DefaultCoalesceThreshold
+	}
+	t.coalesce = coalesceConfig{interval: interval, maxBytes: maxBytes, threshold: threshold}
+}
+
+// Coalescer batches small packets for one sender. Its own Encoder encodes the
+// batches, so it may run alongside other encoders of the same tunnel.
+//
+// MsgCoalesced payload layout: Count[2] | (Len[2] | Packet[Len])*Count.
+type Coalescer struct {
+	enc   *Encoder
+	cfg   coalesceConfig
+	alloc func(size int) []byte
+	emit  func([]byte) error
+
+	mu    sync.Mutex
+	buf   []byte
+	count int
+	timer *time.Timer
+	err   error
+}
+
+// NewCoalescer returns nil unless coalescing is enabled. Datagrams are built
+// in buffers from alloc, as with EncodePacketTo, or in scratch space when
+// alloc is nil; emit may be called from a timer goroutine.
+func (t *Tunnel) NewCoalescer(alloc func(size int) []byte, emit func([]byte) error) *Coalescer {
+	if t.coalesce.interval <= 0 {
+		return nil
+	}
+	c := &Coalescer{enc: t.NewEncoder(), cfg: t.coalesce, alloc: alloc, emit: emit}
+	c.timer = time.AfterFunc(time.Hour, c.onTimer)
+	c.timer.Stop()
+	return c
+}
+
+// Add copies pkt into the pending batch. It returns false, taking nothing,
+// for packets too large to coalesce; the caller should Flush and send those
+// normally to keep packet order.
+func (c *Coalescer) Add(pkt []byte) (bool, error) {
+	if len(pkt) >= c.cfg.threshold {
+		return false, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return false, c.err
+	}
+	limit := c.limit()
+	if 4+len(pkt) > limit {
+		return false, nil
+	}
+	if len(c.buf)+2+len(pkt) > limit {
+		if err := c.flushLocked(); err != nil {
+			return false, err
+		}
+	}
+	if c.count == 0 {
+		c.buf = append(c.buf[:0], 0, 0)
+		c.timer.Reset(c.cfg.interval)
+	}
+	c.buf = binary.BigEndian.AppendUint16(c.buf, uint16(len(pkt)))
+	c.buf = append(c.buf, pkt...)
+	c.count++
+	return true, nil
+}
+
+// Flush sends the pending batch now.
+func (c *Coalescer) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return c.flushLocked()
+}
+
+// Stop discards the pending batch and stops the timer.
+func (c *Coalescer) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer.Stop()
+	c.count = 0
+}
+
+func (c *Coalescer) onTimer() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		_ = c.flushLocked()
+	}
+}
+
+func (c *Coalescer) limit() int {
+	t := c.enc.t
+	t.mtuMu.RLock()
+	limit := t.payloadMTUValue
+	t.mtuMu.RUnlock()
+	if c.cfg.maxBytes > 0 && c.cfg.maxBytes < limit {
+		limit = c.cfg.maxBytes
+	}
+	return limit
+}
+
+func (c *Coalescer) flushLocked() error {
+	if c.count == 0 {
+		return nil
+	}
+	c.timer.Stop()
+	var err error
+	if c.count == 1 {
+		err = c.encodePacket(c.buf[4:])
+	} else {
+		binary.BigEndian.PutUint16(c.buf[:2], uint16(c.count))
+		err = c.encodeBatch()
+	}
+	c.count = 0
+	c.buf = c.buf[:0]
+	if err != nil {
+		c.err = err
+	}
+	return err
+}
+
+func (c *Coalescer) encodePacket(pkt []byte) error {
+	if c.alloc != nil {
+		return c.enc.EncodePacketTo(pkt, c.alloc, c.emit)
+	}
+	return c.enc.EncodePacket(pkt, c.emit)
+}
+
+// encodeBatch sends c.buf as one MsgCoalesced datagram, or packet by packet
+// if the MTU shrank below the batch since it was started.
+func (c *Coalescer) encodeBatch() error {
+	t := c.enc.t
+	t.mtuMu.RLock()
+	if len(c.buf) <= t.payloadMTUValue {
+		var err error
+		if c.alloc != nil {
+			err = c.enc.encodeAndEmitTo(MsgCoalesced, c.buf, c.alloc, c.emit)
+		} else {
+			err = c.enc.encodeAndEmit(MsgCoalesced, c.buf, c.emit)
+		}
+		t.mtuMu.RUnlock()
+		if err != nil {
+			return err
+		}
+		for rest := c.buf[2:]; len(rest) > 0; {
+			n := int(binary.BigEndian.Uint16(rest))
+			t.stats.sent(n)
+			rest = rest[2+n:]
+		}
+		return nil
+	}
+	t.mtuMu.RUnlock()
+	for rest := c.buf[2:]; len(rest) > 0; {
+		n := int(binary.BigEndian.Uint16(rest))
+		if err := c.encodePacket(rest[2 : 2+n]); err != nil {
+			return err
+		}
+		rest = rest[2+n:]
+	}
+	return nil
+}
+
+// splitCoalesced validates a MsgCoalesced payload and returns the first
+// packet and the entries after it.
+func splitCoalesced(payload []byte) (first, rest []byte, count int, err error) {
+	if len(payload) < 2 {
+		return nil, nil, 0, fmt.Errorf("%w: short coalesced payload", ErrInvalidDatagram)
+	}
+	count = int(binary.BigEndian.Uint16(payload))
+	entries := payload[2:]
+	for i, off := 0, 0; i < count; i++ {
+		if len(entries)-off < 2 {
+			return nil, nil, 0, fmt.Errorf("%w: truncated coalesced entry", ErrInvalidDatagram)
+		}
+		n := int(binary.BigEndian.Uint16(entries[off:]))
+		off += 2
+		if n == 0 || len(entries)-off < n {
+			return nil, nil, 0, fmt.Errorf("%w: truncated coalesced entry", ErrInvalidDatagram)
+		}
+		off += n
+		if i == count-1 && off != len(entries) {
+			return nil, nil, 0, fmt.Errorf("%w: trailing coalesced data", ErrInvalidDatagram)
+		}
+	}
+	if count == 0 {
+		return nil, nil, 0, fmt.Errorf("%w: empty coalesced payload", ErrInvalidDatagram)
+	}
+	n := int(binary.BigEndian.Uint16(entries))
+	return entries[2 : 2+n], entries[2+n:], count, nil
+}
+
+// NextCoalesced returns the next packet left over from the last MsgCoalesced
+// datagram, copied into dst when it fits. Like DecodeDatagramInto it must
+// not be called concurrently with other decodes.
+func (t *Tunnel) NextCoalesced(dst []byte) ([]byte, bool) {
+	return t.nextCoalesced(&t.dec, dst)
+}
+
+func (t *Tunnel) nextCoalesced(st *decodeState, dst []byte) ([]byte, bool) {
+	if len(st.coalesced) == 0 {
+		return nil, false
+	}
+	n := int(binary.BigEndian.Uint16(st.coalesced))
+	pkt := st.coalesced[2 : 2+n]
+	st.coalesced = st.coalesced[2+n:]
+	t.stats.recv(n)
+	if cap(dst) >= n {
+		dst = dst[:n]
+		copy(dst, pkt)
+		return dst, true
+	}
+	return append([]byte(nil), pkt...), true
+}
@@ -0,0 +1,46 @@
+package qdt
+
+// CapCompactHeader is advertised in ConnectRequest.Caps and
+// ConnectResponse.Caps by peers that send and accept compact headers.
+const CapCompactHeader = "compact-header"
+
+// EnableCompactHeader makes the tunnel send CompactHeaderLen byte headers,
+// leaving 12 more bytes of each datagram for payload. Full headers are
+// still accepted. It must be called before the tunnel carries traffic, once
+// CapCompactHeader was negotiated.
+func (t *Tunnel) EnableCompactHeader() {
+	t.mtuMu.Lock()
+	defer t.mtuMu.Unlock()
+	t.compactHeader = true
+	t.recomputeMTU()
+}
+
+func (t *Tunnel) header(msgType MessageType, counter uint64) Header {
+	return Header{
+		Version:   ProtocolVersion,
+		Type:      msgType,
+		SessionID: t.SessionID,
+		Counter:   counter,
+		Compact:   t.compactHeader,
+	}
+}
+
+// expandCounter restores a counter sent in a compact header from its low 32
+// bits, as the value closest to the newest counter received. Without a
+// replay window only the first 2^32 counters can be told apart.
+func (c *CipherState) expandCounter(low uint32) uint64 {
+	if c.replay == nil {
+		return uint64(low)
+	}
+	c.replay.mu.Lock()
+	newest := c.replay.max
+	c.replay.mu.Unlock()
+	counter := newest&^0xffffffff | uint64(low)
+	switch {
+	case counter > newest && counter-newest > 1<<31 && counter >= 1<<32:
+		counter -= 1 << 32
+	case counter < newest && newest-counter > 1<<31:
+		counter += 1 << 32
+	}
+	return counter
+}
@@ -0,0 +1,57 @@
+package qdt
+
+import (
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CapCompress is advertised in ConnectRequest.Caps and echoed in
+// ConnectResponse.Caps when both sides agree to zstd-compress payloads.
+const CapCompress = "compress"
+
+const (
+	minCompressSize  = 128
+	maxDecompressLen = 1 << 16
+)
+
+// The zstd encoder and decoder are safe for concurrent EncodeAll/DecodeAll
+// calls, so all tunnels share one of each.
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderCRC(false))
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, _ := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressLen), zstd.WithDecoderConcurrency(0))
+		return dec
+	})
+)
+
+// EnableCompression turns on zstd compression of outgoing packets. It must be
+// called before the tunnel carries traffic, once CapCompress was negotiated.
+func (t *Tunnel) EnableCompression() {
+	t.compress = true
+}
+
+// compressPayload returns payload compressed into dst when that saves space
+// and fits a single datagram.
+func (t *Tunnel) compressPayload(dst, payload []byte) ([]byte, bool) {
+	if !t.compress || len(payload) < minCompressSize {
+		return dst, false
+	}
+	out := zstdEncoder().EncodeAll(payload, dst[:0])
+	if t.CompressObserver != nil {
+		t.CompressObserver(len(payload), len(out))
+	}
+	if len(out) >= len(payload) || len(out) > t.payloadMTUValue {
+		return out, false
+	}
+	t.stats.compressedIn.Add(uint64(len(payload)))
+	t.stats.compressedOut.Add(uint64(len(out)))
+	return out, true
+}
+
+func decompressPayload(plain []byte) ([]byte, error) {
+	return zstdDecoder().DecodeAll(plain, nil)
+}
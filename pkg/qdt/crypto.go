@@ -1,6 +1,7 @@
 package qdt
 
 import (
+	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
@@ -8,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"sync/atomic"
 
 	"golang.org/x/crypto/chacha20poly1305"
@@ -17,12 +19,41 @@ import (
 const (
 	HandshakeNonceSize = 16
 	NoncePrefixSize    = 4
+
+	// maxSendCounter leaves headroom below the point where the 64-bit
+	// counter would wrap and reuse nonces.
+	maxSendCounter = math.MaxUint64 - 1024
 )
 
 var (
-	ErrReplay = errors.New("replay detected")
+	ErrReplay           = errors.New("replay detected")
+	ErrCounterExhausted = errors.New("send counter exhausted")
+	ErrFIPSUnavailable  = errors.New("fips mode requires a FIPS 140 crypto module (GOEXPERIMENT=boringcrypto or GODEBUG=fips140=on)")
 )
 
+// CapFIPS is advertised in ConnectRequest.Caps and echoed in
+// ConnectResponse.Caps by peers in FIPS mode, which seal with AES-256-GCM
+// instead of ChaCha20-Poly1305.
+const CapFIPS = "fips"
+
+var fipsMode atomic.Bool
+
+// EnableFIPSMode makes cipher states created afterwards use AES-256-GCM. It
+// fails unless the binary runs on a FIPS 140 validated crypto module. The
+// mode applies to the whole process and cannot be turned off.
+func EnableFIPSMode() error {
+	if !fipsAvailable() {
+		return ErrFIPSUnavailable
+	}
+	fipsMode.Store(true)
+	return nil
+}
+
+// FIPSMode reports whether EnableFIPSMode has been called.
+func FIPSMode() bool {
+	return fipsMode.Load()
+}
+
 type KeyMaterial struct {
 	ClientKey         [chacha20poly1305.KeySize]byte
 	ServerKey         [chacha20poly1305.KeySize]byte
@@ -33,23 +64,38 @@ type KeyMaterial struct {
 func NewHandshakeNonce() ([]byte, error) {
 	b := make([]byte, HandshakeNonceSize)
 	if _, err := rand.Read(b); err != nil {
-		return nil, fmt.Errorf("handshake nonce: %w", err)
+		return nil, &HandshakeError{Reason: "nonce", Err: err}
 	}
 	return b, nil
 }
 
 func DeriveKeyMaterial(token string, clientNonce, serverNonce []byte) (KeyMaterial, error) {
+	return DeriveHybridKeyMaterial(token, clientNonce, serverNonce, nil)
+}
+
+// DeriveHybridKeyMaterial is DeriveKeyMaterial with an ML-KEM shared secret
+// XORed into the HKDF salt, so the keys stay secret as long as either the
+// token or the KEM holds. A nil secret gives the keys of DeriveKeyMaterial.
+func DeriveHybridKeyMaterial(token string, clientNonce, serverNonce, kemSecret []byte) (KeyMaterial, error) {
 	if token == "" {
-		return KeyMaterial{}, errors.New("token is empty")
+		return KeyMaterial{}, &HandshakeError{Reason: "token is empty"}
 	}
 	if len(clientNonce) != HandshakeNonceSize || len(serverNonce) != HandshakeNonceSize {
-		return KeyMaterial{}, fmt.Errorf("nonce must be %d bytes", HandshakeNonceSize)
+		return KeyMaterial{}, &HandshakeError{Reason: fmt.Sprintf("nonce must be %d bytes", HandshakeNonceSize)}
 	}
 	salt := append(append([]byte{}, clientNonce...), serverNonce...)
+	if kemSecret != nil {
+		if len(kemSecret) != len(salt) {
+			return KeyMaterial{}, &HandshakeError{Reason: fmt.Sprintf("kem secret must be %d bytes", len(salt))}
+		}
+		for i := range salt {
+			salt[i] ^= kemSecret[i]
+		}
+	}
 	r := hkdf.New(sha256.New, []byte(token), salt, []byte("qdt-aead-v1"))
 	var out [chacha20poly1305.KeySize*2 + NoncePrefixSize*2]byte
 	if _, err := io.ReadFull(r, out[:]); err != nil {
-		return KeyMaterial{}, fmt.Errorf("hkdf: %w", err)
+		return KeyMaterial{}, &CipherError{Op: "hkdf", Err: err}
 	}
 	var km KeyMaterial
 	off := 0
@@ -71,13 +117,24 @@ type CipherState struct {
 }
 
 func NewCipherState(key [chacha20poly1305.KeySize]byte, noncePrefix [NoncePrefixSize]byte, replay *ReplayWindow) (*CipherState, error) {
-	aead, err := chacha20poly1305.New(key[:])
+	aead, err := newAEAD(key[:])
 	if err != nil {
-		return nil, fmt.Errorf("aead: %w", err)
+		return nil, &CipherError{Op: "aead", Err: err}
 	}
 	return &CipherState{aead: aead, noncePrefix: noncePrefix, replay: replay}, nil
 }
 
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if !fipsMode.Load() {
+		return chacha20poly1305.New(key)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
 func NewClientCipherStates(km KeyMaterial, replay *ReplayWindow) (send *CipherState, recv *CipherState, err error) {
 	send, err = NewCipherState(km.ClientKey, km.ClientNoncePrefix, nil)
 	if err != nil {
@@ -102,8 +159,16 @@ func NewServerCipherStates(km KeyMaterial, replay *ReplayWindow) (send *CipherSt
 	return send, recv, nil
 }
 
-func (c *CipherState) NextCounter() uint64 {
-	return atomic.AddUint64(&c.sendCounter, 1) - 1
+// NextCounter reserves the next send counter. Once the counter nears
+// wrap-around it returns ErrCounterExhausted on every call; the session must
+// then be torn down and new keys negotiated.
+func (c *CipherState) NextCounter() (uint64, error) {
+	counter := atomic.AddUint64(&c.sendCounter, 1) - 1
+	if counter > maxSendCounter {
+		atomic.StoreUint64(&c.sendCounter, maxSendCounter+1)
+		return 0, ErrCounterExhausted
+	}
+	return counter, nil
 }
 
 func (c *CipherState) nonce(counter uint64) [chacha20poly1305.NonceSize]byte {
@@ -122,13 +187,13 @@ func (c *CipherState) Open(dst []byte, counter uint64, aad, ciphertext []byte) (
 	if c.replay != nil {
 		ok := c.replay.Check(counter)
 		if !ok {
-			return nil, ErrReplay
+			return nil, &CipherError{Op: "open", Err: ErrReplay}
 		}
 	}
 	nonce := c.nonce(counter)
 	pt, err := c.aead.Open(dst, nonce[:], ciphertext, aad)
 	if err != nil {
-		return nil, err
+		return nil, &CipherError{Op: "open", Err: err}
 	}
 	if c.replay != nil {
 		c.replay.Mark(counter)
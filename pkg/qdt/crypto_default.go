@@ -0,0 +1,11 @@
+//go:build !boringcrypto
+
+package qdt
+
+import "crypto/fips140"
+
+// fipsAvailable reports whether Go's native FIPS 140-3 module is enabled, the
+// standard-toolchain alternative to a boringcrypto build.
+func fipsAvailable() bool {
+	return fips140.Enabled()
+}
@@ -0,0 +1,9 @@
+//go:build boringcrypto
+
+package qdt
+
+import "crypto/boring"
+
+func fipsAvailable() bool {
+	return boring.Enabled()
+}
@@ -2,6 +2,9 @@ package qdt
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -29,7 +32,10 @@ func TestAEADRoundTrip(t *testing.T) {
 
 	header := []byte("header")
 	payload := []byte("payload")
-	counter := send.NextCounter()
+	counter, err := send.NextCounter()
+	if err != nil {
+		t.Fatalf("next counter: %v", err)
+	}
 	ciphertext := send.Seal(nil, counter, header, payload)
 
 	plain, err := recv.Open(nil, counter, header, ciphertext)
@@ -40,3 +46,79 @@ func TestAEADRoundTrip(t *testing.T) {
 		t.Fatalf("payload mismatch")
 	}
 }
+
+func TestCounterExhausted(t *testing.T) {
+	client, _ := newTunnelPair(t, 7, DefaultMTU)
+	client.Send.sendCounter = maxSendCounter
+	emit := func([]byte) error { return nil }
+	if err := client.EncodePacket([]byte("last"), emit); err != nil {
+		t.Fatalf("encode at limit: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := client.EncodePacket([]byte("over"), emit); !errors.Is(err, ErrCounterExhausted) {
+			t.Fatalf("encode past limit: got %v, want ErrCounterExhausted", err)
+		}
+	}
+}
+
+func TestFIPSModeCipher(t *testing.T) {
+	fipsMode.Store(true)
+	defer fipsMode.Store(false)
+
+	km, err := DeriveKeyMaterial("secret", make([]byte, HandshakeNonceSize), make([]byte, HandshakeNonceSize))
+	if err != nil {
+		t.Fatalf("derive keys: %v", err)
+	}
+	send, _, err := NewClientCipherStates(km, nil)
+	if err != nil {
+		t.Fatalf("cipher states: %v", err)
+	}
+	_, recv, err := NewServerCipherStates(km, nil)
+	if err != nil {
+		t.Fatalf("cipher states: %v", err)
+	}
+	if name := fmt.Sprintf("%T", send.aead); !strings.Contains(name, "gcm") {
+		t.Fatalf("fips mode uses %s, want aes-gcm", name)
+	}
+	ciphertext := send.Seal(nil, 1, []byte("hdr"), []byte("payload"))
+	plain, err := recv.Open(nil, 1, []byte("hdr"), ciphertext)
+	if err != nil || string(plain) != "payload" {
+		t.Fatalf("open: %q, %v", plain, err)
+	}
+}
+
+func TestHybridKeyMaterial(t *testing.T) {
+	clientNonce := bytes.Repeat([]byte{1}, HandshakeNonceSize)
+	serverNonce := bytes.Repeat([]byte{2}, HandshakeNonceSize)
+	dk, err := NewKEMKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverSecret, ciphertext, err := EncapsulateKEM(dk.EncapsulationKey().Bytes())
+	if err != nil {
+		t.Fatalf("encapsulate: %v", err)
+	}
+	clientSecret, err := DecapsulateKEM(dk, ciphertext)
+	if err != nil {
+		t.Fatalf("decapsulate: %v", err)
+	}
+
+	server, err := DeriveHybridKeyMaterial("secret", clientNonce, serverNonce, serverSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := DeriveHybridKeyMaterial("secret", clientNonce, serverNonce, clientSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client != server {
+		t.Fatal("client and server keys differ")
+	}
+	classical, err := DeriveKeyMaterial("secret", clientNonce, serverNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if classical == server {
+		t.Fatal("kem secret did not change the keys")
+	}
+}
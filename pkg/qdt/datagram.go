@@ -2,19 +2,41 @@ package qdt
 
 import "encoding/binary"
 
+// compactFlag marks a compact header in the byte after the magic, which
+// holds the version in the full form.
+const compactFlag = 0x80
+
+// Header is a datagram header. A compact header carries only the type, the
+// low 16 bits of the session ID and the low 32 bits of the counter; the
+// receiver restores the counter from its replay window.
 type Header struct {
 	Version   uint8
 	Type      MessageType
 	Flags     uint8
 	SessionID uint64
 	Counter   uint64
+	Compact   bool
+}
+
+// Len returns the encoded size of h.
+func (h Header) Len() int {
+	if h.Compact {
+		return CompactHeaderLen
+	}
+	return HeaderLen
 }
 
 func WriteHeader(b []byte, h Header) {
-	if len(b) < HeaderLen {
+	if len(b) < h.Len() {
 		return
 	}
 	copy(b[0:3], Magic)
+	if h.Compact {
+		b[3] = compactFlag | byte(h.Type)
+		binary.BigEndian.PutUint16(b[4:6], uint16(h.SessionID))
+		binary.BigEndian.PutUint32(b[6:10], uint32(h.Counter))
+		return
+	}
 	b[3] = h.Version
 	b[4] = byte(h.Type)
 	b[5] = h.Flags
@@ -24,18 +46,33 @@ func WriteHeader(b []byte, h Header) {
 
 func AppendHeader(dst []byte, h Header) []byte {
 	start := len(dst)
-	dst = append(dst, make([]byte, HeaderLen)...)
-	WriteHeader(dst[start:start+HeaderLen], h)
+	n := h.Len()
+	dst = append(dst, make([]byte, n)...)
+	WriteHeader(dst[start:start+n], h)
 	return dst
 }
 
+// ParseHeader decodes a full or compact header and returns the rest of b.
 func ParseHeader(b []byte) (Header, []byte, error) {
-	if len(b) < HeaderLen {
+	if len(b) < CompactHeaderLen {
 		return Header{}, nil, ErrInvalidDatagram
 	}
 	if b[0] != 'Q' || b[1] != 'D' || b[2] != 'T' {
 		return Header{}, nil, ErrBadMagic
 	}
+	if b[3]&compactFlag != 0 {
+		h := Header{
+			Version:   ProtocolVersion,
+			Type:      MessageType(b[3] &^ compactFlag),
+			SessionID: uint64(binary.BigEndian.Uint16(b[4:6])),
+			Counter:   uint64(binary.BigEndian.Uint32(b[6:10])),
+			Compact:   true,
+		}
+		return h, b[CompactHeaderLen:], nil
+	}
+	if len(b) < HeaderLen {
+		return Header{}, nil, ErrInvalidDatagram
+	}
 	version := b[3]
 	if version != ProtocolVersion {
 		return Header{}, nil, ErrBadVersion
@@ -0,0 +1,154 @@
+package qdt
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Decoder decodes datagrams with its own Reassembler and coalesced-packet
+// state, so several can run in parallel on one Tunnel. The cipher, replay
+// window and stats stay shared.
+type Decoder struct {
+	t     *Tunnel
+	Reasm *Reassembler
+	st    decodeState
+}
+
+// NewDecoder returns a Decoder whose Reassembler has the limits of t.Reasm.
+func (t *Tunnel) NewDecoder() *Decoder {
+	return &Decoder{t: t, Reasm: t.Reasm.partition(1)}
+}
+
+// DecodeDatagramInto is Tunnel.DecodeDatagramInto on the Decoder's state.
+func (d *Decoder) DecodeDatagramInto(dst []byte, raw []byte) ([]byte, bool, error) {
+	hdr, plain, dst, pooled, err := d.t.openDatagram(dst, raw)
+	if err != nil {
+		return nil, false, err
+	}
+	return d.t.handleMessage(&d.st, d.Reasm, hdr.Type, plain, dst, pooled)
+}
+
+// NextCoalesced is Tunnel.NextCoalesced on the Decoder's state.
+func (d *Decoder) NextCoalesced(dst []byte) ([]byte, bool) {
+	return d.t.nextCoalesced(&d.st, dst)
+}
+
+const decodeQueue = 64
+
+// PumpConnToTunConcurrent is PumpConnToTunBuffered with decryption spread
+// over workers goroutines. Datagrams are dispatched by counter, so a replayed
+// copy is checked on the same goroutine as the original. Decoder N owns the
+// fragment IDs with id % workers == N; fragments decrypted elsewhere are
+// handed to it and dropped if it is backed up. Writes to tun are serialized,
+// but packets may reach it out of order, and the Tunnel's handlers may run
+// on any worker.
+func (t *Tunnel) PumpConnToTunConcurrent(ctx context.Context, tun io.Writer, conn DatagramConn, workers, maxPkt int) error {
+	if workers <= 1 {
+		return t.PumpConnToTunBuffered(ctx, tun, conn, maxPkt)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wmu sync.Mutex
+	write := func(pkt []byte) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		if _, err := tun.Write(pkt); err != nil {
+			return &TransportError{Op: "write tun", Err: err}
+		}
+		return nil
+	}
+
+	in := make([]chan []byte, workers)
+	frags := make([]chan []byte, workers)
+	for i := range in {
+		in[i] = make(chan []byte, decodeQueue)
+		frags[i] = make(chan []byte, decodeQueue)
+	}
+	var wg sync.WaitGroup
+	for i := range workers {
+		d := t.NewDecoder()
+		d.Reasm = t.Reasm.partition(workers)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := d.pump(ctx, i, in[i], frags, write, maxPkt); err != nil {
+				cancel(err)
+			}
+		}()
+	}
+
+	var err error
+	for err == nil {
+		var b []byte
+		if b, err = conn.ReceiveDatagram(ctx); err != nil {
+			err = &TransportError{Op: "receive datagram", Err: err}
+			break
+		}
+		hdr, _, perr := ParseHeader(b)
+		if perr != nil {
+			t.stats.decodeErrors.Add(1)
+			continue
+		}
+		select {
+		case in[hdr.Counter%uint64(workers)] <- b:
+		case <-ctx.Done():
+		}
+		err = ctx.Err()
+	}
+	cancel(err)
+	wg.Wait()
+	return context.Cause(ctx)
+}
+
+// pump decodes the datagrams of one PumpConnToTunConcurrent worker.
+func (d *Decoder) pump(ctx context.Context, self int, in <-chan []byte, frags []chan []byte, write func([]byte) error, maxPkt int) error {
+	t := d.t
+	buf := make([]byte, maxPkt)
+	for {
+		var pkt []byte
+		var err error
+		select {
+		case <-ctx.Done():
+			return nil
+		case raw := <-in:
+			hdr, plain, dst, pooled, oerr := t.openDatagram(buf[:0], raw)
+			if oerr != nil {
+				err = oerr
+				break
+			}
+			if hdr.Type == MsgFragment && len(plain) >= t.fragHeaderLen() {
+				if owner := int(t.fragIDLow(plain) % uint32(len(frags))); owner != self {
+					select {
+					case frags[owner] <- append([]byte(nil), plain...):
+					default:
+						t.stats.decodeErrors.Add(1)
+					}
+					continue
+				}
+			}
+			pkt, _, err = t.handleMessage(&d.st, d.Reasm, hdr.Type, plain, dst, pooled)
+		case frag := <-frags[self]:
+			pkt, _, err = t.handleMessage(&d.st, d.Reasm, MsgFragment, frag, buf[:0], true)
+		}
+		if err != nil {
+			t.countDecodeError(err)
+			continue
+		}
+		if len(pkt) > 0 {
+			if err := write(pkt); err != nil {
+				return err
+			}
+		}
+		for {
+			next, ok := d.NextCoalesced(buf)
+			if !ok {
+				break
+			}
+			if err := write(next); err != nil {
+				return err
+			}
+		}
+	}
+}
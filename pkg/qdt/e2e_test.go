@@ -0,0 +1,153 @@
+package qdt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+
+	"qdt/internal/tun"
+)
+
+// FakeDatagramConn is a channel-backed DatagramConn. Datagrams sent on one
+// end of a pair are received on the other.
+type FakeDatagramConn struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func newFakeDatagramPair(depth int) (*FakeDatagramConn, *FakeDatagramConn) {
+	ab := make(chan []byte, depth)
+	ba := make(chan []byte, depth)
+	return &FakeDatagramConn{in: ba, out: ab}, &FakeDatagramConn{in: ab, out: ba}
+}
+
+func (c *FakeDatagramConn) SendDatagram(b []byte) error {
+	c.out <- append([]byte(nil), b...)
+	return nil
+}
+
+func (c *FakeDatagramConn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case b := <-c.in:
+		return b, nil
+	}
+}
+
+func buildIPv4Packet(src, dst [4]byte, payload []byte) []byte {
+	pkt := make([]byte, 20+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = 17
+	copy(pkt[12:16], src[:])
+	copy(pkt[16:20], dst[:])
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pkt[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	binary.BigEndian.PutUint16(pkt[10:12], ^uint16(sum))
+	copy(pkt[20:], payload)
+	return pkt
+}
+
+func newTunnelPair(t *testing.T, sessionID uint64, mtu int) (client, server *Tunnel) {
+	t.Helper()
+	clientNonce, err := NewHandshakeNonce()
+	if err != nil {
+		t.Fatalf("nonce: %v", err)
+	}
+	serverNonce, err := NewHandshakeNonce()
+	if err != nil {
+		t.Fatalf("nonce: %v", err)
+	}
+	km, err := DeriveKeyMaterial("e2e-secret", clientNonce, serverNonce)
+	if err != nil {
+		t.Fatalf("derive keys: %v", err)
+	}
+	cSend, cRecv, err := NewClientCipherStates(km, NewReplayWindow(2048))
+	if err != nil {
+		t.Fatalf("client cipher states: %v", err)
+	}
+	sSend, sRecv, err := NewServerCipherStates(km, NewReplayWindow(2048))
+	if err != nil {
+		t.Fatalf("server cipher states: %v", err)
+	}
+	return NewTunnel(sessionID, mtu, cSend, cRecv), NewTunnel(sessionID, mtu, sSend, sRecv)
+}
+
+func TestEndToEndTunnelPair(t *testing.T) {
+	const packets = 100
+	client, server := newTunnelPair(t, 99, 400)
+	clientDev := tun.NewFakeDevice(packets)
+	serverDev := tun.NewFakeDevice(packets)
+	clientConn, serverConn := newFakeDatagramPair(packets * 8)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	pump := func(f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = f()
+		}()
+	}
+	pump(func() error { return client.PumpTunToConn(ctx, clientDev, clientConn, 65535) })
+	pump(func() error { return client.PumpConnToTunBuffered(ctx, clientDev, clientConn, 65535) })
+	pump(func() error { return server.PumpTunToConn(ctx, serverDev, serverConn, 65535) })
+	pump(func() error { return server.PumpConnToTunBuffered(ctx, serverDev, serverConn, 65535) })
+
+	clientIP := [4]byte{10, 8, 0, 2}
+	remoteIP := [4]byte{192, 0, 2, 1}
+	var sent [][]byte
+	for i := 0; i < packets; i++ {
+		// Every third packet exceeds the 400 byte MTU and is fragmented.
+		size := 32 + i
+		if i%3 == 0 {
+			size = 900 + i
+		}
+		payload := bytes.Repeat([]byte{byte(i)}, size)
+		pkt := buildIPv4Packet(clientIP, remoteIP, payload)
+		sent = append(sent, pkt)
+		clientDev.InjectPacket(pkt)
+	}
+	for i, want := range sent {
+		got := waitPacket(t, serverDev)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("packet %d mismatch: got %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+
+	reply := buildIPv4Packet(remoteIP, clientIP, []byte("pong"))
+	serverDev.InjectPacket(reply)
+	if got := waitPacket(t, clientDev); !bytes.Equal(got, reply) {
+		t.Fatalf("reply mismatch")
+	}
+
+	cancel()
+	clientDev.Close()
+	serverDev.Close()
+	wg.Wait()
+
+	var dgram []byte
+	err := client.EncodePacket(reply, func(b []byte) error {
+		dgram = append([]byte(nil), b...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if _, err := server.DecodeDatagram(dgram); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if _, err := server.DecodeDatagram(dgram); !errors.Is(err, ErrReplay) {
+		t.Fatalf("expected ErrReplay, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package qdt
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNoCipher           = errors.New("cipher not set")
+	ErrInvalidMTU         = errors.New("invalid mtu")
+	ErrUnknownMessageType = errors.New("unknown message type")
+	ErrInvalidRoute       = errors.New("invalid route")
+)
+
+// HandshakeError reports a failure while negotiating or authenticating a session.
+type HandshakeError struct {
+	Reason string
+	Err    error
+}
+
+func (e *HandshakeError) Error() string {
+	if e.Err == nil {
+		return "handshake: " + e.Reason
+	}
+	return fmt.Sprintf("handshake: %s: %v", e.Reason, e.Err)
+}
+
+func (e *HandshakeError) Unwrap() error { return e.Err }
+
+// CipherError reports a key derivation, seal or open failure.
+type CipherError struct {
+	Op  string
+	Err error
+}
+
+func (e *CipherError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *CipherError) Unwrap() error { return e.Err }
+
+// FragmentError reports an invalid or inconsistent fragment.
+type FragmentError struct {
+	ID     uint64
+	Reason string
+	Err    error
+}
+
+func (e *FragmentError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("fragment %d: %s", e.ID, e.Reason)
+	}
+	return fmt.Sprintf("fragment %d: %s: %v", e.ID, e.Reason, e.Err)
+}
+
+func (e *FragmentError) Unwrap() error { return e.Err }
+
+// TransportError reports a failure of the TUN device or datagram connection.
+type TransportError struct {
+	Op  string
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *TransportError) Unwrap() error { return e.Err }
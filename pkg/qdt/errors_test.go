@@ -0,0 +1,69 @@
+package qdt
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type failingConn struct{ err error }
+
+func (c failingConn) SendDatagram([]byte) error { return c.err }
+
+func (c failingConn) ReceiveDatagram(context.Context) ([]byte, error) { return nil, c.err }
+
+func TestTypedErrors(t *testing.T) {
+	_, err := DeriveKeyMaterial("", nil, nil)
+	var hsErr *HandshakeError
+	if !errors.As(err, &hsErr) {
+		t.Fatalf("expected HandshakeError, got %v", err)
+	}
+
+	_, err = DecodeConnectRequest(strings.NewReader(`{"version":9}`))
+	if !errors.As(err, &hsErr) {
+		t.Fatalf("expected HandshakeError for version, got %v", err)
+	}
+
+	client, server := newTunnelPair(t, 1, DefaultMTU)
+	var dgram []byte
+	err = client.EncodePacket([]byte("payload"), func(b []byte) error {
+		dgram = append([]byte(nil), b...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	tampered := append([]byte(nil), dgram...)
+	tampered[len(tampered)-1] ^= 0xff
+	_, err = server.DecodeDatagram(tampered)
+	var cErr *CipherError
+	if !errors.As(err, &cErr) {
+		t.Fatalf("expected CipherError, got %v", err)
+	}
+	if _, err := server.DecodeDatagram(dgram); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	_, err = server.DecodeDatagram(dgram)
+	if !errors.As(err, &cErr) || !errors.Is(err, ErrReplay) {
+		t.Fatalf("expected CipherError wrapping ErrReplay, got %v", err)
+	}
+
+	connErr := errors.New("conn gone")
+	err = client.PumpConnToTun(context.Background(), nil, failingConn{err: connErr})
+	var tErr *TransportError
+	if !errors.As(err, &tErr) || !errors.Is(err, connErr) {
+		t.Fatalf("expected TransportError, got %v", err)
+	}
+	if errors.As(err, &cErr) || errors.As(err, &hsErr) {
+		t.Fatalf("transport error matched wrong type")
+	}
+
+	reasm := NewReassembler(time.Second, 4, 0, 0)
+	_, err = reasm.Push(EncodeFragmentHeader(5, 0, 0))
+	var fErr *FragmentError
+	if !errors.As(err, &fErr) || fErr.ID != 5 {
+		t.Fatalf("expected FragmentError for id 5, got %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package qdt
+
+import "encoding/binary"
+
+// CapFragEpoch is advertised in ConnectRequest.Caps and ConnectResponse.Caps
+// by peers that send and accept 64-bit fragment IDs.
+const CapFragEpoch = "frag-epoch"
+
+// EnableFragEpoch makes the tunnel send fragments with 64-bit IDs that carry
+// the Fragmenter epoch, so a reassembler cannot mix up the fragments of
+// packets 2^32 IDs apart, and expect them from the peer. It must be called
+// before the tunnel carries traffic, once CapFragEpoch was negotiated.
+func (t *Tunnel) EnableFragEpoch() {
+	t.mtuMu.Lock()
+	defer t.mtuMu.Unlock()
+	t.fragEpoch = true
+	t.recomputeMTU()
+}
+
+// FragEpoch returns the number of times the fragment ID of t has wrapped.
+func (t *Tunnel) FragEpoch() uint32 {
+	return t.Frag.Epoch()
+}
+
+func (t *Tunnel) fragHeaderLen() int {
+	if t.fragEpoch {
+		return fragEpochHeaderLen
+	}
+	return fragHeaderLen
+}
+
+// nextFragID returns the ID for the fragments of the next packet.
+func (t *Tunnel) nextFragID() uint64 {
+	if t.fragEpoch {
+		return t.Frag.NextID64()
+	}
+	return uint64(t.Frag.NextID())
+}
+
+func (t *Tunnel) writeFragmentHeader(dst []byte, id uint64, offset, total uint32) {
+	if t.fragEpoch {
+		WriteFragmentHeader64(dst, id, offset, total)
+		return
+	}
+	WriteFragmentHeader(dst, uint32(id), offset, total)
+}
+
+func (t *Tunnel) pushFragment(reasm *Reassembler, plain []byte) ([]byte, error) {
+	if t.fragEpoch {
+		return reasm.Push64(plain)
+	}
+	return reasm.Push(plain)
+}
+
+// fragIDLow returns the low 32 bits of the ID of fragment message plain,
+// which must hold a full fragment header.
+func (t *Tunnel) fragIDLow(plain []byte) uint32 {
+	if t.fragEpoch {
+		return binary.BigEndian.Uint32(plain[4:8])
+	}
+	return binary.BigEndian.Uint32(plain)
+}
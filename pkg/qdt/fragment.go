@@ -1,9 +1,9 @@
 package qdt
 
 import (
+	"container/heap"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -11,21 +11,72 @@ import (
 )
 
 const (
-	fragHeaderLen        = 12
-	DefaultMaxReassembly = 65535
+	fragHeaderLen                 = 12
+	fragEpochHeaderLen            = 16
+	DefaultMaxReassembly          = 65535
+	DefaultMaxReassemblyAggregate = 4 << 20
+	DefaultMaxFragmentsPerPacket  = 256
+	DefaultReassemblyTTL          = 5 * time.Second
+
+	// maxNAKRounds bounds the NAKs sent for one packet.
+	maxNAKRounds = 3
+	// maxNAKOffsets bounds the offsets listed in one NAK.
+	maxNAKOffsets = 64
 )
 
 var (
 	ErrFragmentTooSmall = errors.New("fragment payload too small")
 	ErrFragmentOverlap  = errors.New("fragment overlap")
+
+	ErrReassemblyMemoryExceeded = errors.New("reassembly memory limit exceeded")
+	ErrTooManyFragments         = errors.New("too many fragments")
+	ErrTooManyPartialPackets    = errors.New("too many partial packets")
 )
 
+// EntryBudget caps the partial packets held by several Reassemblers
+// together, e.g. all sessions of a server.
+type EntryBudget struct {
+	max  int64
+	used atomic.Int64
+}
+
+func NewEntryBudget(max int) *EntryBudget {
+	return &EntryBudget{max: int64(max)}
+}
+
+func (b *EntryBudget) acquire() bool {
+	if b.used.Add(1) > b.max {
+		b.used.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (b *EntryBudget) release() {
+	b.used.Add(-1)
+}
+
+// Fragmenter numbers fragmented packets. IDs are 32 bits on the wire
+// unless CapFragEpoch was negotiated; the epoch counts how often they
+// wrapped.
 type Fragmenter struct {
-	nextID uint32
+	nextID uint64
 }
 
 func (f *Fragmenter) NextID() uint32 {
-	return atomic.AddUint32(&f.nextID, 1)
+	return uint32(atomic.AddUint64(&f.nextID, 1))
+}
+
+// NextID64 returns the next ID with the epoch in its upper 16 bits, as sent
+// in the headers written by WriteFragmentHeader64.
+func (f *Fragmenter) NextID64() uint64 {
+	n := atomic.AddUint64(&f.nextID, 1)
+	return n>>32<<48 | n&0xffffffff
+}
+
+// Epoch returns the number of times the 32-bit ID has wrapped.
+func (f *Fragmenter) Epoch() uint32 {
+	return uint32(atomic.LoadUint64(&f.nextID) >> 32)
 }
 
 func EncodeFragmentHeader(id uint32, offset uint32, total uint32) []byte {
@@ -54,18 +105,68 @@ func DecodeFragmentHeader(b []byte) (id uint32, offset uint32, total uint32, pay
 	return id, offset, total, payload, nil
 }
 
+// WriteFragmentHeader64 writes the header of a fragment whose ID carries the
+// epoch. Layout: FragID[8] | Offset[4] | Total[4].
+func WriteFragmentHeader64(dst []byte, id uint64, offset uint32, total uint32) {
+	if len(dst) < fragEpochHeaderLen {
+		return
+	}
+	binary.BigEndian.PutUint64(dst[0:8], id)
+	binary.BigEndian.PutUint32(dst[8:12], offset)
+	binary.BigEndian.PutUint32(dst[12:16], total)
+}
+
+func DecodeFragmentHeader64(b []byte) (id uint64, offset uint32, total uint32, payload []byte, err error) {
+	if len(b) < fragEpochHeaderLen {
+		return 0, 0, 0, nil, ErrFragmentTooSmall
+	}
+	id = binary.BigEndian.Uint64(b[0:8])
+	offset = binary.BigEndian.Uint32(b[8:12])
+	total = binary.BigEndian.Uint32(b[12:16])
+	payload = b[fragEpochHeaderLen:]
+	return id, offset, total, payload, nil
+}
+
 type Reassembler struct {
+	// MaxFragmentsPerPacket bounds the segments tracked for one packet, so
+	// tiny fragments cannot inflate the bookkeeping; zero selects
+	// DefaultMaxFragmentsPerPacket.
+	MaxFragmentsPerPacket int
+	// Budget, if set, is shared with other Reassemblers and limits their
+	// partial packets together.
+	Budget *EntryBudget
+	// OnAssembled, if set, is called with the time from the first fragment
+	// of a packet to its reassembly.
+	OnAssembled func(wait time.Duration)
+	// OnMissing, if set, is called outside the lock with the offsets still
+	// missing once the last fragment of a packet has arrived, so they can
+	// be requested with a MsgFragmentNAK. A NAK names the packet by the low
+	// 32 bits of its ID.
+	OnMissing func(id uint32, missing []uint32)
+
 	mu         sync.Mutex
 	ttl        time.Duration
 	maxEntries int
 	maxTotal   int
-	frags      map[uint32]*fragState
+	maxAggr    int64
+	frags      map[uint64]*fragState
+	order      fragOrder
+	seq        uint64
 	lastSweep  time.Time
+	totalBytes atomic.Int64
 }
 
 type fragState struct {
-	total     int
-	received  int
+	id       uint64
+	seq      uint64
+	index    int
+	total    int
+	received int
+	// sawLast is set once the fragment ending at total has arrived; as
+	// fragments are sent in order, anything missing after it was lost.
+	sawLast   bool
+	naks      int
+	firstSeen time.Time
 	updatedAt time.Time
 	buf       []byte
 	segments  []fragSegment
@@ -76,9 +177,11 @@ type fragSegment struct {
 	end   int
 }
 
-func NewReassembler(ttl time.Duration, maxEntries int, maxTotal int) *Reassembler {
+// NewReassembler bounds each packet to maxTotal bytes and all partial packets
+// together to maxAggregate bytes; zero selects the defaults.
+func NewReassembler(ttl time.Duration, maxEntries int, maxTotal int, maxAggregate int) *Reassembler {
 	if ttl <= 0 {
-		ttl = 5 * time.Second
+		ttl = DefaultReassemblyTTL
 	}
 	if maxEntries <= 0 {
 		maxEntries = 1024
@@ -86,7 +189,29 @@ func NewReassembler(ttl time.Duration, maxEntries int, maxTotal int) *Reassemble
 	if maxTotal <= 0 {
 		maxTotal = DefaultMaxReassembly
 	}
-	return &Reassembler{ttl: ttl, maxEntries: maxEntries, maxTotal: maxTotal, frags: make(map[uint32]*fragState)}
+	if maxAggregate <= 0 {
+		maxAggregate = DefaultMaxReassemblyAggregate
+	}
+	return &Reassembler{ttl: ttl, maxEntries: maxEntries, maxTotal: maxTotal, maxAggr: int64(maxAggregate), frags: make(map[uint64]*fragState)}
+}
+
+// partition returns an empty Reassembler with r's settings and 1/n of its
+// entry and memory limits, for one of n decoders splitting the fragment IDs.
+func (r *Reassembler) partition(n int) *Reassembler {
+	if r == nil {
+		return nil
+	}
+	p := NewReassembler(r.ttl, max(r.maxEntries/n, 1), r.maxTotal, int(max(r.maxAggr/int64(n), int64(r.maxTotal))))
+	p.MaxFragmentsPerPacket = r.MaxFragmentsPerPacket
+	p.Budget = r.Budget
+	p.OnAssembled = r.OnAssembled
+	p.OnMissing = r.OnMissing
+	return p
+}
+
+// TotalBytes reports the memory currently held by partial packets.
+func (r *Reassembler) TotalBytes() int64 {
+	return r.totalBytes.Load()
 }
 
 func (r *Reassembler) Push(b []byte) ([]byte, error) {
@@ -94,16 +219,35 @@ func (r *Reassembler) Push(b []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	return r.push(uint64(id), offset, total, payload)
+}
+
+// Push64 is Push for fragments with the header of WriteFragmentHeader64.
+func (r *Reassembler) Push64(b []byte) ([]byte, error) {
+	id, offset, total, payload, err := DecodeFragmentHeader64(b)
+	if err != nil {
+		return nil, err
+	}
+	return r.push(id, offset, total, payload)
+}
+
+func (r *Reassembler) push(id uint64, offset uint32, total uint32, payload []byte) ([]byte, error) {
 	if total == 0 {
-		return nil, fmt.Errorf("invalid fragment total")
+		return nil, &FragmentError{ID: id, Reason: "invalid total"}
 	}
 	if r.maxTotal > 0 && int(total) > r.maxTotal {
-		return nil, fmt.Errorf("fragment total too large")
+		return nil, &FragmentError{ID: id, Reason: "total too large"}
 	}
 	if int(offset)+len(payload) > int(total) {
-		return nil, fmt.Errorf("fragment exceeds total")
+		return nil, &FragmentError{ID: id, Reason: "exceeds total"}
 	}
 
+	var missing []uint32
+	defer func() {
+		if missing != nil {
+			r.OnMissing(uint32(id), missing)
+		}
+	}()
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if len(r.frags) >= r.maxEntries {
@@ -111,13 +255,43 @@ func (r *Reassembler) Push(b []byte) ([]byte, error) {
 	}
 	state := r.frags[id]
 	if state == nil {
+		if len(r.frags) >= r.maxEntries {
+			r.evictOldestLocked()
+		}
+		if r.totalBytes.Load()+int64(total) > r.maxAggr {
+			r.sweepLocked()
+			if r.totalBytes.Load()+int64(total) > r.maxAggr {
+				return nil, &FragmentError{ID: id, Reason: "reassembly", Err: ErrReassemblyMemoryExceeded}
+			}
+		}
+		if r.Budget != nil && !r.Budget.acquire() {
+			// Make room at our own expense rather than another session's.
+			if len(r.frags) == 0 {
+				return nil, &FragmentError{ID: id, Reason: "reassembly", Err: ErrTooManyPartialPackets}
+			}
+			r.evictOldestLocked()
+			if !r.Budget.acquire() {
+				return nil, &FragmentError{ID: id, Reason: "reassembly", Err: ErrTooManyPartialPackets}
+			}
+		}
+		now := time.Now()
 		state = &fragState{
+			id:        id,
+			seq:       r.seq,
 			total:     int(total),
-			updatedAt: time.Now(),
+			firstSeen: now,
+			updatedAt: now,
 			buf:       make([]byte, int(total)),
 			segments:  make([]fragSegment, 0, 8),
 		}
+		r.seq++
 		r.frags[id] = state
+		heap.Push(&r.order, state)
+		r.totalBytes.Add(int64(total))
+	}
+	if len(state.segments) >= r.maxFragments() {
+		r.deleteLocked(id)
+		return nil, &FragmentError{ID: id, Reason: "reassembly", Err: ErrTooManyFragments}
 	}
 	off := int(offset)
 	end := off + len(payload)
@@ -130,23 +304,26 @@ func (r *Reassembler) Push(b []byte) ([]byte, error) {
 			state.received += len(payload)
 			state.updatedAt = time.Now()
 			if state.received < state.total {
+				missing = r.checkMissingLocked(state, end)
 				return nil, nil
 			}
-			assembled, err := assemble(state)
-			delete(r.frags, id)
-			return assembled, err
+			return r.assembleLocked(id, state)
 		}
 	}
 	idx := sort.Search(len(segs), func(i int) bool {
 		return segs[i].start >= off
 	})
+	// A fragment resent after a NAK may cross one that arrived late.
+	if idx < len(segs) && segs[idx].start == off && segs[idx].end == end {
+		return nil, nil
+	}
 	if idx > 0 && segs[idx-1].end > off {
-		delete(r.frags, id)
-		return nil, ErrFragmentOverlap
+		r.deleteLocked(id)
+		return nil, &FragmentError{ID: id, Reason: "reassembly", Err: ErrFragmentOverlap}
 	}
 	if idx < len(segs) && segs[idx].start < end {
-		delete(r.frags, id)
-		return nil, ErrFragmentOverlap
+		r.deleteLocked(id)
+		return nil, &FragmentError{ID: id, Reason: "reassembly", Err: ErrFragmentOverlap}
 	}
 	copy(state.buf[off:end], payload)
 	state.segments = append(segs, fragSegment{})
@@ -155,13 +332,72 @@ func (r *Reassembler) Push(b []byte) ([]byte, error) {
 	state.received += len(payload)
 	state.updatedAt = time.Now()
 	if state.received < state.total {
+		missing = r.checkMissingLocked(state, end)
 		return nil, nil
 	}
-	assembled, err := assemble(state)
-	delete(r.frags, id)
+	return r.assembleLocked(id, state)
+}
+
+// checkMissingLocked returns the offsets to NAK after a fragment ending at
+// end was added to an incomplete packet, or nil.
+func (r *Reassembler) checkMissingLocked(state *fragState, end int) []uint32 {
+	if end == state.total {
+		state.sawLast = true
+	}
+	if r.OnMissing == nil || !state.sawLast || state.naks >= maxNAKRounds {
+		return nil
+	}
+	state.naks++
+	return state.missingOffsets(maxNAKOffsets)
+}
+
+// missingOffsets lists up to limit offsets of fragments not yet received.
+// All fragments but the last have the same size, so a gap is split at that
+// size when a full fragment shows it; otherwise only its start is listed.
+func (s *fragState) missingOffsets(limit int) []uint32 {
+	step := 0
+	for _, seg := range s.segments {
+		if seg.end != s.total {
+			step = seg.end - seg.start
+			break
+		}
+	}
+	var out []uint32
+	pos := 0
+	for i := 0; i <= len(s.segments) && len(out) < limit; i++ {
+		next := s.total
+		if i < len(s.segments) {
+			next = s.segments[i].start
+		}
+		for off := pos; off < next && len(out) < limit; off += step {
+			out = append(out, uint32(off))
+			if step == 0 {
+				break
+			}
+		}
+		if i < len(s.segments) {
+			pos = s.segments[i].end
+		}
+	}
+	return out
+}
+
+func (r *Reassembler) assembleLocked(id uint64, state *fragState) ([]byte, error) {
+	assembled, err := assemble(id, state)
+	r.deleteLocked(id)
+	if err == nil && r.OnAssembled != nil {
+		r.OnAssembled(time.Since(state.firstSeen))
+	}
 	return assembled, err
 }
 
+func (r *Reassembler) maxFragments() int {
+	if r.MaxFragmentsPerPacket > 0 {
+		return r.MaxFragmentsPerPacket
+	}
+	return DefaultMaxFragmentsPerPacket
+}
+
 func (r *Reassembler) sweepLocked() {
 	now := time.Now()
 	if now.Sub(r.lastSweep) < r.ttl {
@@ -169,25 +405,75 @@ func (r *Reassembler) sweepLocked() {
 	}
 	for id, state := range r.frags {
 		if now.Sub(state.updatedAt) > r.ttl {
-			delete(r.frags, id)
+			r.deleteLocked(id)
 		}
 	}
 	r.lastSweep = now
 }
 
-func assemble(state *fragState) ([]byte, error) {
+// Reset drops all partial packets, returning their share of the Budget.
+func (r *Reassembler) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id := range r.frags {
+		r.deleteLocked(id)
+	}
+}
+
+// evictOldestLocked drops the partial packet that was started first.
+func (r *Reassembler) evictOldestLocked() {
+	if len(r.order) > 0 {
+		r.deleteLocked(r.order[0].id)
+	}
+}
+
+func (r *Reassembler) deleteLocked(id uint64) {
+	if state, ok := r.frags[id]; ok {
+		r.totalBytes.Add(-int64(state.total))
+		delete(r.frags, id)
+		heap.Remove(&r.order, state.index)
+		if r.Budget != nil {
+			r.Budget.release()
+		}
+	}
+}
+
+// fragOrder is a min-heap of partial packets by start order.
+type fragOrder []*fragState
+
+func (o fragOrder) Len() int           { return len(o) }
+func (o fragOrder) Less(i, j int) bool { return o[i].seq < o[j].seq }
+func (o fragOrder) Swap(i, j int) {
+	o[i], o[j] = o[j], o[i]
+	o[i].index = i
+	o[j].index = j
+}
+func (o *fragOrder) Push(x any) {
+	s := x.(*fragState)
+	s.index = len(*o)
+	*o = append(*o, s)
+}
+func (o *fragOrder) Pop() any {
+	old := *o
+	s := old[len(old)-1]
+	old[len(old)-1] = nil
+	*o = old[:len(old)-1]
+	return s
+}
+
+func assemble(id uint64, state *fragState) ([]byte, error) {
 	if state.received != state.total {
-		return nil, fmt.Errorf("incomplete reassembly")
+		return nil, &FragmentError{ID: id, Reason: "incomplete reassembly"}
 	}
 	pos := 0
 	for _, seg := range state.segments {
 		if seg.start != pos {
-			return nil, fmt.Errorf("fragment gap")
+			return nil, &FragmentError{ID: id, Reason: "gap"}
 		}
 		pos = seg.end
 	}
 	if pos != state.total {
-		return nil, fmt.Errorf("fragment size mismatch")
+		return nil, &FragmentError{ID: id, Reason: "size mismatch"}
 	}
 	return state.buf, nil
 }
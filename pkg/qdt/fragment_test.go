@@ -2,6 +2,8 @@ package qdt
 
 import (
 	"bytes"
+	"errors"
+	"slices"
 	"testing"
 	"time"
 )
@@ -10,7 +12,9 @@ func TestReassembly(t *testing.T) {
 	payload := bytes.Repeat([]byte("a"), 4000)
 	frag := &Fragmenter{}
 	id := frag.NextID()
-	reasm := NewReassembler(2*time.Second, 10, 0)
+	reasm := NewReassembler(2*time.Second, 10, 0, 0)
+	assembled := 0
+	reasm.OnAssembled = func(wait time.Duration) { assembled++ }
 
 	chunk := 1000
 	for offset := 0; offset < len(payload); offset += chunk {
@@ -33,4 +37,105 @@ func TestReassembly(t *testing.T) {
 			}
 		}
 	}
+	if assembled != 1 {
+		t.Fatalf("OnAssembled called %d times, want 1", assembled)
+	}
+}
+
+func TestReassemblyMemoryLimit(t *testing.T) {
+	reasm := NewReassembler(time.Minute, 10, 0, 3000)
+	if _, err := reasm.Push(append(EncodeFragmentHeader(1, 0, 2000), make([]byte, 100)...)); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if got := reasm.TotalBytes(); got != 2000 {
+		t.Fatalf("total bytes %d, want 2000", got)
+	}
+	_, err := reasm.Push(append(EncodeFragmentHeader(2, 0, 2000), make([]byte, 100)...))
+	if !errors.Is(err, ErrReassemblyMemoryExceeded) {
+		t.Fatalf("expected ErrReassemblyMemoryExceeded, got %v", err)
+	}
+	out, err := reasm.Push(append(EncodeFragmentHeader(1, 100, 2000), make([]byte, 1900)...))
+	if err != nil || len(out) != 2000 {
+		t.Fatalf("complete: %d %v", len(out), err)
+	}
+	if got := reasm.TotalBytes(); got != 0 {
+		t.Fatalf("total bytes %d after completion, want 0", got)
+	}
+}
+
+func TestReassemblyFragmentLimit(t *testing.T) {
+	reasm := NewReassembler(time.Minute, 10, 0, 0)
+	var err error
+	for i := 0; i <= DefaultMaxFragmentsPerPacket; i++ {
+		if _, err = reasm.Push(append(EncodeFragmentHeader(7, uint32(i), 1000), 'x')); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrTooManyFragments) {
+		t.Fatalf("expected ErrTooManyFragments, got %v", err)
+	}
+	if got := reasm.TotalBytes(); got != 0 {
+		t.Fatalf("total bytes %d after limit, want 0", got)
+	}
+}
+
+func TestReassemblyEviction(t *testing.T) {
+	budget := NewEntryBudget(3)
+	a := NewReassembler(time.Minute, 2, 0, 0)
+	a.Budget = budget
+	b := NewReassembler(time.Minute, 2, 0, 0)
+	b.Budget = budget
+	partial := func(r *Reassembler, id uint32) error {
+		_, err := r.Push(append(EncodeFragmentHeader(id, 0, 100), 'x'))
+		return err
+	}
+	for id := uint32(1); id <= 3; id++ {
+		if err := partial(a, id); err != nil {
+			t.Fatalf("push %d: %v", id, err)
+		}
+	}
+	// The third entry evicted the first.
+	if _, ok := a.frags[1]; ok || len(a.frags) != 2 {
+		t.Fatalf("oldest entry not evicted: %d entries", len(a.frags))
+	}
+	if err := partial(b, 1); err != nil {
+		t.Fatalf("push b: %v", err)
+	}
+	if err := partial(b, 2); err != nil {
+		t.Fatalf("push b over budget should evict its own entry: %v", err)
+	}
+	c := NewReassembler(time.Minute, 2, 0, 0)
+	c.Budget = budget
+	if err := partial(c, 1); !errors.Is(err, ErrTooManyPartialPackets) {
+		t.Fatalf("expected ErrTooManyPartialPackets, got %v", err)
+	}
+	a.Reset()
+	if err := partial(c, 1); err != nil {
+		t.Fatalf("push after reset: %v", err)
+	}
+}
+
+func TestReassemblyReportsMissing(t *testing.T) {
+	reasm := NewReassembler(time.Minute, 10, 0, 0)
+	var got []uint32
+	reasm.OnMissing = func(id uint32, missing []uint32) { got = missing }
+	payload := bytes.Repeat([]byte("m"), 4000)
+	push := func(offset, end int) []byte {
+		t.Helper()
+		out, err := reasm.Push(append(EncodeFragmentHeader(7, uint32(offset), uint32(len(payload))), payload[offset:end]...))
+		if err != nil {
+			t.Fatalf("push %d: %v", offset, err)
+		}
+		return out
+	}
+	push(0, 1000)
+	push(3000, 4000)
+	if want := []uint32{1000, 2000}; !slices.Equal(got, want) {
+		t.Fatalf("missing = %v, want %v", got, want)
+	}
+	push(2000, 3000)
+	push(2000, 3000)
+	if out := push(1000, 2000); !bytes.Equal(out, payload) {
+		t.Fatalf("packet not reassembled after the resend")
+	}
 }
@@ -0,0 +1,118 @@
+package qdt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// CapFragmentNAK is advertised in ConnectRequest.Caps and ConnectResponse.Caps
+// by peers that send and answer MsgFragmentNAK.
+const CapFragmentNAK = "frag_nak"
+
+// DefaultFragmentCachePackets is the number of fragmented packets kept for
+// resending when no size is configured.
+const DefaultFragmentCachePackets = 32
+
+var ErrFragmentNotCached = errors.New("fragment not cached")
+
+// EnableFragmentNAK keeps the fragments of the last cachePackets fragmented
+// packets so ResendFragment can answer the peer's NAKs. It must be called
+// before the tunnel carries traffic, once CapFragmentNAK was negotiated.
+func (t *Tunnel) EnableFragmentNAK(cachePackets int) {
+	if cachePackets <= 0 {
+		cachePackets = DefaultFragmentCachePackets
+	}
+	t.fragCache = newFragmentCache(cachePackets)
+}
+
+// FragmentNAKEnabled reports whether EnableFragmentNAK was called.
+func (t *Tunnel) FragmentNAKEnabled() bool {
+	return t.fragCache != nil
+}
+
+// SendFragmentNAK asks the peer to resend the fragments of packet fragID at
+// the given offsets.
+//
+// MsgFragmentNAK payload layout: FragID[4] | Offset[4]*N.
+func (t *Tunnel) SendFragmentNAK(conn DatagramConn, fragID uint32, missing []uint32) error {
+	payload := make([]byte, 4+4*len(missing))
+	binary.BigEndian.PutUint32(payload, fragID)
+	for i, off := range missing {
+		binary.BigEndian.PutUint32(payload[4+4*i:], off)
+	}
+	return t.sendControl(conn, MsgFragmentNAK, payload)
+}
+
+// ResendFragment sends the cached fragment of packet fragID at offset again.
+func (t *Tunnel) ResendFragment(conn DatagramConn, fragID uint32, offset uint32) error {
+	if t.fragCache == nil {
+		return ErrFragmentNotCached
+	}
+	plain := t.fragCache.get(fragID, offset)
+	if plain == nil {
+		return ErrFragmentNotCached
+	}
+	if err := t.sendControl(conn, MsgFragment, plain); err != nil {
+		return err
+	}
+	t.stats.fragmentsSent.Add(1)
+	return nil
+}
+
+func decodeFragmentNAK(b []byte) (uint32, []uint32, error) {
+	if len(b) < 4 || len(b)%4 != 0 {
+		return 0, nil, fmt.Errorf("%w: fragment nak of %d bytes", ErrInvalidDatagram, len(b))
+	}
+	missing := make([]uint32, 0, len(b)/4-1)
+	for i := 4; i < len(b); i += 4 {
+		missing = append(missing, binary.BigEndian.Uint32(b[i:]))
+	}
+	return binary.BigEndian.Uint32(b), missing, nil
+}
+
+// fragmentCache holds the plaintext fragment messages, header included, of
+// the most recent fragmented packets.
+type fragmentCache struct {
+	mu      sync.Mutex
+	packets map[uint32][]cachedFragment
+	order   []uint32
+	next    int
+}
+
+type cachedFragment struct {
+	offset uint32
+	plain  []byte
+}
+
+func newFragmentCache(size int) *fragmentCache {
+	return &fragmentCache{packets: make(map[uint32][]cachedFragment, size), order: make([]uint32, 0, size)}
+}
+
+func (c *fragmentCache) add(fragID uint32, offset int, plain []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	frags, ok := c.packets[fragID]
+	if !ok {
+		if len(c.order) < cap(c.order) {
+			c.order = append(c.order, fragID)
+		} else {
+			delete(c.packets, c.order[c.next])
+			c.order[c.next] = fragID
+			c.next = (c.next + 1) % len(c.order)
+		}
+	}
+	c.packets[fragID] = append(frags, cachedFragment{offset: uint32(offset), plain: append([]byte(nil), plain...)})
+}
+
+func (c *fragmentCache) get(fragID, offset uint32) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range c.packets[fragID] {
+		if f.offset == offset {
+			return f.plain
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package qdt
+
+import "errors"
+
+// CapNotification is advertised in ConnectRequest.Caps and
+// ConnectResponse.Caps by peers that accept MsgNotification.
+const CapNotification = "notify"
+
+// MaxNotificationBytes bounds the payload of a MsgNotification.
+const MaxNotificationBytes = 512
+
+var (
+	ErrNotificationTooLarge = errors.New("notification too large")
+	ErrNotificationDisabled = errors.New("notifications not negotiated")
+)
+
+// EnableNotifications lets the tunnel send and accept MsgNotification. It
+// must be called before the tunnel carries traffic, once CapNotification
+// was negotiated.
+func (t *Tunnel) EnableNotifications() {
+	t.notify = true
+}
+
+// SendNotification sends payload, opaque to the tunnel, to the peer's
+// NotificationHandler.
+func (t *Tunnel) SendNotification(conn DatagramConn, payload []byte) error {
+	if !t.notify {
+		return ErrNotificationDisabled
+	}
+	if len(payload) > MaxNotificationBytes {
+		return ErrNotificationTooLarge
+	}
+	return t.sendControl(conn, MsgNotification, payload)
+}
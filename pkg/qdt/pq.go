@@ -0,0 +1,41 @@
+package qdt
+
+import (
+	"crypto/mlkem"
+)
+
+// CapPQMLKEM768 is advertised by a client that sends an ML-KEM-768
+// encapsulation key in ConnectRequest.KemPublicKey, and echoed by a server
+// that returns a ciphertext in ConnectResponse.KemCiphertext. Both then mix
+// the encapsulated secret into the key derivation, so recording the
+// handshake and later recovering the token is not enough to decrypt it.
+const CapPQMLKEM768 = "pq-mlkem768"
+
+// NewKEMKey generates the client's ML-KEM-768 key for one handshake.
+func NewKEMKey() (*mlkem.DecapsulationKey768, error) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, &HandshakeError{Reason: "kem key", Err: err}
+	}
+	return dk, nil
+}
+
+// EncapsulateKEM encapsulates a fresh secret to the client's encapsulation
+// key and returns the secret and the ciphertext for the client.
+func EncapsulateKEM(publicKey []byte) (secret, ciphertext []byte, err error) {
+	ek, err := mlkem.NewEncapsulationKey768(publicKey)
+	if err != nil {
+		return nil, nil, &HandshakeError{Reason: "kem public key", Err: err}
+	}
+	secret, ciphertext = ek.Encapsulate()
+	return secret, ciphertext, nil
+}
+
+// DecapsulateKEM recovers the secret the server encapsulated to dk.
+func DecapsulateKEM(dk *mlkem.DecapsulationKey768, ciphertext []byte) ([]byte, error) {
+	secret, err := dk.Decapsulate(ciphertext)
+	if err != nil {
+		return nil, &HandshakeError{Reason: "kem ciphertext", Err: err}
+	}
+	return secret, nil
+}
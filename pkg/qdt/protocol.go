@@ -13,13 +13,26 @@ const (
 	ProtocolVersion uint8 = 1
 	Magic                 = "QDT"
 
-	ConnectPath = "/connect"
-	TokenHeader = "X-QDT-Token"
+	// ALPNv1 carries the JSON connect over HTTP/3, like plain h3 for
+	// clients that predate it. ALPNv2 is reserved for the binary connect.
+	ALPNv1 = "qdt/1"
+	ALPNv2 = "qdt/2"
+
+	ConnectPath   = "/connect"
+	WebSocketPath = "/ws"
+	TokenHeader   = "X-QDT-Token"
+	// RequestIDHeader carries the ID that ties the client and server logs
+	// of one connect request together.
+	RequestIDHeader = "X-Request-ID"
 
 	DefaultMTU   = 1350
 	MaxBodyBytes = 4096
+	// MinMTU is the smallest MTU SetMTU accepts below the handshake MTU;
+	// smaller ones would split every packet into many tiny fragments.
+	MinMTU = 576
 
-	HeaderLen = 3 + 1 + 1 + 1 + 8 + 8
+	HeaderLen        = 3 + 1 + 1 + 1 + 8 + 8
+	CompactHeaderLen = 3 + 1 + 2 + 4
 )
 
 var (
@@ -36,8 +49,35 @@ const (
 	MsgPing
 	MsgPong
 	MsgClose
+	MsgRouteUpdate
+	MsgCompressedData
+	MsgCoalesced
+	MsgFragmentNAK
+	MsgNotification
 )
 
+// CapPong is advertised in ConnectResponse.Caps by servers that answer the
+// client's MsgPing with MsgPong.
+const CapPong = "pong"
+
+// RouteUpdate is the JSON payload of MsgRouteUpdate. A non-zero MTU asks the
+// peer to switch its tunnel to that MTU.
+type RouteUpdate struct {
+	Add []string `json:"add,omitempty"`
+	Del []string `json:"del,omitempty"`
+	MTU int      `json:"mtu,omitempty"`
+}
+
+// HasCap reports whether caps contains c.
+func HasCap(caps []string, c string) bool {
+	for _, v := range caps {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
 type ConnectRequest struct {
 	Version     uint8    `json:"version"`
 	ClientNonce string   `json:"client_nonce"`
@@ -45,18 +85,29 @@ type ConnectRequest struct {
 	Caps        []string `json:"caps,omitempty"`
 	ClientID    string   `json:"client_id,omitempty"`
 	Platform    string   `json:"platform,omitempty"`
+	ResumeToken string   `json:"resume_token,omitempty"`
+	// AdvertiseRoutes lists CIDRs behind the client that the server should
+	// route through this session.
+	AdvertiseRoutes []string `json:"advertise_routes,omitempty"`
+	// KemPublicKey is the ML-KEM-768 encapsulation key sent with
+	// CapPQMLKEM768.
+	KemPublicKey []byte `json:"kem_public_key,omitempty"`
 }
 
 type ConnectResponse struct {
-	Version     uint8    `json:"version"`
-	SessionID   uint64   `json:"session_id"`
-	ServerNonce string   `json:"server_nonce"`
-	MTU         int      `json:"mtu"`
-	ClientIP    string   `json:"client_ip"`
-	GatewayIP   string   `json:"gateway_ip"`
-	CIDR        string   `json:"cidr"`
-	DNS         []string `json:"dns,omitempty"`
-	Caps        []string `json:"caps,omitempty"`
+	Version       uint8    `json:"version"`
+	SessionID     uint64   `json:"session_id"`
+	ServerNonce   string   `json:"server_nonce"`
+	MTU           int      `json:"mtu"`
+	ClientIP      string   `json:"client_ip"`
+	GatewayIP     string   `json:"gateway_ip"`
+	CIDR          string   `json:"cidr"`
+	DNS           []string `json:"dns,omitempty"`
+	SearchDomains []string `json:"search_domains,omitempty"`
+	Caps          []string `json:"caps,omitempty"`
+	ResumeToken   string   `json:"resume_token,omitempty"`
+	KemCiphertext []byte   `json:"kem_ciphertext,omitempty"`
+	RequestID     string   `json:"request_id,omitempty"`
 }
 
 func NewConnectRequest(clientNonce []byte, mtu int, caps []string, clientID, platform string) ConnectRequest {
@@ -78,10 +129,10 @@ func DecodeConnectRequest(r io.Reader) (ConnectRequest, error) {
 	limited := io.LimitReader(r, MaxBodyBytes)
 	dec := json.NewDecoder(limited)
 	if err := dec.Decode(&req); err != nil {
-		return ConnectRequest{}, fmt.Errorf("decode connect request: %w", err)
+		return ConnectRequest{}, &HandshakeError{Reason: "decode connect request", Err: err}
 	}
 	if req.Version != ProtocolVersion {
-		return ConnectRequest{}, fmt.Errorf("unsupported protocol version: %d", req.Version)
+		return ConnectRequest{}, &HandshakeError{Reason: fmt.Sprintf("unsupported protocol version: %d", req.Version)}
 	}
 	if req.MTU <= 0 {
 		req.MTU = DefaultMTU
@@ -101,10 +152,10 @@ func ReadConnectResponse(r io.Reader) (ConnectResponse, error) {
 	limited := io.LimitReader(r, MaxBodyBytes)
 	dec := json.NewDecoder(limited)
 	if err := dec.Decode(&resp); err != nil {
-		return ConnectResponse{}, fmt.Errorf("decode connect response: %w", err)
+		return ConnectResponse{}, &HandshakeError{Reason: "decode connect response", Err: err}
 	}
 	if resp.Version != ProtocolVersion {
-		return ConnectResponse{}, fmt.Errorf("unsupported protocol version: %d", resp.Version)
+		return ConnectResponse{}, &HandshakeError{Reason: fmt.Sprintf("unsupported protocol version: %d", resp.Version)}
 	}
 	if resp.MTU <= 0 {
 		resp.MTU = DefaultMTU
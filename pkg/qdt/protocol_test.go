@@ -20,6 +20,21 @@ func TestHeaderRoundTrip(t *testing.T) {
 	}
 }
 
+func TestCompactHeaderRoundTrip(t *testing.T) {
+	h := Header{Version: ProtocolVersion, Type: MsgFragment, SessionID: 0xbeef, Counter: 0xdeadbeef, Compact: true}
+	buf := AppendHeader(nil, h)
+	if len(buf) != CompactHeaderLen {
+		t.Fatalf("compact header is %d bytes, want %d", len(buf), CompactHeaderLen)
+	}
+	parsed, rest, err := ParseHeader(append(buf, 'x'))
+	if err != nil {
+		t.Fatalf("parse header: %v", err)
+	}
+	if parsed != h || string(rest) != "x" {
+		t.Fatalf("header mismatch: %+v != %+v, rest %q", parsed, h, rest)
+	}
+}
+
 func TestHeaderInvalid(t *testing.T) {
 	_, _, err := ParseHeader([]byte("bad"))
 	if err == nil {
@@ -1,13 +1,41 @@
 package qdt
 
-import "sync"
+import (
+	"math/bits"
+	"sync"
+	"time"
+)
+
+const (
+	MinReplayWindow = 512
+	MaxReplayWindow = 65536
+
+	// reorderQuantile weights samples above the estimate against those
+	// below, so it settles near the 99th percentile of the reorder delta.
+	reorderQuantile = 0.99
+	reorderAlpha    = 1.0 / 64
+	// scaleEvery is how many marks pass between checks of the estimate.
+	scaleEvery     = 256
+	scaleUpAfter   = 30 * time.Second
+	scaleDownAfter = 5 * time.Minute
+)
 
 type ReplayWindow struct {
 	mu          sync.Mutex
 	size        uint64
 	max         uint64
+	first       uint64
 	initialized bool
 	bits        []uint64
+
+	// autoScale state: reorder is the moving estimate of how far behind
+	// the newest counter packets arrive, and highSince and lowSince when it
+	// last crossed the grow and shrink thresholds.
+	autoScale bool
+	reorder   float64
+	marks     uint64
+	highSince time.Time
+	lowSince  time.Time
 }
 
 func NewReplayWindow(size uint64) *ReplayWindow {
@@ -18,6 +46,23 @@ func NewReplayWindow(size uint64) *ReplayWindow {
 	return &ReplayWindow{size: size, bits: make([]uint64, words)}
 }
 
+// EnableAutoScale lets the window grow while packets arrive reordered by more
+// than 75% of its size for 30 seconds, up to MaxReplayWindow, and shrink
+// after 5 minutes below 10%, down to MinReplayWindow.
+func (w *ReplayWindow) EnableAutoScale() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.autoScale = true
+}
+
+// Size returns the number of counters behind the newest one that are
+// still accepted.
+func (w *ReplayWindow) Size() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
 func (w *ReplayWindow) Check(counter uint64) bool {
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -39,6 +84,7 @@ func (w *ReplayWindow) Mark(counter uint64) {
 	defer w.mu.Unlock()
 	if !w.initialized {
 		w.max = counter
+		w.first = counter
 		w.initialized = true
 		w.set(0)
 		return
@@ -48,12 +94,92 @@ func (w *ReplayWindow) Mark(counter uint64) {
 		w.shift(delta)
 		w.max = counter
 		w.set(0)
+		w.observeReorder(0)
 		return
 	}
 	offset := w.max - counter
 	if offset < w.size {
 		w.set(offset)
 	}
+	w.observeReorder(offset)
+}
+
+// observeReorder feeds the reorder delta of a marked counter, zero for one
+// that arrived in order, to the auto scaling estimate.
+func (w *ReplayWindow) observeReorder(delta uint64) {
+	if !w.autoScale {
+		return
+	}
+	d := float64(delta) - w.reorder
+	if d > 0 {
+		w.reorder += reorderAlpha * reorderQuantile * d
+	} else {
+		w.reorder += reorderAlpha * (1 - reorderQuantile) * d
+	}
+	w.marks++
+	if w.marks%scaleEvery == 0 {
+		w.scale(time.Now())
+	}
+}
+
+// scale resizes the window once the reorder estimate stayed above 75% or
+// below 10% of it for long enough.
+func (w *ReplayWindow) scale(now time.Time) {
+	size := float64(w.size)
+	switch {
+	case w.reorder > 0.75*size && w.size < MaxReplayWindow:
+		w.lowSince = time.Time{}
+		if w.highSince.IsZero() {
+			w.highSince = now
+		} else if now.Sub(w.highSince) >= scaleUpAfter {
+			w.resize(min(w.size*2, MaxReplayWindow))
+			w.highSince = time.Time{}
+		}
+	case w.reorder < 0.1*size && w.size > MinReplayWindow:
+		w.highSince = time.Time{}
+		if w.lowSince.IsZero() {
+			w.lowSince = now
+		} else if now.Sub(w.lowSince) >= scaleDownAfter {
+			w.resize(max(w.size/2, MinReplayWindow))
+			w.lowSince = time.Time{}
+		}
+	default:
+		w.highSince = time.Time{}
+		w.lowSince = time.Time{}
+	}
+}
+
+// resize keeps the marks of the counters that still fit in a window of
+// size. Counters a grown window newly covers were forgotten and may have
+// been seen, so they are marked and rejected.
+func (w *ReplayWindow) resize(size uint64) {
+	words := make([]uint64, (size+63)/64)
+	copy(words, w.bits)
+	w.bits = words
+	for off := w.size; off < size; off++ {
+		w.set(off)
+	}
+	w.size = size
+	if maskBits := size % 64; maskBits != 0 {
+		w.bits[len(w.bits)-1] &= (uint64(1) << maskBits) - 1
+	}
+}
+
+// LossEstimate returns the share of counters missing from the window, from
+// the first counter seen or the window size back from the newest one.
+// Packets still in flight behind reordered ones count as missing.
+func (w *ReplayWindow) LossEstimate() float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.initialized {
+		return 0
+	}
+	span := min(w.max-w.first+1, w.size)
+	seen := 0
+	for _, word := range w.bits {
+		seen += bits.OnesCount64(word)
+	}
+	return float64(span-uint64(seen)) / float64(span)
 }
 
 func (w *ReplayWindow) set(offset uint64) {
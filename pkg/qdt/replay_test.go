@@ -1,6 +1,9 @@
 package qdt
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestReplayWindow(t *testing.T) {
 	w := NewReplayWindow(4)
@@ -21,3 +24,49 @@ func TestReplayWindow(t *testing.T) {
 		t.Fatalf("too old packet should be rejected")
 	}
 }
+
+func TestReplayWindowLossEstimate(t *testing.T) {
+	w := NewReplayWindow(64)
+	if got := w.LossEstimate(); got != 0 {
+		t.Fatalf("empty window loss = %v, want 0", got)
+	}
+	for c := uint64(1); c <= 10; c++ {
+		if c != 4 && c != 7 {
+			w.Mark(c)
+		}
+	}
+	if got := w.LossEstimate(); got != 0.2 {
+		t.Fatalf("loss = %v, want 0.2", got)
+	}
+}
+
+func TestReplayWindowAutoScale(t *testing.T) {
+	w := NewReplayWindow(MinReplayWindow)
+	w.EnableAutoScale()
+	// Every fourth packet arrives 500 counters late.
+	for c := uint64(1000); c < 20000; c++ {
+		w.Mark(c)
+		if c%4 == 0 {
+			w.Mark(c - 500)
+		}
+	}
+	now := time.Now()
+	w.scale(now)
+	w.scale(now.Add(scaleUpAfter))
+	if got := w.Size(); got != 2*MinReplayWindow {
+		t.Fatalf("size after reordering = %d, want %d", got, 2*MinReplayWindow)
+	}
+	if w.Check(19999 - 700) {
+		t.Fatalf("counter forgotten before growing was accepted")
+	}
+
+	for c := uint64(20000); c < 40000; c++ {
+		w.Mark(c)
+	}
+	now = time.Now()
+	w.scale(now)
+	w.scale(now.Add(scaleDownAfter))
+	if got := w.Size(); got != MinReplayWindow {
+		t.Fatalf("size after in-order traffic = %d, want %d", got, MinReplayWindow)
+	}
+}
@@ -0,0 +1,54 @@
+package qdt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	ErrResumeTokenInvalid = errors.New("invalid resume token")
+	ErrResumeTokenExpired = errors.New("resume token expired")
+)
+
+// resumeTokenLen is sessionID[8] | clientIP[4] | expiry[8] | mac[32].
+const resumeTokenLen = 8 + 4 + 8 + sha256.Size
+
+// IssueResumeToken returns a token that lets a client reconnect with the same
+// address until expiry. The MAC is HMAC-SHA256(key, sessionID || clientIP ||
+// expiry).
+func IssueResumeToken(key []byte, sessionID uint64, clientIP net.IP, expiry time.Time) string {
+	b := make([]byte, 0, resumeTokenLen)
+	b = binary.BigEndian.AppendUint64(b, sessionID)
+	b = append(b, clientIP.To4()...)
+	b = binary.BigEndian.AppendUint64(b, uint64(expiry.Unix()))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	b = mac.Sum(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// VerifyResumeToken checks the MAC and expiry of token and returns the
+// session ID and client address it was issued for.
+func VerifyResumeToken(key []byte, token string, now time.Time) (uint64, net.IP, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) != resumeTokenLen {
+		return 0, nil, ErrResumeTokenInvalid
+	}
+	body, sum := b[:resumeTokenLen-sha256.Size], b[resumeTokenLen-sha256.Size:]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return 0, nil, ErrResumeTokenInvalid
+	}
+	expiry := time.Unix(int64(binary.BigEndian.Uint64(body[12:20])), 0)
+	if now.After(expiry) {
+		return 0, nil, ErrResumeTokenExpired
+	}
+	ip := net.IPv4(body[8], body[9], body[10], body[11])
+	return binary.BigEndian.Uint64(body[:8]), ip, nil
+}
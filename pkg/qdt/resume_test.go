@@ -0,0 +1,35 @@
+package qdt
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResumeToken(t *testing.T) {
+	key := []byte("resume-key")
+	ip := net.ParseIP("10.8.0.7")
+	now := time.Now()
+	tok := IssueResumeToken(key, 42, ip, now.Add(time.Minute))
+
+	id, got, err := VerifyResumeToken(key, tok, now)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if id != 42 || !got.Equal(ip) {
+		t.Fatalf("got id=%d ip=%s", id, got)
+	}
+
+	if _, _, err := VerifyResumeToken(key, tok, now.Add(2*time.Minute)); !errors.Is(err, ErrResumeTokenExpired) {
+		t.Fatalf("expected expired, got %v", err)
+	}
+	if _, _, err := VerifyResumeToken([]byte("other-key"), tok, now); !errors.Is(err, ErrResumeTokenInvalid) {
+		t.Fatalf("expected invalid for wrong key, got %v", err)
+	}
+	tampered := []byte(tok)
+	tampered[3] ^= 1
+	if _, _, err := VerifyResumeToken(key, string(tampered), now); !errors.Is(err, ErrResumeTokenInvalid) {
+		t.Fatalf("expected invalid for tampered token, got %v", err)
+	}
+}
@@ -1,10 +1,18 @@
 package qdt
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"qdt/internal/netcfg"
 )
 
 type DatagramConn interface {
@@ -25,17 +33,100 @@ type Tunnel struct {
 	Frag      *Fragmenter
 	Reasm     *Reassembler
 
+	// RouteUpdateHandler is called from the decode path for each
+	// MsgRouteUpdate received from the peer.
+	RouteUpdateHandler func(add, del []netcfg.Route)
+	// PingHandler and PongHandler are called from the decode path for each
+	// MsgPing and MsgPong received from the peer.
+	PingHandler func()
+	PongHandler func()
+	// FragmentNAKHandler is called from the decode path with the fragments
+	// the peer reported missing; it normally calls ResendFragment for each.
+	FragmentNAKHandler func(fragID uint32, missing []uint32)
+	// NotificationHandler is called from the decode path with the payload
+	// of each MsgNotification received from the peer.
+	NotificationHandler func(payload []byte)
+	// CompressObserver, if set, is called with the original and compressed
+	// size of every packet the encoder tried to compress.
+	CompressObserver func(raw, compressed int)
+
+	// mtuMu guards MTU and the derived payload sizes; encoders hold it for
+	// reading so SetMTU never changes them mid-packet.
+	mtuMu               sync.RWMutex
+	maxMTU              int
 	payloadMTUValue     int
 	fragPayloadMTUValue int
+	compress            bool
+	compactHeader       bool
+	fragEpoch           bool
+	notify              bool
+	coalesce            coalesceConfig
+	fragCache           *fragmentCache
 	scratch             []byte
 	fragScratch         []byte
+	compScratch         []byte
+	stats               tunnelStats
+	// pingSent is when the oldest unanswered ping went out, or 0, and rtt
+	// the round trip of the last answered one, both in nanoseconds.
+	pingSent atomic.Int64
+	rtt      atomic.Int64
+
+	dec decodeState
+}
+
+// decodeState holds the entries of the last MsgCoalesced datagram that
+// NextCoalesced has not returned yet; coalescedBuf backs coalesced.
+type decodeState struct {
+	coalesced    []byte
+	coalescedBuf []byte
+}
+
+// Stats is a point-in-time snapshot of tunnel traffic counters.
+type Stats struct {
+	BytesSent     uint64
+	BytesRecv     uint64
+	PacketsSent   uint64
+	PacketsRecv   uint64
+	FragmentsSent uint64
+	FragmentsRecv uint64
+	ReplayDrops   uint64
+	DecodeErrors  uint64
+	// CompressedIn and CompressedOut are the bytes of packets sent compressed,
+	// before and after compression.
+	CompressedIn  uint64
+	CompressedOut uint64
+}
+
+type tunnelStats struct {
+	bytesSent     atomic.Uint64
+	bytesRecv     atomic.Uint64
+	packetsSent   atomic.Uint64
+	packetsRecv   atomic.Uint64
+	fragmentsSent atomic.Uint64
+	fragmentsRecv atomic.Uint64
+	replayDrops   atomic.Uint64
+	decodeErrors  atomic.Uint64
+	compressedIn  atomic.Uint64
+	compressedOut atomic.Uint64
+}
+
+func (s *tunnelStats) sent(n int) {
+	s.packetsSent.Add(1)
+	s.bytesSent.Add(uint64(n))
+}
+
+func (s *tunnelStats) recv(n int) {
+	s.packetsRecv.Add(1)
+	s.bytesRecv.Add(uint64(n))
 }
 
 func NewTunnel(sessionID uint64, mtu int, send, recv *CipherState) *Tunnel {
-	return NewTunnelWithLimits(sessionID, mtu, send, recv, 0)
+	return NewTunnelWithLimits(sessionID, mtu, send, recv, 0, 0, 0)
 }
 
-func NewTunnelWithLimits(sessionID uint64, mtu int, send, recv *CipherState, maxReassembly int) *Tunnel {
+// NewTunnelWithLimits bounds reassembly like NewReassembler; partial packets
+// are dropped after reassemblyTTL without a new fragment.
+func NewTunnelWithLimits(sessionID uint64, mtu int, send, recv *CipherState, maxReassembly, maxReassemblyAggregate int, reassemblyTTL time.Duration) *Tunnel {
 	if mtu <= 0 {
 		mtu = DefaultMTU
 	}
@@ -45,19 +136,70 @@ func NewTunnelWithLimits(sessionID uint64, mtu int, send, recv *CipherState, max
 		Send:      send,
 		Recv:      recv,
 		Frag:      &Fragmenter{},
-		Reasm:     NewReassembler(0, 0, maxReassembly),
+		Reasm:     NewReassembler(reassemblyTTL, 0, maxReassembly, maxReassemblyAggregate),
+		maxMTU:    mtu,
 	}
 	t.recomputeMTU()
 	return t
 }
 
+func (t *Tunnel) Stats() Stats {
+	return Stats{
+		BytesSent:     t.stats.bytesSent.Load(),
+		BytesRecv:     t.stats.bytesRecv.Load(),
+		PacketsSent:   t.stats.packetsSent.Load(),
+		PacketsRecv:   t.stats.packetsRecv.Load(),
+		FragmentsSent: t.stats.fragmentsSent.Load(),
+		FragmentsRecv: t.stats.fragmentsRecv.Load(),
+		ReplayDrops:   t.stats.replayDrops.Load(),
+		DecodeErrors:  t.stats.decodeErrors.Load(),
+		CompressedIn:  t.stats.compressedIn.Load(),
+		CompressedOut: t.stats.compressedOut.Load(),
+	}
+}
+
 func (t *Tunnel) recomputeMTU() {
+	t.payloadMTUValue = t.MTU - t.headerOverhead()
+	t.fragPayloadMTUValue = t.payloadMTUValue - t.fragHeaderLen()
+}
+
+// headerOverhead is the header and cipher overhead of every datagram.
+func (t *Tunnel) headerOverhead() int {
 	overhead := HeaderLen
+	if t.compactHeader {
+		overhead = CompactHeaderLen
+	}
 	if t.Send != nil {
 		overhead += t.Send.Overhead()
 	}
-	t.payloadMTUValue = t.MTU - overhead
-	t.fragPayloadMTUValue = t.payloadMTUValue - fragHeaderLen
+	return overhead
+}
+
+// SetMTU changes the datagram MTU for subsequent packets, e.g. after path MTU
+// discovery or an MTU update from the peer. It may not exceed the MTU the
+// tunnel was created with, which the transport was sized for, nor drop below
+// MinMTU.
+func (t *Tunnel) SetMTU(mtu int) error {
+	t.mtuMu.Lock()
+	defer t.mtuMu.Unlock()
+	if !t.mtuInRange(mtu) || mtu <= t.headerOverhead()+t.fragHeaderLen() {
+		return fmt.Errorf("%w: %d", ErrInvalidMTU, mtu)
+	}
+	t.MTU = mtu
+	t.recomputeMTU()
+	return nil
+}
+
+func (t *Tunnel) mtuInRange(mtu int) bool {
+	return mtu <= t.maxMTU && mtu >= min(MinMTU, t.maxMTU)
+}
+
+// CurrentMTU returns the MTU; unlike the MTU field it is safe to call while
+// the tunnel carries traffic.
+func (t *Tunnel) CurrentMTU() int {
+	t.mtuMu.RLock()
+	defer t.mtuMu.RUnlock()
+	return t.MTU
 }
 
 func (t *Tunnel) payloadMTU() int {
@@ -83,53 +225,70 @@ func (t *Tunnel) fragmentScratch(size int) []byte {
 }
 
 func (t *Tunnel) EncodePacket(payload []byte, emit func([]byte) error) error {
+	t.mtuMu.RLock()
+	defer t.mtuMu.RUnlock()
 	if t.Send == nil {
-		return errors.New("send cipher not set")
+		return &CipherError{Op: "seal", Err: ErrNoCipher}
 	}
 	maxPayload := t.payloadMTU()
 	if maxPayload <= 0 {
-		return fmt.Errorf("invalid mtu")
+		return ErrInvalidMTU
+	}
+	var compressed bool
+	if t.compScratch, compressed = t.compressPayload(t.compScratch, payload); compressed {
+		if err := t.encodeAndEmit(MsgCompressedData, t.compScratch, emit); err != nil {
+			return err
+		}
+		t.stats.sent(len(payload))
+		return nil
 	}
 	if len(payload) <= maxPayload {
-		return t.encodeAndEmit(MsgData, payload, emit)
+		if err := t.encodeAndEmit(MsgData, payload, emit); err != nil {
+			return err
+		}
+		t.stats.sent(len(payload))
+		return nil
 	}
 	fragMax := t.fragmentPayloadMTU()
 	if fragMax <= 0 {
-		return fmt.Errorf("fragment mtu too small")
+		return ErrInvalidMTU
 	}
-	fragID := t.Frag.NextID()
+	fragID := t.nextFragID()
 	offset := 0
 	for offset < len(payload) {
 		end := offset + fragMax
 		if end > len(payload) {
 			end = len(payload)
 		}
-		plainLen := fragHeaderLen + (end - offset)
+		hlen := t.fragHeaderLen()
+		plainLen := hlen + (end - offset)
 		plain := t.fragmentScratch(plainLen)
-		WriteFragmentHeader(plain[:fragHeaderLen], fragID, uint32(offset), uint32(len(payload)))
-		copy(plain[fragHeaderLen:], payload[offset:end])
+		t.writeFragmentHeader(plain[:hlen], fragID, uint32(offset), uint32(len(payload)))
+		copy(plain[hlen:], payload[offset:end])
+		if t.fragCache != nil {
+			t.fragCache.add(uint32(fragID), offset, plain)
+		}
 		if err := t.encodeAndEmit(MsgFragment, plain, emit); err != nil {
 			return err
 		}
+		t.stats.fragmentsSent.Add(1)
 		offset = end
 	}
+	t.stats.sent(len(payload))
 	return nil
 }
 
 func (t *Tunnel) encodeAndEmit(msgType MessageType, payload []byte, emit func([]byte) error) error {
-	counter := t.Send.NextCounter()
-	overhead := t.Send.Overhead()
-	bufSize := HeaderLen + overhead + len(payload)
-	hdr := Header{
-		Version:   ProtocolVersion,
-		Type:      msgType,
-		Flags:     0,
-		SessionID: t.SessionID,
-		Counter:   counter,
+	counter, err := t.Send.NextCounter()
+	if err != nil {
+		return err
 	}
+	hdr := t.header(msgType, counter)
+	hlen := hdr.Len()
+	bufSize := hlen + t.Send.Overhead() + len(payload)
 	buf := t.datagramScratch(bufSize)
-	WriteHeader(buf[:HeaderLen], hdr)
-	buf = t.Send.Seal(buf[:HeaderLen], counter, buf[:HeaderLen], payload)
+	WriteHeader(buf[:hlen], hdr)
+	buf = t.Send.Seal(buf[:hlen], counter, buf[:hlen], payload)
 	return emit(buf)
 }
 
@@ -138,6 +297,7 @@ type Encoder struct {
 	t           *Tunnel
 	scratch     []byte
 	fragScratch []byte
+	compScratch []byte
 }
 
 func (t *Tunnel) NewEncoder() *Encoder {
@@ -146,98 +306,139 @@ func (t *Tunnel) NewEncoder() *Encoder {
 
 func (e *Encoder) EncodePacket(payload []byte, emit func([]byte) error) error {
 	t := e.t
+	t.mtuMu.RLock()
+	defer t.mtuMu.RUnlock()
 	if t.Send == nil {
-		return errors.New("send cipher not set")
+		return &CipherError{Op: "seal", Err: ErrNoCipher}
 	}
 	maxPayload := t.payloadMTUValue
 	if maxPayload <= 0 {
-		return fmt.Errorf("invalid mtu")
+		return ErrInvalidMTU
+	}
+	var compressed bool
+	if e.compScratch, compressed = t.compressPayload(e.compScratch, payload); compressed {
+		if err := e.encodeAndEmit(MsgCompressedData, e.compScratch, emit); err != nil {
+			return err
+		}
+		t.stats.sent(len(payload))
+		return nil
 	}
 	if len(payload) <= maxPayload {
-		return e.encodeAndEmit(MsgData, payload, emit)
+		if err := e.encodeAndEmit(MsgData, payload, emit); err != nil {
+			return err
+		}
+		t.stats.sent(len(payload))
+		return nil
 	}
 	fragMax := t.fragPayloadMTUValue
 	if fragMax <= 0 {
-		return fmt.Errorf("fragment mtu too small")
+		return ErrInvalidMTU
 	}
-	fragID := t.Frag.NextID()
+	fragID := t.nextFragID()
 	offset := 0
 	for offset < len(payload) {
 		end := offset + fragMax
 		if end > len(payload) {
 			end = len(payload)
 		}
-		plainLen := fragHeaderLen + (end - offset)
+		hlen := t.fragHeaderLen()
+		plainLen := hlen + (end - offset)
 		plain := e.fragmentScratch(plainLen)
-		WriteFragmentHeader(plain[:fragHeaderLen], fragID, uint32(offset), uint32(len(payload)))
-		copy(plain[fragHeaderLen:], payload[offset:end])
+		t.writeFragmentHeader(plain[:hlen], fragID, uint32(offset), uint32(len(payload)))
+		copy(plain[hlen:], payload[offset:end])
+		if t.fragCache != nil {
+			t.fragCache.add(uint32(fragID), offset, plain)
+		}
 		if err := e.encodeAndEmit(MsgFragment, plain, emit); err != nil {
 			return err
 		}
+		t.stats.fragmentsSent.Add(1)
 		offset = end
 	}
+	t.stats.sent(len(payload))
 	return nil
 }
 
 func (e *Encoder) encodeAndEmit(msgType MessageType, payload []byte, emit func([]byte) error) error {
 	t := e.t
-	counter := t.Send.NextCounter()
-	overhead := t.Send.Overhead()
-	bufSize := HeaderLen + overhead + len(payload)
-	hdr := Header{
-		Version:   ProtocolVersion,
-		Type:      msgType,
-		Flags:     0,
-		SessionID: t.SessionID,
-		Counter:   counter,
+	counter, err := t.Send.NextCounter()
+	if err != nil {
+		return err
 	}
+	hdr := t.header(msgType, counter)
+	hlen := hdr.Len()
+	bufSize := hlen + t.Send.Overhead() + len(payload)
 	buf := e.datagramScratch(bufSize)
-	WriteHeader(buf[:HeaderLen], hdr)
-	buf = t.Send.Seal(buf[:HeaderLen], counter, buf[:HeaderLen], payload)
+	WriteHeader(buf[:hlen], hdr)
+	buf = t.Send.Seal(buf[:hlen], counter, buf[:hlen], payload)
 	return emit(buf)
 }
 
 // EncodePacketTo writes encrypted datagrams into caller-provided buffers.
 func (e *Encoder) EncodePacketTo(payload []byte, alloc func(size int) []byte, emit func([]byte) error) error {
 	t := e.t
+	t.mtuMu.RLock()
+	defer t.mtuMu.RUnlock()
 	if t.Send == nil {
-		return errors.New("send cipher not set")
+		return &CipherError{Op: "seal", Err: ErrNoCipher}
 	}
 	maxPayload := t.payloadMTUValue
 	if maxPayload <= 0 {
-		return fmt.Errorf("invalid mtu")
+		return ErrInvalidMTU
+	}
+	var compressed bool
+	if e.compScratch, compressed = t.compressPayload(e.compScratch, payload); compressed {
+		if err := e.encodeAndEmitTo(MsgCompressedData, e.compScratch, alloc, emit); err != nil {
+			return err
+		}
+		t.stats.sent(len(payload))
+		return nil
 	}
 	if len(payload) <= maxPayload {
-		return e.encodeAndEmitTo(MsgData, payload, alloc, emit)
+		if err := e.encodeAndEmitTo(MsgData, payload, alloc, emit); err != nil {
+			return err
+		}
+		t.stats.sent(len(payload))
+		return nil
 	}
 	fragMax := t.fragPayloadMTUValue
 	if fragMax <= 0 {
-		return fmt.Errorf("fragment mtu too small")
+		return ErrInvalidMTU
 	}
-	fragID := t.Frag.NextID()
+	fragID := t.nextFragID()
 	offset := 0
 	for offset < len(payload) {
 		end := offset + fragMax
 		if end > len(payload) {
 			end = len(payload)
 		}
-		plainLen := fragHeaderLen + (end - offset)
+		hlen := t.fragHeaderLen()
+		plainLen := hlen + (end - offset)
 		plain := e.fragmentScratch(plainLen)
-		WriteFragmentHeader(plain[:fragHeaderLen], fragID, uint32(offset), uint32(len(payload)))
-		copy(plain[fragHeaderLen:], payload[offset:end])
+		t.writeFragmentHeader(plain[:hlen], fragID, uint32(offset), uint32(len(payload)))
+		copy(plain[hlen:], payload[offset:end])
+		if t.fragCache != nil {
+			t.fragCache.add(uint32(fragID), offset, plain)
+		}
 		if err := e.encodeAndEmitTo(MsgFragment, plain, alloc, emit); err != nil {
 			return err
 		}
+		t.stats.fragmentsSent.Add(1)
 		offset = end
 	}
+	t.stats.sent(len(payload))
 	return nil
 }
 
 func (e *Encoder) encodeAndEmitTo(msgType MessageType, payload []byte, alloc func(size int) []byte, emit func([]byte) error) error {
 	t := e.t
-	counter := t.Send.NextCounter()
-	overhead := t.Send.Overhead()
-	bufSize := HeaderLen + overhead + len(payload)
+	counter, err := t.Send.NextCounter()
+	if err != nil {
+		return err
+	}
+	hdr := t.header(msgType, counter)
+	hlen := hdr.Len()
+	bufSize := hlen + t.Send.Overhead() + len(payload)
 	buf := alloc(bufSize)
 	if cap(buf) < bufSize {
 		return ErrPayloadTooLarge
@@ -245,15 +446,8 @@ func (e *Encoder) encodeAndEmitTo(msgType MessageType, payload []byte, alloc fun
 	if len(buf) < bufSize {
 		buf = buf[:bufSize]
 	}
-	hdr := Header{
-		Version:   ProtocolVersion,
-		Type:      msgType,
-		Flags:     0,
-		SessionID: t.SessionID,
-		Counter:   counter,
-	}
-	WriteHeader(buf[:HeaderLen], hdr)
-	out := t.Send.Seal(buf[:HeaderLen], counter, buf[:HeaderLen], payload)
+	WriteHeader(buf[:hlen], hdr)
+	out := t.Send.Seal(buf[:hlen], counter, buf[:hlen], payload)
 	return emit(out)
 }
 
@@ -277,19 +471,35 @@ func (t *Tunnel) DecodeDatagram(raw []byte) ([]byte, error) {
 }
 
 func (t *Tunnel) DecodeDatagramInto(dst []byte, raw []byte) ([]byte, bool, error) {
+	hdr, plain, dst, pooled, err := t.openDatagram(dst, raw)
+	if err != nil {
+		return nil, false, err
+	}
+	return t.handleMessage(&t.dec, t.Reasm, hdr.Type, plain, dst, pooled)
+}
+
+// openDatagram authenticates and decrypts raw, into dst when it fits; dst is
+// returned reset to nil otherwise.
+func (t *Tunnel) openDatagram(dst []byte, raw []byte) (Header, []byte, []byte, bool, error) {
 	if t.Recv == nil {
-		return nil, false, errors.New("recv cipher not set")
+		return Header{}, nil, nil, false, &CipherError{Op: "open", Err: ErrNoCipher}
 	}
 	hdr, ciphertext, err := ParseHeader(raw)
 	if err != nil {
-		return nil, false, err
+		return Header{}, nil, nil, false, err
 	}
-	if hdr.SessionID != t.SessionID {
-		return nil, false, ErrSessionMismatch
+	if hdr.Compact {
+		if uint16(hdr.SessionID) != uint16(t.SessionID) {
+			return Header{}, nil, nil, false, ErrSessionMismatch
+		}
+		hdr.SessionID = t.SessionID
+		hdr.Counter = t.Recv.expandCounter(uint32(hdr.Counter))
+	} else if hdr.SessionID != t.SessionID {
+		return Header{}, nil, nil, false, ErrSessionMismatch
 	}
 	plainLen := len(ciphertext) - t.Recv.Overhead()
 	if plainLen < 0 {
-		return nil, false, ErrInvalidDatagram
+		return Header{}, nil, nil, false, ErrInvalidDatagram
 	}
 	pooled := cap(dst) >= plainLen
 	if pooled {
@@ -297,36 +507,232 @@ func (t *Tunnel) DecodeDatagramInto(dst []byte, raw []byte) ([]byte, bool, error
 	} else {
 		dst = nil
 	}
-	plain, err := t.Recv.Open(dst, hdr.Counter, raw[:HeaderLen], ciphertext)
+	plain, err := t.Recv.Open(dst, hdr.Counter, raw[:len(raw)-len(ciphertext)], ciphertext)
 	if err != nil {
-		return nil, false, err
+		return Header{}, nil, nil, false, err
 	}
-	switch hdr.Type {
+	return hdr, plain, dst, pooled, nil
+}
+
+// handleMessage processes a decrypted message, reassembling fragments with
+// reasm and keeping the rest of a coalesced datagram in st.
+func (t *Tunnel) handleMessage(st *decodeState, reasm *Reassembler, typ MessageType, plain, dst []byte, pooled bool) ([]byte, bool, error) {
+	st.coalesced = nil
+	switch typ {
 	case MsgData:
+		t.stats.recv(len(plain))
 		return plain, pooled, nil
 	case MsgFragment:
-		if t.Reasm == nil {
+		t.stats.fragmentsRecv.Add(1)
+		if reasm == nil {
 			return nil, pooled, nil
 		}
-		assembled, err := t.Reasm.Push(plain)
+		assembled, err := t.pushFragment(reasm, plain)
 		if err != nil || assembled == nil {
 			return assembled, pooled, err
 		}
+		t.stats.recv(len(assembled))
 		if cap(dst) >= len(assembled) {
 			out := dst[:len(assembled)]
 			copy(out, assembled)
 			return out, true, nil
 		}
 		return assembled, false, nil
-	case MsgPing, MsgPong:
+	case MsgCompressedData:
+		if !t.compress {
+			return nil, false, &TransportError{Op: "decode", Err: fmt.Errorf("%w: %d", ErrUnknownMessageType, typ)}
+		}
+		out, err := decompressPayload(plain)
+		if err != nil {
+			return nil, false, &TransportError{Op: "decompress", Err: err}
+		}
+		t.stats.recv(len(out))
+		if cap(dst) >= len(out) {
+			dst = dst[:len(out)]
+			copy(dst, out)
+			return dst, true, nil
+		}
+		return out, false, nil
+	case MsgCoalesced:
+		first, rest, _, err := splitCoalesced(plain)
+		if err != nil {
+			return nil, false, &TransportError{Op: "decode coalesced", Err: err}
+		}
+		st.coalescedBuf = append(st.coalescedBuf[:0], rest...)
+		st.coalesced = st.coalescedBuf
+		t.stats.recv(len(first))
+		// Move the first packet to the start of the buffer so callers can
+		// hand it back to their pool like any other packet.
+		n := copy(plain, first)
+		return plain[:n], pooled, nil
+	case MsgPing:
+		if t.PingHandler != nil {
+			t.PingHandler()
+		}
+		return nil, pooled, nil
+	case MsgPong:
+		if sent := t.pingSent.Swap(0); sent != 0 {
+			t.rtt.Store(time.Now().UnixNano() - sent)
+		}
+		if t.PongHandler != nil {
+			t.PongHandler()
+		}
+		return nil, pooled, nil
+	case MsgFragmentNAK:
+		if t.fragCache == nil {
+			return nil, false, &TransportError{Op: "decode", Err: fmt.Errorf("%w: %d", ErrUnknownMessageType, typ)}
+		}
+		fragID, missing, err := decodeFragmentNAK(plain)
+		if err != nil {
+			return nil, pooled, &TransportError{Op: "decode fragment nak", Err: err}
+		}
+		if t.FragmentNAKHandler != nil {
+			t.FragmentNAKHandler(fragID, missing)
+		}
+		return nil, pooled, nil
+	case MsgNotification:
+		if !t.notify {
+			return nil, false, &TransportError{Op: "decode", Err: fmt.Errorf("%w: %d", ErrUnknownMessageType, typ)}
+		}
+		if len(plain) > MaxNotificationBytes {
+			return nil, pooled, &TransportError{Op: "decode notification", Err: ErrNotificationTooLarge}
+		}
+		if t.NotificationHandler != nil {
+			t.NotificationHandler(bytes.Clone(plain))
+		}
+		return nil, pooled, nil
+	case MsgRouteUpdate:
+		var upd RouteUpdate
+		if err := json.Unmarshal(plain, &upd); err != nil {
+			return nil, pooled, &TransportError{Op: "decode route update", Err: err}
+		}
+		if upd.MTU > 0 {
+			if err := t.SetMTU(upd.MTU); err != nil {
+				return nil, pooled, err
+			}
+		}
+		add, err := toRoutes(upd.Add)
+		if err != nil {
+			return nil, pooled, &TransportError{Op: "decode route update", Err: err}
+		}
+		del, err := toRoutes(upd.Del)
+		if err != nil {
+			return nil, pooled, &TransportError{Op: "decode route update", Err: err}
+		}
+		if len(add)+len(del) > 0 && t.RouteUpdateHandler != nil {
+			t.RouteUpdateHandler(add, del)
+		}
 		return nil, pooled, nil
 	default:
-		return nil, false, fmt.Errorf("unknown message type: %d", hdr.Type)
+		return nil, false, &TransportError{Op: "decode", Err: fmt.Errorf("%w: %d", ErrUnknownMessageType, typ)}
+	}
+}
+
+// SendRouteUpdate asks the peer to add and remove the given CIDR routes.
+func (t *Tunnel) SendRouteUpdate(conn DatagramConn, add, del []string) error {
+	payload, err := json.Marshal(RouteUpdate{Add: add, Del: del})
+	if err != nil {
+		return err
 	}
+	return t.sendControl(conn, MsgRouteUpdate, payload)
+}
+
+// SendMTUUpdate tells the peer to use mtu and then applies it locally.
+func (t *Tunnel) SendMTUUpdate(conn DatagramConn, mtu int) error {
+	if !t.mtuInRange(mtu) {
+		return fmt.Errorf("%w: %d", ErrInvalidMTU, mtu)
+	}
+	payload, err := json.Marshal(RouteUpdate{MTU: mtu})
+	if err != nil {
+		return err
+	}
+	if err := t.sendControl(conn, MsgRouteUpdate, payload); err != nil {
+		return err
+	}
+	return t.SetMTU(mtu)
+}
+
+// SendPing sends a keepalive ping. The round trip is timed from the oldest
+// ping still unanswered, so a lost pong counts against the RTT.
+func (t *Tunnel) SendPing(conn DatagramConn) error {
+	t.pingSent.CompareAndSwap(0, time.Now().UnixNano())
+	return t.sendControl(conn, MsgPing, nil)
+}
+
+// RTT returns the round trip of the last answered ping, or how long the
+// outstanding ping has waited if that is longer; 0 before any ping.
+func (t *Tunnel) RTT() time.Duration {
+	rtt := t.rtt.Load()
+	if sent := t.pingSent.Load(); sent != 0 {
+		rtt = max(rtt, time.Now().UnixNano()-sent)
+	}
+	return time.Duration(rtt)
+}
+
+// LossEstimate returns the share of the peer's recent packets that never
+// arrived, as tracked by the replay window.
+func (t *Tunnel) LossEstimate() float64 {
+	if t.Recv == nil || t.Recv.replay == nil {
+		return 0
+	}
+	return t.Recv.replay.LossEstimate()
+}
+
+// Quality scores the tunnel from 0 to 1 (healthy): RTT up to 500ms, loss
+// and up to 100 replay drops cost at most 0.4, 0.4 and 0.2.
+func (t *Tunnel) Quality() float64 {
+	rttMs := float64(t.RTT()) / float64(time.Millisecond)
+	return 1 - clamp01(rttMs/500)*0.4 - clamp01(t.LossEstimate())*0.4 - clamp01(float64(t.stats.replayDrops.Load())/100)*0.2
+}
+
+func clamp01(v float64) float64 {
+	return min(max(v, 0), 1)
+}
+
+func (t *Tunnel) SendPong(conn DatagramConn) error {
+	return t.sendControl(conn, MsgPong, nil)
+}
+
+// sendControl encodes a single unfragmented control message. It uses its own
+// Encoder so it is safe to call alongside the data path.
+func (t *Tunnel) sendControl(conn DatagramConn, msgType MessageType, payload []byte) error {
+	t.mtuMu.RLock()
+	defer t.mtuMu.RUnlock()
+	if t.Send == nil {
+		return &CipherError{Op: "seal", Err: ErrNoCipher}
+	}
+	if len(payload) > t.payloadMTUValue {
+		return ErrPayloadTooLarge
+	}
+	return t.NewEncoder().encodeAndEmit(msgType, payload, conn.SendDatagram)
+}
+
+// toRoutes parses the CIDRs of a route update. The peer must not replace
+// the default route, so /0 prefixes are refused along with malformed ones.
+func toRoutes(cidrs []string) ([]netcfg.Route, error) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+	routes := make([]netcfg.Route, 0, len(cidrs))
+	for _, c := range cidrs {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidRoute, c)
+		}
+		if p.Bits() == 0 {
+			return nil, fmt.Errorf("%w: default route %q", ErrInvalidRoute, c)
+		}
+		routes = append(routes, netcfg.Route{Dest: p.Masked().String()})
+	}
+	return routes, nil
 }
 
 func (t *Tunnel) PumpTunToConn(ctx context.Context, tun io.Reader, conn DatagramConn, maxPacket int) error {
 	buf := make([]byte, maxPacket)
+	co := t.NewCoalescer(nil, conn.SendDatagram)
+	if co != nil {
+		defer co.Stop()
+	}
 	for {
 		select {
 		case <-ctx.Done():
@@ -335,11 +741,23 @@ func (t *Tunnel) PumpTunToConn(ctx context.Context, tun io.Reader, conn Datagram
 		}
 		n, err := tun.Read(buf)
 		if err != nil {
-			return fmt.Errorf("read tun: %w", err)
+			return &TransportError{Op: "read tun", Err: err}
 		}
 		if n == 0 {
 			continue
 		}
+		if co != nil {
+			ok, err := co.Add(buf[:n])
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+			if err := co.Flush(); err != nil {
+				return err
+			}
+		}
 		if err := t.EncodePacket(buf[:n], conn.SendDatagram); err != nil {
 			return err
 		}
@@ -350,18 +768,36 @@ func (t *Tunnel) PumpConnToTun(ctx context.Context, tun io.Writer, conn Datagram
 	for {
 		b, err := conn.ReceiveDatagram(ctx)
 		if err != nil {
-			return fmt.Errorf("receive datagram: %w", err)
+			return &TransportError{Op: "receive datagram", Err: err}
 		}
 		pkt, err := t.DecodeDatagram(b)
 		if err != nil {
+			t.countDecodeError(err)
 			return err
 		}
 		if len(pkt) == 0 {
 			continue
 		}
 		if _, err := tun.Write(pkt); err != nil {
-			return fmt.Errorf("write tun: %w", err)
+			return &TransportError{Op: "write tun", Err: err}
 		}
+		for {
+			next, ok := t.NextCoalesced(nil)
+			if !ok {
+				break
+			}
+			if _, err := tun.Write(next); err != nil {
+				return &TransportError{Op: "write tun", Err: err}
+			}
+		}
+	}
+}
+
+func (t *Tunnel) countDecodeError(err error) {
+	if errors.Is(err, ErrReplay) {
+		t.stats.replayDrops.Add(1)
+	} else {
+		t.stats.decodeErrors.Add(1)
 	}
 }
 
@@ -371,10 +807,11 @@ func (t *Tunnel) PumpConnToTunBuffered(ctx context.Context, tun io.Writer, conn
 	for {
 		b, err := conn.ReceiveDatagram(ctx)
 		if err != nil {
-			return fmt.Errorf("receive datagram: %w", err)
+			return &TransportError{Op: "receive datagram", Err: err}
 		}
 		pkt, pooled, err := t.DecodeDatagramInto(buf[:0], b)
 		if err != nil {
+			t.countDecodeError(err)
 			return err
 		}
 		if len(pkt) == 0 {
@@ -382,13 +819,22 @@ func (t *Tunnel) PumpConnToTunBuffered(ctx context.Context, tun io.Writer, conn
 		}
 		if !pooled {
 			if len(pkt) > cap(buf) {
-				return fmt.Errorf("packet too large: %d", len(pkt))
+				return &TransportError{Op: "write tun", Err: ErrPayloadTooLarge}
 			}
 			copy(buf, pkt)
 			pkt = buf[:len(pkt)]
 		}
 		if _, err := tun.Write(pkt); err != nil {
-			return fmt.Errorf("write tun: %w", err)
+			return &TransportError{Op: "write tun", Err: err}
+		}
+		for {
+			next, ok := t.NextCoalesced(buf)
+			if !ok {
+				break
+			}
+			if _, err := tun.Write(next); err != nil {
+				return &TransportError{Op: "write tun", Err: err}
+			}
 		}
 	}
 }
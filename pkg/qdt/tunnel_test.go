@@ -2,7 +2,17 @@ package qdt
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"math"
 	"testing"
+	"time"
+
+	"qdt/internal/netcfg"
+	"qdt/internal/testutil"
+	"qdt/internal/tun"
 )
 
 func TestTunnelEncodeDecode(t *testing.T) {
@@ -52,4 +62,666 @@ func TestTunnelEncodeDecode(t *testing.T) {
 	if !bytes.Equal(out, payload) {
 		t.Fatalf("payload mismatch")
 	}
+	stats := tun.Stats()
+	if stats.PacketsSent != 1 || stats.BytesSent != uint64(len(payload)) {
+		t.Fatalf("unexpected send stats: %+v", stats)
+	}
+	if stats.FragmentsSent != uint64(len(dgrams)) || stats.FragmentsRecv != uint64(len(dgrams)) {
+		t.Fatalf("unexpected fragment stats: %+v", stats)
+	}
+	if stats.PacketsRecv != 1 || stats.BytesRecv != uint64(len(payload)) {
+		t.Fatalf("unexpected recv stats: %+v", stats)
+	}
+}
+
+func TestTunnelPumpFakeDevice(t *testing.T) {
+	km, err := DeriveKeyMaterial("secret", make([]byte, HandshakeNonceSize), make([]byte, HandshakeNonceSize))
+	if err != nil {
+		t.Fatalf("derive keys: %v", err)
+	}
+	send, _, err := NewClientCipherStates(km, nil)
+	if err != nil {
+		t.Fatalf("cipher states: %v", err)
+	}
+	_, recv, err := NewServerCipherStates(km, NewReplayWindow(128))
+	if err != nil {
+		t.Fatalf("cipher states: %v", err)
+	}
+	tunnel := NewTunnel(7, 400, send, recv)
+
+	in := tun.NewFakeDevice(16)
+	out := tun.NewFakeDevice(16)
+	defer in.Close()
+	defer out.Close()
+	a, b := newFakeDatagramPair(64)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tunnel.PumpTunToConn(ctx, in, a, 65535)
+	go tunnel.PumpConnToTunBuffered(ctx, out, b, 65535)
+
+	payloads := [][]byte{[]byte("small"), bytes.Repeat([]byte("y"), 1500)}
+	for _, p := range payloads {
+		in.InjectPacket(p)
+	}
+	for _, want := range payloads {
+		got := waitPacket(t, out)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("payload mismatch: got %d bytes, want %d", len(got), len(want))
+		}
+	}
+}
+
+func waitPacket(t *testing.T, dev *tun.FakeDevice) []byte {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if pkt, ok := dev.DrainPacket(); ok {
+			return pkt
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for packet")
+	return nil
+}
+
+func TestRouteUpdate(t *testing.T) {
+	client, server := newTunnelPair(t, 3, DefaultMTU)
+	a, b := newFakeDatagramPair(4)
+	var gotAdd, gotDel []netcfg.Route
+	client.RouteUpdateHandler = func(add, del []netcfg.Route) {
+		gotAdd, gotDel = add, del
+	}
+	if err := server.SendRouteUpdate(a, []string{"10.1.0.0/24"}, []string{"10.2.0.0/24"}); err != nil {
+		t.Fatalf("send route update: %v", err)
+	}
+	d, err := b.ReceiveDatagram(context.Background())
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	pkt, err := client.DecodeDatagram(d)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if pkt != nil {
+		t.Fatalf("route update should not yield a packet")
+	}
+	if len(gotAdd) != 1 || gotAdd[0].Dest != "10.1.0.0/24" {
+		t.Fatalf("unexpected add routes: %+v", gotAdd)
+	}
+	if len(gotDel) != 1 || gotDel[0].Dest != "10.2.0.0/24" {
+		t.Fatalf("unexpected del routes: %+v", gotDel)
+	}
+
+	for _, bad := range [][]string{{"10.3.0.0/24", "10.4.0.0"}, {"10.3.0.0/24", "0.0.0.0/0"}, {"::/0"}, {"bogus/8"}} {
+		gotAdd = nil
+		if err := server.SendRouteUpdate(a, bad, nil); err != nil {
+			t.Fatalf("send route update: %v", err)
+		}
+		d, err := b.ReceiveDatagram(context.Background())
+		if err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+		if _, err := client.DecodeDatagram(d); !errors.Is(err, ErrInvalidRoute) {
+			t.Fatalf("%v: got %v, want ErrInvalidRoute", bad, err)
+		}
+		if gotAdd != nil {
+			t.Fatalf("%v: handler called with %+v", bad, gotAdd)
+		}
+	}
+}
+
+func TestNotification(t *testing.T) {
+	client, server := newTunnelPair(t, 9, DefaultMTU)
+	a, b := newFakeDatagramPair(4)
+	if err := server.SendNotification(a, []byte("hi")); !errors.Is(err, ErrNotificationDisabled) {
+		t.Fatalf("send before enable: %v, want ErrNotificationDisabled", err)
+	}
+	client.EnableNotifications()
+	server.EnableNotifications()
+	var got string
+	client.NotificationHandler = func(payload []byte) { got = string(payload) }
+	if err := server.SendNotification(a, make([]byte, MaxNotificationBytes+1)); !errors.Is(err, ErrNotificationTooLarge) {
+		t.Fatalf("oversized notification: %v, want ErrNotificationTooLarge", err)
+	}
+	if err := server.SendNotification(a, []byte("maintenance at 02:00")); err != nil {
+		t.Fatalf("send notification: %v", err)
+	}
+	d, err := b.ReceiveDatagram(context.Background())
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if pkt, err := client.DecodeDatagram(d); err != nil || pkt != nil {
+		t.Fatalf("decode = %v, %v; want no packet", pkt, err)
+	}
+	if got != "maintenance at 02:00" {
+		t.Fatalf("notification = %q", got)
+	}
+}
+
+func TestCompactHeader(t *testing.T) {
+	client, server := newTunnelPair(t, 0x1234_5678_9abc, DefaultMTU)
+	fullMTU := client.payloadMTU()
+	client.EnableCompactHeader()
+	server.EnableCompactHeader()
+	if got := client.payloadMTU(); got != fullMTU+HeaderLen-CompactHeaderLen {
+		t.Fatalf("payload mtu = %d, want %d", got, fullMTU+HeaderLen-CompactHeaderLen)
+	}
+
+	// Cross the 32 bit counter boundary the compact header truncates at.
+	client.Send.sendCounter = 1<<32 - 2
+	payload := []byte("compact")
+	for i := 0; i < 4; i++ {
+		var datagram []byte
+		if err := client.EncodePacket(payload, func(d []byte) error {
+			datagram = append([]byte(nil), d...)
+			return nil
+		}); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		if want := CompactHeaderLen + client.Send.Overhead() + len(payload); len(datagram) != want {
+			t.Fatalf("datagram is %d bytes, want %d", len(datagram), want)
+		}
+		pkt, err := server.DecodeDatagram(datagram)
+		if err != nil {
+			t.Fatalf("decode packet %d: %v", i, err)
+		}
+		if !bytes.Equal(pkt, payload) {
+			t.Fatalf("packet %d = %q", i, pkt)
+		}
+	}
+
+	// Full headers are still accepted.
+	server.compactHeader = false
+	var full []byte
+	if err := server.EncodePacket(payload, func(d []byte) error {
+		full = append([]byte(nil), d...)
+		return nil
+	}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if pkt, err := client.DecodeDatagram(full); err != nil || !bytes.Equal(pkt, payload) {
+		t.Fatalf("decode full header = %q, %v", pkt, err)
+	}
+}
+
+func TestFragEpoch(t *testing.T) {
+	client, server := newTunnelPair(t, 7, DefaultMTU)
+	client.EnableFragEpoch()
+	server.EnableFragEpoch()
+	encode := func(payload []byte) [][]byte {
+		var out [][]byte
+		if err := client.EncodePacket(payload, func(d []byte) error {
+			out = append(out, append([]byte(nil), d...))
+			return nil
+		}); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		return out
+	}
+
+	// Leave a packet with low ID 0xffffffff partial, then send one with the
+	// same low ID an epoch later.
+	client.Frag.nextID = 1<<32 - 2
+	stale := encode(bytes.Repeat([]byte("a"), 3000))
+	for _, d := range stale[:len(stale)-1] {
+		if _, err := server.DecodeDatagram(d); err != nil {
+			t.Fatalf("decode stale: %v", err)
+		}
+	}
+	client.Frag.nextID = 2<<32 - 2
+	payload := bytes.Repeat([]byte("b"), 3000)
+	var got []byte
+	for _, d := range encode(payload) {
+		pkt, err := server.DecodeDatagram(d)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if pkt != nil {
+			got = pkt
+		}
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("reassembled %d bytes, want the second packet", len(got))
+	}
+	if e := client.FragEpoch(); e != 1 {
+		t.Fatalf("epoch = %d, want 1", e)
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	client, server := newTunnelPair(t, 4, DefaultMTU)
+	a, b := newFakeDatagramPair(4)
+	client.PingHandler = func() {
+		if err := client.SendPong(b); err != nil {
+			t.Errorf("send pong: %v", err)
+		}
+	}
+	ponged := false
+	server.PongHandler = func() { ponged = true }
+	if err := server.SendPing(a); err != nil {
+		t.Fatalf("send ping: %v", err)
+	}
+	ping, err := b.ReceiveDatagram(context.Background())
+	if err != nil {
+		t.Fatalf("receive ping: %v", err)
+	}
+	if _, err := client.DecodeDatagram(ping); err != nil {
+		t.Fatalf("decode ping: %v", err)
+	}
+	pong, err := a.ReceiveDatagram(context.Background())
+	if err != nil {
+		t.Fatalf("receive pong: %v", err)
+	}
+	if _, err := server.DecodeDatagram(pong); err != nil {
+		t.Fatalf("decode pong: %v", err)
+	}
+	if !ponged {
+		t.Fatalf("pong handler not called")
+	}
+	rtt := server.RTT()
+	if rtt <= 0 {
+		t.Fatalf("rtt not recorded")
+	}
+
+	// An unanswered ping counts against the RTT from when it was sent, even
+	// when further pings follow it.
+	if err := server.SendPing(a); err != nil {
+		t.Fatalf("send ping: %v", err)
+	}
+	time.Sleep(rtt + 20*time.Millisecond)
+	if err := server.SendPing(a); err != nil {
+		t.Fatalf("send ping: %v", err)
+	}
+	if got := server.RTT(); got < rtt+20*time.Millisecond {
+		t.Fatalf("rtt with a ping outstanding = %v, want at least %v", got, rtt+20*time.Millisecond)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	client, server := newTunnelPair(t, 11, DefaultMTU)
+	client.EnableCompression()
+	server.EnableCompression()
+
+	var observed int
+	client.CompressObserver = func(raw, compressed int) { observed++ }
+
+	text := bytes.Repeat([]byte("GET /api/v1/items HTTP/1.1\r\nHost: example.com\r\n"), 60)
+	random := make([]byte, 1000)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	for _, payload := range [][]byte{text, random} {
+		var dgrams [][]byte
+		err := client.EncodePacket(payload, func(b []byte) error {
+			dgrams = append(dgrams, append([]byte(nil), b...))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		var got []byte
+		for _, d := range dgrams {
+			hdr, _, err := ParseHeader(d)
+			if err != nil {
+				t.Fatalf("header: %v", err)
+			}
+			if bytes.Equal(payload, text) && hdr.Type != MsgCompressedData {
+				t.Fatalf("text sent as type %d, want compressed", hdr.Type)
+			}
+			if bytes.Equal(payload, random) && hdr.Type == MsgCompressedData {
+				t.Fatalf("incompressible payload sent compressed")
+			}
+			out, err := server.DecodeDatagram(d)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if out != nil {
+				got = out
+			}
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("payload mismatch after round trip")
+		}
+	}
+	if observed != 2 {
+		t.Fatalf("observer called %d times, want 2", observed)
+	}
+	st := client.Stats()
+	if st.CompressedIn != uint64(len(text)) || st.CompressedOut == 0 || st.CompressedOut >= st.CompressedIn {
+		t.Fatalf("unexpected compression stats: %+v", st)
+	}
+}
+
+func TestSetMTU(t *testing.T) {
+	client, server := newTunnelPair(t, 12, DefaultMTU)
+	if err := client.SetMTU(HeaderLen); !errors.Is(err, ErrInvalidMTU) {
+		t.Fatalf("expected ErrInvalidMTU, got %v", err)
+	}
+
+	a, b := newFakeDatagramPair(4)
+	if err := server.SendMTUUpdate(a, 600); err != nil {
+		t.Fatalf("send mtu update: %v", err)
+	}
+	if got := server.CurrentMTU(); got != 600 {
+		t.Fatalf("server mtu %d, want 600", got)
+	}
+	d, err := b.ReceiveDatagram(context.Background())
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if _, err := client.DecodeDatagram(d); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got := client.CurrentMTU(); got != 600 {
+		t.Fatalf("client mtu %d, want 600", got)
+	}
+
+	payload := bytes.Repeat([]byte("m"), 1000)
+	var dgrams int
+	err = client.EncodePacket(payload, func(b []byte) error {
+		if len(b) > 600 {
+			t.Fatalf("datagram of %d bytes exceeds mtu", len(b))
+		}
+		dgrams++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if dgrams < 2 {
+		t.Fatalf("expected fragmentation at the new mtu, got %d datagram(s)", dgrams)
+	}
+}
+
+func TestMTUUpdateBounds(t *testing.T) {
+	client, server := newTunnelPair(t, 13, 1200)
+	a, b := newFakeDatagramPair(4)
+	if err := server.SendMTUUpdate(a, 1201); !errors.Is(err, ErrInvalidMTU) {
+		t.Fatalf("send above handshake mtu: got %v", err)
+	}
+	if err := client.SetMTU(MinMTU - 1); !errors.Is(err, ErrInvalidMTU) {
+		t.Fatalf("set below MinMTU: got %v", err)
+	}
+
+	// A peer that skips the sender check is refused by the receiver.
+	for _, mtu := range []int{1500, 100} {
+		payload, _ := json.Marshal(RouteUpdate{MTU: mtu})
+		if err := server.sendControl(a, MsgRouteUpdate, payload); err != nil {
+			t.Fatal(err)
+		}
+		d, err := b.ReceiveDatagram(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.DecodeDatagram(d); !errors.Is(err, ErrInvalidMTU) {
+			t.Fatalf("mtu %d: got %v, want ErrInvalidMTU", mtu, err)
+		}
+		if got := client.CurrentMTU(); got != 1200 {
+			t.Fatalf("mtu %d: client mtu changed to %d", mtu, got)
+		}
+	}
+}
+
+func TestSetMTUCompactHeader(t *testing.T) {
+	client, _ := newTunnelPair(t, 14, 1200)
+	full := client.payloadMTU()
+	client.EnableCompactHeader()
+	if err := client.SetMTU(1000); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := client.payloadMTU(), full-200+HeaderLen-CompactHeaderLen; got != want {
+		t.Fatalf("payload mtu %d, want %d", got, want)
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+	client, server := newTunnelPair(t, 12, DefaultMTU)
+	client.EnableCoalescing(20*time.Millisecond, 0, 128)
+
+	dgrams := make(chan []byte, 16)
+	co := client.NewCoalescer(nil, func(b []byte) error {
+		dgrams <- append([]byte(nil), b...)
+		return nil
+	})
+	defer co.Stop()
+
+	var sent [][]byte
+	for i := 0; i < 5; i++ {
+		pkt := bytes.Repeat([]byte{byte(i + 1)}, 40+i)
+		sent = append(sent, pkt)
+		ok, err := co.Add(pkt)
+		if err != nil || !ok {
+			t.Fatalf("add %d: ok=%v err=%v", i, ok, err)
+		}
+	}
+	if ok, _ := co.Add(make([]byte, 128)); ok {
+		t.Fatalf("packet at threshold was coalesced")
+	}
+	if err := co.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(dgrams) != 1 {
+		t.Fatalf("got %d datagrams, want 1", len(dgrams))
+	}
+	d := <-dgrams
+	if hdr, _, _ := ParseHeader(d); hdr.Type != MsgCoalesced {
+		t.Fatalf("sent as type %d, want coalesced", hdr.Type)
+	}
+	var got [][]byte
+	first, _, err := server.DecodeDatagramInto(make([]byte, 2048), d)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	got = append(got, first)
+	for {
+		pkt, ok := server.NextCoalesced(make([]byte, 0, 2048))
+		if !ok {
+			break
+		}
+		got = append(got, pkt)
+	}
+	if len(got) != len(sent) {
+		t.Fatalf("got %d packets, want %d", len(got), len(sent))
+	}
+	for i := range sent {
+		if !bytes.Equal(got[i], sent[i]) {
+			t.Fatalf("packet %d mismatch", i)
+		}
+	}
+
+	// A lone packet is flushed by the timer as plain data.
+	if ok, err := co.Add([]byte("tick")); !ok || err != nil {
+		t.Fatalf("add: ok=%v err=%v", ok, err)
+	}
+	select {
+	case d := <-dgrams:
+		if hdr, _, _ := ParseHeader(d); hdr.Type != MsgData {
+			t.Fatalf("single packet sent as type %d, want data", hdr.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timer did not flush")
+	}
+
+	var bad []byte
+	err = client.NewEncoder().encodeAndEmit(MsgCoalesced, []byte{0, 2, 0, 3, 'a', 'b', 'c', 0, 9}, func(b []byte) error {
+		bad = append([]byte(nil), b...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if _, _, err := server.DecodeDatagramInto(make([]byte, 2048), bad); !errors.Is(err, ErrInvalidDatagram) {
+		t.Fatalf("malformed payload: got %v, want ErrInvalidDatagram", err)
+	}
+}
+
+func TestPumpConnToTunConcurrent(t *testing.T) {
+	const packets = 60
+	client, server := newTunnelPair(t, 5, 400)
+	dev := tun.NewFakeDevice(packets)
+	defer dev.Close()
+	clientConn, serverConn := newFakeDatagramPair(packets * 8)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.PumpConnToTunConcurrent(ctx, dev, serverConn, 4, 65535) }()
+
+	want := make(map[string]bool)
+	for i := 0; i < packets; i++ {
+		// Every other packet is split into several fragments.
+		pkt := bytes.Repeat([]byte{byte(i)}, 40+i%2*1200)
+		want[string(pkt)] = true
+		if err := client.EncodePacket(pkt, clientConn.SendDatagram); err != nil {
+			t.Fatalf("encode %d: %v", i, err)
+		}
+	}
+	for range packets {
+		got := waitPacket(t, dev)
+		if !want[string(got)] {
+			t.Fatalf("unexpected or duplicate packet of %d bytes", len(got))
+		}
+		delete(want, string(got))
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("pump returned %v, want context.Canceled", err)
+	}
+}
+
+func TestTunnelUnderChaos(t *testing.T) {
+	tests := []struct {
+		name string
+		// lossy cases may lose whole packets but must never deliver a
+		// corrupted or repeated one.
+		lossy bool
+		setup func(*testutil.ChaosProxy)
+	}{
+		{"reorder", false, func(p *testutil.ChaosProxy) {
+			p.ReorderRate, p.ReorderBufferSize = 0.5, 8
+		}},
+		{"duplicate", false, func(p *testutil.ChaosProxy) { p.DuplicateRate = 0.3 }},
+		{"drop", true, func(p *testutil.ChaosProxy) { p.DropRate = 0.2 }},
+		{"all", true, func(p *testutil.ChaosProxy) {
+			p.DropRate, p.ReorderRate, p.ReorderBufferSize, p.DuplicateRate, p.MaxDelayMs = 0.1, 0.3, 4, 0.2, 1
+		}},
+	}
+	for n, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			const packets = 100
+			client, server := newTunnelPair(t, 11, 400)
+			a, b := newFakeDatagramPair(packets * 8)
+			send := testutil.NewChaosProxy(a, uint64(n))
+			recv := testutil.NewChaosProxy(b, uint64(n)+100)
+			tc.setup(send)
+			tc.setup(recv)
+
+			want := make(map[string]bool)
+			for i := 0; i < packets; i++ {
+				// Every third packet is fragmented.
+				pkt := bytes.Repeat([]byte{byte(i)}, 60+i%3/2*1000)
+				want[string(pkt)] = true
+				if err := client.EncodePacket(pkt, send.SendDatagram); err != nil {
+					t.Fatalf("encode %d: %v", i, err)
+				}
+			}
+			if err := send.Flush(); err != nil {
+				t.Fatalf("flush: %v", err)
+			}
+
+			got := 0
+			for {
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				raw, err := recv.ReceiveDatagram(ctx)
+				cancel()
+				if err != nil {
+					break
+				}
+				pkt, err := server.DecodeDatagram(raw)
+				if err != nil || pkt == nil {
+					continue
+				}
+				if !want[string(pkt)] {
+					t.Fatalf("unexpected, corrupted or duplicate packet of %d bytes", len(pkt))
+				}
+				delete(want, string(pkt))
+				got++
+			}
+			if !tc.lossy && got != packets {
+				t.Fatalf("delivered %d packets, want %d", got, packets)
+			}
+			if tc.lossy && got == 0 {
+				t.Fatalf("no packets delivered")
+			}
+		})
+	}
+}
+
+func TestTunnelQuality(t *testing.T) {
+	_, server := newTunnelPair(t, 5, DefaultMTU)
+	if q := server.Quality(); q != 1 {
+		t.Fatalf("idle quality = %v, want 1", q)
+	}
+	server.stats.replayDrops.Store(50)
+	server.rtt.Store(int64(250 * time.Millisecond))
+	if q := server.Quality(); math.Abs(q-0.7) > 1e-9 {
+		t.Fatalf("quality = %v, want 0.7", q)
+	}
+}
+
+func TestFragmentNAKResend(t *testing.T) {
+	client, server := newTunnelPair(t, 6, 600)
+	client.EnableFragmentNAK(0)
+	server.EnableFragmentNAK(0)
+	a, b := newFakeDatagramPair(8)
+	server.Reasm.OnMissing = func(id uint32, missing []uint32) {
+		if err := server.SendFragmentNAK(b, id, missing); err != nil {
+			t.Errorf("send nak: %v", err)
+		}
+	}
+	client.FragmentNAKHandler = func(id uint32, missing []uint32) {
+		for _, off := range missing {
+			if err := client.ResendFragment(a, id, off); err != nil {
+				t.Errorf("resend: %v", err)
+			}
+		}
+	}
+
+	payload := bytes.Repeat([]byte("n"), 1500)
+	var frags [][]byte
+	err := client.EncodePacket(payload, func(dg []byte) error {
+		frags = append(frags, append([]byte(nil), dg...))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if len(frags) != 3 {
+		t.Fatalf("got %d fragments, want 3", len(frags))
+	}
+	// Lose the middle fragment; the last one triggers a NAK.
+	for _, dg := range [][]byte{frags[0], frags[2]} {
+		if out, err := server.DecodeDatagram(dg); err != nil || out != nil {
+			t.Fatalf("decode = %v, %v; want nothing yet", out, err)
+		}
+	}
+	nak, err := a.ReceiveDatagram(context.Background())
+	if err != nil {
+		t.Fatalf("receive nak: %v", err)
+	}
+	if _, err := client.DecodeDatagram(nak); err != nil {
+		t.Fatalf("decode nak: %v", err)
+	}
+	resent, err := b.ReceiveDatagram(context.Background())
+	if err != nil {
+		t.Fatalf("receive resent fragment: %v", err)
+	}
+	out, err := server.DecodeDatagram(resent)
+	if err != nil {
+		t.Fatalf("decode resent fragment: %v", err)
+	}
+	if !bytes.Equal(out, payload) {
+		t.Fatalf("reassembled %d bytes, want the original %d", len(out), len(payload))
+	}
 }
@@ -0,0 +1,501 @@
+// Package qdtclient embeds a QDT client in another Go program. A Client
+// performs the handshake, owns the QUIC (or WebSocket) connection and pumps
+// packets between the tunnel and a TUN device or a caller-supplied
+// packet source.
+package qdtclient
+
+import (
+	"context"
+	"crypto/mlkem"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/quic-go/quic-go/http3"
+
+	"qdt/internal/netcfg"
+	"qdt/internal/transport"
+	"qdt/internal/tun"
+	"qdt/pkg/qdt"
+)
+
+const maxPacketSize = 65535
+
+var (
+	ErrAlreadyConnected = errors.New("qdtclient: already connected")
+	ErrNotConnected     = errors.New("qdtclient: not connected")
+	// ErrLinkDegraded ends a connection whose quality stayed below
+	// MinQuality for QualityDegradeTimeout.
+	ErrLinkDegraded = errors.New("qdtclient: link quality degraded")
+)
+
+// qualityCheckInterval is how often the tunnel quality is sampled.
+const qualityCheckInterval = 10 * time.Second
+
+// pingInterval is how often the client pings a server that answers, to time
+// the round trip that the tunnel quality is scored on.
+const pingInterval = 5 * time.Second
+
+type Option func(*Client)
+
+// WithTUN makes the client read outgoing packets from dev and write incoming
+// ones to it instead of opening a TUN device. No interface, route or DNS
+// configuration is done in that case, and dev is not closed by the client.
+func WithTUN(dev io.ReadWriter) Option {
+	return func(c *Client) { c.dev = dev }
+}
+
+func WithLogger(log *slog.Logger) Option {
+	return func(c *Client) { c.log = log }
+}
+
+type Client struct {
+	cfg Config
+	dev io.ReadWriter
+	log *slog.Logger
+
+	mu          sync.Mutex
+	tunnel      *qdt.Tunnel
+	localIP     net.IP
+	cancel      context.CancelFunc
+	done        chan struct{}
+	err         error
+	state       clientState
+	stateLoaded bool
+	// tlsSessions keeps session tickets across reconnects for 0-RTT.
+	tlsSessions tls.ClientSessionCache
+	path        pathStatser
+	registry    *prometheus.Registry
+}
+
+// New returns a disconnected client. Zero fields of cfg take their defaults.
+func New(cfg Config, opts ...Option) *Client {
+	cfg.SetDefaults()
+	c := &Client{cfg: cfg, log: slog.Default(), tlsSessions: tls.NewLRUClientSessionCache(4)}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if cfg.StatsAddr != "" {
+		c.registry = c.newRegistry()
+	}
+	return c
+}
+
+// Connect performs the handshake and starts forwarding packets. ctx bounds
+// the connect only; the tunnel runs until Disconnect is called or the
+// connection fails, which closes Done.
+func (c *Client) Connect(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel != nil {
+		return ErrAlreadyConnected
+	}
+	cfg := c.cfg
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	var cleanup []func()
+	teardown := func() {
+		for i := len(cleanup) - 1; i >= 0; i-- {
+			cleanup[i]()
+		}
+	}
+	fail := func(err error) error {
+		teardown()
+		return err
+	}
+
+	dev := c.dev
+	var tunDev *tun.Device
+	if dev == nil {
+		var err error
+		tunDev, err = tun.Open(cfg.TunName)
+		if err != nil {
+			return fmt.Errorf("tun open: %w", err)
+		}
+		cleanup = append(cleanup, func() { tunDev.Close() })
+		dev = tunDev
+	}
+
+	host, _, err := net.SplitHostPort(cfg.Server)
+	if err != nil {
+		return fail(fmt.Errorf("invalid server address: %w", err))
+	}
+	if cfg.ProbeMTU {
+		// The probe only lowers the MTU below the one derived from the
+		// local link.
+		if mtu, err := probeMTU(ctx, cfg.Server); err != nil {
+			c.log.Warn("mtu probe failed", "err", err)
+		} else if mtu < cfg.MTU {
+			c.log.Info("path mtu probed", "mtu", mtu)
+			cfg.MTU = mtu
+		}
+	}
+	if cfg.MASQUEProxy != "" && cfg.MTU > transport.MASQUEDatagramSize {
+		c.log.Info("mtu lowered to fit masque proxy datagrams", "mtu", transport.MASQUEDatagramSize)
+		cfg.MTU = transport.MASQUEDatagramSize
+	}
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: cfg.Insecure,
+		NextProtos:         []string{qdt.ALPNv1, http3.NextProtoH3},
+		ServerName:         host,
+	}
+	if cfg.Enable0RTT {
+		tlsConf.ClientSessionCache = c.tlsSessions
+	}
+	if cfg.PinnedCert != "" {
+		pin, err := parseCertPin(cfg.PinnedCert)
+		if err != nil {
+			return fail(err)
+		}
+		tlsConf.InsecureSkipVerify = true
+		tlsConf.VerifyPeerCertificate = pinVerifier(pin, "pinned_cert")
+	}
+
+	clientNonce, err := qdt.NewHandshakeNonce()
+	if err != nil {
+		return fail(fmt.Errorf("nonce: %w", err))
+	}
+	caps := []string{"fragment", "aead", qdt.CapCoalesce, qdt.CapFragmentNAK, qdt.CapNotification, qdt.CapCompactHeader, qdt.CapFragEpoch}
+	if cfg.Compress {
+		caps = append(caps, qdt.CapCompress)
+	}
+	if cfg.FIPSMode {
+		if err := qdt.EnableFIPSMode(); err != nil {
+			return fail(err)
+		}
+		caps = append(caps, qdt.CapFIPS)
+	}
+	var kemKey *mlkem.DecapsulationKey768
+	if cfg.PostQuantum {
+		if kemKey, err = qdt.NewKEMKey(); err != nil {
+			return fail(err)
+		}
+		caps = append(caps, qdt.CapPQMLKEM768)
+	}
+	c.loadState()
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = c.state.ClientID
+	}
+	req := qdt.NewConnectRequest(clientNonce, cfg.MTU, caps, clientID, runtime.GOOS)
+	req.ResumeToken = c.state.ResumeToken
+	if cfg.ReverseTunnel {
+		req.AdvertiseRoutes = []string{cfg.AdvertiseCIDR}
+	}
+	if kemKey != nil {
+		req.KemPublicKey = kemKey.EncapsulationKey().Bytes()
+	}
+
+	stream, resp, closeConn, err := connect(ctx, cfg, host, tlsConf, req, c.log)
+	if err != nil {
+		return fail(err)
+	}
+	cleanup = append(cleanup, closeConn)
+	c.log.Info("connected", "session_id", resp.SessionID, "client_ip", resp.ClientIP, "request_id", resp.RequestID)
+
+	if cfg.FIPSMode && !qdt.HasCap(resp.Caps, qdt.CapFIPS) {
+		return fail(fmt.Errorf("server is not in fips mode"))
+	}
+	serverNonce, err := qdt.DecodeNonce(resp.ServerNonce)
+	if err != nil {
+		return fail(fmt.Errorf("decode server nonce: %w", err))
+	}
+	var kemSecret []byte
+	if kemKey != nil {
+		if !qdt.HasCap(resp.Caps, qdt.CapPQMLKEM768) {
+			return fail(fmt.Errorf("server does not support post-quantum key exchange"))
+		}
+		if kemSecret, err = qdt.DecapsulateKEM(kemKey, resp.KemCiphertext); err != nil {
+			return fail(err)
+		}
+	}
+	keys, err := qdt.DeriveHybridKeyMaterial(cfg.Token, clientNonce, serverNonce, kemSecret)
+	if err != nil {
+		return fail(fmt.Errorf("key derivation: %w", err))
+	}
+	send, recv, err := qdt.NewClientCipherStates(keys, qdt.NewReplayWindow(2048))
+	if err != nil {
+		return fail(fmt.Errorf("cipher: %w", err))
+	}
+	mtu := resp.MTU
+	if mtu <= 0 {
+		mtu = cfg.MTU
+	}
+	tunnel := qdt.NewTunnelWithLimits(resp.SessionID, mtu, send, recv, cfg.MaxReassemblyBytes, cfg.MaxReassemblyAggregateBytes, cfg.ReassemblyTTL)
+	if qdt.HasCap(resp.Caps, qdt.CapCompress) {
+		tunnel.EnableCompression()
+	}
+	if cfg.CoalesceInterval > 0 && qdt.HasCap(resp.Caps, qdt.CapCoalesce) {
+		tunnel.EnableCoalescing(cfg.CoalesceInterval, cfg.CoalesceMaxBytes, cfg.CoalesceThreshold)
+	}
+	tunnel.PingHandler = func() {
+		if err := tunnel.SendPong(stream); err != nil {
+			c.log.Debug("send pong failed", "err", err)
+		}
+	}
+	if qdt.HasCap(resp.Caps, qdt.CapFragmentNAK) {
+		tunnel.EnableFragmentNAK(0)
+		tunnel.Reasm.OnMissing = func(id uint32, missing []uint32) {
+			_ = tunnel.SendFragmentNAK(stream, id, missing)
+		}
+		tunnel.FragmentNAKHandler = func(id uint32, missing []uint32) {
+			for _, off := range missing {
+				if err := tunnel.ResendFragment(stream, id, off); err != nil {
+					c.log.Debug("resend fragment failed", "frag_id", id, "offset", off, "err", err)
+					return
+				}
+			}
+		}
+	}
+	if qdt.HasCap(resp.Caps, qdt.CapCompactHeader) {
+		tunnel.EnableCompactHeader()
+	}
+	if qdt.HasCap(resp.Caps, qdt.CapFragEpoch) {
+		tunnel.EnableFragEpoch()
+	}
+	if qdt.HasCap(resp.Caps, qdt.CapNotification) {
+		tunnel.EnableNotifications()
+		tunnel.NotificationHandler = func(payload []byte) {
+			c.log.Info("server notification", "message", string(payload))
+		}
+	}
+
+	var (
+		routes   []netcfg.Route
+		routesMu sync.Mutex
+	)
+	if tunDev != nil {
+		routes, err = configureInterface(tunDev.Name, resp, cfg, c.log)
+		if err != nil {
+			return fail(err)
+		}
+		// Packets for the advertised network arrive on the tun and are
+		// forwarded by the kernel.
+		if cfg.ReverseTunnel {
+			if on, _ := netcfg.IsIPForwardingEnabled(); !on {
+				if err := netcfg.EnableIPForwarding(); err != nil {
+					c.log.Warn("enable ip forwarding failed", "err", err)
+				}
+			}
+		}
+		tunnel.RouteUpdateHandler = func(add, del []netcfg.Route) {
+			routesMu.Lock()
+			defer routesMu.Unlock()
+			routes = applyRouteUpdate(tunDev.Name, routes, add, del, resp.GatewayIP, c.log)
+		}
+		cleanup = append(cleanup, func() {
+			routesMu.Lock()
+			defer routesMu.Unlock()
+			if err := netcfg.DeleteRoutes(tunDev.Name, routes); err != nil {
+				c.log.Warn("route cleanup failed", "err", err)
+			}
+			if len(cfg.PolicyRoutes) > 0 {
+				if err := netcfg.DeletePolicyRoutes(tunDev.Name, policyRoutes(cfg.PolicyRoutes)); err != nil {
+					c.log.Warn("policy route cleanup failed", "err", err)
+				}
+			}
+			if err := netcfg.ResetDNS(tunDev.Name); err != nil {
+				c.log.Warn("dns cleanup failed", "err", err)
+			}
+		})
+	}
+
+	c.saveResumeToken(resp.ResumeToken)
+
+	if cfg.StatsAddr != "" {
+		srv, err := c.startStatsServer()
+		if err != nil {
+			return fail(err)
+		}
+		cleanup = append(cleanup, func() { srv.Close() })
+	}
+
+	loopCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	c.tunnel = tunnel
+	c.path, _ = stream.(pathStatser)
+	c.localIP = net.ParseIP(resp.ClientIP)
+	c.cancel = cancel
+	c.done = done
+	c.err = nil
+
+	if cfg.StatsInterval > 0 {
+		go logStats(loopCtx, tunnel, cfg.StatsInterval, c.log)
+	}
+	if tunDev != nil {
+		restoreRoutes := func() {
+			routesMu.Lock()
+			defer routesMu.Unlock()
+			reapplyRoutes(tunDev.Name, routes, cfg, c.log)
+		}
+		watchInterfaces(loopCtx, tunDev.Name, restoreRoutes, dnsServers(cfg, resp), resp.SearchDomains, c.log)
+	}
+	errCh := make(chan error, 3)
+	if qdt.HasCap(resp.Caps, qdt.CapPong) {
+		go pingLoop(loopCtx, tunnel, stream, pingInterval, c.log)
+	}
+	if cfg.QualityDegradeTimeout > 0 {
+		go watchQuality(loopCtx, tunnel, qualityCheckInterval, cfg.MinQuality, cfg.QualityDegradeTimeout, errCh, c.log)
+	}
+	go func() {
+		errCh <- tunnel.PumpTunToConn(loopCtx, dev, stream, maxPacketSize)
+	}()
+	go func() {
+		errCh <- tunnel.PumpConnToTunBuffered(loopCtx, dev, stream, maxPacketSize)
+	}()
+	go func() {
+		defer close(done)
+		var err error
+		select {
+		case <-loopCtx.Done():
+		case err = <-errCh:
+		}
+		cancel()
+		teardown()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.err = err
+		c.localIP = nil
+		c.cancel = nil
+	}()
+	return nil
+}
+
+// Disconnect stops the tunnel and waits for the connection, TUN device and
+// routes to be released.
+func (c *Client) Disconnect() error {
+	c.mu.Lock()
+	cancel, done := c.cancel, c.done
+	c.mu.Unlock()
+	if cancel == nil {
+		return ErrNotConnected
+	}
+	cancel()
+	<-done
+	return nil
+}
+
+// Done returns a channel that is closed when the current connection ends, or
+// nil before the first successful Connect.
+func (c *Client) Done() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done
+}
+
+// Err returns the error that ended the last connection, or nil if it was
+// ended by Disconnect or is still running.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Stats returns the counters of the current or last connection.
+func (c *Client) Stats() qdt.Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tunnel == nil {
+		return qdt.Stats{}
+	}
+	return c.tunnel.Stats()
+}
+
+// Quality returns the current tunnel's score from 0 to 1, or 0 while
+// disconnected; see qdt.Tunnel.Quality.
+func (c *Client) Quality() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tunnel == nil {
+		return 0
+	}
+	return c.tunnel.Quality()
+}
+
+// LocalIP returns the tunnel address assigned by the server, or nil while
+// disconnected.
+func (c *Client) LocalIP() net.IP {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.localIP
+}
+
+// watchQuality samples the tunnel quality every interval and reports
+// ErrLinkDegraded on errCh once it has stayed below min for timeout.
+func watchQuality(ctx context.Context, tunnel *qdt.Tunnel, interval time.Duration, min float64, timeout time.Duration, errCh chan<- error, log *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var since time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			q := tunnel.Quality()
+			if q >= min {
+				since = time.Time{}
+				continue
+			}
+			if since.IsZero() {
+				since = now
+			}
+			if now.Sub(since) >= timeout {
+				log.Warn("link quality degraded, reconnecting", "quality", q, "min_quality", min, "for", now.Sub(since).Round(time.Second))
+				errCh <- ErrLinkDegraded
+				return
+			}
+		}
+	}
+}
+
+// pingLoop pings the server every interval so that the tunnel RTT stays
+// current.
+func pingLoop(ctx context.Context, tunnel *qdt.Tunnel, conn qdt.DatagramConn, interval time.Duration, log *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := tunnel.SendPing(conn); err != nil {
+				log.Debug("send ping failed", "err", err)
+			}
+		}
+	}
+}
+
+func logStats(ctx context.Context, tunnel *qdt.Tunnel, interval time.Duration, log *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			st := tunnel.Stats()
+			log.Info("tunnel stats",
+				"bytes_sent", st.BytesSent,
+				"bytes_recv", st.BytesRecv,
+				"packets_sent", st.PacketsSent,
+				"packets_recv", st.PacketsRecv,
+				"fragments_sent", st.FragmentsSent,
+				"fragments_recv", st.FragmentsRecv,
+				"replay_drops", st.ReplayDrops,
+				"decode_errors", st.DecodeErrors,
+				"compressed_in", st.CompressedIn,
+				"compressed_out", st.CompressedOut,
+				"quality", tunnel.Quality(),
+			)
+		}
+	}
+}
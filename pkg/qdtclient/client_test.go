@@ -0,0 +1,92 @@
+package qdtclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"qdt/pkg/qdt"
+)
+
+// dropConn discards everything sent on it, like a server that stopped
+// answering.
+type dropConn struct{}
+
+func (dropConn) SendDatagram([]byte) error { return nil }
+
+func (dropConn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func newTestTunnels(t *testing.T) (client, server *qdt.Tunnel) {
+	t.Helper()
+	clientNonce, err := qdt.NewHandshakeNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverNonce, err := qdt.NewHandshakeNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	km, err := qdt.DeriveKeyMaterial("secret", clientNonce, serverNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cSend, cRecv, err := qdt.NewClientCipherStates(km, qdt.NewReplayWindow(2048))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sSend, sRecv, err := qdt.NewServerCipherStates(km, qdt.NewReplayWindow(2048))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return qdt.NewTunnel(1, qdt.DefaultMTU, cSend, cRecv), qdt.NewTunnel(1, qdt.DefaultMTU, sSend, sRecv)
+}
+
+func TestWatchQualityDegraded(t *testing.T) {
+	client, server := newTestTunnels(t)
+	// Nine in ten packets from the server are lost.
+	for i := range 31 {
+		var dg []byte
+		if err := server.EncodePacket(make([]byte, 64), func(b []byte) error {
+			dg = append([]byte(nil), b...)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 != 0 {
+			continue
+		}
+		if _, err := client.DecodeDatagram(dg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q := client.Quality(); q < DefaultMinQuality {
+		t.Fatalf("quality %v below the threshold before any ping", q)
+	}
+
+	// The server stops answering pings: the RTT grows until the quality
+	// stays below the threshold and the link is reported degraded, which
+	// makes qdt-client reconnect.
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go pingLoop(ctx, client, dropConn{}, 10*time.Millisecond, log)
+	go watchQuality(ctx, client, 10*time.Millisecond, DefaultMinQuality, 100*time.Millisecond, errCh, log)
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, ErrLinkDegraded) {
+			t.Fatalf("got %v, want ErrLinkDegraded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("link not reported degraded, quality %v", client.Quality())
+	}
+	if q := client.Quality(); q >= DefaultMinQuality {
+		t.Fatalf("quality %v, want below %v", q, DefaultMinQuality)
+	}
+}
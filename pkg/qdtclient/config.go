@@ -0,0 +1,170 @@
+package qdtclient
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"qdt/pkg/qdt"
+)
+
+// Config holds the connection settings of a Client. The yaml tags match the
+// keys of client.yaml.
+type Config struct {
+	Server                      string        `yaml:"server"`
+	Discover                    string        `yaml:"discover"`
+	Token                       string        `yaml:"token"`
+	MTU                         int           `yaml:"mtu"`
+	TunName                     string        `yaml:"tun_name"`
+	RouteMode                   string        `yaml:"route_mode"`
+	PolicyRoutes                []PolicyRoute `yaml:"policy_routes"`
+	DNS                         []string      `yaml:"dns"`
+	PreventDNSLeak              bool          `yaml:"prevent_dns_leak"`
+	Insecure                    bool          `yaml:"insecure"`
+	PinnedCert                  string        `yaml:"pinned_cert"`
+	Timeout                     time.Duration `yaml:"timeout"`
+	ClientID                    string        `yaml:"client_id"`
+	MaxReassemblyBytes          int           `yaml:"max_reassembly_bytes"`
+	MaxReassemblyAggregateBytes int           `yaml:"max_reassembly_aggregate_bytes"`
+	ReassemblyTTL               time.Duration `yaml:"reassembly_ttl"`
+	StatsInterval               time.Duration `yaml:"stats_interval"`
+	StatsAddr                   string        `yaml:"stats_addr"`
+	ProxyURL                    string        `yaml:"proxy_url"`
+	MASQUEProxy                 string        `yaml:"masque_proxy"`
+	MASQUEProxyCA               string        `yaml:"masque_proxy_ca"`
+	MASQUEProxyPinnedCert       string        `yaml:"masque_proxy_pinned_cert"`
+	FallbackWebSocket           bool          `yaml:"fallback_websocket"`
+	FallbackTCP                 bool          `yaml:"fallback_tcp"`
+	TCPFallbackServer           string        `yaml:"tcp_fallback_server"`
+	Compress                    bool          `yaml:"compress"`
+	CoalesceInterval            time.Duration `yaml:"coalesce_interval"`
+	CoalesceMaxBytes            int           `yaml:"coalesce_max_bytes"`
+	CoalesceThreshold           int           `yaml:"coalesce_threshold"`
+	StateFile                   string        `yaml:"state_file"`
+	QUICRecvBufferSize          int           `yaml:"quic_recv_buffer_size"`
+	Enable0RTT                  bool          `yaml:"enable_0rtt"`
+	FIPSMode                    bool          `yaml:"fips_mode"`
+	ReverseTunnel               bool          `yaml:"reverse_tunnel"`
+	AdvertiseCIDR               string        `yaml:"advertise_cidr"`
+	PostQuantum                 bool          `yaml:"post_quantum"`
+	ProbeMTU                    bool          `yaml:"probe_mtu"`
+	MinQuality                  float64       `yaml:"min_quality"`
+	QualityDegradeTimeout       time.Duration `yaml:"quality_degrade_timeout"`
+}
+
+// PolicyRoute routes traffic from SrcCIDR to DstCIDR through the tunnel
+// using routing table Table, like `ip rule add from SrcCIDR to DstCIDR
+// table Table priority Priority`. Empty CIDRs match everything; a lower
+// Priority takes precedence. Linux only.
+type PolicyRoute struct {
+	SrcCIDR  string `yaml:"src_cidr"`
+	DstCIDR  string `yaml:"dst_cidr"`
+	Table    int    `yaml:"table"`
+	Priority int    `yaml:"priority"`
+}
+
+// DefaultPolicyPriority is used for policy routes without a priority.
+const DefaultPolicyPriority = 100
+
+// DefaultMinQuality is the tunnel quality below which a link counts as
+// degraded.
+const DefaultMinQuality = 0.3
+
+// SetDefaults fills zero fields with their defaults. A zero MTU is derived
+// from the MTU of the local interface that routes to Server, falling back
+// to qdt.DefaultMTU.
+func (c *Config) SetDefaults() {
+	if c.MTU == 0 && c.Server != "" {
+		c.MTU = detectMTU(c.Server)
+	}
+	if c.MTU == 0 {
+		c.MTU = qdt.DefaultMTU
+	}
+	if c.TunName == "" {
+		c.TunName = "qdt0"
+	}
+	if c.RouteMode == "" {
+		c.RouteMode = "default"
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.TCPFallbackServer == "" {
+		c.TCPFallbackServer = c.Server
+	}
+	if c.MaxReassemblyBytes == 0 {
+		c.MaxReassemblyBytes = qdt.DefaultMaxReassembly
+	}
+	if c.MaxReassemblyAggregateBytes == 0 {
+		c.MaxReassemblyAggregateBytes = qdt.DefaultMaxReassemblyAggregate
+	}
+	if c.ReassemblyTTL == 0 {
+		c.ReassemblyTTL = qdt.DefaultReassemblyTTL
+	}
+	if c.MinQuality == 0 {
+		c.MinQuality = DefaultMinQuality
+	}
+	for i := range c.PolicyRoutes {
+		if c.PolicyRoutes[i].Priority == 0 {
+			c.PolicyRoutes[i].Priority = DefaultPolicyPriority
+		}
+	}
+}
+
+func (c Config) Validate() error {
+	if c.Server == "" {
+		return fmt.Errorf("server is required")
+	}
+	if c.Token == "" {
+		return fmt.Errorf("token is required")
+	}
+	if c.PinnedCert != "" {
+		if _, err := parseCertPin(c.PinnedCert); err != nil {
+			return err
+		}
+	}
+	for i, r := range c.PolicyRoutes {
+		if r.Table <= 0 {
+			return fmt.Errorf("policy_routes[%d]: table is required", i)
+		}
+		for _, cidr := range []string{r.SrcCIDR, r.DstCIDR} {
+			if cidr == "" {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("policy_routes[%d]: %w", i, err)
+			}
+		}
+	}
+	if c.MASQUEProxy != "" {
+		if c.ProxyURL != "" {
+			return fmt.Errorf("masque_proxy and proxy_url are mutually exclusive")
+		}
+		if _, _, err := net.SplitHostPort(c.MASQUEProxy); err != nil {
+			return fmt.Errorf("masque_proxy: %w", err)
+		}
+		if c.MASQUEProxyPinnedCert != "" {
+			if _, err := parseCertPin(c.MASQUEProxyPinnedCert); err != nil {
+				return fmt.Errorf("masque_proxy_pinned_cert: %w", err)
+			}
+		}
+	}
+	if c.MinQuality < 0 || c.MinQuality > 1 {
+		return fmt.Errorf("min_quality must be between 0 and 1")
+	}
+	if c.QualityDegradeTimeout < 0 {
+		return fmt.Errorf("quality_degrade_timeout must be positive")
+	}
+	if c.ReassemblyTTL < 0 {
+		return fmt.Errorf("reassembly_ttl must be positive")
+	}
+	if c.ReverseTunnel {
+		if c.AdvertiseCIDR == "" {
+			return fmt.Errorf("advertise_cidr is required with reverse_tunnel")
+		}
+		if _, _, err := net.ParseCIDR(c.AdvertiseCIDR); err != nil {
+			return fmt.Errorf("advertise_cidr: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package qdtclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"qdt/internal/transport"
+	"qdt/pkg/qdt"
+)
+
+// quicFallbackTimeout bounds each attempt that has a fallback after it, so
+// a blocked path does not stall the connect for long.
+const quicFallbackTimeout = 3 * time.Second
+
+// connect performs the handshake over QUIC, falling back to WebSocket and
+// then TCP when enabled and the previous transport fails. The returned func
+// releases the connection.
+func connect(ctx context.Context, cfg Config, host string, tlsConf *tls.Config, req qdt.ConnectRequest, log *slog.Logger) (qdt.DatagramConn, qdt.ConnectResponse, func(), error) {
+	timeout := cfg.Timeout
+	if (cfg.FallbackWebSocket || cfg.FallbackTCP) && timeout > quicFallbackTimeout {
+		timeout = quicFallbackTimeout
+	}
+	conn, resp, closeConn, err := connectQUIC(ctx, cfg, host, tlsConf, req, timeout)
+	if cfg.Enable0RTT && errors.Is(err, quic.Err0RTTRejected) {
+		log.Debug("0-rtt rejected, retrying with a full handshake")
+		cfg.Enable0RTT = false
+		conn, resp, closeConn, err = connectQUIC(ctx, cfg, host, tlsConf, req, timeout)
+	}
+	if err == nil || ctx.Err() != nil || !(cfg.FallbackWebSocket || cfg.FallbackTCP) {
+		return conn, resp, closeConn, err
+	}
+	if cfg.FallbackWebSocket {
+		log.Warn("quic connect failed, falling back to websocket", "err", err)
+		wsTimeout := cfg.Timeout
+		if cfg.FallbackTCP && wsTimeout > quicFallbackTimeout {
+			wsTimeout = quicFallbackTimeout
+		}
+		conn, resp, closeConn, err = connectWS(ctx, cfg, tlsConf, req, wsTimeout)
+		if err == nil || !cfg.FallbackTCP || ctx.Err() != nil {
+			return conn, resp, closeConn, err
+		}
+	}
+	log.Warn("connect failed, falling back to tcp", "err", err)
+	return connectTCP(ctx, cfg, tlsConf, req)
+}
+
+func connectQUIC(ctx context.Context, cfg Config, host string, tlsConf *tls.Config, req qdt.ConnectRequest, timeout time.Duration) (qdt.DatagramConn, qdt.ConnectResponse, func(), error) {
+	quicConf := &quic.Config{
+		EnableDatagrams: true,
+		KeepAlivePeriod: 10 * time.Second,
+		MaxIdleTimeout:  30 * time.Second,
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := dialQUIC(dialCtx, cfg, tlsConf, quicConf)
+	if err != nil {
+		return nil, qdt.ConnectResponse{}, nil, fmt.Errorf("quic dial: %w", err)
+	}
+	fail := func(err error) (qdt.DatagramConn, qdt.ConnectResponse, func(), error) {
+		conn.CloseWithError(0, "")
+		return nil, qdt.ConnectResponse{}, nil, err
+	}
+
+	tr := &http3.Transport{EnableDatagrams: true}
+	cc := tr.NewClientConn(conn)
+	stream, err := cc.OpenRequestStream(ctx)
+	if err != nil {
+		return fail(fmt.Errorf("open request stream: %w", err))
+	}
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return fail(fmt.Errorf("encode connect request: %w", err))
+	}
+
+	reqURL := &url.URL{Scheme: "https", Host: host, Path: qdt.ConnectPath}
+	hdr := make(http.Header)
+	hdr.Set(qdt.TokenHeader, cfg.Token)
+	hdr.Set("Content-Type", "application/json")
+
+	// The body is written to the stream below; http.NoBody makes http3 send
+	// ContentLength instead of content-length: 0.
+	hreq := &http.Request{
+		Method:        http.MethodPost,
+		URL:           reqURL,
+		Header:        hdr,
+		Body:          http.NoBody,
+		ContentLength: int64(len(payload)),
+	}
+	if err := stream.SendRequestHeader(hreq); err != nil {
+		return fail(fmt.Errorf("send request: %w", err))
+	}
+	if _, err := stream.Write(payload); err != nil {
+		return fail(fmt.Errorf("write request body: %w", err))
+	}
+
+	resp, err := stream.ReadResponse()
+	if err != nil {
+		return fail(fmt.Errorf("read response: %w", err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return fail(fmt.Errorf("connect failed: %s (%s, request id %q)", resp.Status, strings.TrimSpace(string(body)), resp.Header.Get(qdt.RequestIDHeader)))
+	}
+	connectResp, err := qdt.ReadConnectResponse(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return fail(fmt.Errorf("read connect response: %w", err))
+	}
+	closeConn := func() {
+		resp.Body.Close()
+		conn.CloseWithError(0, "")
+	}
+	return quicStream{stream, conn}, connectResp, closeConn, nil
+}
+
+func connectWS(ctx context.Context, cfg Config, tlsConf *tls.Config, req qdt.ConnectRequest, timeout time.Duration) (qdt.DatagramConn, qdt.ConnectResponse, func(), error) {
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	wsURL := (&url.URL{Scheme: "wss", Host: cfg.Server, Path: qdt.WebSocketPath}).String()
+	conn, err := transport.DialWS(dialCtx, wsURL, tlsConf)
+	if err != nil {
+		return nil, qdt.ConnectResponse{}, nil, err
+	}
+	return connectInband(dialCtx, conn, cfg.Token, req)
+}
+
+func connectTCP(ctx context.Context, cfg Config, tlsConf *tls.Config, req qdt.ConnectRequest) (qdt.DatagramConn, qdt.ConnectResponse, func(), error) {
+	dialCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	conn, err := transport.DialTCP(dialCtx, cfg.TCPFallbackServer, tlsConf)
+	if err != nil {
+		return nil, qdt.ConnectResponse{}, nil, err
+	}
+	return connectInband(dialCtx, conn, cfg.Token, req)
+}
+
+// connectInband runs the handshake over a stream transport: the token and
+// the connect request are sent as the first two messages.
+func connectInband(ctx context.Context, conn qdt.DatagramConn, token string, req qdt.ConnectRequest) (qdt.DatagramConn, qdt.ConnectResponse, func(), error) {
+	closeConn := func() {
+		if c, ok := conn.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	fail := func(err error) (qdt.DatagramConn, qdt.ConnectResponse, func(), error) {
+		closeConn()
+		return nil, qdt.ConnectResponse{}, nil, err
+	}
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return fail(fmt.Errorf("encode connect request: %w", err))
+	}
+	if err := conn.SendDatagram([]byte(token)); err != nil {
+		return fail(fmt.Errorf("send token: %w", err))
+	}
+	if err := conn.SendDatagram(payload); err != nil {
+		return fail(fmt.Errorf("send request: %w", err))
+	}
+	b, err := conn.ReceiveDatagram(ctx)
+	if err != nil {
+		return fail(fmt.Errorf("connect failed: %w", err))
+	}
+	connectResp, err := qdt.ReadConnectResponse(bytes.NewReader(b))
+	if err != nil {
+		return fail(fmt.Errorf("read connect response: %w", err))
+	}
+	return conn, connectResp, closeConn, nil
+}
@@ -0,0 +1,141 @@
+package qdtclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+
+	"qdt/internal/transport"
+)
+
+// parseCertPin accepts a SHA-256 fingerprint either base64-encoded or as hex,
+// optionally colon-separated as printed by openssl x509 -fingerprint -sha256.
+func parseCertPin(pin string) ([]byte, error) {
+	pin = strings.TrimSpace(pin)
+	if h := strings.ReplaceAll(pin, ":", ""); len(h) == sha256.Size*2 {
+		if b, err := hex.DecodeString(h); err == nil {
+			return b, nil
+		}
+	}
+	b, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil {
+		b, err = base64.RawStdEncoding.DecodeString(pin)
+	}
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("pinned_cert must be a sha-256 fingerprint")
+	}
+	return b, nil
+}
+
+// pinVerifier checks the peer leaf certificate against a pinned SHA-256
+// fingerprint, named by the config key in errors. It replaces chain
+// verification, so it must be used with InsecureSkipVerify; otherwise
+// self-signed certs fail before it runs.
+func pinVerifier(pin []byte, key string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("peer presented no certificate")
+		}
+		sum := sha256.Sum256(rawCerts[0])
+		if subtle.ConstantTimeCompare(sum[:], pin) != 1 {
+			return fmt.Errorf("certificate does not match %s", key)
+		}
+		return nil
+	}
+}
+
+// masqueTLSConfig verifies the MASQUE proxy against masque_proxy_ca, or the
+// system roots, or its pinned fingerprint. insecure skips verification of the
+// proxy as it does of the server.
+func masqueTLSConfig(cfg Config) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(cfg.MASQUEProxy)
+	if err != nil {
+		return nil, fmt.Errorf("masque_proxy: %w", err)
+	}
+	conf := &tls.Config{ServerName: host, InsecureSkipVerify: cfg.Insecure}
+	if cfg.MASQUEProxyCA != "" {
+		pem, err := os.ReadFile(cfg.MASQUEProxyCA)
+		if err != nil {
+			return nil, fmt.Errorf("masque_proxy_ca: %w", err)
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("masque_proxy_ca: no certificates in %s", cfg.MASQUEProxyCA)
+		}
+	}
+	if cfg.MASQUEProxyPinnedCert != "" {
+		pin, err := parseCertPin(cfg.MASQUEProxyPinnedCert)
+		if err != nil {
+			return nil, fmt.Errorf("masque_proxy_pinned_cert: %w", err)
+		}
+		conf.InsecureSkipVerify = true
+		conf.VerifyPeerCertificate = pinVerifier(pin, "masque_proxy_pinned_cert")
+	}
+	return conf, nil
+}
+
+func dialQUIC(ctx context.Context, cfg Config, tlsConf *tls.Config, quicConf *quic.Config) (*quic.Conn, error) {
+	dialAddr, dial := quic.DialAddr, quic.Dial
+	if cfg.Enable0RTT {
+		dialAddr, dial = quic.DialAddrEarly, quic.DialEarly
+	}
+	if cfg.ProxyURL == "" && cfg.MASQUEProxy == "" && cfg.QUICRecvBufferSize <= 0 {
+		return dialAddr(ctx, cfg.Server, tlsConf, quicConf)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", cfg.Server)
+	if err != nil {
+		return nil, fmt.Errorf("resolve server: %w", err)
+	}
+	var pc net.PacketConn
+	switch {
+	case cfg.MASQUEProxy != "":
+		proxyTLS, err := masqueTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		pc, err = transport.DialMASQUE(ctx, cfg.MASQUEProxy, cfg.Server, proxyTLS)
+		if err != nil {
+			return nil, fmt.Errorf("masque proxy: %w", err)
+		}
+		// Each packet must fit in one datagram of the proxy connection.
+		quicConf = quicConf.Clone()
+		quicConf.InitialPacketSize = transport.MASQUEPacketSize
+		quicConf.DisablePathMTUDiscovery = true
+	case cfg.ProxyURL != "":
+		pc, err = transport.DialSOCKS5UDP(ctx, cfg.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("socks5 proxy: %w", err)
+		}
+	default:
+		udp, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, fmt.Errorf("listen udp: %w", err)
+		}
+		if err := udp.SetReadBuffer(cfg.QUICRecvBufferSize); err != nil {
+			udp.Close()
+			return nil, fmt.Errorf("set receive buffer: %w", err)
+		}
+		pc = udp
+	}
+	conn, err := dial(ctx, pc, raddr, tlsConf, quicConf)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	go func() {
+		<-conn.Context().Done()
+		pc.Close()
+	}()
+	return conn, nil
+}
@@ -0,0 +1,100 @@
+package qdtclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrNoDiscoveryRecord is returned by DiscoverServer when the domain has no
+// v=qdt1 TXT record.
+var ErrNoDiscoveryRecord = errors.New("qdtclient: no discovery record")
+
+type txtResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DiscoverServer reads the TXT records of _qdt.<domain> and returns the
+// settings of the first one of the form
+//
+//	v=qdt1 addr=server.example.com:443 fp=<sha256> mtu=1350
+//
+// where fp and mtu are optional. The result fills Server, PinnedCert and
+// MTU only; combine it with the user's config using MergeDiscovered.
+func DiscoverServer(ctx context.Context, domain string) (Config, error) {
+	return discoverServer(ctx, net.DefaultResolver, domain)
+}
+
+func discoverServer(ctx context.Context, r txtResolver, domain string) (Config, error) {
+	name := "_qdt." + strings.TrimSuffix(domain, ".")
+	records, err := r.LookupTXT(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return Config{}, ErrNoDiscoveryRecord
+		}
+		return Config{}, fmt.Errorf("lookup %s: %w", name, err)
+	}
+	for _, rec := range records {
+		cfg, ok, err := parseDiscoveryRecord(rec)
+		if err != nil {
+			return Config{}, fmt.Errorf("%s: %w", name, err)
+		}
+		if ok {
+			return cfg, nil
+		}
+	}
+	return Config{}, ErrNoDiscoveryRecord
+}
+
+// parseDiscoveryRecord reports false for records that are not meant for
+// qdt, so other TXT records on the name are skipped.
+func parseDiscoveryRecord(rec string) (Config, bool, error) {
+	fields := strings.Fields(rec)
+	if len(fields) == 0 || fields[0] != "v=qdt1" {
+		return Config{}, false, nil
+	}
+	var cfg Config
+	for _, f := range fields[1:] {
+		key, value, _ := strings.Cut(f, "=")
+		switch key {
+		case "addr":
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return Config{}, false, fmt.Errorf("addr: %w", err)
+			}
+			cfg.Server = value
+		case "fp":
+			if _, err := parseCertPin(value); err != nil {
+				return Config{}, false, fmt.Errorf("fp: %w", err)
+			}
+			cfg.PinnedCert = value
+		case "mtu":
+			mtu, err := strconv.Atoi(value)
+			if err != nil || mtu <= 0 {
+				return Config{}, false, fmt.Errorf("invalid mtu %q", value)
+			}
+			cfg.MTU = mtu
+		}
+	}
+	if cfg.Server == "" {
+		return Config{}, false, fmt.Errorf("record has no addr")
+	}
+	return cfg, true, nil
+}
+
+// MergeDiscovered fills Server, PinnedCert and MTU from d where c leaves
+// them unset.
+func (c *Config) MergeDiscovered(d Config) {
+	if c.Server == "" {
+		c.Server = d.Server
+	}
+	if c.PinnedCert == "" {
+		c.PinnedCert = d.PinnedCert
+	}
+	if c.MTU == 0 {
+		c.MTU = d.MTU
+	}
+}
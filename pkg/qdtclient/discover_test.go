@@ -0,0 +1,51 @@
+package qdtclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func TestDiscoverServer(t *testing.T) {
+	fp := strings.Repeat("ab", 32)
+	r := fakeResolver{
+		"_qdt.example.com": {"google-site-verification=xyz", "v=qdt1 addr=vpn.example.com:443 fp=" + fp + " mtu=1300"},
+		"_qdt.bad.example": {"v=qdt1 fp=" + fp},
+		"_qdt.other.com":   {"v=spf1 -all"},
+	}
+
+	cfg, err := discoverServer(context.Background(), r, "example.com")
+	if err != nil {
+		t.Fatalf("discover: %v", err)
+	}
+	if cfg.Server != "vpn.example.com:443" || cfg.PinnedCert != fp || cfg.MTU != 1300 {
+		t.Fatalf("discovered %+v", cfg)
+	}
+
+	user := Config{Server: "override.example.com:8443"}
+	user.MergeDiscovered(cfg)
+	if user.Server != "override.example.com:8443" || user.PinnedCert != fp || user.MTU != 1300 {
+		t.Fatalf("merged %+v", user)
+	}
+
+	for _, domain := range []string{"other.com", "missing.example"} {
+		if _, err := discoverServer(context.Background(), r, domain); !errors.Is(err, ErrNoDiscoveryRecord) {
+			t.Fatalf("%s: err = %v, want ErrNoDiscoveryRecord", domain, err)
+		}
+	}
+	if _, err := discoverServer(context.Background(), r, "bad.example"); err == nil || errors.Is(err, ErrNoDiscoveryRecord) {
+		t.Fatalf("record without addr: err = %v", err)
+	}
+}
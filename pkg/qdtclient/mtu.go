@@ -0,0 +1,56 @@
+package qdtclient
+
+import (
+	"net"
+
+	"qdt/internal/netcfg"
+	"qdt/pkg/qdt"
+)
+
+// quicOverhead is what QUIC adds around a datagram payload at worst: IPv6
+// and UDP headers, a short header with a 20 byte connection ID and 4 byte
+// packet number, the DATAGRAM frame header and the packet AEAD tag.
+const quicOverhead = 40 + 8 + 1 + 20 + 4 + 3 + 16
+
+// detectMTU returns the tunnel MTU that fits the interface used to reach
+// server, capped at qdt.DefaultMTU, or 0 if it cannot be determined.
+func detectMTU(server string) int {
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return 0
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+	ifName := interfaceWithAddr(local)
+	if ifName == "" {
+		return 0
+	}
+	linkMTU, err := netcfg.GetInterfaceMTU(ifName)
+	if err != nil {
+		return 0
+	}
+	mtu := linkMTU - quicOverhead
+	if mtu <= qdt.HeaderLen || mtu > qdt.DefaultMTU {
+		return 0
+	}
+	return mtu
+}
+
+func interfaceWithAddr(ip net.IP) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,66 @@
+package qdtclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// mtuProbeSizes are the IP packet sizes tried, largest first.
+var mtuProbeSizes = []int{1500, 1400, 1300, 1200}
+
+// mtuProbeTimeout is how long a probe may go without an ICMP error before
+// it counts as delivered.
+const mtuProbeTimeout = time.Second
+
+// probeMTU sends don't-fragment UDP probes to addr and returns the tunnel
+// MTU that fits the largest probe no router rejected with ICMP
+// "fragmentation needed". The server drops the probes as malformed QUIC.
+func probeMTU(ctx context.Context, addr string) (int, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return 0, fmt.Errorf("mtu probe dial: %w", err)
+	}
+	defer conn.Close()
+	udp := conn.(*net.UDPConn)
+	if err := setDontFragment(udp); err != nil {
+		return 0, fmt.Errorf("mtu probe: %w", err)
+	}
+	hdr := 20 + 8
+	if udp.RemoteAddr().(*net.UDPAddr).IP.To4() == nil {
+		hdr = 40 + 8
+	}
+	buf := make([]byte, mtuProbeSizes[0])
+	for _, size := range mtuProbeSizes {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if _, err := udp.Write(buf[:size-hdr]); err != nil {
+			// The kernel already knows a smaller path MTU.
+			if errors.Is(err, syscall.EMSGSIZE) {
+				continue
+			}
+			return 0, fmt.Errorf("mtu probe write: %w", err)
+		}
+		deadline := time.Now().Add(mtuProbeTimeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		udp.SetReadDeadline(deadline)
+		_, err := udp.Read(buf)
+		if errors.Is(err, syscall.EMSGSIZE) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		// A timeout, an answer or any other ICMP error means the probe
+		// got through.
+		return size - quicOverhead, nil
+	}
+	return 0, fmt.Errorf("mtu probe: no probe of %d bytes or more got through", mtuProbeSizes[len(mtuProbeSizes)-1])
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package qdtclient
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func setDontFragment(*net.UDPConn) error {
+	return fmt.Errorf("mtu probing is not supported on %s", runtime.GOOS)
+}
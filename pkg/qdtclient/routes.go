@@ -0,0 +1,195 @@
+package qdtclient
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+
+	"qdt/internal/netcfg"
+	"qdt/pkg/qdt"
+)
+
+func configureInterface(ifName string, resp qdt.ConnectResponse, cfg Config, log *slog.Logger) ([]netcfg.Route, error) {
+	addr, err := clientAddress(resp.ClientIP, resp.CIDR)
+	if err != nil {
+		return nil, err
+	}
+	if err := netcfg.ConfigureInterface(netcfg.InterfaceConfig{
+		Name:    ifName,
+		Address: addr,
+		Gateway: resp.GatewayIP,
+		MTU:     resp.MTU,
+	}); err != nil {
+		return nil, fmt.Errorf("configure tun: %w", err)
+	}
+
+	routes := buildRoutes(cfg.RouteMode, resp)
+	if cfg.PreventDNSLeak && cfg.RouteMode == "default" {
+		// Installed ahead of the default route so no query slips out of the
+		// physical interface while it is being replaced.
+		routes = append(dnsRoutes(slices.Concat(cfg.DNS, resp.DNS), resp), routes...)
+	}
+	if err := netcfg.AddRoutes(ifName, routes); err != nil {
+		return nil, fmt.Errorf("add routes: %w", err)
+	}
+
+	if len(cfg.PolicyRoutes) > 0 {
+		if err := netcfg.AddPolicyRoutes(ifName, policyRoutes(cfg.PolicyRoutes)); err != nil {
+			return nil, fmt.Errorf("add policy routes: %w", err)
+		}
+	}
+
+	if err := netcfg.SetDNS(ifName, dnsServers(cfg, resp), resp.SearchDomains); err != nil {
+		log.Warn("set dns failed", "err", err)
+	}
+
+	return routes, nil
+}
+
+func dnsServers(cfg Config, resp qdt.ConnectResponse) []string {
+	if len(cfg.DNS) > 0 {
+		return cfg.DNS
+	}
+	return resp.DNS
+}
+
+// reapplyRoutes installs routes and the policy routes again after the
+// kernel flushed them with the interface.
+func reapplyRoutes(ifName string, routes []netcfg.Route, cfg Config, log *slog.Logger) {
+	if err := netcfg.AddRoutes(ifName, routes); err != nil {
+		log.Warn("route restore failed", "err", err)
+		return
+	}
+	if len(cfg.PolicyRoutes) > 0 {
+		if err := netcfg.AddPolicyRoutes(ifName, policyRoutes(cfg.PolicyRoutes)); err != nil {
+			log.Warn("policy route restore failed", "err", err)
+			return
+		}
+	}
+	log.Info("routes restored", "name", ifName, "routes", len(routes))
+}
+
+// watchInterfaces follows link changes until ctx is done: restoreRoutes runs
+// when ifName comes back up, and the DNS settings, which the resolver may
+// drop on network changes, are set again whenever another interface comes
+// up. Platforms without link events are left alone.
+func watchInterfaces(ctx context.Context, ifName string, restoreRoutes func(), dns, searchDomains []string, log *slog.Logger) {
+	watch := func(name string, onChange func(up bool)) {
+		err := netcfg.WatchInterface(ctx, name, onChange)
+		if err != nil && ctx.Err() == nil {
+			log.Debug("interface watch stopped", "err", err)
+		}
+	}
+	wasDown := false
+	go watch(ifName, func(up bool) {
+		if !up {
+			wasDown = true
+			log.Warn("tun interface down", "name", ifName)
+			return
+		}
+		if wasDown {
+			wasDown = false
+			restoreRoutes()
+		}
+	})
+	if len(dns) == 0 && len(searchDomains) == 0 {
+		return
+	}
+	go watch("", func(up bool) {
+		if !up {
+			return
+		}
+		if err := netcfg.SetDNS(ifName, dns, searchDomains); err != nil {
+			log.Warn("dns restore failed", "err", err)
+		}
+	})
+}
+
+func applyRouteUpdate(ifName string, routes, add, del []netcfg.Route, gateway string, log *slog.Logger) []netcfg.Route {
+	for i := range add {
+		add[i].Gateway = gateway
+	}
+	for i := range del {
+		del[i].Gateway = gateway
+	}
+	if err := netcfg.DeleteRoutes(ifName, del); err != nil {
+		log.Warn("route update delete failed", "err", err)
+	}
+	if err := netcfg.AddRoutes(ifName, add); err != nil {
+		log.Warn("route update add failed", "err", err)
+	}
+	log.Info("routes updated", "add", len(add), "del", len(del))
+	kept := routes[:0:0]
+	for _, r := range routes {
+		if !containsRoute(del, r.Dest) {
+			kept = append(kept, r)
+		}
+	}
+	for _, r := range add {
+		if !containsRoute(kept, r.Dest) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+func containsRoute(routes []netcfg.Route, dest string) bool {
+	for _, r := range routes {
+		if r.Dest == dest {
+			return true
+		}
+	}
+	return false
+}
+
+func buildRoutes(mode string, resp qdt.ConnectResponse) []netcfg.Route {
+	switch mode {
+	case "none":
+		return nil
+	case "cidr":
+		return []netcfg.Route{{Dest: resp.CIDR, Gateway: resp.GatewayIP}}
+	default:
+		return []netcfg.Route{{Dest: "0.0.0.0/0", Gateway: resp.GatewayIP}}
+	}
+}
+
+// dnsRouteMetric ranks the DNS host routes ahead of any other route to the
+// same address.
+const dnsRouteMetric = 50
+
+// dnsRoutes returns a host route through the tunnel gateway for each IPv4
+// DNS server outside the tunnel network, which is routed already.
+func dnsRoutes(servers []string, resp qdt.ConnectResponse) []netcfg.Route {
+	_, tunnelNet, _ := net.ParseCIDR(resp.CIDR)
+	var routes []netcfg.Route
+	for _, s := range servers {
+		ip := net.ParseIP(s).To4()
+		if ip == nil || (tunnelNet != nil && tunnelNet.Contains(ip)) {
+			continue
+		}
+		dest := ip.String() + "/32"
+		if !containsRoute(routes, dest) {
+			routes = append(routes, netcfg.Route{Dest: dest, Gateway: resp.GatewayIP, Metric: dnsRouteMetric})
+		}
+	}
+	return routes
+}
+
+func policyRoutes(rules []PolicyRoute) []netcfg.PolicyRoute {
+	out := make([]netcfg.PolicyRoute, len(rules))
+	for i, r := range rules {
+		out[i] = netcfg.PolicyRoute(r)
+	}
+	return out
+}
+
+func clientAddress(clientIP, cidr string) (string, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", fmt.Errorf("parse cidr: %w", err)
+	}
+	maskSize, _ := ipnet.Mask.Size()
+	return fmt.Sprintf("%s/%d", clientIP, maskSize), nil
+}
@@ -0,0 +1,80 @@
+package qdtclient
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// clientState is what the client keeps in Config.StateFile between runs.
+type clientState struct {
+	ClientID    string `json:"client_id"`
+	ResumeToken string `json:"resume_token,omitempty"`
+}
+
+// loadState reads the state file once per Client. Without a configured
+// client ID it makes sure the state holds a generated one, writing it out
+// right away so the identity is stable even if the first connect fails.
+func (c *Client) loadState() {
+	if c.stateLoaded || c.cfg.StateFile == "" {
+		return
+	}
+	c.stateLoaded = true
+	b, err := os.ReadFile(c.cfg.StateFile)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &c.state); err != nil {
+			c.log.Warn("invalid state file, starting fresh", "err", err)
+			c.state = clientState{}
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		c.log.Warn("read state file failed", "err", err)
+		return
+	}
+	if c.cfg.ClientID != "" || c.state.ClientID != "" {
+		return
+	}
+	id, err := newUUID()
+	if err != nil {
+		c.log.Warn("generate client id failed", "err", err)
+		return
+	}
+	c.state.ClientID = id
+	c.log.Info("generated client id", "client_id", id)
+	c.saveState()
+}
+
+func (c *Client) saveResumeToken(token string) {
+	if token == "" {
+		return
+	}
+	c.state.ResumeToken = token
+	c.saveState()
+}
+
+func (c *Client) saveState() {
+	if c.cfg.StateFile == "" {
+		return
+	}
+	b, err := json.Marshal(c.state)
+	if err != nil {
+		c.log.Warn("encode state failed", "err", err)
+		return
+	}
+	if err := os.WriteFile(c.cfg.StateFile, append(b, '\n'), 0o600); err != nil {
+		c.log.Warn("write state file failed", "err", err)
+	}
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("uuid random: %w", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
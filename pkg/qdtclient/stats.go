@@ -0,0 +1,112 @@
+package qdtclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// pathStatser is implemented by connections that can report RTT and loss;
+// the WebSocket and TCP fallbacks cannot.
+type pathStatser interface {
+	ConnectionStats() quic.ConnectionStats
+}
+
+// quicStream keeps the QUIC connection next to the request stream so its
+// path statistics stay reachable.
+type quicStream struct {
+	*http3.RequestStream
+	conn *quic.Conn
+}
+
+func (s quicStream) ConnectionStats() quic.ConnectionStats {
+	return s.conn.ConnectionStats()
+}
+
+// newRegistry returns a registry holding the client metrics. They read the
+// current connection on each scrape, so the counters restart when the
+// client reconnects.
+func (c *Client) newRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	factory := promauto.With(reg)
+	factory.NewCounterFunc(prometheus.CounterOpts{
+		Name: "qdt_client_bytes_sent_total",
+		Help: "Bytes of packets sent through the tunnel.",
+	}, func() float64 { return float64(c.Stats().BytesSent) })
+	factory.NewCounterFunc(prometheus.CounterOpts{
+		Name: "qdt_client_bytes_recv_total",
+		Help: "Bytes of packets received through the tunnel.",
+	}, func() float64 { return float64(c.Stats().BytesRecv) })
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "qdt_client_packet_loss_ratio",
+		Help: "Share of QUIC packets declared lost on the current connection.",
+	}, func() float64 {
+		st, ok := c.pathStats()
+		if !ok || st.PacketsSent == 0 {
+			return 0
+		}
+		return float64(st.PacketsLost) / float64(st.PacketsSent)
+	})
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "qdt_client_rtt_seconds",
+		Help: "Smoothed RTT of the current QUIC connection.",
+	}, func() float64 {
+		st, ok := c.pathStats()
+		if !ok {
+			return 0
+		}
+		return st.SmoothedRTT.Seconds()
+	})
+	return reg
+}
+
+func (c *Client) pathStats() (quic.ConnectionStats, bool) {
+	c.mu.Lock()
+	path := c.path
+	c.mu.Unlock()
+	if path == nil {
+		return quic.ConnectionStats{}, false
+	}
+	return path.ConnectionStats(), true
+}
+
+// startStatsServer serves GET /metrics, GET /stats and GET /healthz on
+// cfg.StatsAddr until the returned server is closed.
+func (c *Client) startStatsServer() (*http.Server, error) {
+	ln, err := net.Listen("tcp", c.cfg.StatsAddr)
+	if err != nil {
+		return nil, fmt.Errorf("stats listen: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(c.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(c.Stats())
+	})
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		status := "ok"
+		if c.LocalIP() == nil {
+			status = "disconnected"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"status": status, "quality": c.Quality()})
+	})
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			c.log.Error("stats server error", "err", err)
+		}
+	}()
+	return srv, nil
+}
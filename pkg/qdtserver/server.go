@@ -0,0 +1,116 @@
+// Package qdtserver embeds a QDT server in another Go program. The caller
+// supplies the UDP socket; the server owns a TUN device and configures
+// addressing, forwarding and NAT on it like qdt-server does.
+package qdtserver
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+
+	"qdt/internal/server"
+)
+
+// Config takes the same keys as server.yaml. Unlike qdt-server, New does not
+// generate a token or certificate: set Token and either TLSCert/TLSKey or
+// ACME.Domain. Addr is unused, but MetricsAddr, HealthAddr and AdminAddr
+// default to :9100, :9200 and 127.0.0.1:9300 as in qdt-server; set them to
+// serve elsewhere.
+// RequireIPForwarding defaults to true only in qdt-server, which loads
+// server.yaml; set it here to fail New when forwarding cannot be enabled.
+type Config = server.Config
+
+type (
+	TenantConfig    = server.TenantConfig
+	RateLimitConfig = server.RateLimitConfig
+	SessionInfo     = server.SessionInfo
+)
+
+var (
+	ErrServing = errors.New("qdtserver: already serving")
+	ErrClosed  = errors.New("qdtserver: closed")
+)
+
+// Prometheus collectors are registered globally, so every Server in the
+// process shares one set.
+var metrics = sync.OnceValue(server.NewMetrics)
+
+type Server struct {
+	srv *server.Server
+
+	mu      sync.Mutex
+	serving bool
+	closed  bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// New validates cfg, filling zero fields with their defaults, and opens the
+// TUN device.
+func New(cfg Config, log *slog.Logger) (*Server, error) {
+	if log == nil {
+		log = slog.Default()
+	}
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	srv, err := server.NewServer(cfg, log, metrics())
+	if err != nil {
+		return nil, err
+	}
+	return &Server{srv: srv}, nil
+}
+
+// Serve accepts QUIC connections on conn until ctx is done or Close is
+// called, in which case it returns nil. It may only be called once; conn is
+// not closed.
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	if s.serving {
+		s.mu.Unlock()
+		return ErrServing
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s.serving = true
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.mu.Unlock()
+	defer close(s.done)
+	defer cancel()
+
+	s.srv.PacketConns = []net.PacketConn{conn}
+	err := s.srv.Serve(ctx)
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// Sessions lists the active sessions.
+func (s *Server) Sessions() []SessionInfo {
+	return s.srv.Sessions()
+}
+
+// Close stops Serve, waits for it to return and releases the TUN device.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+	cancel, done := s.cancel, s.done
+	s.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	return s.srv.Close()
+}